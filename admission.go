@@ -0,0 +1,145 @@
+package cacheddownloader
+
+import (
+	"context"
+	"sync"
+)
+
+// Priorities for FetchOptions.Priority. Any other value may be used as well;
+// higher priorities are admitted first.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+// admission limits the number of concurrent downloads. When all slots are
+// taken, a freed slot goes to a waiter with the highest priority. Among those,
+// the keys with waiters take turns, so that many waiters for one key cannot
+// starve the others, and each key's waiters are admitted in arrival order.
+type admission struct {
+	lock    sync.Mutex
+	slots   int
+	inUse   int
+	waiting map[string][]*admissionWaiter
+	// turns holds the keys with waiters, the key whose turn is next first
+	turns []string
+}
+
+type admissionWaiter struct {
+	key      string
+	priority int
+	admitted chan struct{}
+}
+
+func newAdmission(slots int) *admission {
+	return &admission{slots: slots, waiting: map[string][]*admissionWaiter{}}
+}
+
+// acquire blocks until a slot is free or ctx is done
+func (a *admission) acquire(ctx context.Context, key string, priority int) error {
+	a.lock.Lock()
+	if a.inUse < a.slots && len(a.turns) == 0 {
+		a.inUse++
+		a.lock.Unlock()
+		return nil
+	}
+
+	waiter := &admissionWaiter{key: key, priority: priority, admitted: make(chan struct{})}
+	if len(a.waiting[key]) == 0 {
+		a.turns = append(a.turns, key)
+	}
+	a.waiting[key] = append(a.waiting[key], waiter)
+	a.lock.Unlock()
+
+	select {
+	case <-waiter.admitted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	select {
+	case <-waiter.admitted:
+		// admitted in the meantime; pass the slot on
+		a.releaseLocked()
+	default:
+		a.remove(waiter)
+	}
+	return ctx.Err()
+}
+
+func (a *admission) release() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.releaseLocked()
+}
+
+func (a *admission) releaseLocked() {
+	if len(a.turns) == 0 {
+		a.inUse--
+		return
+	}
+
+	// the slot passes straight to the next waiter
+	waiter := a.next()
+	a.remove(waiter)
+	close(waiter.admitted)
+
+	// the key has had its turn
+	if len(a.waiting[waiter.key]) > 0 {
+		a.dropTurn(waiter.key)
+		a.turns = append(a.turns, waiter.key)
+	}
+}
+
+// next returns the first waiter with the highest priority, taking the keys in
+// turn
+func (a *admission) next() *admissionWaiter {
+	var next *admissionWaiter
+	for _, key := range a.turns {
+		for _, waiter := range a.waiting[key] {
+			if next == nil || waiter.priority > next.priority {
+				next = waiter
+			}
+		}
+	}
+	return next
+}
+
+func (a *admission) remove(waiter *admissionWaiter) {
+	waiters := a.waiting[waiter.key]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) > 0 {
+		a.waiting[waiter.key] = waiters
+		return
+	}
+
+	delete(a.waiting, waiter.key)
+	a.dropTurn(waiter.key)
+}
+
+func (a *admission) dropTurn(key string) {
+	for i, k := range a.turns {
+		if k == key {
+			a.turns = append(a.turns[:i:i], a.turns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *admission) inProgress() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.inUse
+}
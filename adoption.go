@@ -0,0 +1,156 @@
+package cacheddownloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewAdopting behaves like NewPersistent, but also keeps the cache when the
+// saved state is missing or out of date, e.g. after a crash or when the cached
+// path was carried over to a new deploy without it: it writes a metadata file
+// next to the file of every entry it adds, and on startup adopts the files in
+// the cached path that have well-formed metadata as entries, rather than
+// removing them. Adopted entries are revalidated with the origin on their
+// first fetch. Files without metadata, and expanded directories, are removed
+// as usual.
+func NewAdopting(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloader *Downloader, transformer CacheTransformer) (*cachedDownloader, RecoveryReport, error) {
+	c, err := NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+	if err != nil {
+		return nil, RecoveryReport{}, err
+	}
+	c.cache.sidecars = true
+
+	report, err := c.RecoverStateWithReport()
+	if err != nil {
+		return nil, RecoveryReport{}, err
+	}
+
+	return c, report, nil
+}
+
+// sidecarSuffix names the metadata file kept next to the file of an entry
+const sidecarSuffix = ".entry.json"
+
+// entrySidecar is the metadata kept next to the file of an entry, which is
+// enough to adopt the file as an entry without the saved state
+type entrySidecar struct {
+	HashedKey             string
+	Key                   string
+	Namespace             string
+	Labels                map[string]string
+	Size                  int64
+	ExpandedDirectoryPath string
+	CachingInfo           CachingInfoType
+	Cacheable             bool
+	Digest                string
+}
+
+// writeSidecar writes the metadata of the entry for cacheKey next to its file,
+// if enabled
+func (c *FileCache) writeSidecar(cacheKey string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if !c.sidecars || entry == nil || entry.FilePath == "" {
+		return
+	}
+
+	metadata, err := json.Marshal(entrySidecar{
+		HashedKey:             cacheKey,
+		Key:                   entry.Key,
+		Namespace:             entry.Namespace,
+		Labels:                entry.Labels,
+		Size:                  entry.Size,
+		ExpandedDirectoryPath: entry.ExpandedDirectoryPath,
+		CachingInfo:           entry.CachingInfo,
+		Cacheable:             entry.Cacheable,
+		Digest:                entry.Digest,
+	})
+	if err == nil {
+		writeFileAtomically(entry.FilePath+sidecarSuffix, metadata)
+	}
+}
+
+// adoptEntries adds the files in the shards that are not tracked but have
+// well-formed metadata as entries, and returns how many it adopted. The
+// adopted files and their metadata are added to trackedFiles.
+func (c *FileCache) adoptEntries(trackedFiles map[string]struct{}) (int, error) {
+	adopted := 0
+	for _, cachedPath := range c.shards() {
+		files, err := ioutil.ReadDir(cachedPath)
+		if err != nil && !os.IsNotExist(err) {
+			return adopted, err
+		}
+
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), sidecarSuffix) {
+				continue
+			}
+
+			sidecarPath := filepath.Join(cachedPath, file.Name())
+			filePath := strings.TrimSuffix(sidecarPath, sidecarSuffix)
+			if _, ok := trackedFiles[filePath]; ok {
+				continue
+			}
+
+			cacheKey, entry, ok := adoptableEntry(filePath, sidecarPath)
+			if !ok {
+				continue
+			}
+			if current := c.Entries[cacheKey]; current != nil {
+				if !entry.Access.After(current.Access) {
+					// an older copy of an entry that is already known
+					continue
+				}
+				delete(trackedFiles, current.FilePath)
+				delete(trackedFiles, current.FilePath+sidecarSuffix)
+				delete(trackedFiles, current.ExpandedDirectoryPath)
+				delete(trackedFiles, current.ExpandedDirectoryPath+manifestSuffix)
+			}
+
+			entry.reaper = c.reaper
+			c.Entries[cacheKey] = entry
+			trackedFiles[filePath] = struct{}{}
+			trackedFiles[sidecarPath] = struct{}{}
+			adopted++
+		}
+	}
+
+	return adopted, nil
+}
+
+// adoptableEntry reads the metadata at sidecarPath, and returns the entry it
+// describes if it matches the file at filePath
+func adoptableEntry(filePath, sidecarPath string) (string, *FileCacheEntry, bool) {
+	data, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var sidecar entrySidecar
+	err = json.Unmarshal(data, &sidecar)
+	if err != nil || sidecar.HashedKey == "" || !(sidecar.Cacheable || sidecar.CachingInfo.isCacheable()) {
+		return "", nil, false
+	}
+	if !strings.HasPrefix(filepath.Base(filePath), sidecar.HashedKey+"-") {
+		return "", nil, false
+	}
+
+	recorded := &FileCacheEntry{FilePath: filePath, ExpandedDirectoryPath: sidecar.ExpandedDirectoryPath, Size: sidecar.Size}
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() || !intactSize(info, recorded) {
+		return "", nil, false
+	}
+
+	entry := newFileCacheEntry(filePath, info.Size(), sidecar.CachingInfo)
+	entry.Key = sidecar.Key
+	entry.Namespace = sidecar.Namespace
+	entry.Labels = sidecar.Labels
+	entry.Digest = sidecar.Digest
+	entry.Access = info.ModTime()
+	return sidecar.HashedKey, entry, true
+}
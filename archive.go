@@ -0,0 +1,301 @@
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// archiveFormat is the kind of archive that a directory entry is expanded from
+type archiveFormat int
+
+const (
+	unknownArchive archiveFormat = iota
+	tarArchive
+	zipArchive
+	gzipArchive
+	zstdArchive
+	xzArchive
+)
+
+// archiveHeaderSize is how much of an archive is needed to tell its format
+const archiveHeaderSize = 512
+
+// sniffArchive tells the format of an archive from its first bytes
+func sniffArchive(header []byte) archiveFormat {
+	switch {
+	case len(header) >= 263 && string(header[257:263]) == "ustar\x00",
+		len(header) >= 263 && string(header[257:263]) == "ustar ":
+		return tarArchive
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return zipArchive
+	case bytes.HasPrefix(header, []byte("\x1f\x8b")):
+		return gzipArchive
+	case bytes.HasPrefix(header, []byte("\x28\xb5\x2f\xfd")):
+		return zstdArchive
+	case bytes.HasPrefix(header, []byte("\xfd7zXZ\x00")):
+		return xzArchive
+	default:
+		return unknownArchive
+	}
+}
+
+// sniffArchiveFile tells the format of the archive at path, and returns its
+// first bytes
+func sniffArchiveFile(path string) (archiveFormat, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return unknownArchive, nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, archiveHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return unknownArchive, nil, err
+	}
+	return sniffArchive(header[:n]), header[:n], nil
+}
+
+// directoryTransform prepares a download to be expanded into a directory:
+// archives that can be expanded as they are, such as zips and compressed
+// tarballs, are kept, and the others are converted to tar by TarTransform
+func directoryTransform(ctx context.Context, source, destination string) (int64, error) {
+	format, _, err := sniffArchiveFile(source)
+	if err != nil {
+		return 0, err
+	}
+
+	if isCompressedArchive(format) {
+		// fail before the archive is cached if it cannot be expanded
+		_, err = archiveDecompressor(format)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if format == zipArchive || isCompressedArchive(format) {
+		return NoopTransform(source, destination)
+	}
+	return ContextTarTransform(ctx, source, destination)
+}
+
+// extractArchiveToDirectory expands the archive, stored in the given form,
+// into the destination directory and returns the number and total size of the
+// regular files it extracted. Compressed archives are decompressed on the fly,
+// and archives that are not recognized are expanded as tarballs, such as those
+// in formats older than ustar; an UnsupportedArchiveError is returned if they
+// are not.
+func extractArchiveToDirectory(sourcePath, destinationDir string, rest atRest, options ExtractionOptions, reporter *extractionReporter) (fileCount int, sizeInBytes int64, err error) {
+	_, err = os.Stat(destinationDir)
+	if err != nil && err.(*os.PathError).Err != syscall.ENOENT {
+		return 0, 0, err
+	}
+
+	file, err := rest.open(sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	// Make the target directory
+	err = os.MkdirAll(destinationDir, 0777)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the zip at sourcePath can only be read as it is if it is stored plain
+	zipPath := ""
+	if !rest.enabled() {
+		zipPath = sourcePath
+	}
+
+	archive := bufio.NewReaderSize(file, archiveHeaderSize)
+	format := peekArchive(archive)
+	if isCompressedArchive(format) {
+		var decompressor ArchiveDecompressor
+		decompressor, err = archiveDecompressor(format)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var decompressed io.ReadCloser
+		decompressed, err = decompressor(archive)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer func() {
+			// the archive may end before the decompressor reports a failure
+			if closeErr := decompressed.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+
+		archive = bufio.NewReaderSize(decompressed, archiveHeaderSize)
+		format = peekArchive(archive)
+		zipPath = ""
+	}
+
+	switch format {
+	case zipArchive:
+		return extractZipToDirectory(zipPath, archive, destinationDir, options, reporter)
+	case tarArchive:
+		return extractTar(archive, destinationDir, options, reporter)
+	default:
+		header, _ := archive.Peek(archiveHeaderSize)
+		header = append([]byte{}, header...)
+
+		fileCount, sizeInBytes, err := extractTar(archive, destinationDir, options, reporter)
+		if err == tar.ErrHeader {
+			err = NewUnsupportedArchiveError(header)
+		}
+		return fileCount, sizeInBytes, err
+	}
+}
+
+func peekArchive(archive *bufio.Reader) archiveFormat {
+	header, _ := archive.Peek(archiveHeaderSize)
+	return sniffArchive(header)
+}
+
+// extractZipToDirectory expands the zip at zipPath into the destination
+// directory. A zip is read from the end, so if there is no such file, e.g.
+// since the zip is stored compressed or encrypted, its content is written to
+// one first.
+func extractZipToDirectory(zipPath string, content io.Reader, destinationDir string, options ExtractionOptions, reporter *extractionReporter) (int, int64, error) {
+	if zipPath == "" {
+		plain, err := ioutil.TempFile(filepath.Dir(destinationDir), filepath.Base(destinationDir)+"-zip")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer os.Remove(plain.Name())
+
+		_, err = copyBuffered(plain, content)
+		if closeErr := plain.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		zipPath = plain.Name()
+	}
+
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer zipReader.Close()
+
+	var fileCount int
+	var sizeInBytes int64
+	var directories modTimes
+	limits := &extractionLimits{options: options}
+
+	for _, zipEntry := range zipReader.File {
+		fullpath, err := extractionPath(destinationDir, zipEntry.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		err = limits.admit(zipEntry.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var written int64
+		info := zipEntry.FileInfo()
+
+		switch {
+		case info.IsDir():
+			err = options.makeDirectory(fullpath, info.Mode())
+			directories.add(fullpath, zipEntry.Modified)
+
+		case info.Mode()&os.ModeSymlink != 0:
+			if options.SkipSymlinks {
+				continue
+			}
+			err = extractZipSymlink(destinationDir, zipEntry, fullpath)
+
+		default:
+			// the zip reader fails if an entry is larger than it claims
+			err = limits.grow(int64(zipEntry.UncompressedSize64))
+			if err != nil {
+				break
+			}
+			written, err = extractZipFile(zipEntry, fullpath, options.mode(info.Mode()))
+			if err == nil && options.PreserveModTimes {
+				err = os.Chtimes(fullpath, zipEntry.Modified, zipEntry.Modified)
+			}
+			fileCount++
+			sizeInBytes += written
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		reporter.entryExtracted(written)
+	}
+
+	if options.PreserveModTimes {
+		err = directories.restore()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	reporter.done()
+	return fileCount, sizeInBytes, nil
+}
+
+func extractZipSymlink(destinationDir string, zipEntry *zip.File, fullpath string) error {
+	err := os.MkdirAll(filepath.Dir(fullpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	reader, err := zipEntry.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	target, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return symlink(destinationDir, string(target), fullpath)
+}
+
+func extractZipFile(zipEntry *zip.File, fullpath string, mode os.FileMode) (int64, error) {
+	reader, err := zipEntry.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	return writeExtractedFile(fullpath, reader, mode)
+}
+
+// extractionPath returns where the archive entry with the given name is
+// extracted to, refusing names that would escape the destination directory,
+// whether by their name or through a symbolic link extracted before them
+func extractionPath(destinationDir, name string) (string, error) {
+	fullpath := filepath.Join(destinationDir, name)
+	if !isWithin(destinationDir, fullpath) {
+		return "", fmt.Errorf("archive entry %s is outside of the destination directory", name)
+	}
+
+	err := refuseSymlinkedParents(destinationDir, fullpath)
+	if err != nil {
+		return "", err
+	}
+	return fullpath, nil
+}
@@ -0,0 +1,135 @@
+package cacheddownloader
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ArchiveDecompressor decompresses an archive, see SetArchiveDecompressor.
+type ArchiveDecompressor func(compressed io.Reader) (io.ReadCloser, error)
+
+var archiveDecompressors = struct {
+	sync.Mutex
+	byName map[string]ArchiveDecompressor
+}{byName: map[string]ArchiveDecompressor{}}
+
+// SetArchiveDecompressor sets how TarTransform and FetchAsDirectory decompress
+// archives in the given format, "zstd" or "xz", e.g. with another
+// implementation. By default such archives are decompressed with the Go
+// implementations of the formats. A nil decompressor restores the default.
+func SetArchiveDecompressor(format string, decompressor ArchiveDecompressor) {
+	archiveDecompressors.Lock()
+	defer archiveDecompressors.Unlock()
+
+	if decompressor == nil {
+		delete(archiveDecompressors.byName, format)
+		return
+	}
+	archiveDecompressors.byName[format] = decompressor
+}
+
+// formatNames maps the formats whose decompressor may be set to their names
+var formatNames = map[archiveFormat]string{
+	zstdArchive: "zstd",
+	xzArchive:   "xz",
+}
+
+// defaultDecompressors decompress the formats whose decompressor may be set,
+// unless one is
+var defaultDecompressors = map[archiveFormat]ArchiveDecompressor{
+	zstdArchive: func(compressed io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+	xzArchive: func(compressed io.Reader) (io.ReadCloser, error) {
+		reader, err := xz.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	},
+}
+
+func isCompressedArchive(format archiveFormat) bool {
+	_, ok := formatNames[format]
+	return ok || format == gzipArchive
+}
+
+// archiveDecompressor returns how archives in the given compressed format are
+// decompressed, or an error if they cannot be
+func archiveDecompressor(format archiveFormat) (ArchiveDecompressor, error) {
+	if format == gzipArchive {
+		return func(compressed io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(compressed)
+		}, nil
+	}
+
+	name, ok := formatNames[format]
+	if !ok {
+		return nil, ErrUnknownArchiveFormat
+	}
+
+	archiveDecompressors.Lock()
+	decompressor := archiveDecompressors.byName[name]
+	archiveDecompressors.Unlock()
+	if decompressor != nil {
+		return decompressor, nil
+	}
+	return defaultDecompressors[format], nil
+}
+
+// decompressToTar writes the decompressed archive at path to destPath and
+// removes the archive
+func decompressToTar(ctx context.Context, format archiveFormat, path, destPath string) (int64, error) {
+	decompressor, err := archiveDecompressor(format)
+	if err != nil {
+		return 0, err
+	}
+
+	dest, err := os.OpenFile(destPath, os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer dest.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decompressed, err := decompressor(file)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := copyBuffered(dest, contextReader{ctx, decompressed})
+	if closeErr := decompressed.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package cacheddownloader
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// atRest is the form that cached files are stored in: compressed with the
+// compressor, if set, and then encrypted with the keys, if set
+type atRest struct {
+	keys       KeyWrapper
+	compressor Compressor
+}
+
+func (a atRest) enabled() bool {
+	return a.keys != nil || a.compressor != nil
+}
+
+// encode writes source to destination in the form it is stored in
+func (a atRest) encode(ctx context.Context, source io.Reader, destination io.Writer) error {
+	if a.compressor != nil {
+		compressed := compressingReader(a.compressor, source)
+		defer compressed.Close()
+		source = compressed
+	}
+
+	if a.keys != nil {
+		return sealFile(ctx, a.keys, source, destination)
+	}
+	_, err := copyBuffered(destination, source)
+	return err
+}
+
+// decode reads source as encoded by encode. Files that are not encoded, e.g.
+// archives written back from an expanded directory, are read as they are.
+func (a atRest) decode(ctx context.Context, source io.Reader) (io.ReadCloser, error) {
+	var content io.ReadCloser = ioutil.NopCloser(source)
+	buffered := bufio.NewReader(content)
+
+	if a.keys != nil && hasPrefix(buffered, sealedMagic) {
+		content = unsealingReader(ctx, a.keys, buffered)
+		buffered = bufio.NewReader(content)
+	}
+
+	if a.compressor != nil && hasPrefix(buffered, compressedMagic) {
+		return decompressingReader(a.compressor, buffered, content)
+	}
+	return readCloser{Reader: buffered, Closer: content}, nil
+}
+
+// open opens the cached file at path for reading its plain content
+func (a atRest) open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !a.enabled() {
+		return f, err
+	}
+
+	content, err := a.decode(context.Background(), f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{Reader: content, Closer: closers{content, f}}, nil
+}
+
+// prepareForCache writes the download, in the form it is stored in, to a new
+// file in the uncached path, and returns the download of that file. The
+// downloaded file is kept. If files are stored as they are, it returns the
+// download itself.
+func (c *cachedDownloader) prepareForCache(ctx context.Context, plain download) (download, error) {
+	rest := c.cache.atRest
+	if !rest.enabled() {
+		return plain, nil
+	}
+
+	source, err := os.Open(plain.path)
+	if err != nil {
+		return download{}, err
+	}
+	defer source.Close()
+
+	stored, err := ioutil.TempFile(c.uncachedPath, "stored-")
+	if err != nil {
+		return download{}, err
+	}
+
+	err = rest.encode(ctx, source, stored)
+	if closeErr := stored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stored.Name())
+		return download{}, err
+	}
+
+	info, err := os.Stat(stored.Name())
+	if err != nil {
+		os.Remove(stored.Name())
+		return download{}, err
+	}
+
+	plain.path = stored.Name()
+	plain.size = info.Size()
+	return plain, nil
+}
+
+// openCached returns a copy of the plain content of the cached file in the
+// uncached path, if the file is compressed or encrypted, and closes the cached
+// file. The copy is removed once it is closed.
+func (c *cachedDownloader) openCached(ctx context.Context, cached *CachedFile) (*CachedFile, error) {
+	rest := c.cache.atRest
+	if !rest.enabled() || !isEncoded(cached.File) {
+		return cached, nil
+	}
+	defer cached.Close()
+
+	content, err := rest.decode(ctx, cached.File)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	plain, err := ioutil.TempFile(c.uncachedPath, "plain-")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = copyBuffered(plain, content)
+	if closeErr := plain.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(plain.Name())
+		return nil, err
+	}
+
+	return c.handOutTempFile(plain.Name())
+}
+
+// isEncoded reports whether the file is compressed or encrypted, and rewinds
+// it
+func isEncoded(f *os.File) bool {
+	magic := make([]byte, len(sealedMagic))
+	_, err := io.ReadFull(f, magic)
+	_, seekErr := f.Seek(0, io.SeekStart)
+	return err == nil && seekErr == nil && (string(magic) == sealedMagic || string(magic) == compressedMagic)
+}
+
+// hasPrefix reports whether the reader continues with prefix, without
+// consuming it
+func hasPrefix(reader *bufio.Reader, prefix string) bool {
+	peeked, err := reader.Peek(len(prefix))
+	return err == nil && string(peeked) == prefix
+}
+
+// unsealingReader decrypts source as it is read
+func unsealingReader(ctx context.Context, keys KeyWrapper, source io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(unsealFile(ctx, keys, source, writer))
+	}()
+	return reader
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes all of its closers, and returns the first error
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package cacheddownloader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// SetBandwidthLimit caps the rate, in bytes per second, at which all
+// downloads of the Downloader together receive data. Zero, the default, means
+// no limit. A fetch can replace the limit with its own using
+// FetchOptions.BytesPerSecond. It should be called before any downloads are
+// started.
+func (downloader *Downloader) SetBandwidthLimit(bytesPerSecond int64) {
+	downloader.bandwidthLimiter = newBandwidthLimiter(bytesPerSecond)
+}
+
+// limiter returns the limiter for a download that asks for the given rate,
+// falling back to the limit shared by all downloads
+func (downloader *Downloader) limiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond > 0 {
+		return newBandwidthLimiter(bytesPerSecond)
+	}
+	return downloader.bandwidthLimiter
+}
+
+// bandwidthLimiter paces readers so that together they do not exceed
+// bytesPerSecond. A nil limiter does not limit anything.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+
+	lock *sync.Mutex
+	next time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &bandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+		lock:           &sync.Mutex{},
+	}
+}
+
+// reader wraps reader so that reading from it is paced by the limiter
+func (l *bandwidthLimiter) reader(ctx context.Context, reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, limiter: l, reader: reader}
+}
+
+// wait accounts for n bytes that were just transferred, blocking until the
+// bytes transferred before them are within the limit
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	limiter *bandwidthLimiter
+	reader  io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// read at most a tenth of a second's worth at once, to keep the pace smooth
+	chunk := int(r.limiter.bytesPerSecond / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		waitErr := r.limiter.wait(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
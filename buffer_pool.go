@@ -0,0 +1,67 @@
+package cacheddownloader
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCopyBufferSize is the size of the buffers that downloads, transforms
+// and directory expansions copy through, unless changed with
+// SetCopyBufferSize.
+const DefaultCopyBufferSize = 1024 * 1024
+
+var copyBuffers = &bufferPool{size: DefaultCopyBufferSize}
+
+// SetCopyBufferSize changes the size of the buffers that downloads, transforms
+// and directory expansions copy through. The buffers are pooled and shared by
+// all cachedDownloaders; larger buffers mean fewer syscalls per download, at
+// the cost of memory for each concurrent copy.
+func SetCopyBufferSize(size int) {
+	if size <= 0 {
+		size = DefaultCopyBufferSize
+	}
+	atomic.StoreInt64(&copyBuffers.size, int64(size))
+}
+
+// bufferPool hands out buffers of its current size; buffers of a previous
+// size are dropped when returned
+type bufferPool struct {
+	size int64
+	pool sync.Pool
+}
+
+func (p *bufferPool) get() *[]byte {
+	size := int(atomic.LoadInt64(&p.size))
+	if buffer, ok := p.pool.Get().(*[]byte); ok && len(*buffer) == size {
+		return buffer
+	}
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+func (p *bufferPool) put(buffer *[]byte) {
+	if len(*buffer) == int(atomic.LoadInt64(&p.size)) {
+		p.pool.Put(buffer)
+	}
+}
+
+// copyBuffered behaves like io.Copy, but copies through a pooled buffer
+func copyBuffered(destination io.Writer, source io.Reader) (int64, error) {
+	buffer := copyBuffers.get()
+	defer copyBuffers.put(buffer)
+
+	return io.CopyBuffer(destination, source, *buffer)
+}
+
+// copyBufferedN behaves like io.CopyN, but copies through a pooled buffer
+func copyBufferedN(destination io.Writer, source io.Reader, n int64) (int64, error) {
+	written, err := copyBuffered(destination, io.LimitReader(source, n))
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		err = io.EOF
+	}
+	return written, err
+}
@@ -0,0 +1,105 @@
+package cacheddownloader
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshnessLifetime returns how long a response may be served from the cache
+// without revalidation according to its Cache-Control max-age directive or,
+// failing that, its Expires header, less the time it already spent in upstream
+// caches according to its Age header. It returns zero if the response does not
+// specify a lifetime, and AlwaysRevalidate if the response is already stale or
+// forbids serving it without revalidation with no-cache or no-store.
+func freshnessLifetime(header http.Header) time.Duration {
+	if cacheControlDirective(header, "no-cache") || cacheControlDirective(header, "no-store") {
+		return AlwaysRevalidate
+	}
+
+	maxAge, ok := cacheControlSeconds(header, "max-age")
+	if !ok {
+		maxAge, ok = expiresSeconds(header)
+	}
+	if !ok {
+		return 0
+	}
+
+	age, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64)
+	if err != nil || age < 0 {
+		age = 0
+	}
+
+	if maxAge <= age {
+		return AlwaysRevalidate
+	}
+
+	return time.Duration(maxAge-age) * time.Second
+}
+
+// expiresSeconds returns the lifetime that the Expires header gives a
+// response, counted from its Date header, or from now if it has none. An
+// Expires that cannot be parsed, such as 0, means already expired.
+func expiresSeconds(header http.Header) (int64, bool) {
+	if _, ok := header["Expires"]; !ok {
+		return 0, false
+	}
+
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0, true
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+
+	seconds := int64(expires.Sub(date) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return seconds, true
+}
+
+// noStore reports whether the response forbids caching it
+func noStore(header http.Header) bool {
+	return cacheControlDirective(header, "no-store")
+}
+
+// cacheControlDirective reports whether a Cache-Control header carries the
+// directive, with or without a value
+func cacheControlDirective(header http.Header, directive string) bool {
+	for _, value := range header["Cache-Control"] {
+		for _, field := range strings.Split(value, ",") {
+			name := strings.SplitN(strings.TrimSpace(field), "=", 2)[0]
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// cacheControlSeconds looks up a Cache-Control directive with a delta-seconds
+// value, such as max-age=60
+func cacheControlSeconds(header http.Header, directive string) (int64, bool) {
+	for _, value := range header["Cache-Control"] {
+		for _, field := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], directive) {
+				continue
+			}
+
+			seconds, err := strconv.ParseInt(strings.Trim(parts[1], `"`), 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, false
+			}
+			return seconds, true
+		}
+	}
+
+	return 0, false
+}
@@ -1,25 +1,67 @@
 package cacheddownloader
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cloudfoundry/systemcerts"
 )
 
+var (
+	OverlappingPaths = errors.New("Cached and uncached paths must not overlap")
+	ErrNotModified   = errors.New("Not modified")
+	NoCachedPaths    = errors.New("At least one cached path is required")
+	ErrShutDown      = errors.New("Cached downloader is shut down")
+)
+
+type TooManyOpenError struct {
+	limit int
+}
+
+func NewTooManyOpenError(limit int) error {
+	return &TooManyOpenError{
+		limit: limit,
+	}
+}
+
+func (e *TooManyOpenError) Error() string {
+	return fmt.Sprintf("Too many open files and directories: limit '%d'", e.limit)
+}
+
 // called after a new object has entered the cache.
 // it is assumed that `path` will be removed, if a new path is returned.
 // a noop transformer returns the given path and its detected size.
 type CacheTransformer func(source, destination string) (newSize int64, err error)
 
+// ContextCacheTransformer is a CacheTransformer that is given the context of
+// the fetch that triggered it, so that it can observe its deadline,
+// cancellation and values. The context is done when the fetch is cancelled,
+// e.g. by its cancel channel or CancelAll; a transformer should then stop as
+// soon as it can, leave its destination empty and return ctx.Err(). The fetch
+// fails with a DownloadCancelledError either way, and does not try the
+// fallback transformers.
+type ContextCacheTransformer func(ctx context.Context, source, destination string) (newSize int64, err error)
+
+// withoutContext adapts a CacheTransformer to a ContextCacheTransformer that
+// ignores the context
+func withoutContext(transformer CacheTransformer) ContextCacheTransformer {
+	return func(ctx context.Context, source, destination string) (int64, error) {
+		return transformer(source, destination)
+	}
+}
+
 //go:generate counterfeiter -o cacheddownloaderfakes/fake_cached_downloader.go . CachedDownloader
 
 // CachedDownloader is responsible for downloading and caching files and maintaining reference counts for each cache entry.
@@ -33,14 +75,66 @@ type CachedDownloader interface {
 	Fetch(urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (stream io.ReadCloser, size int64, err error)
 
 	// FetchAsDirectory downloads the tarfile pointed to by the given URL, expands the tarfile into a directory, and returns the path of that directory as well as the total number of bytes downloaded.
+	// If the response cannot be cached, e.g. since it has neither an ETag nor a Last-Modified header, the tarfile is expanded
+	// into a directory in the uncached path instead, which is removed by CloseDirectory.
 	FetchAsDirectory(urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (dirPath string, size int64, err error)
 
+	// FetchWithContext behaves like Fetch, but is cancelled when ctx is done.
+	// The context is handed to the downloader's RequestDecorator for every outgoing request.
+	FetchWithContext(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType) (stream io.ReadCloser, size int64, err error)
+
+	// FetchAsDirectoryWithContext behaves like FetchAsDirectory, but is cancelled when ctx is done.
+	// The context is handed to the downloader's RequestDecorator for every outgoing request.
+	FetchAsDirectoryWithContext(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType) (dirPath string, size int64, err error)
+
+	// FetchWithOptions behaves like FetchWithContext, but allows the given options to override the defaults for this fetch.
+	FetchWithOptions(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (stream io.ReadCloser, size int64, err error)
+
+	// FetchAsDirectoryWithOptions behaves like FetchAsDirectoryWithContext, but allows the given options to override the defaults for this fetch.
+	FetchAsDirectoryWithOptions(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (dirPath string, size int64, err error)
+
+	// FetchAsDirectoryWithInfo behaves like FetchAsDirectoryWithOptions, but also describes the contents of the
+	// directory and whether it was served from the cache.
+	FetchAsDirectoryWithInfo(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (info DirectoryInfo, err error)
+
+	// FetchDirectory behaves like FetchAsDirectoryWithInfo, but returns a handle on the directory that is
+	// released by closing it rather than with CloseDirectory. Handles that are garbage collected without
+	// being closed are reported and released, see SetDirectoryLeakHandler.
+	FetchDirectory(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (dir Directory, err error)
+
+	// FetchIfModified downloads the file at the given URL unless the origin reports that it has not changed
+	// since the given caching info was obtained, in which case ErrNotModified is returned without a stream.
+	// The download is not stored in the cache; the stream removes the file once closed. The returned caching
+	// info describes the newly downloaded content.
+	FetchIfModified(ctx context.Context, urlToFetch *url.URL, cachingInfo CachingInfoType, checksum ChecksumInfoType) (stream io.ReadCloser, size int64, newCachingInfo CachingInfoType, err error)
+
 	// CloseDirectory decrements the usage counter for the given cacheKey/directoryPath pair.
 	// It should be called when the directory returned by FetchAsDirectory is no longer in use.
 	// In this way, FetchAsDirectory and CloseDirectory should be treated as a pair of operations,
 	// and a process that calls FetchAsDirectory should make sure a corresponding CloseDirectory is eventually called.
 	CloseDirectory(cacheKey, directoryPath string) error
 
+	// CancelAll cancels every fetch that is in flight, whether it is still waiting for its turn or already
+	// downloading, making it return a DownloadCancelledError. Fetches started afterwards are not affected.
+	CancelAll()
+
+	// Shutdown stops admitting fetches, which fail with ErrShutDown from then on, and waits for the fetches
+	// in flight to return. If ctx is done first, they are cancelled as with CancelAll, and Shutdown returns
+	// ctx.Err() once they have returned. Finally it removes the files that fetches left in the uncached path.
+	Shutdown(ctx context.Context) error
+
+	// Remove evicts the entry for the given cacheKey, so that the next fetch downloads it again. An entry
+	// that is in use is only deleted from disk once its last reader or directory is closed.
+	Remove(cacheKey string)
+
+	// RemoveByPrefix evicts, as Remove does, every entry whose cache key starts with prefix, and returns
+	// the number of entries it evicted. Entries saved by a version that did not record cache keys are
+	// only evicted by Remove and Clear.
+	RemoveByPrefix(prefix string) int
+
+	// Clear evicts every entry in the cache, as Remove does.
+	Clear()
+
 	// SaveState writes the current state of the cache metadata to a file so that it can be recovered
 	// later. This should be called on process shutdown.
 	SaveState() error
@@ -64,25 +158,192 @@ func NoopTransform(source, destination string) (int64, error) {
 	return fi.Size(), nil
 }
 
+// CacheabilityFunc decides whether the response to a download may be cached.
+type CacheabilityFunc func(url *url.URL, resp *http.Response) bool
+
 type CachingInfoType struct {
 	ETag         string
 	LastModified string
+
+	// freshness is the lifetime the origin gave the response, and noStore
+	// whether it forbade caching it; they are only set on caching info returned
+	// by the Downloader and are not persisted
+	freshness time.Duration
+	noStore   bool
 }
 
+// ChecksumInfoType gives the checksum that a download must match: Algorithm is
+// md5, sha1, sha256, sha384 or sha512, and Value the hex digest. A Value in
+// the Subresource Integrity format may be given without an Algorithm, see
+// ParseIntegrity.
 type ChecksumInfoType struct {
 	Algorithm string
 	Value     string
 }
 
+const (
+	// AlwaysRevalidate makes every fetch of an entry revalidate it with the origin.
+	AlwaysRevalidate time.Duration = -1
+	// NeverRevalidate marks an entry as immutable; it is served from the cache
+	// without revalidation for as long as it stays in the cache.
+	NeverRevalidate time.Duration = math.MaxInt64
+)
+
+// FetchOptions overrides the defaults of the cachedDownloader for a single fetch.
+// The zero value uses the defaults.
+type FetchOptions struct {
+	// TTL is how long the fetched entry may be served from the cache before it is
+	// revalidated with the origin. Zero uses the lifetime given by the response's
+	// Cache-Control max-age or Expires, less its Age, or else the default TTL;
+	// use AlwaysRevalidate or NeverRevalidate for the extremes.
+	TTL time.Duration
+
+	// ExtractionProgress, if set, is called periodically while FetchAsDirectory
+	// expands the downloaded tarball, and once more when it is done. It is called
+	// with the cache locked and must not call back into the cachedDownloader.
+	ExtractionProgress func(ExtractionProgress)
+
+	// ExtractionProgressInterval is the minimum time between two calls to
+	// ExtractionProgress. Zero uses DefaultExtractionProgressInterval.
+	ExtractionProgressInterval time.Duration
+
+	// DeferExpansion makes FetchAsDirectory cache the downloaded tarball
+	// without expanding it, e.g. when the fetch only verifies the checksum or
+	// warms the cache. The returned DirectoryInfo has no path, and nothing has
+	// to be closed. The tarball is expanded, and its directory counted in the
+	// size of the cache, when the entry is first fetched as a directory
+	// without this option or got with GetDirectory. A tarball that cannot be
+	// cached is verified and discarded. It is ignored by FetchDirectory.
+	DeferExpansion bool
+
+	// SkipTransform serves the downloaded bytes as they are, without running the
+	// transformer given to New. The untransformed entry is cached separately from
+	// the transformed one for the same cache key. It is ignored by
+	// FetchAsDirectory, which always needs a tarball.
+	SkipTransform bool
+
+	// BytesPerSecond, if set, limits the rate at which this fetch downloads in
+	// place of the limit set with Downloader.SetBandwidthLimit.
+	BytesPerSecond int64
+
+	// Mirrors are tried in order if the download from the URL given to the
+	// fetch fails. The fetch only fails once every mirror has failed. Entries
+	// are cached under the cache key regardless of the mirror they came from.
+	Mirrors []*url.URL
+
+	// RefreshURL, if set, is called before each retry of the download from the
+	// URL given to the fetch, and the retry downloads the URL it returns. It
+	// lets pre-signed URLs that have expired in the meantime be replaced. The
+	// fetch fails if RefreshURL does.
+	RefreshURL func() (*url.URL, error)
+
+	// ChecksumURL, if set, is downloaded before the artifact to obtain its
+	// checksum, e.g. from a sibling .sha256 file. The file may list checksums
+	// as written by coreutils (sha256sum and the like) or BSD tools; the one
+	// for the file name at the end of the artifact's URL is used, or the only
+	// one listed. The artifact is verified against it before it is cached. It
+	// is ignored if the fetch is given a checksum.
+	ChecksumURL *url.URL
+
+	// SignatureURL, if set, is downloaded after the artifact to verify it
+	// against the detached PGP signature there, armored or binary, with the
+	// keyring set with Downloader.SetPGPKeyring. Signature gives the signature
+	// inline instead. A download whose signature does not verify fails with a
+	// SignatureFailedError before it is transformed or cached.
+	SignatureURL *url.URL
+	Signature    []byte
+
+	// Priority orders the fetch among those waiting for a concurrent download
+	// slot of the Downloader: when a slot frees up, the waiting fetch with the
+	// highest priority gets it. Zero is PriorityNormal.
+	Priority int
+
+	// Namespace, if set, keeps the entry apart from those of other namespaces:
+	// entries with the same cache key in different namespaces are separate,
+	// and each namespace may have its own quota, see SetNamespaceQuota.
+	// Remove only removes entries outside of any namespace.
+	Namespace string
+
+	// Labels are recorded with the entry when it is added to the cache, e.g.
+	// the app or the source that it belongs to, so that tooling can map the
+	// contents of the cache back to workloads; see Labels and Entries. An
+	// entry downloaded again keeps its labels unless the fetch gives others.
+	Labels map[string]string
+
+	// admissionKey is what the fetch takes turns for a download slot under; it
+	// is the cache key of cached fetches, and else the URL.
+	admissionKey string
+	// cacheKey is the cache key that the fetch was given, before it was
+	// hashed; it is stored with the entry.
+	cacheKey string
+}
+
+// DirectoryInfo describes a directory returned by FetchAsDirectoryWithInfo.
+type DirectoryInfo struct {
+	// Path is the expanded directory; it must be released with CloseDirectory,
+	// unless it was fetched with FetchDirectory.
+	Path string
+	// DownloadedSize is the number of bytes downloaded, zero when the directory
+	// was served from the cache.
+	DownloadedSize int64
+	// FileCount is the number of regular files extracted into the directory.
+	FileCount int
+	// SizeInBytes is the total size of the extracted regular files.
+	SizeInBytes int64
+	// FromCache reports whether the cached directory was served without
+	// downloading it again.
+	FromCache bool
+	// Labels are those recorded with the cache entry, see FetchOptions.Labels.
+	Labels map[string]string
+}
+
+// untransformedKeySuffix keeps entries fetched with SkipTransform apart from
+// the transformed entries for the same cache key
+const untransformedKeySuffix = "\x00untransformed"
+
 type cachedDownloader struct {
 	downloader    *Downloader
 	uncachedPath  string
 	cache         *FileCache
-	transformer   CacheTransformer
+	transformer   ContextCacheTransformer
+	fallbacks     []CacheTransformer
 	cacheLocation string
-
-	lock       *sync.Mutex
-	inProgress map[string]chan struct{}
+	defaultTTL    time.Duration
+
+	cacheabilityFunc   CacheabilityFunc
+	ignoreCacheHeaders bool
+	maxEntrySize       int64
+	freeSpaceReserve   int64
+	namespaceQuotas    map[string]int64
+	secondary          SecondaryCache
+	keyHasher          KeyHasher
+	md5Compatibility   bool
+	memory             *memoryTier
+	entryObserver      EntryObserver
+
+	directoryLeakHandler func(DirectoryInfo)
+
+	lock                *sync.Mutex
+	inProgress          map[string]chan struct{}
+	keyQueue            *queueTracker
+	cancelAll           chan struct{}
+	coalesce            bool
+	sharedDownloads     map[string]*sharedDownload
+	uncachedDirectories map[string]struct{}
+	uncachedFiles       map[string]struct{}
+	lowerDirs           map[string]*lowerDirPin
+	openHandles         int
+	shutDown            bool
+	fetches             sync.WaitGroup
+	maxOpenHandles      int
+	hits                int64
+	misses              int64
+	revalidations       int64
+	bytesFromCache      int64
+	corrupted           int64
+	verifyOnRead        float64
+	tempFileReaperStop  chan struct{}
+	entryEventLock      sync.Mutex
 }
 
 func (c CachingInfoType) isCacheable() bool {
@@ -95,17 +356,241 @@ func (c CachingInfoType) Equal(other CachingInfoType) bool {
 
 // A transformer function can be used to do post-download
 // processing on the file before it is stored in the cache.
-func New(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloadTimeout time.Duration, maxConcurrentDownloads int, skipSSLVerification bool, caCertPool *systemcerts.CertPool, transformer CacheTransformer) *cachedDownloader {
-	os.MkdirAll(cachedPath, 0770)
+//
+// New returns an OverlappingPaths error if cachedPath and uncachedPath are the
+// same directory or one is nested inside the other. New is kept for existing
+// callers; NewWithOptions takes the same settings as options.
+func New(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloadTimeout time.Duration, maxConcurrentDownloads int, skipSSLVerification bool, caCertPool *systemcerts.CertPool, transformer CacheTransformer) (*cachedDownloader, error) {
+	return NewWithOptions(cachedPath, uncachedPath,
+		WithMaxSize(maxSizeInBytes),
+		WithDownloadTimeout(downloadTimeout),
+		WithMaxConcurrentDownloads(maxConcurrentDownloads),
+		WithSkipSSLVerification(skipSSLVerification),
+		WithCACertPool(caCertPool),
+		WithTransformer(transformer),
+	)
+}
+
+// NewWithDownloader behaves like New, but uses the given Downloader so that it
+// can be configured (e.g. with a RequestDecorator) before it is handed over.
+func NewWithDownloader(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloader *Downloader, transformer CacheTransformer) (*cachedDownloader, error) {
+	return NewSharded([]string{cachedPath}, uncachedPath, maxSizeInBytes, downloader, transformer)
+}
+
+// NewSharded behaves like NewWithDownloader, but spreads the cache across
+// several directories, e.g. one per disk. Entries are assigned to a shard by
+// their cache key; maxSizeInBytes and least recently used eviction apply to
+// all shards together. The saved state is kept in the first shard.
+//
+// NewSharded returns an OverlappingPaths error if any two of the given paths
+// overlap, and NoCachedPaths if cachedPaths is empty.
+func NewSharded(cachedPaths []string, uncachedPath string, maxSizeInBytes int64, downloader *Downloader, transformer CacheTransformer) (*cachedDownloader, error) {
+	if len(cachedPaths) == 0 {
+		return nil, NoCachedPaths
+	}
+
+	err := validatePaths(cachedPaths, uncachedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cachedPath := range cachedPaths {
+		os.MkdirAll(cachedPath, 0770)
+		removeStagedFiles(cachedPath)
+	}
+
 	return &cachedDownloader{
-		downloader:    NewDownloader(downloadTimeout, maxConcurrentDownloads, skipSSLVerification, caCertPool),
+		downloader:    downloader,
 		uncachedPath:  uncachedPath,
-		cache:         NewCache(cachedPath, maxSizeInBytes),
-		transformer:   transformer,
+		cache:         NewShardedCache(cachedPaths, maxSizeInBytes),
+		transformer:   withoutContext(transformer),
+		keyHasher:     SHA256KeyHasher,
 		lock:          &sync.Mutex{},
 		inProgress:    map[string]chan struct{}{},
-		cacheLocation: filepath.Join(cachedPath, "saved_cache.json"),
+		keyQueue:      newQueueTracker(CacheKeyQueue),
+		cancelAll:     make(chan struct{}),
+		cacheLocation: filepath.Join(cachedPaths[0], "saved_cache.json"),
+
+		uncachedDirectories: map[string]struct{}{},
+		uncachedFiles:       map[string]struct{}{},
+		sharedDownloads:     map[string]*sharedDownload{},
+	}, nil
+}
+
+// NewPersistent behaves like NewWithDownloader, but keeps the cache of a
+// previous run: it immediately recovers the state saved by SaveState, keeping
+// the entries that are still valid and removing everything else from the
+// cached path.
+func NewPersistent(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloader *Downloader, transformer CacheTransformer) (*cachedDownloader, RecoveryReport, error) {
+	c, err := NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+	if err != nil {
+		return nil, RecoveryReport{}, err
+	}
+
+	report, err := c.RecoverStateWithReport()
+	if err != nil {
+		return nil, RecoveryReport{}, err
+	}
+
+	return c, report, nil
+}
+
+// validatePaths makes sure that temporary files in the uncached path, and the
+// contents of the other shards, can never collide with, or be cleaned up along
+// with, the contents of a shard
+func validatePaths(cachedPaths []string, uncachedPath string) error {
+	paths := []string{}
+	for _, path := range append([]string{uncachedPath}, cachedPaths...) {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		for _, other := range paths {
+			if isWithin(path, other) || isWithin(other, path) {
+				return OverlappingPaths
+			}
+		}
+		paths = append(paths, path)
+	}
+
+	return nil
+}
+
+// isWithin reports whether path is dir itself or is nested inside of it
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// SetDefaultTTL sets how long cached entries are served without revalidating
+// them with the origin, unless a fetch overrides it or the response carries a
+// Cache-Control max-age. By default every fetch revalidates.
+func (c *cachedDownloader) SetDefaultTTL(ttl time.Duration) {
+	c.defaultTTL = ttl
+}
+
+// SetIgnoreCacheHeaders makes the cachedDownloader disregard the
+// Cache-Control and Expires headers of responses: entries are then revalidated
+// according to the TTL of the fetch or the default TTL alone, which by default
+// means on every fetch, and responses marked no-store are cached like any
+// other. It should be called before any fetches are started.
+func (c *cachedDownloader) SetIgnoreCacheHeaders(ignore bool) {
+	c.ignoreCacheHeaders = ignore
+}
+
+// SetMaxEntrySize limits the size of a single entry in the cache, e.g. to a
+// quarter of its maximum size, so that one huge download cannot evict
+// everything else. Larger downloads are served from the uncached path like
+// downloads that are not cacheable, and any older entry for their cache key is
+// removed. Zero, the default, means no limit other than the maximum size of
+// the cache. It should be called before any fetches are started.
+func (c *cachedDownloader) SetMaxEntrySize(maxSizeInBytes int64) {
+	c.maxEntrySize = maxSizeInBytes
+}
+
+// admitsEntry reports whether an entry of the given size may be cached by the
+// fetch, given the maximum entry size and the quota of its namespace
+func (c *cachedDownloader) admitsEntry(options FetchOptions, size int64) bool {
+	if c.maxEntrySize > 0 && size > c.maxEntrySize {
+		return false
 	}
+	quota := c.namespaceQuota(options.Namespace)
+	return quota <= 0 || size <= quota
+}
+
+// SetCacheabilityFunc overrides the default rule that a download is only
+// cached if the response carries an ETag or Last-Modified header. The function
+// is given the response once its body has been read; returning false serves
+// the download without caching it. Downloads cached without validators are
+// downloaded again whenever they need to be revalidated.
+func (c *cachedDownloader) SetCacheabilityFunc(cacheable CacheabilityFunc) {
+	c.cacheabilityFunc = cacheable
+}
+
+func (c *cachedDownloader) isCacheable(url *url.URL, download download) bool {
+	if c.cacheabilityFunc != nil {
+		return c.cacheabilityFunc(url, download.response)
+	}
+	if download.cachingInfo.noStore && !c.ignoreCacheHeaders {
+		return false
+	}
+	return download.cachingInfo.isCacheable()
+}
+
+// SetFallbackTransformers configures transformers that are tried, in order,
+// when the transformer given to New fails on a download. A fetch only fails
+// once every transformer has failed.
+func (c *cachedDownloader) SetFallbackTransformers(transformers ...CacheTransformer) {
+	c.fallbacks = transformers
+}
+
+// SetContextTransformer replaces the transformer given to New with one that is
+// handed the context of the fetch.
+func (c *cachedDownloader) SetContextTransformer(transformer ContextCacheTransformer) {
+	c.transformer = transformer
+}
+
+func (c *cachedDownloader) transformers(options FetchOptions) []ContextCacheTransformer {
+	if options.SkipTransform {
+		return []ContextCacheTransformer{withoutContext(NoopTransform)}
+	}
+
+	transformers := []ContextCacheTransformer{c.transformer}
+	for _, fallback := range c.fallbacks {
+		transformers = append(transformers, withoutContext(fallback))
+	}
+	return transformers
+}
+
+// SetMaxOpenHandles limits how many readers returned by Fetch and directories
+// returned by FetchAsDirectory may be open at once. Once the limit is reached,
+// fetches fail with a TooManyOpenError until a reader is closed or a directory
+// is released with CloseDirectory. Zero, the default, means no limit.
+func (c *cachedDownloader) SetMaxOpenHandles(max int) {
+	c.lock.Lock()
+	c.maxOpenHandles = max
+	c.lock.Unlock()
+}
+
+// OpenHandles returns the number of readers and directories that are
+// currently handed out and not yet closed.
+func (c *cachedDownloader) OpenHandles() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.openHandles
+}
+
+func (c *cachedDownloader) acquireHandle() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.maxOpenHandles > 0 && c.openHandles >= c.maxOpenHandles {
+		return NewTooManyOpenError(c.maxOpenHandles)
+	}
+
+	c.openHandles++
+	return nil
+}
+
+func (c *cachedDownloader) releaseHandle() {
+	c.lock.Lock()
+	c.openHandles--
+	c.lock.Unlock()
+}
+
+func (c *cachedDownloader) ttl(options FetchOptions, cachingInfo CachingInfoType) time.Duration {
+	if options.TTL != 0 {
+		return options.TTL
+	}
+	if cachingInfo.freshness != 0 && !c.ignoreCacheHeaders {
+		return cachingInfo.freshness
+	}
+	return c.defaultTTL
 }
 
 func (c *cachedDownloader) SaveState() error {
@@ -114,13 +599,41 @@ func (c *cachedDownloader) SaveState() error {
 		return err
 	}
 
-	return ioutil.WriteFile(c.cacheLocation, json, 0600)
+	return writeFileAtomically(c.cacheLocation, json)
+}
+
+// RecoveryReport describes how RecoverState reconciled the saved state with
+// the contents of the cached path.
+type RecoveryReport struct {
+	// Entries is the number of entries that were kept, including adopted ones.
+	Entries int
+	// DroppedEntries is the number of saved entries that were discarded since
+	// their files are gone or they lack the caching info to revalidate them.
+	DroppedEntries int
+	// AdoptedEntries is the number of entries that were not in the saved state
+	// but were adopted from the metadata next to their files, see NewAdopting.
+	AdoptedEntries int
+	// EvictedEntries is the number of valid entries that were evicted to fit
+	// the cache into its maximum size.
+	EvictedEntries int
+	// RemovedFiles are the files and directories in the cached path that were
+	// deleted since no entry refers to them.
+	RemovedFiles []string
 }
 
 func (c *cachedDownloader) RecoverState() error {
+	_, err := c.RecoverStateWithReport()
+	return err
+}
+
+// RecoverStateWithReport behaves like RecoverState, and also reports what was
+// kept and what was cleaned up.
+func (c *cachedDownloader) RecoverStateWithReport() (RecoveryReport, error) {
+	report := RecoveryReport{}
+
 	file, err := os.Open(c.cacheLocation)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return report, err
 	}
 
 	if err == nil {
@@ -130,10 +643,17 @@ func (c *cachedDownloader) RecoverState() error {
 	}
 
 	// set the inuse count to 0 since all containers will be recreated
-	for _, entry := range c.cache.Entries {
+	for cacheKey, entry := range c.cache.Entries {
+		if !c.recoverable(entry) {
+			delete(c.cache.Entries, cacheKey)
+			report.DroppedEntries++
+			continue
+		}
+
 		// inuseCount starts at 1 (i.e. 1 == no references to the entry)
 		entry.directoryInUseCount = 0
 		entry.fileInUseCount = 0
+		entry.reaper = c.cache.reaper
 	}
 
 	// delete files that aren't in the cache. **note** if there is no
@@ -142,67 +662,253 @@ func (c *cachedDownloader) RecoverState() error {
 
 	for _, entry := range c.cache.Entries {
 		trackedFiles[entry.FilePath] = struct{}{}
+		trackedFiles[entry.FilePath+sidecarSuffix] = struct{}{}
 		trackedFiles[entry.ExpandedDirectoryPath] = struct{}{}
+		trackedFiles[entry.ExpandedDirectoryPath+manifestSuffix] = struct{}{}
 	}
 
-	files, err := ioutil.ReadDir(c.cache.CachedPath)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+	if c.cache.sidecars {
+		report.AdoptedEntries, err = c.cache.adoptEntries(trackedFiles)
+		if err != nil {
+			return report, err
+		}
 	}
 
-	for _, file := range files {
-		path := filepath.Join(c.cache.CachedPath, file.Name())
-		if _, ok := trackedFiles[path]; ok {
-			continue
+	for _, cachedPath := range c.cache.shards() {
+		var files []os.FileInfo
+		files, err = ioutil.ReadDir(cachedPath)
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
 		}
 
-		err = os.RemoveAll(path)
-		if err != nil {
-			return err
+		for _, file := range files {
+			path := filepath.Join(cachedPath, file.Name())
+			if _, ok := trackedFiles[path]; ok {
+				continue
+			}
+
+			err = removeAll(path)
+			if err != nil {
+				return report, err
+			}
+			report.RemovedFiles = append(report.RemovedFiles, path)
 		}
 	}
 
 	// free some disk space in case the maxSizeInBytes was changed
+	recovered := len(c.cache.Entries)
 	c.cache.makeRoom(0, "")
-	return err
+	c.cache.persist()
+	report.Entries = len(c.cache.Entries)
+	report.EvictedEntries = recovered - report.Entries
+	return report, err
+}
+
+// recoverable reports whether a saved entry can still be served: it must have
+// been admitted as cacheable, and its file or directory must still be in one
+// of the shards. A file that is not the size that was recorded for it was
+// truncated, e.g. by a crash while it was being written, and is not served.
+func (c *cachedDownloader) recoverable(entry *FileCacheEntry) bool {
+	if !entry.cacheable() {
+		return false
+	}
+
+	if info, err := os.Stat(entry.FilePath); err == nil && !intactSize(info, entry) {
+		return false
+	}
+
+	for _, path := range []string{entry.FilePath, entry.ExpandedDirectoryPath} {
+		if path == "" {
+			continue
+		}
+
+		for _, cachedPath := range c.cache.shards() {
+			if filepath.Dir(path) != filepath.Clean(cachedPath) {
+				continue
+			}
+
+			if _, err := os.Stat(path); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// intactSize reports whether info, the file of entry, has the size recorded
+// for it. The recorded size is doubled while the entry has both a file and an
+// expanded directory.
+func intactSize(info os.FileInfo, entry *FileCacheEntry) bool {
+	if info.IsDir() || entry.Size <= 0 {
+		return true
+	}
+	if entry.FilePath != "" && entry.ExpandedDirectoryPath != "" {
+		return info.Size() == entry.Size/2
+	}
+	return info.Size() == entry.Size
 }
 
 func (c *cachedDownloader) CloseDirectory(cacheKey, directoryPath string) error {
-	cacheKey = fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
-	return c.cache.CloseDirectory(cacheKey, directoryPath)
+	if c.closeUncachedDirectory(directoryPath) {
+		c.releaseHandle()
+		return removeAll(directoryPath)
+	}
+
+	cacheKey = c.hashCacheKey(cacheKey)
+	err := c.cache.CloseDirectory(cacheKey, directoryPath)
+	if err == EntryNotFound {
+		// the directory may have been fetched in a namespace
+		if hashedKey, ok := c.cache.keyForDirectory(directoryPath); ok {
+			err = c.cache.CloseDirectory(hashedKey, directoryPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.releaseHandle()
+	return nil
 }
 
 func (c *cachedDownloader) Fetch(url *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (io.ReadCloser, int64, error) {
+	return c.fetch(context.Background(), url, cacheKey, checksum, FetchOptions{}, cancelChan)
+}
+
+func (c *cachedDownloader) FetchWithContext(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType) (io.ReadCloser, int64, error) {
+	return c.fetch(ctx, url, cacheKey, checksum, FetchOptions{}, nil)
+}
+
+func (c *cachedDownloader) FetchWithOptions(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (io.ReadCloser, int64, error) {
+	return c.fetch(ctx, url, cacheKey, checksum, options, nil)
+}
+
+func (c *cachedDownloader) fetch(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions, cancelChan <-chan struct{}) (io.ReadCloser, int64, error) {
+	err := c.beginFetch()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.fetches.Done()
+	defer c.notifyEntryObserver()
+
+	err = c.acquireHandle()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := c.fetchContext(ctx, cancelChan)
+	defer cancel()
+
+	var file *CachedFile
+	var size int64
 	if cacheKey == "" {
-		return c.fetchUncachedFile(url, checksum, cancelChan)
+		file, size, err = c.fetchUncachedFile(ctx, url, checksum, options)
+	} else {
+		options.cacheKey = cacheKey
+		cacheKey = namespacedKey(options.Namespace, cacheKey)
+		if options.SkipTransform {
+			cacheKey += untransformedKeySuffix
+		}
+		cacheKey = c.hashCacheKey(cacheKey)
+
+		if file, ok := c.fromMemory(cacheKey, options); ok {
+			return file, 0, nil
+		}
+		file, size, err = c.fetchCachedFile(ctx, url, cacheKey, checksum, options)
+	}
+
+	if err != nil {
+		c.releaseHandle()
+		return nil, 0, err
 	}
 
-	cacheKey = fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
-	return c.fetchCachedFile(url, cacheKey, checksum, cancelChan)
+	file.afterClose(c.releaseHandle)
+	return file, size, nil
 }
 
-func (c *cachedDownloader) fetchUncachedFile(url *url.URL, checksum ChecksumInfoType, cancelChan <-chan struct{}) (*CachedFile, int64, error) {
-	download, _, size, err := c.populateCache(url, "uncached", CachingInfoType{}, checksum, c.transformer, cancelChan)
+func (c *cachedDownloader) FetchIfModified(ctx context.Context, url *url.URL, cachingInfo CachingInfoType, checksum ChecksumInfoType) (io.ReadCloser, int64, CachingInfoType, error) {
+	err := c.beginFetch()
+	if err != nil {
+		return nil, 0, CachingInfoType{}, err
+	}
+	defer c.fetches.Done()
+	defer c.notifyEntryObserver()
+
+	err = c.acquireHandle()
+	if err != nil {
+		return nil, 0, CachingInfoType{}, err
+	}
+
+	ctx, cancel := c.fetchContext(ctx, nil)
+	defer cancel()
+
+	download, notModified, size, err := c.populateCache(ctx, url, "uncached", cachingInfo, checksum, c.transformers(FetchOptions{}), FetchOptions{})
+	if err == nil && notModified {
+		err = ErrNotModified
+	}
+	if err != nil {
+		c.releaseHandle()
+		return nil, 0, CachingInfoType{}, err
+	}
+
+	file, err := c.handOutTempFile(download.path)
+	if err != nil {
+		c.releaseHandle()
+		return nil, 0, CachingInfoType{}, err
+	}
+
+	file.afterClose(c.releaseHandle)
+	return file, size, download.cachingInfo, nil
+}
+
+func (c *cachedDownloader) fetchUncachedFile(ctx context.Context, url *url.URL, checksum ChecksumInfoType, options FetchOptions) (*CachedFile, int64, error) {
+	download, _, size, err := c.populateCache(ctx, url, "uncached", CachingInfoType{}, checksum, c.transformers(options), options)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	file, err := tempFileRemoveOnClose(download.path)
+	file, err := c.handOutTempFile(download.path)
 	return file, size, err
 }
 
-func (c *cachedDownloader) fetchCachedFile(url *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (*CachedFile, int64, error) {
-	rateLimiter, err := c.acquireLimiter(cacheKey, cancelChan)
+func (c *cachedDownloader) fetchCachedFile(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (*CachedFile, int64, error) {
+	rateLimiter, err := c.acquireLimiter(ctx, cacheKey)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer c.releaseLimiter(cacheKey, rateLimiter)
 
+	c.cache.removeCollision(cacheKey, options.cacheKey, options.Namespace)
+
 	// lookup cache entry
 	currentReader, currentCachingInfo, getErr := c.cache.Get(cacheKey)
 
+	// the cached file is corrupt; download it again
+	if currentReader != nil && !c.intact(cacheKey, currentReader) {
+		currentReader.Close()
+		c.cache.removeAs(cacheKey, EntryCorrupted)
+		currentReader, currentCachingInfo, getErr = nil, CachingInfoType{}, EntryNotFound
+	}
+
+	// entries that are compressed or encrypted are served from a plain copy
+	if currentReader != nil {
+		currentReader, err = c.openCached(ctx, currentReader)
+		if err != nil {
+			c.cache.removeAs(cacheKey, EntryCorrupted)
+			currentReader, currentCachingInfo, getErr = nil, CachingInfoType{}, EntryNotFound
+		}
+	}
+
+	// the entry is still within its TTL; no need to ask the origin
+	if currentReader != nil && c.cache.IsFresh(cacheKey) {
+		c.recordHit(fileSize(currentReader), false)
+		c.keepInMemory(cacheKey, currentReader)
+		return currentReader, 0, nil
+	}
+
 	// download (short circuits if endpoint respects etag/etc.)
-	download, cacheIsWarm, size, err := c.populateCache(url, cacheKey, currentCachingInfo, checksum, c.transformer, cancelChan)
+	options.admissionKey = cacheKey
+	download, cacheIsWarm, size, err := c.populateCache(ctx, url, cacheKey, currentCachingInfo, checksum, c.transformers(options), options)
 	if err != nil {
 		if currentReader != nil {
 			currentReader.Close()
@@ -212,9 +918,16 @@ func (c *cachedDownloader) fetchCachedFile(url *url.URL, cacheKey string, checks
 
 	// nothing had to be downloaded; return the cached entry
 	if cacheIsWarm {
+		if getErr == nil {
+			c.recordHit(fileSize(currentReader), true)
+			c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+			c.keepInMemory(cacheKey, currentReader)
+		}
 		return currentReader, 0, getErr
 	}
 
+	c.recordMiss()
+
 	// current cache is not fresh; disregard it
 	if currentReader != nil {
 		currentReader.Close()
@@ -222,11 +935,46 @@ func (c *cachedDownloader) fetchCachedFile(url *url.URL, cacheKey string, checks
 
 	// fetch uncached data
 	var newReader *CachedFile
-	if download.cachingInfo.isCacheable() {
-		newReader, err = c.cache.Add(cacheKey, download.path, download.size, download.cachingInfo)
+	cacheable := c.isCacheable(url, download)
+	stored := download
+	if cacheable {
+		stored, err = c.prepareForCache(ctx, download)
+		if err != nil {
+			os.Remove(download.path)
+			return nil, 0, err
+		}
+	}
+
+	if cacheable && c.admitsEntry(options, stored.size) {
+		digest := c.digestForCache(stored.path)
+		c.makeNamespaceRoom(cacheKey, options, stored.size)
+		newReader, err = c.cache.Add(cacheKey, stored.path, stored.size, stored.cachingInfo)
+		if err == nil {
+			c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+			c.cache.setDigest(cacheKey, digest)
+			c.cache.setOrigin(cacheKey, options.cacheKey, options.Namespace, options.Labels)
+			c.cache.recordAdded(cacheKey)
+			c.cache.writeSidecar(cacheKey)
+		}
+
+		// the plain download is handed out rather than the encrypted entry
+		if stored.path != download.path {
+			if err == nil {
+				newReader.Close()
+				newReader, err = c.handOutTempFile(download.path)
+			} else {
+				os.Remove(download.path)
+			}
+		}
+		if err == nil {
+			c.keepInMemory(cacheKey, newReader)
+		}
 	} else {
-		c.cache.Remove(cacheKey)
-		newReader, err = tempFileRemoveOnClose(download.path)
+		if stored.path != download.path {
+			os.Remove(stored.path)
+		}
+		c.cache.removeAs(cacheKey, EntryExpired)
+		newReader, err = c.handOutTempFile(download.path)
 	}
 
 	// return newly fetched file
@@ -234,58 +982,224 @@ func (c *cachedDownloader) fetchCachedFile(url *url.URL, cacheKey string, checks
 }
 
 func (c *cachedDownloader) FetchAsDirectory(url *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (string, int64, error) {
+	info, err := c.fetchAsDirectory(context.Background(), url, cacheKey, checksum, FetchOptions{}, cancelChan)
+	return info.Path, info.DownloadedSize, err
+}
+
+func (c *cachedDownloader) FetchAsDirectoryWithContext(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType) (string, int64, error) {
+	info, err := c.fetchAsDirectory(ctx, url, cacheKey, checksum, FetchOptions{}, nil)
+	return info.Path, info.DownloadedSize, err
+}
+
+func (c *cachedDownloader) FetchAsDirectoryWithOptions(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (string, int64, error) {
+	info, err := c.fetchAsDirectory(ctx, url, cacheKey, checksum, options, nil)
+	return info.Path, info.DownloadedSize, err
+}
+
+func (c *cachedDownloader) FetchAsDirectoryWithInfo(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (DirectoryInfo, error) {
+	return c.fetchAsDirectory(ctx, url, cacheKey, checksum, options, nil)
+}
+
+func (c *cachedDownloader) fetchAsDirectory(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions, cancelChan <-chan struct{}) (DirectoryInfo, error) {
 	if cacheKey == "" {
-		return "", 0, NotCacheable
+		return DirectoryInfo{}, NotCacheable
+	}
+
+	err := c.beginFetch()
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+	defer c.fetches.Done()
+	defer c.notifyEntryObserver()
+
+	ctx, cancel := c.fetchContext(ctx, cancelChan)
+	defer cancel()
+
+	options.cacheKey = cacheKey
+	cacheKey = c.hashCacheKey(namespacedKey(options.Namespace, cacheKey))
+	if options.DeferExpansion {
+		// no directory is handed out, so there is no handle to take up
+		return c.fetchDeferredDirectory(ctx, url, cacheKey, checksum, options)
+	}
+
+	err = c.acquireHandle()
+	if err != nil {
+		return DirectoryInfo{}, err
 	}
 
-	cacheKey = fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
-	return c.fetchCachedDirectory(url, cacheKey, checksum, cancelChan)
+	info, err := c.fetchCachedDirectory(ctx, url, cacheKey, checksum, options)
+	if err != nil {
+		c.releaseHandle()
+		return DirectoryInfo{}, err
+	}
+
+	return info, nil
 }
 
-func (c *cachedDownloader) fetchCachedDirectory(url *url.URL, cacheKey string, checksum ChecksumInfoType, cancelChan <-chan struct{}) (string, int64, error) {
-	rateLimiter, err := c.acquireLimiter(cacheKey, cancelChan)
+func (c *cachedDownloader) fetchCachedDirectory(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (DirectoryInfo, error) {
+	rateLimiter, err := c.acquireLimiter(ctx, cacheKey)
 	if err != nil {
-		return "", 0, err
+		return DirectoryInfo{}, err
 	}
 	defer c.releaseLimiter(cacheKey, rateLimiter)
 
+	c.cache.removeCollision(cacheKey, options.cacheKey, options.Namespace)
+
 	// lookup cache entry
-	currentDirectory, currentCachingInfo, getErr := c.cache.GetDirectory(cacheKey)
+	currentDirectory, currentCachingInfo, getErr := c.cache.getDirectory(cacheKey, newExtractionReporter(options))
+
+	// the entry is still within its TTL; no need to ask the origin
+	if currentDirectory != "" && c.cache.IsFresh(cacheKey) {
+		info := c.cache.directoryInfo(cacheKey, currentDirectory)
+		info.FromCache = true
+		c.recordHit(info.SizeInBytes, false)
+		return info, nil
+	}
 
 	// download (short circuits if endpoint respects etag/etc.)
-	download, cacheIsWarm, size, err := c.populateCache(url, cacheKey, currentCachingInfo, checksum, TarTransform, cancelChan)
+	options.admissionKey = cacheKey
+	download, cacheIsWarm, size, err := c.populateCache(ctx, url, cacheKey, currentCachingInfo, checksum, []ContextCacheTransformer{directoryTransform}, options)
 	if err != nil {
 		if currentDirectory != "" {
 			c.cache.CloseDirectory(cacheKey, currentDirectory)
 		}
-		return "", 0, err
+		return DirectoryInfo{}, err
 	}
 
 	// nothing had to be downloaded; return the cached entry
 	if cacheIsWarm {
-		return currentDirectory, 0, getErr
+		if getErr != nil {
+			return DirectoryInfo{}, getErr
+		}
+
+		c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+		info := c.cache.directoryInfo(cacheKey, currentDirectory)
+		info.FromCache = true
+		c.recordHit(info.SizeInBytes, true)
+		return info, nil
 	}
 
+	c.recordMiss()
+
 	// current cache is not fresh; disregard it
 	if currentDirectory != "" {
 		c.cache.CloseDirectory(cacheKey, currentDirectory)
 	}
 
 	// fetch uncached data
-	var newDirectory string
-	if download.cachingInfo.isCacheable() {
-		newDirectory, err = c.cache.AddDirectory(cacheKey, download.path, download.size, download.cachingInfo)
+	if c.isCacheable(url, download) {
+		var info DirectoryInfo
+		_, _, maxSizeInBytes := c.cache.Usage()
+		if download.size > maxSizeInBytes || !c.admitsEntry(options, download.size) {
+			// the directory can never fit in the cache, or may not take up that
+			// much of it; expand it to a temp directory instead
+			c.cache.removeAs(cacheKey, EntryExpired)
+			info, err = c.uncachedDirectory(download.path, newExtractionReporter(options))
+		} else if err = c.ensureFreeSpace(download.size); err != nil {
+			os.Remove(download.path)
+		} else {
+			var newDirectory string
+			c.makeNamespaceRoom(cacheKey, options, download.size)
+			newDirectory, err = c.cache.addDirectory(cacheKey, download.path, download.size, download.cachingInfo, newExtractionReporter(options))
+			if _, ok := err.(*ExtractionLimitError); ok {
+				// keeping the archive would only have it expanded again
+				c.cache.removeAs(cacheKey, EntryExpired)
+			}
+			if err == nil {
+				c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+				c.cache.setOrigin(cacheKey, options.cacheKey, options.Namespace, options.Labels)
+				c.cache.recordAdded(cacheKey)
+				c.cache.writeSidecar(cacheKey)
+				info = c.cache.directoryInfo(cacheKey, newDirectory)
+			}
+		}
+		if err != nil {
+			return DirectoryInfo{}, err
+		}
+
 		// return newly fetched directory
-		return newDirectory, size, err
-	} else {
-		c.cache.Remove(cacheKey)
+		info.DownloadedSize = size
+		return info, nil
+	}
+
+	// the download is fine but cannot be cached; expand it to a temp
+	// directory, like uncached files
+	c.cache.removeAs(cacheKey, EntryExpired)
+	info, err := c.uncachedDirectory(download.path, newExtractionReporter(options))
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+	info.DownloadedSize = size
+	return info, nil
+}
+
+// uncachedDirectory expands the tarball at path into a temp directory that is
+// removed by CloseDirectory. The tarball is removed either way.
+func (c *cachedDownloader) uncachedDirectory(path string, reporter *extractionReporter) (DirectoryInfo, error) {
+	defer os.Remove(path)
+
+	dir, err := ioutil.TempDir(c.uncachedPath, "directory")
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+
+	fileCount, sizeInBytes, err := extractArchiveToDirectory(path, dir, atRest{}, c.cache.currentExtractionOptions(), reporter)
+	if err == nil {
+		err = c.cache.currentPermissions().applyToTree(dir)
+	}
+	if err != nil {
+		removeAll(dir)
+		return DirectoryInfo{}, err
 	}
 
-	return "", 0, NotCacheable
+	c.lock.Lock()
+	c.uncachedDirectories[dir] = struct{}{}
+	c.lock.Unlock()
+
+	return DirectoryInfo{Path: dir, FileCount: fileCount, SizeInBytes: sizeInBytes}, nil
+}
+
+func (c *cachedDownloader) closeUncachedDirectory(path string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.uncachedDirectories[path]
+	delete(c.uncachedDirectories, path)
+	return ok
+}
+
+func (c *cachedDownloader) CancelAll() {
+	c.lock.Lock()
+	close(c.cancelAll)
+	c.cancelAll = make(chan struct{})
+	c.lock.Unlock()
 }
 
-func (c *cachedDownloader) acquireLimiter(cacheKey string, cancelChan <-chan struct{}) (chan struct{}, error) {
+// fetchContext derives the context of a fetch from ctx; it is also cancelled
+// once cancelChan is closed or CancelAll is called. The returned CancelFunc
+// must be called once the fetch is over.
+func (c *cachedDownloader) fetchContext(ctx context.Context, cancelChan <-chan struct{}) (context.Context, context.CancelFunc) {
+	c.lock.Lock()
+	cancelAll := c.cancelAll
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-cancelChan:
+			cancel()
+		case <-cancelAll:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+func (c *cachedDownloader) acquireLimiter(ctx context.Context, cacheKey string) (chan struct{}, error) {
 	startTime := time.Now()
+	leaveQueue := c.keyQueue.enter(cacheKey)
 
 	for {
 		c.lock.Lock()
@@ -294,13 +1208,15 @@ func (c *cachedDownloader) acquireLimiter(cacheKey string, cancelChan <-chan str
 			rateLimiter = make(chan struct{})
 			c.inProgress[cacheKey] = rateLimiter
 			c.lock.Unlock()
+			leaveQueue(false)
 			return rateLimiter, nil
 		}
 		c.lock.Unlock()
 
 		select {
 		case <-rateLimiter:
-		case <-cancelChan:
+		case <-ctx.Done():
+			leaveQueue(true)
 			return nil, NewDownloadCancelledError("acquire-limiter", time.Now().Sub(startTime), NoBytesReceived)
 		}
 	}
@@ -320,7 +1236,7 @@ func tempFileRemoveOnClose(path string) (*CachedFile, error) {
 	}
 
 	return NewFileCloser(f, func(path string) {
-		os.RemoveAll(path)
+		removeAll(path)
 	}), nil
 }
 
@@ -328,28 +1244,33 @@ type download struct {
 	path        string
 	size        int64
 	cachingInfo CachingInfoType
+	response    *http.Response
 }
 
-// Currently populateCache takes a transformer due to the fact that a fetchCachedDirectory
-// uses only a TarTransformer, which overwrites what is currently set. This way one transformer
+// Currently populateCache takes the transformers due to the fact that a fetchCachedDirectory
+// uses only a directoryTransform, which overwrites what is currently set. This way one transformer
 // can be used to call Fetch and FetchAsDirectory
 func (c *cachedDownloader) populateCache(
+	ctx context.Context,
 	url *url.URL,
 	name string,
 	cachingInfo CachingInfoType,
 	checksum ChecksumInfoType,
-	transformer CacheTransformer,
-	cancelChan <-chan struct{},
+	transformers []ContextCacheTransformer,
+	options FetchOptions,
 ) (download, bool, int64, error) {
-	filename, cachingInfo, err := c.downloader.Download(url, func() (*os.File, error) {
-		return ioutil.TempFile(c.uncachedPath, name+"-")
-	}, cachingInfo, checksum, cancelChan)
+	err := c.ensureFreeSpace(0)
+	if err != nil {
+		return download{}, false, 0, err
+	}
+
+	filename, cachingInfo, response, err := c.download(ctx, url, name, cachingInfo, checksum, options)
 	if err != nil {
 		return download{}, false, 0, err
 	}
 
 	if filename == "" {
-		return download{}, true, 0, nil
+		return download{cachingInfo: cachingInfo}, true, 0, nil
 	}
 
 	fileInfo, err := os.Stat(filename)
@@ -367,9 +1288,13 @@ func (c *cachedDownloader) populateCache(
 		return download{}, false, 0, err
 	}
 
-	cachedSize, err := transformer(filename, cachedFile.Name())
+	startTime := time.Now()
+	cachedSize, err := c.transform(ctx, transformers, filename, cachedFile.Name())
 	if err != nil {
-		// os.Remove(filename)
+		os.Remove(cachedFile.Name())
+		if ctx.Err() != nil {
+			err = NewDownloadCancelledError("transform", time.Now().Sub(startTime), fileInfo.Size())
+		}
 		return download{}, false, 0, err
 	}
 
@@ -377,5 +1302,94 @@ func (c *cachedDownloader) populateCache(
 		path:        cachedFile.Name(),
 		size:        cachedSize,
 		cachingInfo: cachingInfo,
+		response:    response,
 	}, false, fileInfo.Size(), nil
 }
+
+// transform runs the transformers in order until one of them succeeds. Every
+// attempt but the last one works on a link to the source, since transformers
+// consume their source and a failed attempt must not take it away from the
+// next one.
+func (c *cachedDownloader) transform(ctx context.Context, transformers []ContextCacheTransformer, source, destination string) (int64, error) {
+	var err error
+	for i, transformer := range transformers {
+		last := i == len(transformers)-1
+
+		if ctx.Err() != nil {
+			os.Remove(source)
+			return 0, ctx.Err()
+		}
+
+		attemptSource := source
+		if !last {
+			attemptSource, err = c.duplicate(source)
+			if err != nil {
+				os.Remove(source)
+				return 0, err
+			}
+		}
+
+		if i > 0 {
+			// start over from the empty destination that the first attempt was given
+			err = ioutil.WriteFile(destination, nil, 0600)
+			if err != nil {
+				os.Remove(attemptSource)
+				os.Remove(source)
+				return 0, err
+			}
+		}
+
+		var size int64
+		size, err = transformer(ctx, attemptSource, destination)
+		if err == nil {
+			if !last {
+				os.Remove(source)
+			}
+			return size, nil
+		}
+
+		os.Remove(attemptSource)
+	}
+
+	return 0, err
+}
+
+// duplicate makes a copy of path in the uncached path, hard linking it when
+// possible
+func (c *cachedDownloader) duplicate(path string) (string, error) {
+	dup, err := ioutil.TempFile(c.uncachedPath, "fallback")
+	if err != nil {
+		return "", err
+	}
+	defer dup.Close()
+
+	err = os.Remove(dup.Name())
+	if err != nil {
+		return "", err
+	}
+
+	if os.Link(path, dup.Name()) == nil {
+		return dup.Name(), nil
+	}
+
+	dup, err = os.OpenFile(dup.Name(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer dup.Close()
+
+	src, err := os.Open(path)
+	if err != nil {
+		os.Remove(dup.Name())
+		return "", err
+	}
+	defer src.Close()
+
+	_, err = copyBuffered(dup, src)
+	if err != nil {
+		os.Remove(dup.Name())
+		return "", err
+	}
+
+	return dup.Name(), nil
+}
@@ -2,9 +2,11 @@ package cacheddownloader_test
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"fmt"
 	"log"
+	"os"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -73,3 +75,36 @@ func createTarBuffer(content string, numFiles int) *bytes.Buffer {
 
 	return buf
 }
+
+func createZipBuffer(content string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	var files = []struct {
+		Name, Body string
+		Mode       os.FileMode
+	}{
+		{"readme.txt", "This archive contains some text files.", 0600},
+		{"testdir/", "", os.ModeDir | 0755},
+		{"testdir/file.txt", content, 0640},
+		{"link.txt", "readme.txt", os.ModeSymlink | 0777},
+	}
+
+	for _, file := range files {
+		header := &zip.FileHeader{Name: file.Name, Method: zip.Deflate}
+		header.SetMode(file.Mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if _, err := w.Write([]byte(file.Body)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Fatalln(err)
+	}
+
+	return buf
+}
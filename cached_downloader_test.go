@@ -1,21 +1,35 @@
 package cacheddownloader_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	Url "net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/cacheddownloader"
 	"github.com/cloudfoundry/systemcerts"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -23,8 +37,8 @@ import (
 
 const MAX_CONCURRENT_DOWNLOADS = 10
 
-func computeMd5(key string) string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(key)))
+func computeKeyHash(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
 }
 
 var _ = Describe("File cache", func() {
@@ -64,7 +78,9 @@ var _ = Describe("File cache", func() {
 
 		transformer = cacheddownloader.NoopTransform
 
-		cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+		cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+
+		Expect(err).NotTo(HaveOccurred())
 		server = ghttp.NewServer()
 
 		url, err = Url.Parse(server.URL() + "/my_file")
@@ -81,7 +97,8 @@ var _ = Describe("File cache", func() {
 	Describe("when the cache folder does not exist", func() {
 		It("should create it", func() {
 			os.RemoveAll(cachedPath)
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
 			_, err := os.Stat(cachedPath)
 			Expect(err).NotTo(HaveOccurred())
 		})
@@ -91,10 +108,187 @@ var _ = Describe("File cache", func() {
 		It("should not nuke that stuff", func() {
 			filename := filepath.Join(cachedPath, "last_nights_dinner")
 			ioutil.WriteFile(filename, []byte("leftovers"), 0666)
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
 			_, err := os.Stat(filename)
 			Expect(err).NotTo(HaveOccurred())
 		})
+
+		It("removes files that were staged but never added to the cache", func() {
+			staged := filepath.Join(cachedPath, "download-123-staged456")
+			Expect(ioutil.WriteFile(staged, []byte("half a move"), 0666)).To(Succeed())
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(staged).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("when the cached and uncached paths overlap", func() {
+		It("fails when they are the same directory", func() {
+			_, err := cacheddownloader.New(cachedPath, cachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
+
+		It("fails when they only differ by an unclean path", func() {
+			_, err := cacheddownloader.New(cachedPath, cachedPath+"/./", maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
+
+		It("fails when the uncached path is nested in the cached path", func() {
+			_, err := cacheddownloader.New(cachedPath, filepath.Join(cachedPath, "tmp"), maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
+
+		It("fails when the cached path is nested in the uncached path", func() {
+			_, err := cacheddownloader.New(filepath.Join(uncachedPath, "cache"), uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
+
+		It("allows sibling directories sharing a name prefix", func() {
+			_, err := cacheddownloader.New(cachedPath, cachedPath+"-uncached", maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("NewWithOptions", func() {
+		BeforeEach(func() {
+			header := http.Header{}
+			header.Set("ETag", "foo")
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "some content", header))
+		})
+
+		It("applies the given options", func() {
+			d, err := cacheddownloader.NewWithOptions(cachedPath, uncachedPath,
+				cacheddownloader.WithMaxSize(1234),
+				cacheddownloader.WithDownloadTimeout(time.Second),
+				cacheddownloader.WithTransformer(func(source, destination string) (int64, error) {
+					err := ioutil.WriteFile(destination, []byte("transformed"), 0600)
+					return int64(len("transformed")), err
+				}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Stats().MaxSizeInBytes).To(BeEquivalentTo(1234))
+
+			file, _, err := d.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("transformed")))
+		})
+
+		It("uses the defaults for the options that are not given", func() {
+			d, err := cacheddownloader.NewWithOptions(cachedPath, uncachedPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(d.Stats().MaxSizeInBytes).To(Equal(cacheddownloader.DefaultMaxSizeInBytes))
+
+			file, _, err := d.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("some content")))
+		})
+
+		It("prefers a context transformer", func() {
+			d, err := cacheddownloader.NewWithOptions(cachedPath, uncachedPath,
+				cacheddownloader.WithTransformer(transformer),
+				cacheddownloader.WithContextTransformer(func(ctx context.Context, source, destination string) (int64, error) {
+					err := ioutil.WriteFile(destination, []byte("context"), 0600)
+					return int64(len("context")), err
+				}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			file, _, err := d.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("context")))
+		})
+
+		It("fails like New when the paths overlap", func() {
+			_, err := cacheddownloader.NewWithOptions(cachedPath, cachedPath)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
+	})
+
+	Describe("NewSharded", func() {
+		var shards []string
+
+		BeforeEach(func() {
+			shards = []string{filepath.Join(cachedPath, "disk1"), filepath.Join(cachedPath, "disk2")}
+
+			d, err := cacheddownloader.NewSharded(shards, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			server.RouteToHandler("GET", regexp.MustCompile("/shard-.*"), func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == req.URL.Path {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", req.URL.Path)
+				w.Write([]byte("content of " + req.URL.Path))
+			})
+		})
+
+		fetchKey := func(key string) string {
+			url, err := Url.Parse(server.URL() + "/shard-" + key)
+			Expect(err).NotTo(HaveOccurred())
+
+			reader, _, err := cache.Fetch(url, key, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			content, err := ioutil.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			return string(content)
+		}
+
+		It("distributes the entries across all shards and serves them from there", func() {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				Expect(fetchKey(key)).To(Equal("content of /shard-" + key))
+			}
+
+			Expect(ioutil.ReadDir(shards[0])).NotTo(BeEmpty())
+			Expect(ioutil.ReadDir(shards[1])).NotTo(BeEmpty())
+			Expect(len(server.ReceivedRequests())).To(Equal(10))
+
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				Expect(fetchKey(key)).To(Equal("content of /shard-" + key))
+			}
+
+			files := 0
+			for _, shard := range shards {
+				infos, err := ioutil.ReadDir(shard)
+				Expect(err).NotTo(HaveOccurred())
+				files += len(infos)
+			}
+			Expect(files).To(Equal(10))
+		})
+
+		It("always puts a key in the same shard", func() {
+			fetchKey("stable-key")
+			shard, err := filepath.Glob(filepath.Join(cachedPath, "disk*", computeKeyHash("stable-key")+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shard).To(HaveLen(1))
+
+			d, err := cacheddownloader.NewSharded(shards, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			os.RemoveAll(shard[0])
+			fetchKey("stable-key")
+			Expect(filepath.Glob(filepath.Join(filepath.Dir(shard[0]), computeKeyHash("stable-key")+"*"))).To(HaveLen(1))
+		})
+
+		It("fails without any shards", func() {
+			_, err := cacheddownloader.NewSharded(nil, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).To(Equal(cacheddownloader.NoCachedPaths))
+		})
+
+		It("fails when two shards overlap", func() {
+			_, err := cacheddownloader.NewSharded([]string{cachedPath, filepath.Join(cachedPath, "disk1")}, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).To(Equal(cacheddownloader.OverlappingPaths))
+		})
 	})
 
 	Describe("When providing a file that should not be cached", func() {
@@ -154,7 +348,7 @@ var _ = Describe("File cache", func() {
 		var returnedHeader http.Header
 
 		BeforeEach(func() {
-			cacheFilePath = filepath.Join(cachedPath, computeMd5(cacheKey))
+			cacheFilePath = filepath.Join(cachedPath, computeKeyHash(cacheKey))
 			returnedHeader = http.Header{}
 			returnedHeader.Set("ETag", "my-original-etag")
 		})
@@ -208,7 +402,8 @@ var _ = Describe("File cache", func() {
 
 							return 100, err
 						}
-						cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+						cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+						Expect(err).NotTo(HaveOccurred())
 					})
 
 					It("passes the download through the transformer", func() {
@@ -218,6 +413,107 @@ var _ = Describe("File cache", func() {
 						Expect(err).NotTo(HaveOccurred())
 						Expect(string(content)).To(Equal("hello tmp"))
 					})
+
+					Context("when the same URL is fetched with SkipTransform", func() {
+						var rawFile io.ReadCloser
+
+						JustBeforeEach(func() {
+							Expect(fetchErr).NotTo(HaveOccurred())
+							Expect(fetchedFile.Close()).To(Succeed())
+
+							server.AppendHandlers(ghttp.CombineHandlers(
+								ghttp.VerifyRequest("GET", "/my_file"),
+								http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+									Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
+								}),
+								ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+							))
+
+							var err error
+							rawFile, _, err = cache.FetchWithOptions(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{SkipTransform: true})
+							Expect(err).NotTo(HaveOccurred())
+						})
+
+						It("serves the raw download", func() {
+							Expect(ioutil.ReadAll(rawFile)).To(Equal(downloadContent))
+						})
+
+						It("caches it next to the transformed entry", func() {
+							Expect(rawFile.Close()).To(Succeed())
+							Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
+
+							server.AppendHandlers(
+								ghttp.RespondWith(http.StatusNotModified, "", returnedHeader),
+								ghttp.RespondWith(http.StatusNotModified, "", returnedHeader),
+							)
+
+							transformed, _, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(ioutil.ReadAll(transformed)).To(Equal([]byte("hello tmp")))
+							Expect(transformed.Close()).To(Succeed())
+
+							raw, _, err := cache.FetchWithOptions(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{SkipTransform: true})
+							Expect(err).NotTo(HaveOccurred())
+							Expect(ioutil.ReadAll(raw)).To(Equal(downloadContent))
+							Expect(raw.Close()).To(Succeed())
+						})
+					})
+				})
+				Describe("downloading with fallback transformers", func() {
+					var fallbackErr error
+
+					BeforeEach(func() {
+						fallbackErr = nil
+						failing := func(source string, destination string) (int64, error) {
+							// consume the source and leave a partial result behind
+							Expect(os.Remove(source)).To(Succeed())
+							Expect(ioutil.WriteFile(destination, []byte("partial"), 0644)).To(Succeed())
+							return 0, errors.New("not my format")
+						}
+						fallback := func(source string, destination string) (int64, error) {
+							if fallbackErr != nil {
+								return 0, fallbackErr
+							}
+
+							content, err := ioutil.ReadFile(source)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(os.Remove(source)).To(Succeed())
+
+							transformed := []byte(fmt.Sprintf("fallback(%d)", len(content)))
+							err = ioutil.WriteFile(destination, transformed, 0644)
+							return int64(len(transformed)), err
+						}
+
+						downloader, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, failing)
+						Expect(err).NotTo(HaveOccurred())
+						downloader.SetFallbackTransformers(failing, fallback)
+						cache = downloader
+					})
+
+					It("returns the output of the first transformer that succeeds", func() {
+						Expect(fetchErr).NotTo(HaveOccurred())
+
+						content, err := ioutil.ReadAll(fetchedFile)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(content)).To(Equal(fmt.Sprintf("fallback(%d)", len(downloadContent))))
+					})
+
+					It("cleans up the intermediate outputs", func() {
+						Expect(fetchErr).NotTo(HaveOccurred())
+						Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+					})
+
+					Context("when every transformer fails", func() {
+						BeforeEach(func() {
+							fallbackErr = errors.New("not my format either")
+						})
+
+						It("returns the error of the last transformer and cleans up", func() {
+							Expect(fetchErr).To(Equal(fallbackErr))
+							Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+							Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+						})
+					})
 				})
 			})
 
@@ -499,10 +795,10 @@ var _ = Describe("File cache", func() {
 				It("deletes the oldest cached files until there is space", func() {
 					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
 
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("B")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("C")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("D")+"*"))).To(HaveLen(1))
 				})
 			})
 
@@ -518,10 +814,10 @@ var _ = Describe("File cache", func() {
 				It("does not delete the cache entries from disk", func() {
 					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(4))
 
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("B")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("C")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("D")+"*"))).To(HaveLen(1))
 				})
 
 				Context("and an earlier cache key was fetched", func() {
@@ -546,7 +842,7 @@ var _ = Describe("File cache", func() {
 					})
 
 					It("does not fetch the file again", func() {
-						Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(1))
+						Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(1))
 					})
 				})
 			})
@@ -571,10 +867,10 @@ var _ = Describe("File cache", func() {
 
 					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
 
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("B")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("C")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("D")+"*"))).To(HaveLen(1))
 				})
 			})
 		})
@@ -662,122 +958,2458 @@ var _ = Describe("File cache", func() {
 		})
 	})
 
-	Describe("FetchAsDirectory", func() {
-		var returnedHeader http.Header
+	Describe("FetchWithContext", func() {
+		type traceKey struct{}
 
 		BeforeEach(func() {
-			returnedHeader = http.Header{}
-			returnedHeader.Set("ETag", "my-original-etag")
-		})
+			downloader := cacheddownloader.NewDownloader(1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil)
+			downloader.SetRequestDecorator(func(ctx context.Context, req *http.Request) {
+				req.Header.Set("X-Trace-Id", ctx.Value(traceKey{}).(string))
+			})
+			cache, err = cacheddownloader.NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+			Expect(err).NotTo(HaveOccurred())
 
-		It("returns a NotCacheable error if the cache key is empty", func() {
-			_, _, fetchErr := cache.FetchAsDirectory(url, "", checksum, cancelChan)
-			Expect(fetchErr).To(Equal(cacheddownloader.NotCacheable))
+			header := http.Header{}
+			header.Set("ETag", "foo")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.VerifyHeaderKV("X-Trace-Id", "some-trace-id"),
+				ghttp.RespondWith(http.StatusOK, "traced content", header),
+			))
 		})
 
-		Context("when the file is not in the cache", func() {
-			var (
-				fetchedDir     string
-				fetchedDirSize int64
-				fetchErr       error
-			)
+		It("hands the context to the request decorator", func() {
+			ctx := context.WithValue(context.Background(), traceKey{}, "some-trace-id")
+			file, _, err := cache.FetchWithContext(ctx, url, cacheKey, checksum)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
 
-			JustBeforeEach(func() {
-				fetchedDir, fetchedDirSize, fetchErr = cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("traced content")))
+		})
+
+		It("hands the context to a context transformer", func() {
+			downloader := cacheddownloader.NewDownloader(1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil)
+			downloader.SetRequestDecorator(func(ctx context.Context, req *http.Request) {
+				req.Header.Set("X-Trace-Id", ctx.Value(traceKey{}).(string))
 			})
+			d, err := cacheddownloader.NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+			Expect(err).NotTo(HaveOccurred())
 
-			Context("when the download succeeds", func() {
-				BeforeEach(func() {
-					downloadContent = createTarBuffer("test content", 0).Bytes()
-					server.AppendHandlers(ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/my_file"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
-						}),
-						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
-					))
-				})
+			var traceID string
+			d.SetContextTransformer(func(ctx context.Context, source, destination string) (int64, error) {
+				traceID = ctx.Value(traceKey{}).(string)
+				return cacheddownloader.NoopTransform(source, destination)
+			})
+			cache = d
 
-				It("should not error", func() {
-					Expect(fetchErr).NotTo(HaveOccurred())
-				})
+			ctx := context.WithValue(context.Background(), traceKey{}, "some-trace-id")
+			file, _, err := cache.FetchWithContext(ctx, url, cacheKey, checksum)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
 
-				It("should return a directory", func() {
-					Expect(fetchedDir).NotTo(BeEmpty())
-					fileInfo, err := os.Stat(fetchedDir)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(fileInfo.IsDir()).To(BeTrue())
-				})
+			Expect(traceID).To(Equal("some-trace-id"))
+		})
 
-				It("returns the total number of bytes downloaded", func() {
-					Expect(fetchedDirSize).To(Equal(int64(len(downloadContent))))
-				})
+		Context("when the context expires while waiting for the same cache key", func() {
+			var (
+				requestInitiated chan struct{}
+				completeRequest  chan struct{}
+			)
 
-				It("should store the directory in the cache", func() {
-					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(1))
-				})
+			BeforeEach(func() {
+				requestInitiated = make(chan struct{})
+				completeRequest = make(chan struct{})
 
-				It("should remove any temporary assets generated along the way", func() {
-					Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+				requestInitiated, completeRequest := requestInitiated, completeRequest
+				server.SetHandler(0, func(w http.ResponseWriter, r *http.Request) {
+					requestInitiated <- struct{}{}
+					<-completeRequest
+					w.Write([]byte("response data..."))
 				})
 			})
 
-			Context("when the download succeeds but does not have an ETag", func() {
-				BeforeEach(func() {
-					downloadContent = createTarBuffer("test content", 0).Bytes()
-					server.AppendHandlers(ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/my_file"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
-						}),
-						ghttp.RespondWith(http.StatusOK, string(downloadContent)),
-					))
-				})
+			It("stops waiting", func() {
+				errs := make(chan error)
+				go func() {
+					ctx := context.WithValue(context.Background(), traceKey{}, "some-trace-id")
+					_, _, err := cache.FetchWithContext(ctx, url, cacheKey, checksum)
+					errs <- err
+				}()
+				Eventually(requestInitiated).Should(Receive())
 
-				It("should error", func() {
-					Expect(fetchErr).To(HaveOccurred())
-				})
+				ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), traceKey{}, "some-trace-id"), 100*time.Millisecond)
+				defer cancel()
+				_, _, err := cache.FetchWithContext(ctx, url, cacheKey, checksum)
+				Expect(err).To(BeAssignableToTypeOf(cacheddownloader.NewDownloadCancelledError("", 0, cacheddownloader.NoBytesReceived)))
+
+				close(completeRequest)
+				Eventually(errs).Should(Receive(BeNil()))
 			})
+		})
+	})
 
-			Context("when the download fails", func() {
-				BeforeEach(func() {
-					server.AllowUnhandledRequests = true //will 500 for any attempted requests
-				})
+	Describe("FetchWithOptions", func() {
+		var (
+			immutableURL, volatileURL *Url.URL
+			ctx                       context.Context
+		)
 
-				It("should return an error and no file", func() {
-					Expect(fetchedDir).To(BeEmpty())
-					Expect(fetchErr).To(HaveOccurred())
-				})
+		fetchWithTTL := func(u *Url.URL, key string, ttl time.Duration) {
+			file, _, err := cache.FetchWithOptions(ctx, u, key, checksum, cacheddownloader.FetchOptions{TTL: ttl})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		}
+
+		requestsTo := func(path string) int {
+			count := 0
+			for _, req := range server.ReceivedRequests() {
+				if req.URL.Path == path {
+					count++
+				}
+			}
+			return count
+		}
 
-				It("should clean up after itself", func() {
-					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
-					Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
-				})
+		BeforeEach(func() {
+			ctx = context.Background()
+			immutableURL, _ = Url.Parse(server.URL() + "/immutable")
+			volatileURL, _ = Url.Parse(server.URL() + "/volatile")
+
+			server.RouteToHandler("GET", "/immutable", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("immutable content"))
+			})
+			server.RouteToHandler("GET", "/volatile", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("volatile content"))
 			})
 		})
 
-		Context("when the file is already on disk in the cache", func() {
-			var fileContent []byte
-			var status int
-			var downloadContent []byte
+		Context("when the fetch gives mirrors", func() {
+			It("caches the download of the first mirror that succeeds under the cache key", func() {
+				missingURL, _ := Url.Parse(server.URL() + "/missing")
+				server.RouteToHandler("GET", "/missing", ghttp.RespondWith(http.StatusNotFound, ""))
 
-			BeforeEach(func() {
-				status = http.StatusOK
-				fileContent = createTarBuffer("now you see it", 0).Bytes()
+				options := cacheddownloader.FetchOptions{Mirrors: []*Url.URL{immutableURL, volatileURL}}
+				file, _, err := cache.FetchWithOptions(ctx, missingURL, "mirrored-key", checksum, options)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable content")))
+				Expect(file.Close()).To(Succeed())
 
-				server.AppendHandlers(ghttp.CombineHandlers(
-					ghttp.VerifyRequest("GET", "/my_file"),
-					ghttp.RespondWith(http.StatusOK, string(fileContent), returnedHeader),
-				))
+				Expect(requestsTo("/missing")).To(Equal(1))
+				Expect(requestsTo("/volatile")).To(Equal(0))
+			})
+		})
 
-				dir, _, _ := cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
-				err := cache.CloseDirectory(cacheKey, dir)
-				Expect(err).ToNot(HaveOccurred())
+		Context("when the fetch gives a checksum URL", func() {
+			var checksumURL *Url.URL
 
-				downloadContent = createTarBuffer("now you don't", 0).Bytes()
+			serveChecksums := func(content string) {
+				server.RouteToHandler("GET", "/SHA256SUMS", ghttp.RespondWith(http.StatusOK, content))
+			}
 
-				etag := "second-round-etag"
-				returnedHeader.Set("ETag", etag)
+			sha256Of := func(content string) string {
+				value, err := cacheddownloader.HexValue("sha256", content)
+				Expect(err).NotTo(HaveOccurred())
+				return strings.Trim(value, `"`)
+			}
+
+			BeforeEach(func() {
+				checksumURL, _ = Url.Parse(server.URL() + "/SHA256SUMS")
+			})
+
+			It("verifies the download against the checksum listed for its file name", func() {
+				serveChecksums(sha256Of("volatile content") + "  volatile\n" +
+					sha256Of("immutable content") + " *dir/immutable\n")
+
+				options := cacheddownloader.FetchOptions{ChecksumURL: checksumURL}
+				file, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, options)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable content")))
+				Expect(file.Close()).To(Succeed())
+			})
+
+			It("understands the BSD format", func() {
+				serveChecksums("SHA256 (immutable) = " + strings.ToUpper(sha256Of("immutable content")) + "\n")
+
+				options := cacheddownloader.FetchOptions{ChecksumURL: checksumURL}
+				file, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, options)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(file.Close()).To(Succeed())
+			})
+
+			It("does not cache a download that does not match", func() {
+				serveChecksums(sha256Of("other content") + "  immutable\n")
+
+				options := cacheddownloader.FetchOptions{ChecksumURL: checksumURL}
+				_, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, options)
+				Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+
+				file, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(file.Close()).To(Succeed())
+				Expect(requestsTo("/immutable")).To(Equal(2))
+			})
+
+			It("fails when the file lists no checksum for the download", func() {
+				serveChecksums(sha256Of("a") + "  a\n" + sha256Of("b") + "  b\n")
+
+				options := cacheddownloader.FetchOptions{ChecksumURL: checksumURL}
+				_, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, options)
+				Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+				Expect(requestsTo("/immutable")).To(Equal(0))
+			})
+		})
+
+		Context("when the fetch sets its own bandwidth limit", func() {
+			BeforeEach(func() {
+				downloader := cacheddownloader.NewDownloader(10*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil)
+				downloader.SetBandwidthLimit(1)
+				cache, err = cacheddownloader.NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("is limited by its own rate instead of the downloader's", func() {
+				startTime := time.Now()
+				file, _, err := cache.FetchWithOptions(ctx, immutableURL, "immutable-key", checksum, cacheddownloader.FetchOptions{BytesPerSecond: 1024 * 1024})
+				Expect(err).NotTo(HaveOccurred())
+				defer file.Close()
+
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable content")))
+				Expect(time.Since(startTime)).To(BeNumerically("<", time.Second))
+			})
+		})
+
+		Context("when the fetch refreshes its URL", func() {
+			var signedURL func(signature string) *Url.URL
+
+			BeforeEach(func() {
+				signedURL = func(signature string) *Url.URL {
+					u, err := Url.Parse(server.URL() + "/signed?signature=" + signature)
+					Expect(err).NotTo(HaveOccurred())
+					return u
+				}
+
+				server.RouteToHandler("GET", "/signed", func(w http.ResponseWriter, req *http.Request) {
+					if req.URL.Query().Get("signature") != "fresh" {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.Write([]byte("signed content"))
+				})
+			})
+
+			It("retries with the URL returned by RefreshURL", func() {
+				options := cacheddownloader.FetchOptions{
+					RefreshURL: func() (*Url.URL, error) {
+						return signedURL("fresh"), nil
+					},
+				}
+
+				file, _, err := cache.FetchWithOptions(ctx, signedURL("expired"), "signed-key", checksum, options)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("signed content")))
+				Expect(file.Close()).To(Succeed())
+			})
+
+			It("fails if RefreshURL fails", func() {
+				options := cacheddownloader.FetchOptions{
+					RefreshURL: func() (*Url.URL, error) {
+						return nil, errors.New("cannot sign")
+					},
+				}
+
+				_, _, err := cache.FetchWithOptions(ctx, signedURL("expired"), "signed-key", checksum, options)
+				Expect(err).To(MatchError("cannot sign"))
+				Expect(requestsTo("/signed")).To(Equal(1))
+			})
+		})
+
+		Context("when fetches wait for a download slot", func() {
+			var (
+				release   chan struct{}
+				requested chan string
+			)
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+				requested = make(chan string, 3)
+				server.RouteToHandler("GET", "/slow", func(w http.ResponseWriter, req *http.Request) {
+					requested <- req.URL.Query().Get("name")
+					if req.URL.Query().Get("name") == "blocker" {
+						<-release
+					}
+					w.Write([]byte("content"))
+				})
+
+				downloader := cacheddownloader.NewDownloader(10*time.Second, 1, false, nil)
+				cache, err = cacheddownloader.NewWithDownloader(cachedPath, uncachedPath, maxSizeInBytes, downloader, transformer)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("admits the fetch with the highest priority first", func() {
+				fetch := func(name string, priority int) {
+					defer GinkgoRecover()
+					u, _ := Url.Parse(server.URL() + "/slow?name=" + name)
+					file, _, err := cache.FetchWithOptions(ctx, u, name, checksum, cacheddownloader.FetchOptions{Priority: priority})
+					Expect(err).NotTo(HaveOccurred())
+					file.Close()
+				}
+
+				go fetch("blocker", cacheddownloader.PriorityNormal)
+				Eventually(requested).Should(Receive(Equal("blocker")))
+
+				go fetch("prefetch", cacheddownloader.PriorityLow)
+				time.Sleep(50 * time.Millisecond)
+				go fetch("app-start", cacheddownloader.PriorityHigh)
+				time.Sleep(50 * time.Millisecond)
+
+				close(release)
+				Eventually(requested).Should(Receive(Equal("app-start")))
+				Eventually(requested).Should(Receive(Equal("prefetch")))
+			})
+		})
+
+		Context("when keys are stored with different TTLs", func() {
+			BeforeEach(func() {
+				fetchWithTTL(immutableURL, "immutable-key", cacheddownloader.NeverRevalidate)
+				fetchWithTTL(volatileURL, "volatile-key", cacheddownloader.AlwaysRevalidate)
+			})
+
+			It("only revalidates the entries whose TTL has elapsed", func() {
+				fetchWithTTL(immutableURL, "immutable-key", cacheddownloader.NeverRevalidate)
+				fetchWithTTL(volatileURL, "volatile-key", cacheddownloader.AlwaysRevalidate)
+
+				Expect(requestsTo("/immutable")).To(Equal(1))
+				Expect(requestsTo("/volatile")).To(Equal(2))
+			})
+		})
+
+		Context("when the TTL is a duration", func() {
+			BeforeEach(func() {
+				fetchWithTTL(immutableURL, "immutable-key", time.Hour)
+				fetchWithTTL(volatileURL, "volatile-key", 200*time.Millisecond)
+			})
+
+			It("serves each entry from the cache until its own TTL elapses", func() {
+				fetchWithTTL(immutableURL, "immutable-key", time.Hour)
+				fetchWithTTL(volatileURL, "volatile-key", 200*time.Millisecond)
+				Expect(requestsTo("/immutable")).To(Equal(1))
+				Expect(requestsTo("/volatile")).To(Equal(1))
+
+				time.Sleep(300 * time.Millisecond)
+
+				fetchWithTTL(immutableURL, "immutable-key", time.Hour)
+				fetchWithTTL(volatileURL, "volatile-key", 200*time.Millisecond)
+				Expect(requestsTo("/immutable")).To(Equal(1))
+				Expect(requestsTo("/volatile")).To(Equal(2))
+			})
+		})
+
+		Context("when no TTL is given", func() {
+			BeforeEach(func() {
+				downloader, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
+				downloader.SetDefaultTTL(time.Hour)
+				cache = downloader
+			})
+
+			It("uses the default TTL", func() {
+				fetchWithTTL(immutableURL, "immutable-key", 0)
+				fetchWithTTL(immutableURL, "immutable-key", 0)
+				Expect(requestsTo("/immutable")).To(Equal(1))
+			})
+
+			It("lets a fetch override the default TTL", func() {
+				fetchWithTTL(volatileURL, "volatile-key", cacheddownloader.AlwaysRevalidate)
+				fetchWithTTL(volatileURL, "volatile-key", cacheddownloader.AlwaysRevalidate)
+				Expect(requestsTo("/volatile")).To(Equal(2))
+			})
+		})
+
+		Context("when the response carries a max-age", func() {
+			var agedURL *Url.URL
+
+			routeAged := func(maxAge, age int) {
+				server.RouteToHandler("GET", "/aged", func(w http.ResponseWriter, req *http.Request) {
+					w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+					w.Header().Set("Age", fmt.Sprintf("%d", age))
+					if req.Header.Get("If-None-Match") == "some-etag" {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("ETag", "some-etag")
+					w.Write([]byte("aged content"))
+				})
+			}
+
+			BeforeEach(func() {
+				agedURL, _ = Url.Parse(server.URL() + "/aged")
+			})
+
+			It("subtracts the Age from the max-age", func() {
+				routeAged(100, 90)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				Expect(requestsTo("/aged")).To(Equal(1))
+
+				Expect(cache.SaveState()).To(Succeed())
+				var state struct {
+					Entries map[string]struct{ TTL time.Duration }
+				}
+				content, err := ioutil.ReadFile(filepath.Join(cachedPath, "saved_cache.json"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(json.Unmarshal(content, &state)).To(Succeed())
+				Expect(state.Entries[computeKeyHash("aged-key")].TTL).To(Equal(10 * time.Second))
+			})
+
+			It("revalidates once the remaining lifetime has elapsed", func() {
+				routeAged(2, 1)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				Expect(requestsTo("/aged")).To(Equal(1))
+
+				time.Sleep(1100 * time.Millisecond)
+
+				fetchWithTTL(agedURL, "aged-key", 0)
+				Expect(requestsTo("/aged")).To(Equal(2))
+			})
+
+			It("always revalidates responses that are already stale", func() {
+				routeAged(100, 100)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				Expect(requestsTo("/aged")).To(Equal(2))
+			})
+
+			It("lets a fetch override the lifetime", func() {
+				routeAged(100, 0)
+				fetchWithTTL(agedURL, "aged-key", cacheddownloader.AlwaysRevalidate)
+				fetchWithTTL(agedURL, "aged-key", cacheddownloader.AlwaysRevalidate)
+				Expect(requestsTo("/aged")).To(Equal(2))
+			})
+
+			It("can be told to ignore the lifetime", func() {
+				downloader, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
+				downloader.SetIgnoreCacheHeaders(true)
+				cache = downloader
+
+				routeAged(100, 0)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				fetchWithTTL(agedURL, "aged-key", 0)
+				Expect(requestsTo("/aged")).To(Equal(2))
+			})
+		})
+
+		Context("when the response carries other caching headers", func() {
+			var headersURL *Url.URL
+
+			routeHeaders := func(headers map[string]string) {
+				server.RouteToHandler("GET", "/headers", func(w http.ResponseWriter, req *http.Request) {
+					for name, value := range headers {
+						w.Header().Set(name, value)
+					}
+					if req.Header.Get("If-None-Match") == "some-etag" {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("ETag", "some-etag")
+					w.Write([]byte("content"))
+				})
+			}
+
+			BeforeEach(func() {
+				headersURL, _ = Url.Parse(server.URL() + "/headers")
+			})
+
+			It("serves the entry from the cache until it Expires", func() {
+				now := time.Now().UTC()
+				routeHeaders(map[string]string{
+					"Date":    now.Format(http.TimeFormat),
+					"Expires": now.Add(time.Hour).Format(http.TimeFormat),
+				})
+				fetchWithTTL(headersURL, "headers-key", 0)
+				fetchWithTTL(headersURL, "headers-key", 0)
+				Expect(requestsTo("/headers")).To(Equal(1))
+			})
+
+			It("prefers the max-age to Expires", func() {
+				routeHeaders(map[string]string{
+					"Cache-Control": "max-age=0",
+					"Expires":       time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+				})
+				fetchWithTTL(headersURL, "headers-key", 0)
+				fetchWithTTL(headersURL, "headers-key", 0)
+				Expect(requestsTo("/headers")).To(Equal(2))
+			})
+
+			It("revalidates entries whose Expires is invalid", func() {
+				downloader, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
+				downloader.SetDefaultTTL(time.Hour)
+				cache = downloader
+
+				routeHeaders(map[string]string{"Expires": "0"})
+				fetchWithTTL(headersURL, "headers-key", 0)
+				fetchWithTTL(headersURL, "headers-key", 0)
+				Expect(requestsTo("/headers")).To(Equal(2))
+			})
+
+			It("revalidates no-cache entries despite their max-age", func() {
+				routeHeaders(map[string]string{"Cache-Control": "no-cache, max-age=3600"})
+				fetchWithTTL(headersURL, "headers-key", 0)
+				fetchWithTTL(headersURL, "headers-key", 0)
+				Expect(requestsTo("/headers")).To(Equal(2))
+
+				requests := server.ReceivedRequests()
+				Expect(requests[len(requests)-1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+			})
+
+			It("does not cache no-store responses", func() {
+				routeHeaders(map[string]string{"Cache-Control": "no-store"})
+				fetchWithTTL(headersURL, "headers-key", 0)
+				fetchWithTTL(headersURL, "headers-key", 0)
+				Expect(requestsTo("/headers")).To(Equal(2))
+
+				requests := server.ReceivedRequests()
+				Expect(requests[len(requests)-1].Header.Get("If-None-Match")).To(BeEmpty())
+			})
+		})
+
+		Context("when fetching as a directory", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/immutable.tar", func(w http.ResponseWriter, req *http.Request) {
+					w.Header().Set("ETag", "some-etag")
+					w.Write(createTarBuffer("test content", 0).Bytes())
+				})
+				immutableURL, _ = Url.Parse(server.URL() + "/immutable.tar")
+			})
+
+			It("serves the directory from the cache within its TTL", func() {
+				for i := 0; i < 2; i++ {
+					dir, _, err := cache.FetchAsDirectoryWithOptions(ctx, immutableURL, "immutable-key", checksum, cacheddownloader.FetchOptions{TTL: time.Hour})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(dir).To(BeADirectory())
+					Expect(cache.CloseDirectory("immutable-key", dir)).To(Succeed())
+				}
+				Expect(requestsTo("/immutable.tar")).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("FetchIfModified", func() {
+		var (
+			knownInfo cacheddownloader.CachingInfoType
+			reader    io.ReadCloser
+			newInfo   cacheddownloader.CachingInfoType
+			fetchErr  error
+		)
+
+		BeforeEach(func() {
+			knownInfo = cacheddownloader.CachingInfoType{ETag: "known-etag"}
+
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "current-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "current-etag")
+				w.Write([]byte("current content"))
+			})
+		})
+
+		JustBeforeEach(func() {
+			reader, _, newInfo, fetchErr = cache.FetchIfModified(context.Background(), url, knownInfo, checksum)
+		})
+
+		Context("when the caller's validators are current", func() {
+			BeforeEach(func() {
+				knownInfo = cacheddownloader.CachingInfoType{ETag: "current-etag"}
+			})
+
+			It("returns ErrNotModified and no body", func() {
+				Expect(fetchErr).To(Equal(cacheddownloader.ErrNotModified))
+				Expect(reader).To(BeNil())
+				Expect(server.ReceivedRequests()).To(HaveLen(1))
+			})
+
+			It("does not leave anything behind", func() {
+				Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+			})
+		})
+
+		Context("when the content has changed", func() {
+			It("returns the new content and its caching info", func() {
+				Expect(fetchErr).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(reader)).To(Equal([]byte("current content")))
+				Expect(newInfo).To(Equal(cacheddownloader.CachingInfoType{ETag: "current-etag"}))
+			})
+
+			It("does not store the content in the cache", func() {
+				Expect(reader.Close()).To(Succeed())
+				Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+			})
+		})
+	})
+
+	Describe("SetCacheabilityFunc", func() {
+		var (
+			d interface {
+				cacheddownloader.CachedDownloader
+				SetCacheabilityFunc(cacheddownloader.CacheabilityFunc)
+			}
+			blobURL    *Url.URL
+			dynamicURL *Url.URL
+		)
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetCacheabilityFunc(func(u *Url.URL, resp *http.Response) bool {
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				return strings.HasPrefix(u.Path, "/blobs/")
+			})
+			cache = d
+
+			server.RouteToHandler("GET", "/blobs/immutable", ghttp.RespondWith(http.StatusOK, "immutable blob"))
+			server.RouteToHandler("GET", "/dynamic", ghttp.RespondWith(http.StatusOK, "dynamic content", http.Header{"ETag": []string{"some-etag"}}))
+
+			blobURL, _ = Url.Parse(server.URL() + "/blobs/immutable")
+			dynamicURL, _ = Url.Parse(server.URL() + "/dynamic")
+		})
+
+		It("caches responses without validators that the function accepts", func() {
+			file, _, err := d.FetchWithOptions(context.Background(), blobURL, "blob", checksum, cacheddownloader.FetchOptions{TTL: cacheddownloader.NeverRevalidate})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable blob")))
+			Expect(file.Close()).To(Succeed())
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("blob")+"*"))).To(HaveLen(1))
+
+			file, _, err = d.FetchWithOptions(context.Background(), blobURL, "blob", checksum, cacheddownloader.FetchOptions{TTL: cacheddownloader.NeverRevalidate})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable blob")))
+			Expect(file.Close()).To(Succeed())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("keeps responses without validators that the function accepts across restarts", func() {
+			file, _, err := d.FetchWithOptions(context.Background(), blobURL, "blob", checksum, cacheddownloader.FetchOptions{TTL: cacheddownloader.NeverRevalidate})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			Expect(d.SaveState()).To(Succeed())
+
+			restarted, report, err := cacheddownloader.NewPersistent(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = restarted
+			Expect(report.Entries).To(Equal(1))
+			Expect(report.DroppedEntries).To(BeZero())
+
+			file, _, err = restarted.FetchWithOptions(context.Background(), blobURL, "blob", checksum, cacheddownloader.FetchOptions{TTL: cacheddownloader.NeverRevalidate})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("immutable blob")))
+			Expect(file.Close()).To(Succeed())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("adopts responses without validators that the function accepts", func() {
+			adopting, _, err := cacheddownloader.NewAdopting(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).NotTo(HaveOccurred())
+			adopting.SetCacheabilityFunc(func(u *Url.URL, resp *http.Response) bool { return true })
+
+			file, _, err := adopting.Fetch(blobURL, "blob", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			_, report, err := cacheddownloader.NewAdopting(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.AdoptedEntries).To(Equal(1))
+		})
+
+		It("does not cache responses with an ETag that the function rejects", func() {
+			file, _, err := d.Fetch(dynamicURL, "dynamic", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("dynamic content")))
+			Expect(file.Close()).To(Succeed())
+
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+
+			file, _, err = d.Fetch(dynamicURL, "dynamic", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+			for _, req := range server.ReceivedRequests() {
+				Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
+			}
+		})
+	})
+
+	Describe("SetMaxEntrySize", func() {
+		var (
+			d interface {
+				cacheddownloader.CachedDownloader
+				SetMaxEntrySize(int64)
+			}
+			smallURL, hugeURL *Url.URL
+		)
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetMaxEntrySize(10)
+			cache = d
+
+			header := http.Header{"ETag": []string{"some-etag"}}
+			server.RouteToHandler("GET", "/small", ghttp.RespondWith(http.StatusOK, "small", header))
+			server.RouteToHandler("GET", "/huge", ghttp.RespondWith(http.StatusOK, "a huge droplet", header))
+			server.RouteToHandler("GET", "/huge.tar", ghttp.RespondWith(http.StatusOK, createTarBuffer("a huge droplet", 0).Bytes(), header))
+
+			smallURL, _ = Url.Parse(server.URL() + "/small")
+			hugeURL, _ = Url.Parse(server.URL() + "/huge")
+		})
+
+		It("caches entries up to the maximum size", func() {
+			file, _, err := d.Fetch(smallURL, "small", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("small")+"*"))).To(HaveLen(1))
+		})
+
+		It("serves larger files without caching them", func() {
+			file, _, err := d.Fetch(hugeURL, "huge", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("a huge droplet")))
+			Expect(file.Close()).To(Succeed())
+
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+		})
+
+		It("expands larger directories without caching them", func() {
+			tarURL, _ := Url.Parse(server.URL() + "/huge.tar")
+			dir, _, err := d.FetchAsDirectory(tarURL, "huge-dir", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(dir)).To(Equal(filepath.Clean(uncachedPath)))
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			Expect(d.CloseDirectory("huge-dir", dir)).To(Succeed())
+		})
+	})
+
+	Describe("extraction limits", func() {
+		var (
+			d interface {
+				cacheddownloader.CachedDownloader
+				SetExtractionOptions(cacheddownloader.ExtractionOptions)
+			}
+			options cacheddownloader.ExtractionOptions
+			dirErr  error
+		)
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			options = cacheddownloader.ExtractionOptions{
+				MaxExpandedSizeInBytes: 1000,
+				MaxFileCount:           10,
+				MaxPathDepth:           2,
+			}
+		})
+
+		JustBeforeEach(func() {
+			d.SetExtractionOptions(options)
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, downloadContent, http.Header{"ETag": []string{"some-etag"}}))
+			dir, _, dirErr = d.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+		})
+
+		Context("when the archive is within the limits", func() {
+			BeforeEach(func() {
+				downloadContent = createTarBuffer("test content", 2).Bytes()
+			})
+
+			It("expands it", func() {
+				Expect(dirErr).NotTo(HaveOccurred())
+				Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+				Expect(d.CloseDirectory(cacheKey, dir)).To(Succeed())
+			})
+		})
+
+		Context("when the archive expands beyond the maximum size", func() {
+			BeforeEach(func() {
+				downloadContent = createTarBuffer(strings.Repeat("a", 1000), 0).Bytes()
+			})
+
+			It("fails with an ExtractionLimitError and removes the entry", func() {
+				Expect(dirErr).To(Equal(cacheddownloader.NewExtractionLimitError("expanded size", 1000)))
+				Expect(dir).To(BeEmpty())
+				Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			})
+		})
+
+		Context("when the archive has too many entries", func() {
+			BeforeEach(func() {
+				downloadContent = createTarBuffer("test content", 10).Bytes()
+			})
+
+			It("fails with an ExtractionLimitError and removes the entry", func() {
+				Expect(dirErr).To(Equal(cacheddownloader.NewExtractionLimitError("file count", 10)))
+				Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			})
+		})
+
+		Context("when the archive is nested too deep", func() {
+			BeforeEach(func() {
+				options.MaxPathDepth = 1
+				downloadContent = createTarBuffer("test content", 0).Bytes()
+			})
+
+			It("fails with an ExtractionLimitError", func() {
+				Expect(dirErr).To(Equal(cacheddownloader.NewExtractionLimitError("path depth", 1)))
+				Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+			})
+		})
+
+		Context("when the archive is too large to be cached", func() {
+			BeforeEach(func() {
+				maxSizeInBytes = 1000
+				d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
+				cache = d
+
+				downloadContent = createTarBuffer(strings.Repeat("a", 1000), 0).Bytes()
+			})
+
+			It("removes what was expanded of it", func() {
+				Expect(dirErr).To(BeAssignableToTypeOf(&cacheddownloader.ExtractionLimitError{}))
+				Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("cancelling a transform", func() {
+		var (
+			transformStarted chan struct{}
+			fallbackCalls    int32
+		)
+
+		BeforeEach(func() {
+			transformStarted = make(chan struct{})
+			fallbackCalls = 0
+
+			d, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetContextTransformer(func(ctx context.Context, source, destination string) (int64, error) {
+				close(transformStarted)
+				<-ctx.Done()
+				return 0, ctx.Err()
+			})
+			d.SetFallbackTransformers(func(source, destination string) (int64, error) {
+				atomic.AddInt32(&fallbackCalls, 1)
+				return cacheddownloader.NoopTransform(source, destination)
+			})
+			cache = d
+
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "some content", http.Header{"ETag": []string{"some-etag"}}))
+		})
+
+		It("fails the fetch without trying the fallback transformers", func() {
+			errs := make(chan error)
+			go func() {
+				_, _, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+				errs <- err
+			}()
+
+			Eventually(transformStarted).Should(BeClosed())
+			close(cancelChan)
+
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(err).To(BeAssignableToTypeOf(cacheddownloader.NewDownloadCancelledError("", 0, cacheddownloader.NoBytesReceived)))
+			Expect(err.Error()).To(ContainSubstring("transform"))
+			Expect(atomic.LoadInt32(&fallbackCalls)).To(BeZero())
+			Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+		})
+	})
+
+	Describe("deferred expansion", func() {
+		var (
+			info    cacheddownloader.DirectoryInfo
+			headers http.Header
+		)
+
+		BeforeEach(func() {
+			downloadContent = createTarBuffer("test content", 0).Bytes()
+			headers = http.Header{"ETag": []string{"some-etag"}}
+		})
+
+		JustBeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, downloadContent, headers))
+			info, err = cache.FetchAsDirectoryWithInfo(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{DeferExpansion: true})
+		})
+
+		It("caches the tarball without expanding it", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Path).To(BeEmpty())
+			Expect(info.DownloadedSize).To(BeEquivalentTo(len(downloadContent)))
+			Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(1))
+		})
+
+		It("expands the tarball when the entry is first fetched as a directory", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotModified, nil))
+
+			info, err = cache.FetchAsDirectoryWithInfo(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.FromCache).To(BeTrue())
+			Expect(filepath.Join(info.Path, "testdir", "file.txt")).To(BeARegularFile())
+			Expect(cache.CloseDirectory(cacheKey, info.Path)).To(Succeed())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		Context("when the tarball cannot be cached", func() {
+			BeforeEach(func() {
+				headers = http.Header{}
+			})
+
+			It("discards it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Path).To(BeEmpty())
+				Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+				Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("invalidating entries", func() {
+		var keys = []string{"app-1/droplet", "app-1/buildpack", "app-2/droplet"}
+
+		fetch := func(cacheKey string) io.ReadCloser {
+			u, _ := Url.Parse(server.URL() + "/" + cacheKey)
+			file, _, err := cache.Fetch(u, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			return file
+		}
+
+		cachedFiles := func(cacheKey string) []string {
+			files, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			return files
+		}
+
+		BeforeEach(func() {
+			for _, key := range keys {
+				server.RouteToHandler("GET", "/"+key, ghttp.RespondWith(http.StatusOK, "content of "+key, http.Header{"ETag": []string{"some-etag"}}))
+				Expect(fetch(key).Close()).To(Succeed())
+			}
+		})
+
+		Describe("Remove", func() {
+			It("makes the next fetch download the entry again", func() {
+				cache.Remove("app-1/droplet")
+				Expect(cachedFiles("app-1/droplet")).To(BeEmpty())
+				Expect(cachedFiles("app-1/buildpack")).To(HaveLen(1))
+
+				Expect(fetch("app-1/droplet").Close()).To(Succeed())
+				requests := server.ReceivedRequests()
+				Expect(requests[len(requests)-1].Header.Get("If-None-Match")).To(BeEmpty())
+			})
+
+			It("keeps entries that are in use until they are closed", func() {
+				server.RouteToHandler("GET", "/app-1/droplet", ghttp.RespondWith(http.StatusNotModified, nil))
+				file := fetch("app-1/droplet")
+
+				cache.Remove("app-1/droplet")
+				Expect(cachedFiles("app-1/droplet")).To(HaveLen(1))
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("content of app-1/droplet")))
+
+				Expect(file.Close()).To(Succeed())
+				Expect(cachedFiles("app-1/droplet")).To(BeEmpty())
+			})
+
+			It("does nothing for unknown keys", func() {
+				cache.Remove("unknown")
+				for _, key := range keys {
+					Expect(cachedFiles(key)).To(HaveLen(1))
+				}
+			})
+		})
+
+		Describe("RemoveByPrefix", func() {
+			It("removes the entries whose key starts with the prefix", func() {
+				Expect(cache.RemoveByPrefix("app-1/")).To(Equal(2))
+				Expect(cachedFiles("app-1/droplet")).To(BeEmpty())
+				Expect(cachedFiles("app-1/buildpack")).To(BeEmpty())
+				Expect(cachedFiles("app-2/droplet")).To(HaveLen(1))
+			})
+		})
+
+		Describe("Clear", func() {
+			It("removes every entry", func() {
+				cache.Clear()
+				for _, key := range keys {
+					Expect(cachedFiles(key)).To(BeEmpty())
+				}
+			})
+		})
+	})
+
+	Describe("SetFreeSpaceReserve", func() {
+		var reserving interface {
+			cacheddownloader.CachedDownloader
+			SetFreeSpaceReserve(int64)
+		}
+
+		BeforeEach(func() {
+			reserving, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = reserving
+
+			header := http.Header{"ETag": []string{"some-etag"}}
+			server.RouteToHandler("GET", "/old", ghttp.RespondWith(http.StatusOK, "old content", header))
+			server.RouteToHandler("GET", "/new", ghttp.RespondWith(http.StatusOK, "new content", header))
+
+			oldURL, _ := Url.Parse(server.URL() + "/old")
+			file, _, err := reserving.Fetch(oldURL, "old-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		})
+
+		It("fetches as usual while the reserve is free", func() {
+			reserving.SetFreeSpaceReserve(1)
+
+			newURL, _ := Url.Parse(server.URL() + "/new")
+			file, _, err := reserving.Fetch(newURL, "new-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("old-key")+"*"))).To(HaveLen(1))
+		})
+
+		It("evicts entries and fails with NotEnoughSpace when the reserve cannot be freed", func() {
+			reserving.SetFreeSpaceReserve(math.MaxInt64)
+
+			newURL, _ := Url.Parse(server.URL() + "/new")
+			_, _, err := reserving.Fetch(newURL, "new-key", checksum, cancelChan)
+			Expect(err).To(Equal(cacheddownloader.NotEnoughSpace))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("old-key")+"*"))).To(BeEmpty())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("namespaces", func() {
+		var namespaced interface {
+			cacheddownloader.CachedDownloader
+			SetNamespaceQuota(string, int64)
+			NamespaceUsage(string) (int, int64, int64)
+		}
+
+		fetchIn := func(namespace, cacheKey string) {
+			u, _ := Url.Parse(server.URL() + "/" + cacheKey)
+			file, _, err := namespaced.FetchWithOptions(context.Background(), u, cacheKey, checksum, cacheddownloader.FetchOptions{Namespace: namespace})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			namespaced, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = namespaced
+
+			for _, key := range []string{"one", "two", "three", "huge"} {
+				content := "ten bytes!"
+				if key == "huge" {
+					content = "more than twenty bytes"
+				}
+				server.RouteToHandler("GET", "/"+key, ghttp.RespondWith(http.StatusOK, content, http.Header{"ETag": []string{"some-etag"}}))
+			}
+			server.RouteToHandler("GET", "/dir.tar", ghttp.RespondWith(http.StatusOK, createTarBuffer("content", 0).Bytes(), http.Header{"ETag": []string{"some-etag"}}))
+
+			namespaced.SetNamespaceQuota("buildpacks", 20)
+		})
+
+		It("keeps entries with the same key in different namespaces apart", func() {
+			fetchIn("droplets", "one")
+			fetchIn("buildpacks", "one")
+
+			requests := server.ReceivedRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Header.Get("If-None-Match")).To(BeEmpty())
+
+			entries, used, quota := namespaced.NamespaceUsage("droplets")
+			Expect(entries).To(Equal(1))
+			Expect(used).To(BeEquivalentTo(10))
+			Expect(quota).To(BeZero())
+		})
+
+		It("evicts the entries of a namespace to keep it within its quota", func() {
+			fetchIn("droplets", "one")
+			fetchIn("buildpacks", "one")
+			fetchIn("buildpacks", "two")
+			fetchIn("buildpacks", "three")
+
+			entries, used, quota := namespaced.NamespaceUsage("buildpacks")
+			Expect(entries).To(Equal(2))
+			Expect(used).To(BeEquivalentTo(20))
+			Expect(quota).To(BeEquivalentTo(20))
+
+			entries, _, _ = namespaced.NamespaceUsage("droplets")
+			Expect(entries).To(Equal(1))
+		})
+
+		It("does not cache downloads larger than the quota", func() {
+			fetchIn("buildpacks", "one")
+			fetchIn("buildpacks", "huge")
+
+			entries, used, _ := namespaced.NamespaceUsage("buildpacks")
+			Expect(entries).To(Equal(1))
+			Expect(used).To(BeEquivalentTo(10))
+		})
+
+		It("closes directories fetched in a namespace", func() {
+			u, _ := Url.Parse(server.URL() + "/dir.tar")
+			dir, _, err := namespaced.FetchAsDirectoryWithOptions(context.Background(), u, "dir", checksum, cacheddownloader.FetchOptions{Namespace: "droplets"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespaced.CloseDirectory("dir", dir)).To(Succeed())
+			Expect(namespaced.CloseDirectory("dir", dir)).To(Equal(cacheddownloader.AlreadyClosed))
+		})
+	})
+
+	Describe("SetSecondaryCache", func() {
+		type secondaryCached interface {
+			cacheddownloader.CachedDownloader
+			SetSecondaryCache(cacheddownloader.SecondaryCache)
+		}
+
+		var (
+			secondaryPath string
+			secondary     *cacheddownloader.DirectorySecondaryCache
+			first         secondaryCached
+			otherCached   string
+		)
+
+		newDownloader := func(cachedPath string, secondary cacheddownloader.SecondaryCache) secondaryCached {
+			d, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetSecondaryCache(secondary)
+			return d
+		}
+
+		fetchContent := func(d secondaryCached, checksum cacheddownloader.ChecksumInfoType) string {
+			file, _, err := d.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			secondaryPath, err = ioutil.TempDir("", "test_secondary_cache")
+			Expect(err).NotTo(HaveOccurred())
+			otherCached, err = ioutil.TempDir("", "test_file_cached_other")
+			Expect(err).NotTo(HaveOccurred())
+
+			secondary, err = cacheddownloader.NewDirectorySecondaryCache(secondaryPath)
+			Expect(err).NotTo(HaveOccurred())
+			first = newDownloader(cachedPath, secondary)
+			cache = first
+
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", "some-etag")
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte("shared content"))
+			})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(secondaryPath)
+			os.RemoveAll(otherCached)
+		})
+
+		It("writes downloads through to the secondary cache", func() {
+			Expect(fetchContent(first, checksum)).To(Equal("shared content"))
+			Expect(filepath.Join(secondaryPath, computeKeyHash(cacheKey)+".json")).To(BeARegularFile())
+		})
+
+		It("revalidates the copy in the secondary cache instead of downloading it again", func() {
+			Expect(fetchContent(first, checksum)).To(Equal("shared content"))
+
+			second := newDownloader(otherCached, secondary)
+			Expect(fetchContent(second, checksum)).To(Equal("shared content"))
+
+			requests := server.ReceivedRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+		})
+
+		It("ignores copies in the secondary cache that do not match the checksum", func() {
+			Expect(fetchContent(first, checksum)).To(Equal("shared content"))
+
+			md5Checksum := cacheddownloader.ChecksumInfoType{Algorithm: "md5", Value: fmt.Sprintf("%x", md5.Sum([]byte("shared content")))}
+			Expect(secondary.Put(context.Background(), computeKeyHash(cacheKey), createFile("tampered", "tampered content").Name(), cacheddownloader.CachingInfoType{ETag: "some-etag"})).To(Succeed())
+
+			second := newDownloader(otherCached, secondary)
+			Expect(fetchContent(second, md5Checksum)).To(Equal("shared content"))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(BeEmpty())
+		})
+
+		It("fetches from a peer that exposes its secondary cache over HTTP", func() {
+			Expect(fetchContent(first, checksum)).To(Equal("shared content"))
+
+			peer := httptest.NewServer(secondary)
+			defer peer.Close()
+			peerURL, _ := Url.Parse(peer.URL)
+
+			second := newDownloader(otherCached, cacheddownloader.NewHTTPSecondaryCache(peerURL, nil))
+			Expect(fetchContent(second, checksum)).To(Equal("shared content"))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+		})
+	})
+
+	Describe("SetEntryObserver", func() {
+		var (
+			observed interface {
+				cacheddownloader.CachedDownloader
+				SetEntryObserver(cacheddownloader.EntryObserver)
+				SetVerifyOnRead(float64)
+				Entries() []cacheddownloader.EntryInfo
+			}
+			events  []cacheddownloader.EntryEvent
+			version string
+		)
+
+		fetchKey := func(key string) {
+			u, _ := Url.Parse(server.URL() + "/" + key)
+			file, _, err := observed.FetchWithOptions(context.Background(), u, key, checksum, cacheddownloader.FetchOptions{Labels: map[string]string{"app": "some-app"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		}
+
+		eventTypes := func() []cacheddownloader.EntryEventType {
+			types := []cacheddownloader.EntryEventType{}
+			for _, event := range events {
+				types = append(types, event.Type)
+			}
+			return types
+		}
+
+		BeforeEach(func() {
+			observed, err = cacheddownloader.New(cachedPath, uncachedPath, 30, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = observed
+
+			events = nil
+			version = "v1"
+			observed.SetEntryObserver(func(event cacheddownloader.EntryEvent) {
+				// the observer may call back into the cachedDownloader
+				observed.Entries()
+				events = append(events, event)
+			})
+
+			server.RouteToHandler("GET", "/small", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", version)
+				w.Write([]byte("ten bytes!"))
+			})
+			server.RouteToHandler("GET", "/large", ghttp.RespondWith(http.StatusOK, "twenty-five bytes of data", http.Header{"ETag": []string{"some-etag"}}))
+		})
+
+		It("reports entries being added, replaced, evicted and removed", func() {
+			fetchKey("small")
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Type).To(Equal(cacheddownloader.EntryAdded))
+			Expect(events[0].Key).To(Equal("small"))
+			Expect(events[0].HashedKey).To(Equal(computeKeyHash("small")))
+			Expect(events[0].Labels).To(Equal(map[string]string{"app": "some-app"}))
+			Expect(events[0].Size).To(BeEquivalentTo(10))
+
+			version = "v2"
+			fetchKey("small")
+			fetchKey("large")
+			observed.Remove("large")
+
+			Expect(eventTypes()).To(Equal([]cacheddownloader.EntryEventType{
+				cacheddownloader.EntryAdded,
+				cacheddownloader.EntryExpired,
+				cacheddownloader.EntryAdded,
+				cacheddownloader.EntryEvicted,
+				cacheddownloader.EntryAdded,
+				cacheddownloader.EntryRemoved,
+			}))
+			Expect(events[3].Key).To(Equal("small"))
+			Expect(events[5].Key).To(Equal("large"))
+		})
+
+		It("reports corrupted entries", func() {
+			observed.SetVerifyOnRead(1)
+			fetchKey("small")
+
+			cachedFiles, err := filepath.Glob(filepath.Join(cachedPath, "*-*-*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cachedFiles).To(HaveLen(1))
+			Expect(ioutil.WriteFile(cachedFiles[0], []byte("ten bytes?"), 0644)).To(Succeed())
+
+			fetchKey("small")
+			Expect(eventTypes()).To(Equal([]cacheddownloader.EntryEventType{
+				cacheddownloader.EntryAdded,
+				cacheddownloader.EntryCorrupted,
+				cacheddownloader.EntryAdded,
+			}))
+		})
+	})
+
+	Describe("SetEncryption", func() {
+		var (
+			encrypting interface {
+				cacheddownloader.CachedDownloader
+				SetEncryption(cacheddownloader.KeyWrapper)
+				Entries() []cacheddownloader.EntryInfo
+			}
+			content []byte
+		)
+
+		fetchContent := func() []byte {
+			file, _, err := encrypting.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			fetched, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			return fetched
+		}
+
+		cachedFiles := func() []string {
+			files, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"-*"))
+			Expect(err).NotTo(HaveOccurred())
+			return files
+		}
+
+		BeforeEach(func() {
+			encrypting, err = cacheddownloader.New(cachedPath, uncachedPath, 1024*1024, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = encrypting
+
+			keys, err := cacheddownloader.NewStaticKeyWrapper(bytes.Repeat([]byte("k"), 32))
+			Expect(err).NotTo(HaveOccurred())
+			encrypting.SetEncryption(keys)
+
+			// spans several chunks, the last of which is full
+			content = bytes.Repeat([]byte("secret content! "), 2*64*1024/16)
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write(content)
+			})
+		})
+
+		It("stores entries encrypted and serves them decrypted", func() {
+			Expect(fetchContent()).To(Equal(content))
+
+			Expect(cachedFiles()).To(HaveLen(1))
+			stored, err := ioutil.ReadFile(cachedFiles()[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bytes.Contains(stored, []byte("secret content!"))).To(BeFalse())
+
+			entries := encrypting.Entries()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Size).To(BeEquivalentTo(len(stored)))
+			Expect(entries[0].Size).To(BeNumerically(">", len(content)))
+
+			Expect(fetchContent()).To(Equal(content))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+		})
+
+		It("downloads entries again that cannot be decrypted", func() {
+			Expect(fetchContent()).To(Equal(content))
+
+			stored, err := ioutil.ReadFile(cachedFiles()[0])
+			Expect(err).NotTo(HaveOccurred())
+			stored[len(stored)-1] ^= 0xff
+			Expect(ioutil.WriteFile(cachedFiles()[0], stored, 0600)).To(Succeed())
+
+			Expect(fetchContent()).To(Equal(content))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(BeEmpty())
+		})
+
+		It("rejects keys of an invalid size", func() {
+			_, err := cacheddownloader.NewStaticKeyWrapper([]byte("too short"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("SetCompression", func() {
+		var (
+			compressing interface {
+				cacheddownloader.CachedDownloader
+				SetCompression(cacheddownloader.Compressor)
+				SetEncryption(cacheddownloader.KeyWrapper)
+				Entries() []cacheddownloader.EntryInfo
+			}
+			content []byte
+		)
+
+		fetchContent := func() []byte {
+			file, _, err := compressing.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			fetched, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			return fetched
+		}
+
+		BeforeEach(func() {
+			compressing, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = compressing
+
+			compressor, err := cacheddownloader.NewGzipCompressor(gzip.BestSpeed)
+			Expect(err).NotTo(HaveOccurred())
+			compressing.SetCompression(compressor)
+
+			content = createTarBuffer(strings.Repeat("compressible ", 2000), 0).Bytes()
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write(content)
+			})
+		})
+
+		It("stores entries compressed and serves them decompressed", func() {
+			Expect(fetchContent()).To(Equal(content))
+
+			entries := compressing.Entries()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Size).To(BeNumerically("<", len(content)/4))
+
+			Expect(fetchContent()).To(Equal(content))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+		})
+
+		It("expands directories from compressed entries", func() {
+			Expect(fetchContent()).To(Equal(content))
+
+			dir, _, err := compressing.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer compressing.CloseDirectory(cacheKey, dir)
+
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+			Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+		})
+
+		It("compresses entries before encrypting them", func() {
+			keys, err := cacheddownloader.NewStaticKeyWrapper(bytes.Repeat([]byte("k"), 32))
+			Expect(err).NotTo(HaveOccurred())
+			compressing.SetEncryption(keys)
+
+			Expect(fetchContent()).To(Equal(content))
+			Expect(compressing.Entries()[0].Size).To(BeNumerically("<", len(content)/4))
+			Expect(fetchContent()).To(Equal(content))
+
+			dir, _, err := compressing.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer compressing.CloseDirectory(cacheKey, dir)
+			Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+			Expect(server.ReceivedRequests()[2].Header.Get("If-None-Match")).To(Equal("some-etag"))
+		})
+
+		Context("with zstd", func() {
+			BeforeEach(func() {
+				compressor, err := cacheddownloader.NewZstdCompressor(3)
+				Expect(err).NotTo(HaveOccurred())
+				compressing.SetCompression(compressor)
+			})
+
+			It("stores entries compressed and serves them decompressed", func() {
+				Expect(fetchContent()).To(Equal(content))
+				Expect(compressing.Entries()[0].Size).To(BeNumerically("<", len(content)/4))
+				Expect(fetchContent()).To(Equal(content))
+
+				dir, _, err := compressing.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+				Expect(err).NotTo(HaveOccurred())
+				defer compressing.CloseDirectory(cacheKey, dir)
+				Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+			})
+
+			It("rejects invalid compression levels", func() {
+				_, err := cacheddownloader.NewZstdCompressor(23)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("SetMemoryTier", func() {
+		var remembering interface {
+			cacheddownloader.CachedDownloader
+			SetMemoryTier(maxEntrySize, maxSizeInBytes int64)
+			Entries() []cacheddownloader.EntryInfo
+		}
+
+		fetchContent := func(key string) []byte {
+			file, _, err := remembering.FetchWithOptions(context.Background(), url, key, checksum, cacheddownloader.FetchOptions{TTL: time.Hour})
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			fetched, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			return fetched
+		}
+
+		BeforeEach(func() {
+			remembering, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = remembering
+
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "small content", http.Header{"ETag": []string{"some-etag"}}))
+		})
+
+		It("serves fresh entries from memory", func() {
+			remembering.SetMemoryTier(1024, 4096)
+
+			content := fetchContent(cacheKey)
+			entry := remembering.Entries()[0]
+			Expect(os.Remove(entry.FilePath)).To(Succeed())
+
+			Expect(fetchContent(cacheKey)).To(Equal(content))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(remembering.Entries()[0].AccessCount).To(Equal(entry.AccessCount + 1))
+		})
+
+		It("does not keep entries larger than the threshold in memory", func() {
+			remembering.SetMemoryTier(4, 4096)
+
+			fetchContent(cacheKey)
+			Expect(os.Remove(remembering.Entries()[0].FilePath)).To(Succeed())
+
+			fetchContent(cacheKey)
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("evicts the least recently used entries to stay within its size", func() {
+			remembering.SetMemoryTier(1024, 20)
+
+			content := fetchContent("first")
+			fetchContent("second")
+			for _, entry := range remembering.Entries() {
+				Expect(os.Remove(entry.FilePath)).To(Succeed())
+			}
+
+			Expect(fetchContent("second")).To(Equal(content))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+
+			fetchContent("first")
+			Expect(server.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+
+	Describe("Entries", func() {
+		var inspected interface {
+			cacheddownloader.CachedDownloader
+			Entries() []cacheddownloader.EntryInfo
+		}
+
+		BeforeEach(func() {
+			inspected, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = inspected
+
+			header := http.Header{"ETag": []string{"some-etag"}}
+			server.RouteToHandler("GET", "/file", ghttp.RespondWith(http.StatusOK, "file content", header))
+			server.RouteToHandler("GET", "/dir.tar", ghttp.RespondWith(http.StatusOK, createTarBuffer("directory content", 0).Bytes(), header))
+		})
+
+		It("describes the contents of the cache, largest first", func() {
+			fileURL, _ := Url.Parse(server.URL() + "/file")
+			file, _, err := inspected.Fetch(fileURL, "file-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			dirURL, _ := Url.Parse(server.URL() + "/dir.tar")
+			dir, _, err := inspected.FetchAsDirectory(dirURL, "dir-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(inspected.CloseDirectory("dir-key", dir)).To(Succeed())
+
+			entries := inspected.Entries()
+			Expect(entries).To(HaveLen(2))
+
+			Expect(entries[0].HashedKey).To(Equal(computeKeyHash("dir-key")))
+			Expect(entries[0].Key).To(Equal("dir-key"))
+			Expect(entries[0].IsDirectory()).To(BeTrue())
+			Expect(entries[0].DirectoryPath).To(Equal(dir))
+			Expect(entries[0].InUseCount).To(BeZero())
+
+			Expect(entries[1].HashedKey).To(Equal(computeKeyHash("file-key")))
+			Expect(entries[1].Key).To(Equal("file-key"))
+			Expect(entries[1].Size).To(BeEquivalentTo(len("file content")))
+			Expect(entries[1].CachingInfo.ETag).To(Equal("some-etag"))
+			Expect(entries[1].IsDirectory()).To(BeFalse())
+			Expect(entries[1].FilePath).To(BeARegularFile())
+			Expect(entries[1].InUseCount).To(Equal(1))
+			Expect(entries[1].Access).To(BeTemporally("~", time.Now(), time.Second))
+		})
+
+		Context("with labels", func() {
+			var labeled interface {
+				cacheddownloader.CachedDownloader
+				Entries() []cacheddownloader.EntryInfo
+				Labels(string, string) (map[string]string, bool)
+			}
+
+			labels := map[string]string{"app-guid": "some-app", "droplet-hash": "abc123"}
+
+			BeforeEach(func() {
+				labeled, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
+				cache = labeled
+			})
+
+			It("records the labels given when the entry was added", func() {
+				fileURL, _ := Url.Parse(server.URL() + "/file")
+				file, _, err := labeled.FetchWithOptions(context.Background(), fileURL, "file-key", checksum, cacheddownloader.FetchOptions{Namespace: "droplets", Labels: labels})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(file.Close()).To(Succeed())
+
+				recorded, ok := labeled.Labels("droplets", "file-key")
+				Expect(ok).To(BeTrue())
+				Expect(recorded).To(Equal(labels))
+
+				_, ok = labeled.Labels("", "file-key")
+				Expect(ok).To(BeFalse())
+
+				entries := labeled.Entries()
+				Expect(entries).To(HaveLen(1))
+				Expect(entries[0].Labels).To(Equal(labels))
+			})
+
+			It("returns the labels with directories, and keeps them when the entry is fetched again", func() {
+				dirURL, _ := Url.Parse(server.URL() + "/dir.tar")
+				info, err := labeled.FetchAsDirectoryWithInfo(context.Background(), dirURL, "dir-key", checksum, cacheddownloader.FetchOptions{Labels: labels})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Labels).To(Equal(labels))
+				Expect(labeled.CloseDirectory("dir-key", info.Path)).To(Succeed())
+
+				info, err = labeled.FetchAsDirectoryWithInfo(context.Background(), dirURL, "dir-key", checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Labels).To(Equal(labels))
+				Expect(labeled.CloseDirectory("dir-key", info.Path)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("SetCoalesceDownloads", func() {
+		var (
+			requested chan struct{}
+			release   chan struct{}
+			sharedURL *Url.URL
+		)
+
+		BeforeEach(func() {
+			requested = make(chan struct{}, 10)
+			release = make(chan struct{})
+
+			d, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 10*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetCoalesceDownloads(true)
+			cache = d
+
+			requested, release := requested, release
+			server.RouteToHandler("GET", "/content-addressed", func(w http.ResponseWriter, req *http.Request) {
+				requested <- struct{}{}
+				<-release
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("shared content"))
+			})
+			sharedURL, _ = Url.Parse(server.URL() + "/content-addressed")
+		})
+
+		fetchInBackground := func(key string) chan []byte {
+			contents := make(chan []byte, 1)
+			go func() {
+				defer GinkgoRecover()
+				file, _, err := cache.Fetch(sharedURL, key, checksum, nil)
+				Expect(err).NotTo(HaveOccurred())
+				defer file.Close()
+
+				content, err := ioutil.ReadAll(file)
+				Expect(err).NotTo(HaveOccurred())
+				contents <- content
+			}()
+			return contents
+		}
+
+		It("downloads the URL once for concurrent fetches under different keys", func() {
+			first := fetchInBackground("first-name")
+			Eventually(requested).Should(Receive())
+
+			second := fetchInBackground("second-name")
+			Consistently(requested, 100*time.Millisecond).ShouldNot(Receive())
+
+			close(release)
+			Eventually(first).Should(Receive(Equal([]byte("shared content"))))
+			Eventually(second).Should(Receive(Equal([]byte("shared content"))))
+
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("first-name")+"*"))).To(HaveLen(1))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("second-name")+"*"))).To(HaveLen(1))
+			Eventually(func() ([]os.FileInfo, error) { return ioutil.ReadDir(uncachedPath) }).Should(BeEmpty())
+		})
+
+		It("does not share downloads with fetches that verify a signature", func() {
+			first := fetchInBackground("first-name")
+			Eventually(requested).Should(Receive())
+
+			errs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				_, _, err := cache.FetchWithOptions(context.Background(), sharedURL, "second-name", checksum, cacheddownloader.FetchOptions{Signature: []byte("garbage signature")})
+				errs <- err
+			}()
+			Eventually(requested).Should(Receive())
+
+			close(release)
+			Eventually(first).Should(Receive(Equal([]byte("shared content"))))
+			Eventually(errs).Should(Receive(HaveOccurred()))
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Describe("CancelAll", func() {
+		var (
+			started chan struct{}
+			release chan struct{}
+		)
+
+		BeforeEach(func() {
+			started = make(chan struct{}, 10)
+			release = make(chan struct{})
+
+			// only two downloads may run at once, so further fetches wait for a slot
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 10*time.Second, 2, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+
+			started, release := started, release
+			server.RouteToHandler("GET", regexp.MustCompile("/blocking/.*"), func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", "some-etag")
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("the first part"))
+				w.(http.Flusher).Flush()
+				started <- struct{}{}
+
+				select {
+				case <-release:
+				case <-req.Context().Done():
+				}
+			})
+			server.RouteToHandler("GET", "/fine", ghttp.RespondWith(http.StatusOK, "fine", http.Header{"ETag": []string{"fine-etag"}}))
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		fetchInBackground := func(path, key string) chan error {
+			errs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				u, err := Url.Parse(server.URL() + path)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, err = cache.Fetch(u, key, checksum, nil)
+				errs <- err
+			}()
+			return errs
+		}
+
+		It("cancels the downloads that are copying or waiting for their turn", func() {
+			downloading := []chan error{
+				fetchInBackground("/blocking/a", "a"),
+				fetchInBackground("/blocking/b", "b"),
+			}
+			Eventually(started).Should(Receive())
+			Eventually(started).Should(Receive())
+
+			waitingForKey := fetchInBackground("/blocking/a", "a")
+			waitingForSlot := fetchInBackground("/blocking/c", "c")
+			Consistently(waitingForKey, 100*time.Millisecond).ShouldNot(Receive())
+			Consistently(waitingForSlot).ShouldNot(Receive())
+
+			cache.CancelAll()
+
+			for _, errs := range append(downloading, waitingForKey, waitingForSlot) {
+				var err error
+				Eventually(errs).Should(Receive(&err))
+				Expect(err).To(BeAssignableToTypeOf(cacheddownloader.NewDownloadCancelledError("", 0, cacheddownloader.NoBytesReceived)))
+			}
+		})
+
+		It("does not affect fetches started afterwards", func() {
+			cache.CancelAll()
+
+			u, err := Url.Parse(server.URL() + "/fine")
+			Expect(err).NotTo(HaveOccurred())
+
+			file, _, err := cache.Fetch(u, "fine", checksum, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("fine")))
+		})
+	})
+
+	Describe("StartTempFileReaper", func() {
+		var reaping interface {
+			cacheddownloader.CachedDownloader
+			StartTempFileReaper(maxAge, interval time.Duration)
+		}
+
+		leaveTempFile := func(name string, age time.Duration) string {
+			path := filepath.Join(uncachedPath, name)
+			Expect(ioutil.WriteFile(path, []byte("left behind"), 0644)).To(Succeed())
+			modified := time.Now().Add(-age)
+			Expect(os.Chtimes(path, modified, modified)).To(Succeed())
+			return path
+		}
+
+		BeforeEach(func() {
+			reaping, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = reaping
+		})
+
+		AfterEach(func() {
+			Expect(reaping.Shutdown(context.Background())).To(Succeed())
+		})
+
+		It("removes stale temp files on start, and recent ones once they are stale", func() {
+			stale := leaveTempFile("uncached-stale", 2*time.Hour)
+			recent := leaveTempFile("transformed-recent", time.Minute)
+
+			reaping.StartTempFileReaper(time.Hour, 10*time.Millisecond)
+			Expect(stale).NotTo(BeAnExistingFile())
+			Consistently(recent, "100ms").Should(BeAnExistingFile())
+
+			modified := time.Now().Add(-2 * time.Hour)
+			Expect(os.Chtimes(recent, modified, modified)).To(Succeed())
+			Eventually(recent).ShouldNot(BeAnExistingFile())
+		})
+
+		It("keeps stale files that are handed out", func() {
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "uncached content"))
+			file, _, err := reaping.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			handedOut, err := ioutil.ReadDir(uncachedPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handedOut).To(HaveLen(1))
+			path := filepath.Join(uncachedPath, handedOut[0].Name())
+			modified := time.Now().Add(-2 * time.Hour)
+			Expect(os.Chtimes(path, modified, modified)).To(Succeed())
+
+			reaping.StartTempFileReaper(time.Hour, 10*time.Millisecond)
+			Consistently(path, "100ms").Should(BeAnExistingFile())
+		})
+	})
+
+	Describe("Shutdown", func() {
+		var started chan struct{}
+
+		BeforeEach(func() {
+			started = make(chan struct{}, 10)
+
+			started := started
+			server.RouteToHandler("GET", "/slow", func(w http.ResponseWriter, req *http.Request) {
+				started <- struct{}{}
+				time.Sleep(300 * time.Millisecond)
+				w.Write([]byte("slow"))
+			})
+			server.RouteToHandler("GET", "/hanging", func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				started <- struct{}{}
+				<-req.Context().Done()
+			})
+			server.RouteToHandler("GET", "/fine", ghttp.RespondWith(http.StatusOK, "fine"))
+		})
+
+		fetchInBackground := func(path string) chan error {
+			errs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				u, err := Url.Parse(server.URL() + path)
+				Expect(err).NotTo(HaveOccurred())
+
+				file, _, err := cache.Fetch(u, "some-key", checksum, nil)
+				if err == nil {
+					file.Close()
+				}
+				errs <- err
+			}()
+			return errs
+		}
+
+		shutdownInBackground := func(ctx context.Context) chan error {
+			errs := make(chan error, 1)
+			go func() {
+				errs <- cache.Shutdown(ctx)
+			}()
+			return errs
+		}
+
+		It("waits for the fetches in flight and refuses new ones", func() {
+			fetched := fetchInBackground("/slow")
+			Eventually(started).Should(Receive())
+
+			shutdown := shutdownInBackground(context.Background())
+			Consistently(shutdown, 100*time.Millisecond).ShouldNot(Receive())
+
+			u, err := Url.Parse(server.URL() + "/fine")
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = cache.Fetch(u, "fine", checksum, nil)
+			Expect(err).To(Equal(cacheddownloader.ErrShutDown))
+
+			Eventually(fetched).Should(Receive(BeNil()))
+			Eventually(shutdown).Should(Receive(BeNil()))
+		})
+
+		It("cancels the fetches in flight once the context is done", func() {
+			fetched := fetchInBackground("/hanging")
+			Eventually(started).Should(Receive())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Expect(cache.Shutdown(ctx)).To(Equal(context.DeadlineExceeded))
+
+			var fetchErr error
+			Expect(fetched).To(Receive(&fetchErr))
+			Expect(fetchErr).To(BeAssignableToTypeOf(cacheddownloader.NewDownloadCancelledError("", 0, cacheddownloader.NoBytesReceived)))
+		})
+
+		It("removes the files left in the uncached path, but not those still handed out", func() {
+			leftOver := filepath.Join(uncachedPath, "left-over")
+			Expect(ioutil.WriteFile(leftOver, []byte("junk"), 0644)).To(Succeed())
+
+			u, err := Url.Parse(server.URL() + "/fine")
+			Expect(err).NotTo(HaveOccurred())
+			file, _, err := cache.Fetch(u, "", checksum, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			Expect(cache.Shutdown(context.Background())).To(Succeed())
+
+			Expect(leftOver).NotTo(BeAnExistingFile())
+			Expect(file.(*cacheddownloader.CachedFile).Name()).To(BeAnExistingFile())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("fine")))
+		})
+	})
+
+	Describe("SetMaxOpenHandles", func() {
+		var downloader interface {
+			cacheddownloader.CachedDownloader
+			OpenHandles() int
+		}
+
+		BeforeEach(func() {
+			d, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			d.SetMaxOpenHandles(3)
+			downloader = d
+
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("some content"))
+			})
+			server.RouteToHandler("GET", "/my_tar", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", "some-etag")
+				w.Write(createTarBuffer("test content", 0).Bytes())
+			})
+		})
+
+		It("tracks the readers and directories that are still open", func() {
+			reader, _, err := downloader.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(downloader.OpenHandles()).To(Equal(1))
+
+			tarURL, _ := Url.Parse(server.URL() + "/my_tar")
+			dir, _, err := downloader.FetchAsDirectory(tarURL, "tar-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(downloader.OpenHandles()).To(Equal(2))
+
+			Expect(reader.Close()).To(Succeed())
+			Expect(downloader.OpenHandles()).To(Equal(1))
+
+			Expect(downloader.CloseDirectory("tar-key", dir)).To(Succeed())
+			Expect(downloader.OpenHandles()).To(Equal(0))
+		})
+
+		It("enforces the limit until a handle is released", func() {
+			readers := []io.ReadCloser{}
+			for i := 0; i < 3; i++ {
+				reader, _, err := downloader.Fetch(url, cacheKey, checksum, cancelChan)
+				Expect(err).NotTo(HaveOccurred())
+				readers = append(readers, reader)
+			}
+
+			_, _, err := downloader.Fetch(url, "", checksum, cancelChan)
+			Expect(err).To(BeAssignableToTypeOf(cacheddownloader.NewTooManyOpenError(0)))
+			Expect(downloader.OpenHandles()).To(Equal(3))
+
+			Expect(readers[0].Close()).To(Succeed())
+
+			reader, _, err := downloader.Fetch(url, "", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			for _, r := range readers[1:] {
+				Expect(r.Close()).To(Succeed())
+			}
+			Expect(downloader.OpenHandles()).To(Equal(0))
+		})
+
+		It("releases the handle when the fetch fails", func() {
+			failingURL, _ := Url.Parse(server.URL() + "/missing")
+			server.AllowUnhandledRequests = true
+
+			_, _, err := downloader.Fetch(failingURL, cacheKey, checksum, cancelChan)
+			Expect(err).To(HaveOccurred())
+			Expect(downloader.OpenHandles()).To(Equal(0))
+		})
+	})
+
+	Describe("FetchDirectory", func() {
+		var (
+			d interface {
+				cacheddownloader.CachedDownloader
+				SetDirectoryLeakHandler(func(cacheddownloader.DirectoryInfo))
+				Entries() []cacheddownloader.EntryInfo
+			}
+			header http.Header
+		)
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			header = http.Header{"ETag": []string{"some-etag"}}
+			downloadContent = createTarBuffer("test content", 0).Bytes()
+		})
+
+		JustBeforeEach(func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, downloadContent, header))
+		})
+
+		It("returns a handle on the directory that releases it once closed", func() {
+			handle, err := d.FetchDirectory(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(handle.Path(), "testdir", "file.txt")).To(BeARegularFile())
+			Expect(handle.Info().Path).To(Equal(handle.Path()))
+			Expect(d.Entries()[0].InUseCount).To(Equal(1))
+
+			Expect(handle.Close()).To(Succeed())
+			Expect(d.Entries()[0].InUseCount).To(BeZero())
+			Expect(handle.Close()).To(Equal(cacheddownloader.AlreadyClosed))
+		})
+
+		Context("when the directory is not cacheable", func() {
+			BeforeEach(func() {
+				header = http.Header{}
+			})
+
+			It("removes it once closed", func() {
+				handle, err := d.FetchDirectory(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handle.Path()).To(BeADirectory())
+
+				Expect(handle.Close()).To(Succeed())
+				Expect(handle.Path()).NotTo(BeADirectory())
+			})
+		})
+
+		It("reports and releases handles that are not closed", func() {
+			leaked := make(chan cacheddownloader.DirectoryInfo, 1)
+			d.SetDirectoryLeakHandler(func(info cacheddownloader.DirectoryInfo) {
+				leaked <- info
+			})
+
+			func() {
+				_, err := d.FetchDirectory(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			Eventually(func() int {
+				runtime.GC()
+				return len(leaked)
+			}).Should(Equal(1))
+			Expect((<-leaked).Path).To(HavePrefix(cachedPath))
+			Eventually(func() int {
+				return d.Entries()[0].InUseCount
+			}).Should(BeZero())
+		})
+	})
+
+	Describe("CloneDirectory", func() {
+		var (
+			d interface {
+				cacheddownloader.CachedDownloader
+				CloneDirectory(string) (cacheddownloader.Directory, error)
+			}
+			original cacheddownloader.Directory
+			clone    cacheddownloader.Directory
+		)
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			downloadContent = createTarBuffer("test content", 0).Bytes()
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, downloadContent, http.Header{"ETag": []string{"some-etag"}}))
+
+			original, err = d.FetchDirectory(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			clone, err = d.CloneDirectory(original.Path())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			original.Close()
+			clone.Close()
+		})
+
+		It("clones the directory into the uncached path", func() {
+			Expect(filepath.Dir(clone.Path())).To(Equal(filepath.Clean(uncachedPath)))
+			Expect(ioutil.ReadFile(filepath.Join(clone.Path(), "testdir", "file.txt"))).To(Equal([]byte("test content")))
+			Expect(clone.Info().FileCount).To(Equal(original.Info().FileCount))
+			Expect(clone.Info().SizeInBytes).To(Equal(original.Info().SizeInBytes))
+		})
+
+		It("keeps changes to the clone from the directory", func() {
+			Expect(ioutil.WriteFile(filepath.Join(clone.Path(), "new.txt"), []byte("new"), 0644)).To(Succeed())
+			Expect(os.Remove(filepath.Join(clone.Path(), "readme.txt"))).To(Succeed())
+
+			Expect(filepath.Join(original.Path(), "new.txt")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(original.Path(), "readme.txt")).To(BeARegularFile())
+		})
+
+		It("outlives the directory, and is removed once closed", func() {
+			Expect(original.Close()).To(Succeed())
+			Expect(filepath.Join(clone.Path(), "testdir", "file.txt")).To(BeARegularFile())
+
+			Expect(clone.Close()).To(Succeed())
+			Expect(clone.Path()).NotTo(BeADirectory())
+			Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+		})
+	})
+
+	Describe("AcquireLowerDir", func() {
+		var d interface {
+			cacheddownloader.CachedDownloader
+			AcquireLowerDir(context.Context, *Url.URL, string, cacheddownloader.ChecksumInfoType, cacheddownloader.FetchOptions) (cacheddownloader.LowerDir, error)
+			Entries() []cacheddownloader.EntryInfo
+		}
+
+		BeforeEach(func() {
+			d, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = d
+
+			downloadContent = createTarBuffer("test content", 0).Bytes()
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, downloadContent, http.Header{"ETag": []string{"some-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, nil),
+			)
+		})
+
+		It("pins the directory until every mount has released it", func() {
+			first, err := d.AcquireLowerDir(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			second, err := d.AcquireLowerDir(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(second.Path()).To(Equal(first.Path()))
+			Expect(d.Entries()[0].InUseCount).To(Equal(1))
+
+			Expect(first.Release()).To(Succeed())
+			Expect(d.Entries()[0].InUseCount).To(Equal(1))
+			Expect(first.Release()).To(Equal(cacheddownloader.AlreadyClosed))
+
+			Expect(second.Release()).To(Succeed())
+			Expect(d.Entries()[0].InUseCount).To(BeZero())
+		})
+
+		It("builds the options to mount an overlay with", func() {
+			lower, err := d.AcquireLowerDir(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			defer lower.Release()
+
+			Expect(cacheddownloader.OverlayMountOptions([]cacheddownloader.LowerDir{lower}, "/upper,dir", "/work:dir")).To(Equal(
+				"lowerdir=" + lower.Path() + `,upperdir=/upper\,dir,workdir=/work\:dir`,
+			))
+		})
+	})
+
+	Describe("FetchAsDirectory", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+		})
+
+		It("returns a NotCacheable error if the cache key is empty", func() {
+			_, _, fetchErr := cache.FetchAsDirectory(url, "", checksum, cancelChan)
+			Expect(fetchErr).To(Equal(cacheddownloader.NotCacheable))
+		})
+
+		Context("when the file is not in the cache", func() {
+			var (
+				fetchedDir     string
+				fetchedDirSize int64
+				fetchErr       error
+			)
+
+			JustBeforeEach(func() {
+				fetchedDir, fetchedDirSize, fetchErr = cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+			})
+
+			Context("when the download succeeds", func() {
+				BeforeEach(func() {
+					downloadContent = createTarBuffer("test content", 0).Bytes()
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
+						}),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					))
+				})
+
+				It("should not error", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+				})
+
+				It("should return a directory", func() {
+					Expect(fetchedDir).NotTo(BeEmpty())
+					fileInfo, err := os.Stat(fetchedDir)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fileInfo.IsDir()).To(BeTrue())
+				})
+
+				It("returns the total number of bytes downloaded", func() {
+					Expect(fetchedDirSize).To(Equal(int64(len(downloadContent))))
+				})
+
+				It("should store the directory in the cache", func() {
+					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(1))
+				})
+
+				It("should remove any temporary assets generated along the way", func() {
+					Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+				})
+			})
+
+			Context("when the download is a zip", func() {
+				BeforeEach(func() {
+					downloadContent = createZipBuffer("zipped content").Bytes()
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					))
+				})
+
+				It("expands the zip into the directory", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+
+					Expect(ioutil.ReadFile(filepath.Join(fetchedDir, "testdir", "file.txt"))).To(Equal([]byte("zipped content")))
+					info, err := os.Stat(filepath.Join(fetchedDir, "testdir", "file.txt"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+
+					Expect(os.Readlink(filepath.Join(fetchedDir, "link.txt"))).To(Equal("readme.txt"))
+				})
+
+				It("keeps the zip in the cache to expand it again", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+					Expect(cache.CloseDirectory(cacheKey, fetchedDir)).To(Succeed())
+
+					server.AppendHandlers(ghttp.RespondWith(http.StatusNotModified, nil))
+					dir, _, err := cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+					Expect(err).NotTo(HaveOccurred())
+					defer cache.CloseDirectory(cacheKey, dir)
+					Expect(filepath.Join(dir, "readme.txt")).To(BeARegularFile())
+				})
+			})
+
+			Context("when the download is a gzipped tarball", func() {
+				BeforeEach(func() {
+					buf := new(bytes.Buffer)
+					gz := gzip.NewWriter(buf)
+					gz.Write(createTarBuffer("gzipped content", 0).Bytes())
+					Expect(gz.Close()).To(Succeed())
+					downloadContent = buf.Bytes()
+
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					))
+				})
+
+				It("decompresses and expands it into the directory", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+					Expect(ioutil.ReadFile(filepath.Join(fetchedDir, "testdir", "file.txt"))).To(Equal([]byte("gzipped content")))
+					Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+				})
+			})
+
+			Context("when the download is a zstd compressed tarball", func() {
+				BeforeEach(func() {
+					encoder, err := zstd.NewWriter(nil)
+					Expect(err).NotTo(HaveOccurred())
+					downloadContent = encoder.EncodeAll(createTarBuffer("zstd content", 0).Bytes(), nil)
+
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					))
+				})
+
+				It("decompresses and expands it into the directory", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+					Expect(ioutil.ReadFile(filepath.Join(fetchedDir, "testdir", "file.txt"))).To(Equal([]byte("zstd content")))
+				})
+			})
+
+			Context("when the decompressor fails once the archive has been read", func() {
+				BeforeEach(func() {
+					// a fake zstd archive: the magic number followed by the plain tarball
+					downloadContent = append([]byte("\x28\xb5\x2f\xfd"), createTarBuffer("zstd content", 0).Bytes()...)
+					cacheddownloader.SetArchiveDecompressor("zstd", func(compressed io.Reader) (io.ReadCloser, error) {
+						_, err := io.CopyN(ioutil.Discard, compressed, 4)
+						return failingCloser{Reader: compressed, err: errors.New("corrupt frame")}, err
+					})
+
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					))
+				})
+
+				AfterEach(func() {
+					cacheddownloader.SetArchiveDecompressor("zstd", nil)
+				})
+
+				It("reports the failure", func() {
+					Expect(fetchErr).To(MatchError("corrupt frame"))
+				})
+			})
+
+			Context("when the zip has an entry outside of the directory", func() {
+				BeforeEach(func() {
+					buf := new(bytes.Buffer)
+					zw := zip.NewWriter(buf)
+					w, err := zw.Create("../escaped.txt")
+					Expect(err).NotTo(HaveOccurred())
+					w.Write([]byte("escaped"))
+					Expect(zw.Close()).To(Succeed())
+
+					server.AppendHandlers(ghttp.RespondWith(http.StatusOK, buf.String(), returnedHeader))
+				})
+
+				It("refuses to expand it", func() {
+					Expect(fetchErr).To(HaveOccurred())
+					Expect(filepath.Join(cachedPath, "escaped.txt")).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when the download succeeds but does not have an ETag", func() {
+				BeforeEach(func() {
+					downloadContent = createTarBuffer("test content", 0).Bytes()
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
+						}),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent)),
+					))
+				})
+
+				It("should expand it into the uncached path", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+					Expect(filepath.Dir(fetchedDir)).To(Equal(filepath.Clean(uncachedPath)))
+					Expect(ioutil.ReadFile(filepath.Join(fetchedDir, "testdir", "file.txt"))).To(Equal([]byte("test content")))
+					Expect(fetchedDirSize).To(Equal(int64(len(downloadContent))))
+					Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+				})
+
+				It("should remove the directory when it is closed", func() {
+					Expect(cache.CloseDirectory(cacheKey, fetchedDir)).To(Succeed())
+					Expect(fetchedDir).NotTo(BeADirectory())
+					Expect(ioutil.ReadDir(uncachedPath)).To(BeEmpty())
+				})
+			})
+
+			Context("when the download fails", func() {
+				BeforeEach(func() {
+					server.AllowUnhandledRequests = true //will 500 for any attempted requests
+				})
+
+				It("should return an error and no file", func() {
+					Expect(fetchedDir).To(BeEmpty())
+					Expect(fetchErr).To(HaveOccurred())
+				})
+
+				It("should clean up after itself", func() {
+					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+					Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
+				})
+			})
+		})
+
+		Context("when the file is already on disk in the cache", func() {
+			var fileContent []byte
+			var status int
+			var downloadContent []byte
+
+			BeforeEach(func() {
+				status = http.StatusOK
+				fileContent = createTarBuffer("now you see it", 0).Bytes()
+
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, string(fileContent), returnedHeader),
+				))
+
+				dir, _, _ := cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+				err := cache.CloseDirectory(cacheKey, dir)
+				Expect(err).ToNot(HaveOccurred())
+
+				downloadContent = createTarBuffer("now you don't", 0).Bytes()
+
+				etag := "second-round-etag"
+				returnedHeader.Set("ETag", etag)
 
 				server.AppendHandlers(ghttp.CombineHandlers(
 					ghttp.VerifyRequest("GET", "/my_file"),
@@ -834,13 +3466,17 @@ var _ = Describe("File cache", func() {
 					fetchDir, _, fetchErr = cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
 				})
 
-				It("should error", func() {
-					Expect(fetchErr).To(HaveOccurred())
+				It("should return a directory in the uncached path", func() {
+					Expect(fetchErr).NotTo(HaveOccurred())
+					Expect(filepath.Dir(fetchDir)).To(Equal(filepath.Clean(uncachedPath)))
+					Expect(filepath.Join(fetchDir, "testdir", "file.txt")).To(BeARegularFile())
 				})
 
 				It("should have removed the file from the cache", func() {
-					cache.CloseDirectory(cacheKey, fetchDir)
+					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+					Expect(cache.CloseDirectory(cacheKey, fetchDir)).To(Succeed())
 					Expect(fetchDir).NotTo(BeADirectory())
+					Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
 				})
 			})
 
@@ -922,60 +3558,191 @@ var _ = Describe("File cache", func() {
 			}
 
 			BeforeEach(func() {
-				fetchDirOfSize("A", 0)
-				fetchDirOfSize("B", 0)
-				fetchDirOfSize("C", 0)
-			})
+				fetchDirOfSize("A", 0)
+				fetchDirOfSize("B", 0)
+				fetchDirOfSize("C", 0)
+			})
+
+			It("should have all entries in the cache", func() {
+				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(3))
+			})
+
+			It("deletes the oldest cached files until there is space", func() {
+				//try to add a file that has size larger (this creates a file that is 23 GB...)
+				fetchDirOfSize("D", 18)
+
+				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
+
+				Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(0))
+				Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("B")+"*"))).To(HaveLen(0))
+				Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("C")+"*"))).To(HaveLen(1))
+				Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("D")+"*"))).To(HaveLen(1))
+			})
+
+			Context("and cannot delete any items", func() {
+				It("succeeds even if the downloaded file is larger than the resources left", func() {
+					_, downloadedBytes, err := fetchDir("test", 30)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(downloadedBytes).To(Equal(int64(len(fileContent))))
+				})
+			})
+
+			Describe("when one of the files has just been read", func() {
+				BeforeEach(func() {
+					server.AppendHandlers(ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/A"),
+						ghttp.RespondWith(http.StatusNotModified, "", returnedHeader),
+					))
+
+					url, _ = Url.Parse(server.URL() + "/A")
+					// windows timer increments every 15.6ms, without the sleep
+					// A, B & C will sometimes have the same timestamp
+					time.Sleep(16 * time.Millisecond)
+					cache.FetchAsDirectory(url, "A", checksum, cancelChan)
+				})
+
+				It("considers that file to be the newest", func() {
+					//try to add a file that has size larger
+					fetchDirOfSize("D", 18)
+
+					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
+
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("A")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("B")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("C")+"*"))).To(HaveLen(0))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("D")+"*"))).To(HaveLen(1))
+				})
+			})
+		})
+
+		Context("when asking for the directory info", func() {
+			var (
+				expectedFiles int
+				expectedSize  int64
+			)
+
+			BeforeEach(func() {
+				downloadContent = createTarBuffer("some content", 5).Bytes()
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/my_file"),
+						ghttp.RespondWith(http.StatusNotModified, "", returnedHeader),
+					),
+				)
+
+				expectedFiles, expectedSize = 0, 0
+				tarReader := tar.NewReader(bytes.NewReader(downloadContent))
+				for {
+					header, err := tarReader.Next()
+					if err == io.EOF {
+						break
+					}
+					Expect(err).NotTo(HaveOccurred())
+					if header.Typeflag == tar.TypeReg {
+						expectedFiles++
+						expectedSize += header.Size
+					}
+				}
+			})
+
+			It("reports the extracted files and where they came from", func() {
+				info, err := cache.FetchAsDirectoryWithInfo(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Path).To(BeADirectory())
+				Expect(info.FileCount).To(Equal(expectedFiles))
+				Expect(info.SizeInBytes).To(Equal(expectedSize))
+				Expect(info.DownloadedSize).To(Equal(int64(len(downloadContent))))
+				Expect(info.FromCache).To(BeFalse())
+				Expect(cache.CloseDirectory(cacheKey, info.Path)).To(Succeed())
+
+				info, err = cache.FetchAsDirectoryWithInfo(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.FileCount).To(Equal(expectedFiles))
+				Expect(info.SizeInBytes).To(Equal(expectedSize))
+				Expect(info.DownloadedSize).To(BeZero())
+				Expect(info.FromCache).To(BeTrue())
+				Expect(cache.CloseDirectory(cacheKey, info.Path)).To(Succeed())
+			})
+		})
+
+		Context("when extraction progress is requested", func() {
+			var reports []cacheddownloader.ExtractionProgress
+
+			BeforeEach(func() {
+				reports = nil
 
-			It("should have all entries in the cache", func() {
-				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(3))
+				// 4 entries from the fixture plus 5 extra files
+				downloadContent = createTarBuffer("some content", 5).Bytes()
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+				))
 			})
 
-			It("deletes the oldest cached files until there is space", func() {
-				//try to add a file that has size larger (this creates a file that is 23 GB...)
-				fetchDirOfSize("D", 18)
+			It("reports increasing entry counts ending at the total", func() {
+				_, _, fetchErr := cache.FetchAsDirectoryWithOptions(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{
+					ExtractionProgress: func(progress cacheddownloader.ExtractionProgress) {
+						reports = append(reports, progress)
+					},
+					ExtractionProgressInterval: time.Nanosecond,
+				})
+				Expect(fetchErr).NotTo(HaveOccurred())
 
-				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
+				Expect(len(reports)).To(BeNumerically(">", 1))
+				for i := 1; i < len(reports); i++ {
+					Expect(reports[i].Entries).To(BeNumerically(">", reports[i-1].Entries))
+					Expect(reports[i].BytesWritten).To(BeNumerically(">=", reports[i-1].BytesWritten))
+				}
 
-				Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(0))
-				Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(0))
-				Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(1))
-				Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
+				last := reports[len(reports)-1]
+				Expect(last.Entries).To(Equal(9))
+				Expect(last.BytesWritten).To(BeNumerically(">", 6*len("some content")))
 			})
 
-			Context("and cannot delete any items", func() {
-				It("succeeds even if the downloaded file is larger than the resources left", func() {
-					_, downloadedBytes, err := fetchDir("test", 30)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(downloadedBytes).To(Equal(int64(len(fileContent))))
+			It("only reports the final progress when throttled", func() {
+				_, _, fetchErr := cache.FetchAsDirectoryWithOptions(context.Background(), url, cacheKey, checksum, cacheddownloader.FetchOptions{
+					ExtractionProgress: func(progress cacheddownloader.ExtractionProgress) {
+						reports = append(reports, progress)
+					},
+					ExtractionProgressInterval: time.Hour,
 				})
+				Expect(fetchErr).NotTo(HaveOccurred())
+
+				Expect(reports).To(HaveLen(1))
+				Expect(reports[0].Entries).To(Equal(9))
 			})
+		})
 
-			Describe("when one of the files has just been read", func() {
-				BeforeEach(func() {
-					server.AppendHandlers(ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/A"),
-						ghttp.RespondWith(http.StatusNotModified, "", returnedHeader),
-					))
+		Context("when the directory exceeds the total available cache size", func() {
+			var (
+				fetchedDir string
+				fetchErr   error
+			)
 
-					url, _ = Url.Parse(server.URL() + "/A")
-					// windows timer increments every 15.6ms, without the sleep
-					// A, B & C will sometimes have the same timestamp
-					time.Sleep(16 * time.Millisecond)
-					cache.FetchAsDirectory(url, "A", checksum, cancelChan)
-				})
+			BeforeEach(func() {
+				downloadContent = createTarBuffer(strings.Repeat("7", int(maxSizeInBytes*2)), 0).Bytes()
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
+				))
 
-				It("considers that file to be the newest", func() {
-					//try to add a file that has size larger
-					fetchDirOfSize("D", 18)
+				fetchedDir, _, fetchErr = cache.FetchAsDirectory(url, cacheKey, checksum, cancelChan)
+			})
 
-					Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(2))
+			It("serves the directory from the uncached path instead of erroring", func() {
+				Expect(fetchErr).NotTo(HaveOccurred())
+				Expect(filepath.Dir(fetchedDir)).To(Equal(uncachedPath))
+				Expect(ioutil.ReadFile(filepath.Join(fetchedDir, "testdir", "file.txt"))).To(HaveLen(int(maxSizeInBytes * 2)))
+				Expect(ioutil.ReadDir(cachedPath)).To(HaveLen(0))
+			})
 
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(0))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
-				})
+			It("removes the directory when it is closed", func() {
+				Expect(cache.CloseDirectory(cacheKey, fetchedDir)).To(Succeed())
+				Expect(ioutil.ReadDir(uncachedPath)).To(HaveLen(0))
 			})
 		})
 	})
@@ -1003,7 +3770,9 @@ var _ = Describe("File cache", func() {
 					ghttp.RespondWith(http.StatusOK, string(downloadContent), returnedHeader),
 				))
 
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, cacheddownloader.TarTransform)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, cacheddownloader.TarTransform)
+
+				Expect(err).NotTo(HaveOccurred())
 
 				fetchedFile, _, fetchErr = cache.Fetch(url, cacheKey, checksum, cancelChan)
 				Expect(fetchErr).NotTo(HaveOccurred())
@@ -1120,7 +3889,8 @@ var _ = Describe("File cache", func() {
 
 			Context("then is fetched with Fetch", func() {
 				BeforeEach(func() {
-					cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, cacheddownloader.TarTransform)
+					cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, cacheddownloader.TarTransform)
+					Expect(err).NotTo(HaveOccurred())
 				})
 
 				JustBeforeEach(func() {
@@ -1149,6 +3919,65 @@ var _ = Describe("File cache", func() {
 		})
 	})
 
+	Describe("SetVerifyOnRead", func() {
+		var verifying interface {
+			cacheddownloader.CachedDownloader
+			SetVerifyOnRead(probability float64)
+			Stats() cacheddownloader.Stats
+		}
+
+		BeforeEach(func() {
+			verifying, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			verifying.SetVerifyOnRead(1)
+
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("the cached content"))
+			})
+		})
+
+		fetchContent := func() []byte {
+			file, _, err := verifying.Fetch(url, cacheKey, checksum, nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			return content
+		}
+
+		It("serves intact entries from the cache", func() {
+			Expect(fetchContent()).To(Equal([]byte("the cached content")))
+			Expect(fetchContent()).To(Equal([]byte("the cached content")))
+
+			requests := server.ReceivedRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Header.Get("If-None-Match")).To(Equal("some-etag"))
+			Expect(verifying.Stats().Corrupted).To(BeZero())
+		})
+
+		It("evicts and downloads again entries that no longer match their digest", func() {
+			Expect(fetchContent()).To(Equal([]byte("the cached content")))
+
+			cachedFiles, err := filepath.Glob(filepath.Join(cachedPath, "*-*-*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cachedFiles).To(HaveLen(1))
+			Expect(ioutil.WriteFile(cachedFiles[0], []byte("the cached cont\x00\x00\x00"), 0644)).To(Succeed())
+
+			Expect(fetchContent()).To(Equal([]byte("the cached content")))
+
+			requests := server.ReceivedRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Header.Get("If-None-Match")).To(BeEmpty())
+			Expect(verifying.Stats().Corrupted).To(BeEquivalentTo(1))
+		})
+	})
+
 	Describe("SaveState", func() {
 		It("writes the cache to the persistent disk", func() {
 			err := cache.SaveState()
@@ -1158,6 +3987,233 @@ var _ = Describe("File cache", func() {
 		})
 	})
 
+	Describe("SetKeyHasher", func() {
+		var hashing interface {
+			cacheddownloader.CachedDownloader
+			SetKeyHasher(cacheddownloader.KeyHasher)
+			SetMD5Compatibility(bool)
+		}
+
+		newHashing := func() {
+			hashing, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			cache = hashing
+		}
+
+		fetch := func() int64 {
+			file, downloadSize, err := hashing.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			return downloadSize
+		}
+
+		BeforeEach(func() {
+			newHashing()
+
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "some-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "some-etag")
+				w.Write([]byte("hashed content"))
+			})
+		})
+
+		It("names the files of entries with the given hasher", func() {
+			hashing.SetKeyHasher(func(cacheKey string) string { return "custom-" + cacheKey })
+			fetch()
+
+			Expect(filepath.Glob(filepath.Join(cachedPath, "custom-"+cacheKey+"-*"))).To(HaveLen(1))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))).To(BeEmpty())
+		})
+
+		It("does not serve the entry of another cache key with the same hash", func() {
+			hashing.SetKeyHasher(func(cacheKey string) string { return "colliding" })
+			server.RouteToHandler("GET", "/other_file", ghttp.RespondWith(http.StatusOK, "other content", http.Header{"ETag": []string{"some-etag"}}))
+			otherURL, _ := Url.Parse(server.URL() + "/other_file")
+
+			fetch()
+			file, _, err := hashing.Fetch(otherURL, "other-cache-key", checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("other content")))
+
+			Expect(server.ReceivedRequests()[1].Header.Get("If-None-Match")).To(BeEmpty())
+			Expect(filepath.Glob(filepath.Join(cachedPath, "colliding-*"))).To(HaveLen(1))
+		})
+
+		Context("when the cache was saved with MD5 names", func() {
+			BeforeEach(func() {
+				hashing.SetKeyHasher(cacheddownloader.MD5KeyHasher)
+				Expect(fetch()).NotTo(BeZero())
+				Expect(hashing.SaveState()).To(Succeed())
+
+				newHashing()
+				Expect(hashing.RecoverState()).To(Succeed())
+			})
+
+			It("finds the old entries in compatibility mode", func() {
+				hashing.SetMD5Compatibility(true)
+				Expect(fetch()).To(BeZero())
+				Expect(fetch()).To(BeZero())
+			})
+
+			It("does not find them otherwise", func() {
+				Expect(fetch()).NotTo(BeZero())
+			})
+		})
+	})
+
+	Describe("NewAdopting", func() {
+		var (
+			adopting interface {
+				cacheddownloader.CachedDownloader
+				Remove(cacheKey string)
+			}
+			restart func() cacheddownloader.RecoveryReport
+		)
+
+		BeforeEach(func() {
+			restart = func() cacheddownloader.RecoveryReport {
+				d, report, err := cacheddownloader.NewAdopting(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+				Expect(err).NotTo(HaveOccurred())
+				adopting = d
+				cache = d
+				return report
+			}
+			Expect(restart().AdoptedEntries).To(BeZero())
+
+			returnedHeader := http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "adopt me", returnedHeader),
+			))
+
+			file, _, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		})
+
+		It("adopts the entries in the cached path without a saved state", func() {
+			junkFile := filepath.Join(cachedPath, computeKeyHash("partial")+"-123-1")
+			Expect(ioutil.WriteFile(junkFile, []byte("half an admission"), 0644)).To(Succeed())
+
+			report := restart()
+			Expect(report.AdoptedEntries).To(Equal(1))
+			Expect(report.Entries).To(Equal(1))
+			Expect(report.RemovedFiles).To(ConsistOf(junkFile))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))).To(HaveLen(2))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, nil),
+			))
+			file, downloadSize, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(downloadSize).To(BeZero())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte("adopt me")))
+		})
+
+		It("removes files whose metadata is not well-formed", func() {
+			sidecars, err := filepath.Glob(filepath.Join(cachedPath, "*.entry.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sidecars).To(HaveLen(1))
+			Expect(ioutil.WriteFile(sidecars[0], []byte("{not json"), 0644)).To(Succeed())
+
+			report := restart()
+			Expect(report.AdoptedEntries).To(BeZero())
+			Expect(report.Entries).To(BeZero())
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+		})
+
+		It("does not adopt files truncated to half their size", func() {
+			files, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"-*"))
+			Expect(err).NotTo(HaveOccurred())
+			for _, file := range files {
+				if !strings.HasSuffix(file, ".entry.json") {
+					Expect(os.Truncate(file, int64(len("adopt me")/2))).To(Succeed())
+				}
+			}
+
+			report := restart()
+			Expect(report.AdoptedEntries).To(BeZero())
+			Expect(report.Entries).To(BeZero())
+		})
+
+		It("removes the metadata along with the entry", func() {
+			adopting.Remove(cacheKey)
+			Expect(ioutil.ReadDir(cachedPath)).To(BeEmpty())
+		})
+	})
+
+	Describe("SetDurableState", func() {
+		var restart func() cacheddownloader.RecoveryReport
+
+		BeforeEach(func() {
+			durable, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			Expect(err).NotTo(HaveOccurred())
+			durable.SetDurableState(true)
+			cache = durable
+
+			returnedHeader := http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "now you see it", returnedHeader),
+			))
+
+			file, _, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			restart = func() cacheddownloader.RecoveryReport {
+				d, report, err := cacheddownloader.NewPersistent(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+				Expect(err).NotTo(HaveOccurred())
+				cache = d
+				return report
+			}
+		})
+
+		It("saves the state as soon as an entry is added", func() {
+			report := restart()
+			Expect(report.Entries).To(Equal(1))
+			Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))).To(HaveLen(1))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusNotModified, nil),
+			))
+			file, downloadSize, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(downloadSize).To(BeZero())
+		})
+
+		It("saves the state as soon as an entry is removed", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "no longer cacheable"),
+			))
+			file, _, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			report := restart()
+			Expect(report.Entries).To(BeZero())
+			Expect(report.DroppedEntries).To(BeZero())
+		})
+
+		It("leaves no temporary files next to the state", func() {
+			files, err := ioutil.ReadDir(cachedPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(2))
+		})
+	})
+
 	Describe("RecoverState", func() {
 		BeforeEach(func() {
 			fileContent := []byte("now you see it")
@@ -1184,7 +4240,8 @@ var _ = Describe("File cache", func() {
 			})
 
 			It("does not return an error", func() {
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
 
 				err := cache.RecoverState()
 				Expect(err).NotTo(HaveOccurred())
@@ -1199,7 +4256,8 @@ var _ = Describe("File cache", func() {
 			})
 
 			It("does not return an error", func() {
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
 
 				err := cache.RecoverState()
 				Expect(err).NotTo(HaveOccurred())
@@ -1225,13 +4283,15 @@ var _ = Describe("File cache", func() {
 			})
 
 			It("should remove regular files", func() {
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
 				Expect(cache.RecoverState()).To(Succeed())
 				Expect(extraFile).NotTo(BeAnExistingFile())
 			})
 
 			It("should remove directories", func() {
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				Expect(err).NotTo(HaveOccurred())
 				Expect(cache.RecoverState()).To(Succeed())
 				Expect(extraDir).NotTo(BeADirectory())
 			})
@@ -1278,7 +4338,9 @@ var _ = Describe("File cache", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(files).To(HaveLen(3))
 
-				cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+
+				Expect(err).NotTo(HaveOccurred())
 				Expect(cache.RecoverState()).To(Succeed())
 
 				files, err = ioutil.ReadDir(cachedPath)
@@ -1287,13 +4349,120 @@ var _ = Describe("File cache", func() {
 			})
 		})
 
+		Context("when constructing a persistent cache", func() {
+			var (
+				junkFile, junkDir string
+				lostFile          string
+			)
+
+			BeforeEach(func() {
+				returnedHeader := http.Header{}
+				returnedHeader.Set("ETag", "lost-etag")
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/lost_file"),
+					ghttp.RespondWith(http.StatusOK, "soon gone", returnedHeader),
+				))
+
+				lostURL, err := Url.Parse(server.URL() + "/lost_file")
+				Expect(err).NotTo(HaveOccurred())
+				file, _, err := cache.Fetch(lostURL, "lost-cache-key", checksum, cancelChan)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(file.Close()).To(Succeed())
+				Expect(cache.SaveState()).To(Succeed())
+
+				lostFiles, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash("lost-cache-key")+"*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lostFiles).To(HaveLen(1))
+				lostFile = lostFiles[0]
+				Expect(os.Remove(lostFile)).To(Succeed())
+
+				junkFile = filepath.Join(cachedPath, computeKeyHash("partial")+"-123-1")
+				Expect(ioutil.WriteFile(junkFile, []byte("half an admission"), 0644)).To(Succeed())
+				junkDir = filepath.Join(cachedPath, "junk.d")
+				Expect(os.MkdirAll(junkDir, 0755)).To(Succeed())
+			})
+
+			It("keeps the valid entries and reports what it cleaned up", func() {
+				d, report, err := cacheddownloader.NewPersistent(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+				Expect(err).NotTo(HaveOccurred())
+				cache = d
+
+				Expect(report.Entries).To(Equal(1))
+				Expect(report.DroppedEntries).To(Equal(1))
+				Expect(report.EvictedEntries).To(BeZero())
+				Expect(report.RemovedFiles).To(ContainElement(junkFile))
+				Expect(report.RemovedFiles).To(ContainElement(junkDir))
+
+				Expect(junkFile).NotTo(BeAnExistingFile())
+				Expect(junkDir).NotTo(BeADirectory())
+				Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))).To(HaveLen(1))
+
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusNotModified, nil),
+				))
+				file, downloadSize, err := cache.Fetch(url, cacheKey, checksum, cancelChan)
+				Expect(err).NotTo(HaveOccurred())
+				defer file.Close()
+				Expect(downloadSize).To(BeZero())
+				Expect(ioutil.ReadAll(file)).To(Equal([]byte("now you see it")))
+			})
+
+			Context("when a cached file was truncated", func() {
+				var truncatedFile string
+
+				BeforeEach(func() {
+					files, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(files).To(HaveLen(1))
+					truncatedFile = files[0]
+					Expect(os.Truncate(truncatedFile, 3)).To(Succeed())
+				})
+
+				It("drops the entry and removes the file", func() {
+					d, report, err := cacheddownloader.NewPersistent(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+					Expect(err).NotTo(HaveOccurred())
+					cache = d
+
+					Expect(report.Entries).To(BeZero())
+					Expect(report.DroppedEntries).To(Equal(2))
+					Expect(report.RemovedFiles).To(ContainElement(truncatedFile))
+					Expect(truncatedFile).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when a cached file was truncated to half its size", func() {
+				var truncatedFile string
+
+				BeforeEach(func() {
+					files, err := filepath.Glob(filepath.Join(cachedPath, computeKeyHash(cacheKey)+"*"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(files).To(HaveLen(1))
+					truncatedFile = files[0]
+					Expect(os.Truncate(truncatedFile, int64(len("now you see it")/2))).To(Succeed())
+				})
+
+				It("drops the entry and removes the file", func() {
+					d, report, err := cacheddownloader.NewPersistent(cachedPath, uncachedPath, maxSizeInBytes, cacheddownloader.NewDownloader(time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil), transformer)
+					Expect(err).NotTo(HaveOccurred())
+					cache = d
+
+					Expect(report.Entries).To(BeZero())
+					Expect(report.RemovedFiles).To(ContainElement(truncatedFile))
+					Expect(truncatedFile).NotTo(BeAnExistingFile())
+				})
+			})
+		})
+
 		It("recovers the cache from a saved state file", func() {
 			server.AppendHandlers(ghttp.CombineHandlers(
 				ghttp.VerifyRequest("GET", "/my_file"),
 				ghttp.RespondWith(http.StatusNotModified, nil),
 			))
 
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+
+			Expect(err).NotTo(HaveOccurred())
 
 			err := cache.RecoverState()
 			Expect(err).NotTo(HaveOccurred())
@@ -1331,7 +4500,8 @@ var _ = Describe("File cache", func() {
 			Context("and cacheddownloader restarted", func() {
 				JustBeforeEach(func() {
 					Expect(cache.SaveState()).To(Succeed())
-					cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+					cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, 1*time.Second, MAX_CONCURRENT_DOWNLOADS, false, nil, transformer)
+					Expect(err).NotTo(HaveOccurred())
 					Expect(cache.RecoverState()).To(Succeed())
 				})
 
@@ -1420,7 +4590,9 @@ EUO0ukpTwEIl6wIhAMbGqZK3zAAFdq8DD2jPx+UJXnh0rnOkZBzDtJ6/iN69AiEA
 			url, err = Url.Parse(server.URL() + "/my_file")
 			Expect(err).NotTo(HaveOccurred())
 
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, caCertPool, transformer)
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, MAX_CONCURRENT_DOWNLOADS, false, caCertPool, transformer)
+
+			Expect(err).NotTo(HaveOccurred())
 			_, _, err = cache.Fetch(url, "", checksum, cancelChan)
 			Expect(err).NotTo(HaveOccurred())
 		})
@@ -1436,3 +4608,13 @@ type constTransformer struct {
 func (t constTransformer) ConstTransform(path string) (string, int64, error) {
 	return t.file, t.size, t.err
 }
+
+// failingCloser reads from Reader and fails when it is closed
+type failingCloser struct {
+	io.Reader
+	err error
+}
+
+func (c failingCloser) Close() error {
+	return c.err
+}
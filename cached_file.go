@@ -24,6 +24,16 @@ func NewFileCloser(file *os.File, onClose func(string)) *CachedFile {
 	return fc
 }
 
+// afterClose registers an additional callback that is run once the file has
+// been closed
+func (fw *CachedFile) afterClose(callback func()) {
+	onClose := fw.onClose
+	fw.onClose = func(path string) {
+		onClose(path)
+		callback()
+	}
+}
+
 func (fw *CachedFile) Close() error {
 	err := fw.File.Close()
 	if err != nil {
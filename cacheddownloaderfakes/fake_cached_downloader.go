@@ -2,6 +2,7 @@
 package cacheddownloaderfakes
 
 import (
+	"context"
 	"io"
 	"net/url"
 	"sync"
@@ -36,6 +37,100 @@ type FakeCachedDownloader struct {
 		result2 int64
 		result3 error
 	}
+	FetchWithContextStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType) (stream io.ReadCloser, size int64, err error)
+	fetchWithContextMutex       sync.RWMutex
+	fetchWithContextArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+	}
+	fetchWithContextReturns struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 error
+	}
+	FetchAsDirectoryWithContextStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType) (dirPath string, size int64, err error)
+	fetchAsDirectoryWithContextMutex       sync.RWMutex
+	fetchAsDirectoryWithContextArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+	}
+	fetchAsDirectoryWithContextReturns struct {
+		result1 string
+		result2 int64
+		result3 error
+	}
+	FetchWithOptionsStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (stream io.ReadCloser, size int64, err error)
+	fetchWithOptionsMutex       sync.RWMutex
+	fetchWithOptionsArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}
+	fetchWithOptionsReturns struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 error
+	}
+	FetchAsDirectoryWithOptionsStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (dirPath string, size int64, err error)
+	fetchAsDirectoryWithOptionsMutex       sync.RWMutex
+	fetchAsDirectoryWithOptionsArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}
+	fetchAsDirectoryWithOptionsReturns struct {
+		result1 string
+		result2 int64
+		result3 error
+	}
+	FetchAsDirectoryWithInfoStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (info cacheddownloader.DirectoryInfo, err error)
+	fetchAsDirectoryWithInfoMutex       sync.RWMutex
+	fetchAsDirectoryWithInfoArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}
+	fetchAsDirectoryWithInfoReturns struct {
+		result1 cacheddownloader.DirectoryInfo
+		result2 error
+	}
+	FetchDirectoryStub        func(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (dir cacheddownloader.Directory, err error)
+	fetchDirectoryMutex       sync.RWMutex
+	fetchDirectoryArgsForCall []struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}
+	fetchDirectoryReturns struct {
+		result1 cacheddownloader.Directory
+		result2 error
+	}
+	FetchIfModifiedStub        func(ctx context.Context, urlToFetch *url.URL, cachingInfo cacheddownloader.CachingInfoType, checksum cacheddownloader.ChecksumInfoType) (stream io.ReadCloser, size int64, newCachingInfo cacheddownloader.CachingInfoType, err error)
+	fetchIfModifiedMutex       sync.RWMutex
+	fetchIfModifiedArgsForCall []struct {
+		ctx         context.Context
+		urlToFetch  *url.URL
+		cachingInfo cacheddownloader.CachingInfoType
+		checksum    cacheddownloader.ChecksumInfoType
+	}
+	fetchIfModifiedReturns struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 cacheddownloader.CachingInfoType
+		result4 error
+	}
 	CloseDirectoryStub        func(cacheKey, directoryPath string) error
 	closeDirectoryMutex       sync.RWMutex
 	closeDirectoryArgsForCall []struct {
@@ -45,6 +140,33 @@ type FakeCachedDownloader struct {
 	closeDirectoryReturns struct {
 		result1 error
 	}
+	CancelAllStub        func()
+	cancelAllMutex       sync.RWMutex
+	cancelAllArgsForCall []struct{}
+	ShutdownStub         func(ctx context.Context) error
+	shutdownMutex        sync.RWMutex
+	shutdownArgsForCall  []struct {
+		ctx context.Context
+	}
+	shutdownReturns struct {
+		result1 error
+	}
+	RemoveStub        func(cacheKey string)
+	removeMutex       sync.RWMutex
+	removeArgsForCall []struct {
+		cacheKey string
+	}
+	RemoveByPrefixStub        func(prefix string) int
+	removeByPrefixMutex       sync.RWMutex
+	removeByPrefixArgsForCall []struct {
+		prefix string
+	}
+	removeByPrefixReturns struct {
+		result1 int
+	}
+	ClearStub            func()
+	clearMutex           sync.RWMutex
+	clearArgsForCall     []struct{}
 	SaveStateStub        func() error
 	saveStateMutex       sync.RWMutex
 	saveStateArgsForCall []struct{}
@@ -137,6 +259,275 @@ func (fake *FakeCachedDownloader) FetchAsDirectoryReturns(result1 string, result
 	}{result1, result2, result3}
 }
 
+func (fake *FakeCachedDownloader) FetchWithContext(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType) (stream io.ReadCloser, size int64, err error) {
+	fake.fetchWithContextMutex.Lock()
+	fake.fetchWithContextArgsForCall = append(fake.fetchWithContextArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+	}{ctx, urlToFetch, cacheKey, checksum})
+	fake.recordInvocation("FetchWithContext", []interface{}{ctx, urlToFetch, cacheKey, checksum})
+	fake.fetchWithContextMutex.Unlock()
+	if fake.FetchWithContextStub != nil {
+		return fake.FetchWithContextStub(ctx, urlToFetch, cacheKey, checksum)
+	} else {
+		return fake.fetchWithContextReturns.result1, fake.fetchWithContextReturns.result2, fake.fetchWithContextReturns.result3
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchWithContextCallCount() int {
+	fake.fetchWithContextMutex.RLock()
+	defer fake.fetchWithContextMutex.RUnlock()
+	return len(fake.fetchWithContextArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchWithContextArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType) {
+	fake.fetchWithContextMutex.RLock()
+	defer fake.fetchWithContextMutex.RUnlock()
+	return fake.fetchWithContextArgsForCall[i].ctx, fake.fetchWithContextArgsForCall[i].urlToFetch, fake.fetchWithContextArgsForCall[i].cacheKey, fake.fetchWithContextArgsForCall[i].checksum
+}
+
+func (fake *FakeCachedDownloader) FetchWithContextReturns(result1 io.ReadCloser, result2 int64, result3 error) {
+	fake.FetchWithContextStub = nil
+	fake.fetchWithContextReturns = struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithContext(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType) (dirPath string, size int64, err error) {
+	fake.fetchAsDirectoryWithContextMutex.Lock()
+	fake.fetchAsDirectoryWithContextArgsForCall = append(fake.fetchAsDirectoryWithContextArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+	}{ctx, urlToFetch, cacheKey, checksum})
+	fake.recordInvocation("FetchAsDirectoryWithContext", []interface{}{ctx, urlToFetch, cacheKey, checksum})
+	fake.fetchAsDirectoryWithContextMutex.Unlock()
+	if fake.FetchAsDirectoryWithContextStub != nil {
+		return fake.FetchAsDirectoryWithContextStub(ctx, urlToFetch, cacheKey, checksum)
+	} else {
+		return fake.fetchAsDirectoryWithContextReturns.result1, fake.fetchAsDirectoryWithContextReturns.result2, fake.fetchAsDirectoryWithContextReturns.result3
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithContextCallCount() int {
+	fake.fetchAsDirectoryWithContextMutex.RLock()
+	defer fake.fetchAsDirectoryWithContextMutex.RUnlock()
+	return len(fake.fetchAsDirectoryWithContextArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithContextArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType) {
+	fake.fetchAsDirectoryWithContextMutex.RLock()
+	defer fake.fetchAsDirectoryWithContextMutex.RUnlock()
+	return fake.fetchAsDirectoryWithContextArgsForCall[i].ctx, fake.fetchAsDirectoryWithContextArgsForCall[i].urlToFetch, fake.fetchAsDirectoryWithContextArgsForCall[i].cacheKey, fake.fetchAsDirectoryWithContextArgsForCall[i].checksum
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithContextReturns(result1 string, result2 int64, result3 error) {
+	fake.FetchAsDirectoryWithContextStub = nil
+	fake.fetchAsDirectoryWithContextReturns = struct {
+		result1 string
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeCachedDownloader) FetchWithOptions(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (stream io.ReadCloser, size int64, err error) {
+	fake.fetchWithOptionsMutex.Lock()
+	fake.fetchWithOptionsArgsForCall = append(fake.fetchWithOptionsArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.recordInvocation("FetchWithOptions", []interface{}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.fetchWithOptionsMutex.Unlock()
+	if fake.FetchWithOptionsStub != nil {
+		return fake.FetchWithOptionsStub(ctx, urlToFetch, cacheKey, checksum, options)
+	} else {
+		return fake.fetchWithOptionsReturns.result1, fake.fetchWithOptionsReturns.result2, fake.fetchWithOptionsReturns.result3
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchWithOptionsCallCount() int {
+	fake.fetchWithOptionsMutex.RLock()
+	defer fake.fetchWithOptionsMutex.RUnlock()
+	return len(fake.fetchWithOptionsArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchWithOptionsArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType, cacheddownloader.FetchOptions) {
+	fake.fetchWithOptionsMutex.RLock()
+	defer fake.fetchWithOptionsMutex.RUnlock()
+	return fake.fetchWithOptionsArgsForCall[i].ctx, fake.fetchWithOptionsArgsForCall[i].urlToFetch, fake.fetchWithOptionsArgsForCall[i].cacheKey, fake.fetchWithOptionsArgsForCall[i].checksum, fake.fetchWithOptionsArgsForCall[i].options
+}
+
+func (fake *FakeCachedDownloader) FetchWithOptionsReturns(result1 io.ReadCloser, result2 int64, result3 error) {
+	fake.FetchWithOptionsStub = nil
+	fake.fetchWithOptionsReturns = struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithOptions(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (dirPath string, size int64, err error) {
+	fake.fetchAsDirectoryWithOptionsMutex.Lock()
+	fake.fetchAsDirectoryWithOptionsArgsForCall = append(fake.fetchAsDirectoryWithOptionsArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.recordInvocation("FetchAsDirectoryWithOptions", []interface{}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.fetchAsDirectoryWithOptionsMutex.Unlock()
+	if fake.FetchAsDirectoryWithOptionsStub != nil {
+		return fake.FetchAsDirectoryWithOptionsStub(ctx, urlToFetch, cacheKey, checksum, options)
+	} else {
+		return fake.fetchAsDirectoryWithOptionsReturns.result1, fake.fetchAsDirectoryWithOptionsReturns.result2, fake.fetchAsDirectoryWithOptionsReturns.result3
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithOptionsCallCount() int {
+	fake.fetchAsDirectoryWithOptionsMutex.RLock()
+	defer fake.fetchAsDirectoryWithOptionsMutex.RUnlock()
+	return len(fake.fetchAsDirectoryWithOptionsArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithOptionsArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType, cacheddownloader.FetchOptions) {
+	fake.fetchAsDirectoryWithOptionsMutex.RLock()
+	defer fake.fetchAsDirectoryWithOptionsMutex.RUnlock()
+	return fake.fetchAsDirectoryWithOptionsArgsForCall[i].ctx, fake.fetchAsDirectoryWithOptionsArgsForCall[i].urlToFetch, fake.fetchAsDirectoryWithOptionsArgsForCall[i].cacheKey, fake.fetchAsDirectoryWithOptionsArgsForCall[i].checksum, fake.fetchAsDirectoryWithOptionsArgsForCall[i].options
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithOptionsReturns(result1 string, result2 int64, result3 error) {
+	fake.FetchAsDirectoryWithOptionsStub = nil
+	fake.fetchAsDirectoryWithOptionsReturns = struct {
+		result1 string
+		result2 int64
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithInfo(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (info cacheddownloader.DirectoryInfo, err error) {
+	fake.fetchAsDirectoryWithInfoMutex.Lock()
+	fake.fetchAsDirectoryWithInfoArgsForCall = append(fake.fetchAsDirectoryWithInfoArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.recordInvocation("FetchAsDirectoryWithInfo", []interface{}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.fetchAsDirectoryWithInfoMutex.Unlock()
+	if fake.FetchAsDirectoryWithInfoStub != nil {
+		return fake.FetchAsDirectoryWithInfoStub(ctx, urlToFetch, cacheKey, checksum, options)
+	} else {
+		return fake.fetchAsDirectoryWithInfoReturns.result1, fake.fetchAsDirectoryWithInfoReturns.result2
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithInfoCallCount() int {
+	fake.fetchAsDirectoryWithInfoMutex.RLock()
+	defer fake.fetchAsDirectoryWithInfoMutex.RUnlock()
+	return len(fake.fetchAsDirectoryWithInfoArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithInfoArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType, cacheddownloader.FetchOptions) {
+	fake.fetchAsDirectoryWithInfoMutex.RLock()
+	defer fake.fetchAsDirectoryWithInfoMutex.RUnlock()
+	return fake.fetchAsDirectoryWithInfoArgsForCall[i].ctx, fake.fetchAsDirectoryWithInfoArgsForCall[i].urlToFetch, fake.fetchAsDirectoryWithInfoArgsForCall[i].cacheKey, fake.fetchAsDirectoryWithInfoArgsForCall[i].checksum, fake.fetchAsDirectoryWithInfoArgsForCall[i].options
+}
+
+func (fake *FakeCachedDownloader) FetchAsDirectoryWithInfoReturns(result1 cacheddownloader.DirectoryInfo, result2 error) {
+	fake.FetchAsDirectoryWithInfoStub = nil
+	fake.fetchAsDirectoryWithInfoReturns = struct {
+		result1 cacheddownloader.DirectoryInfo
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeCachedDownloader) FetchDirectory(ctx context.Context, urlToFetch *url.URL, cacheKey string, checksum cacheddownloader.ChecksumInfoType, options cacheddownloader.FetchOptions) (dir cacheddownloader.Directory, err error) {
+	fake.fetchDirectoryMutex.Lock()
+	fake.fetchDirectoryArgsForCall = append(fake.fetchDirectoryArgsForCall, struct {
+		ctx        context.Context
+		urlToFetch *url.URL
+		cacheKey   string
+		checksum   cacheddownloader.ChecksumInfoType
+		options    cacheddownloader.FetchOptions
+	}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.recordInvocation("FetchDirectory", []interface{}{ctx, urlToFetch, cacheKey, checksum, options})
+	fake.fetchDirectoryMutex.Unlock()
+	if fake.FetchDirectoryStub != nil {
+		return fake.FetchDirectoryStub(ctx, urlToFetch, cacheKey, checksum, options)
+	} else {
+		return fake.fetchDirectoryReturns.result1, fake.fetchDirectoryReturns.result2
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchDirectoryCallCount() int {
+	fake.fetchDirectoryMutex.RLock()
+	defer fake.fetchDirectoryMutex.RUnlock()
+	return len(fake.fetchDirectoryArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchDirectoryArgsForCall(i int) (context.Context, *url.URL, string, cacheddownloader.ChecksumInfoType, cacheddownloader.FetchOptions) {
+	fake.fetchDirectoryMutex.RLock()
+	defer fake.fetchDirectoryMutex.RUnlock()
+	return fake.fetchDirectoryArgsForCall[i].ctx, fake.fetchDirectoryArgsForCall[i].urlToFetch, fake.fetchDirectoryArgsForCall[i].cacheKey, fake.fetchDirectoryArgsForCall[i].checksum, fake.fetchDirectoryArgsForCall[i].options
+}
+
+func (fake *FakeCachedDownloader) FetchDirectoryReturns(result1 cacheddownloader.Directory, result2 error) {
+	fake.FetchDirectoryStub = nil
+	fake.fetchDirectoryReturns = struct {
+		result1 cacheddownloader.Directory
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeCachedDownloader) FetchIfModified(ctx context.Context, urlToFetch *url.URL, cachingInfo cacheddownloader.CachingInfoType, checksum cacheddownloader.ChecksumInfoType) (stream io.ReadCloser, size int64, newCachingInfo cacheddownloader.CachingInfoType, err error) {
+	fake.fetchIfModifiedMutex.Lock()
+	fake.fetchIfModifiedArgsForCall = append(fake.fetchIfModifiedArgsForCall, struct {
+		ctx         context.Context
+		urlToFetch  *url.URL
+		cachingInfo cacheddownloader.CachingInfoType
+		checksum    cacheddownloader.ChecksumInfoType
+	}{ctx, urlToFetch, cachingInfo, checksum})
+	fake.recordInvocation("FetchIfModified", []interface{}{ctx, urlToFetch, cachingInfo, checksum})
+	fake.fetchIfModifiedMutex.Unlock()
+	if fake.FetchIfModifiedStub != nil {
+		return fake.FetchIfModifiedStub(ctx, urlToFetch, cachingInfo, checksum)
+	} else {
+		return fake.fetchIfModifiedReturns.result1, fake.fetchIfModifiedReturns.result2, fake.fetchIfModifiedReturns.result3, fake.fetchIfModifiedReturns.result4
+	}
+}
+
+func (fake *FakeCachedDownloader) FetchIfModifiedCallCount() int {
+	fake.fetchIfModifiedMutex.RLock()
+	defer fake.fetchIfModifiedMutex.RUnlock()
+	return len(fake.fetchIfModifiedArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) FetchIfModifiedArgsForCall(i int) (context.Context, *url.URL, cacheddownloader.CachingInfoType, cacheddownloader.ChecksumInfoType) {
+	fake.fetchIfModifiedMutex.RLock()
+	defer fake.fetchIfModifiedMutex.RUnlock()
+	return fake.fetchIfModifiedArgsForCall[i].ctx, fake.fetchIfModifiedArgsForCall[i].urlToFetch, fake.fetchIfModifiedArgsForCall[i].cachingInfo, fake.fetchIfModifiedArgsForCall[i].checksum
+}
+
+func (fake *FakeCachedDownloader) FetchIfModifiedReturns(result1 io.ReadCloser, result2 int64, result3 cacheddownloader.CachingInfoType, result4 error) {
+	fake.FetchIfModifiedStub = nil
+	fake.fetchIfModifiedReturns = struct {
+		result1 io.ReadCloser
+		result2 int64
+		result3 cacheddownloader.CachingInfoType
+		result4 error
+	}{result1, result2, result3, result4}
+}
+
 func (fake *FakeCachedDownloader) CloseDirectory(cacheKey string, directoryPath string) error {
 	fake.closeDirectoryMutex.Lock()
 	fake.closeDirectoryArgsForCall = append(fake.closeDirectoryArgsForCall, struct {
@@ -171,6 +562,134 @@ func (fake *FakeCachedDownloader) CloseDirectoryReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeCachedDownloader) CancelAll() {
+	fake.cancelAllMutex.Lock()
+	fake.cancelAllArgsForCall = append(fake.cancelAllArgsForCall, struct{}{})
+	fake.recordInvocation("CancelAll", []interface{}{})
+	fake.cancelAllMutex.Unlock()
+	if fake.CancelAllStub != nil {
+		fake.CancelAllStub()
+	}
+}
+
+func (fake *FakeCachedDownloader) CancelAllCallCount() int {
+	fake.cancelAllMutex.RLock()
+	defer fake.cancelAllMutex.RUnlock()
+	return len(fake.cancelAllArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) Shutdown(ctx context.Context) error {
+	fake.shutdownMutex.Lock()
+	fake.shutdownArgsForCall = append(fake.shutdownArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.recordInvocation("Shutdown", []interface{}{ctx})
+	fake.shutdownMutex.Unlock()
+	if fake.ShutdownStub != nil {
+		return fake.ShutdownStub(ctx)
+	} else {
+		return fake.shutdownReturns.result1
+	}
+}
+
+func (fake *FakeCachedDownloader) ShutdownCallCount() int {
+	fake.shutdownMutex.RLock()
+	defer fake.shutdownMutex.RUnlock()
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	fake.removeByPrefixMutex.RLock()
+	defer fake.removeByPrefixMutex.RUnlock()
+	fake.clearMutex.RLock()
+	defer fake.clearMutex.RUnlock()
+	return len(fake.shutdownArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) ShutdownArgsForCall(i int) context.Context {
+	fake.shutdownMutex.RLock()
+	defer fake.shutdownMutex.RUnlock()
+	return fake.shutdownArgsForCall[i].ctx
+}
+
+func (fake *FakeCachedDownloader) ShutdownReturns(result1 error) {
+	fake.ShutdownStub = nil
+	fake.shutdownReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeCachedDownloader) Remove(cacheKey string) {
+	fake.removeMutex.Lock()
+	fake.removeArgsForCall = append(fake.removeArgsForCall, struct {
+		cacheKey string
+	}{cacheKey})
+	fake.recordInvocation("Remove", []interface{}{cacheKey})
+	fake.removeMutex.Unlock()
+	if fake.RemoveStub != nil {
+		fake.RemoveStub(cacheKey)
+	}
+}
+
+func (fake *FakeCachedDownloader) RemoveCallCount() int {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return len(fake.removeArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) RemoveArgsForCall(i int) string {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return fake.removeArgsForCall[i].cacheKey
+}
+
+func (fake *FakeCachedDownloader) RemoveByPrefix(prefix string) int {
+	fake.removeByPrefixMutex.Lock()
+	fake.removeByPrefixArgsForCall = append(fake.removeByPrefixArgsForCall, struct {
+		prefix string
+	}{prefix})
+	fake.recordInvocation("RemoveByPrefix", []interface{}{prefix})
+	fake.removeByPrefixMutex.Unlock()
+	if fake.RemoveByPrefixStub != nil {
+		return fake.RemoveByPrefixStub(prefix)
+	} else {
+		return fake.removeByPrefixReturns.result1
+	}
+}
+
+func (fake *FakeCachedDownloader) RemoveByPrefixCallCount() int {
+	fake.removeByPrefixMutex.RLock()
+	defer fake.removeByPrefixMutex.RUnlock()
+	return len(fake.removeByPrefixArgsForCall)
+}
+
+func (fake *FakeCachedDownloader) RemoveByPrefixArgsForCall(i int) string {
+	fake.removeByPrefixMutex.RLock()
+	defer fake.removeByPrefixMutex.RUnlock()
+	return fake.removeByPrefixArgsForCall[i].prefix
+}
+
+func (fake *FakeCachedDownloader) RemoveByPrefixReturns(result1 int) {
+	fake.RemoveByPrefixStub = nil
+	fake.removeByPrefixReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeCachedDownloader) Clear() {
+	fake.clearMutex.Lock()
+	fake.clearArgsForCall = append(fake.clearArgsForCall, struct{}{})
+	fake.recordInvocation("Clear", []interface{}{})
+	fake.clearMutex.Unlock()
+	if fake.ClearStub != nil {
+		fake.ClearStub()
+	}
+}
+
+func (fake *FakeCachedDownloader) ClearCallCount() int {
+	fake.clearMutex.RLock()
+	defer fake.clearMutex.RUnlock()
+	return len(fake.clearArgsForCall)
+}
+
 func (fake *FakeCachedDownloader) SaveState() error {
 	fake.saveStateMutex.Lock()
 	fake.saveStateArgsForCall = append(fake.saveStateArgsForCall, struct{}{})
@@ -228,8 +747,26 @@ func (fake *FakeCachedDownloader) Invocations() map[string][][]interface{} {
 	defer fake.fetchMutex.RUnlock()
 	fake.fetchAsDirectoryMutex.RLock()
 	defer fake.fetchAsDirectoryMutex.RUnlock()
+	fake.fetchWithContextMutex.RLock()
+	defer fake.fetchWithContextMutex.RUnlock()
+	fake.fetchAsDirectoryWithContextMutex.RLock()
+	defer fake.fetchAsDirectoryWithContextMutex.RUnlock()
+	fake.fetchWithOptionsMutex.RLock()
+	defer fake.fetchWithOptionsMutex.RUnlock()
+	fake.fetchAsDirectoryWithOptionsMutex.RLock()
+	defer fake.fetchAsDirectoryWithOptionsMutex.RUnlock()
+	fake.fetchAsDirectoryWithInfoMutex.RLock()
+	defer fake.fetchAsDirectoryWithInfoMutex.RUnlock()
+	fake.fetchDirectoryMutex.RLock()
+	defer fake.fetchDirectoryMutex.RUnlock()
+	fake.fetchIfModifiedMutex.RLock()
+	defer fake.fetchIfModifiedMutex.RUnlock()
 	fake.closeDirectoryMutex.RLock()
 	defer fake.closeDirectoryMutex.RUnlock()
+	fake.cancelAllMutex.RLock()
+	defer fake.cancelAllMutex.RUnlock()
+	fake.shutdownMutex.RLock()
+	defer fake.shutdownMutex.RUnlock()
 	fake.saveStateMutex.RLock()
 	defer fake.saveStateMutex.RUnlock()
 	fake.recoverStateMutex.RLock()
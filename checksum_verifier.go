@@ -0,0 +1,53 @@
+package cacheddownloader
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"net/http"
+)
+
+// ChecksumVerifier verifies downloads in a way of its own, e.g. against a
+// digest header of an internal blobstore, or with an algorithm this package
+// does not know.
+type ChecksumVerifier interface {
+	// NewHash returns the hash to compute over the downloaded bytes, after
+	// any Content-Encoding has been decoded.
+	NewHash() hash.Hash
+
+	// Expected returns the sum that the hash of the download must match,
+	// given the response and the checksum that was given to the download,
+	// which may be empty. It returns false if the verifier does not apply to
+	// the download.
+	Expected(resp *http.Response, info ChecksumInfoType) ([]byte, bool)
+}
+
+// SetChecksumVerifiers sets verifiers that are consulted in order for every
+// HTTP download, before the checksum given to the download and the hashes
+// and ETags reported by the origin. The first verifier that applies verifies
+// the download in place of all of them. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetChecksumVerifiers(verifiers ...ChecksumVerifier) {
+	downloader.checksumVerifiers = verifiers
+}
+
+// customChecksum returns a validator for the first checksum verifier that
+// applies to the download, and the sum it must match
+func (downloader *Downloader) customChecksum(resp *http.Response, info ChecksumInfoType) (*hashValidator, []byte) {
+	for _, verifier := range downloader.checksumVerifiers {
+		expected, ok := verifier.Expected(resp, info)
+		if ok {
+			return &hashValidator{algorithm: fmt.Sprintf("%T", verifier), hash: verifier.NewHash()}, expected
+		}
+	}
+	return nil, nil
+}
+
+// validateSum compares the hash with a sum given by a ChecksumVerifier
+func (v hashValidator) validateSum(expected []byte) error {
+	actual := v.hash.Sum(nil)
+	if !bytes.Equal(expected, actual) {
+		return NewChecksumFailedError("checksum mismatch", fmt.Sprintf(`"%x"`, expected), fmt.Sprintf(`"%x"`, actual))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cacheddownloader
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// SetClientCertificate makes the Downloader present the given certificate to
+// origins that require mutual TLS. It should be called before any downloads
+// are started.
+func (downloader *Downloader) SetClientCertificate(cert tls.Certificate) {
+	config := downloader.tlsConfig()
+	config.Certificates = []tls.Certificate{cert}
+	config.GetClientCertificate = nil
+}
+
+// SetClientCertificateFiles behaves like SetClientCertificate, but loads the
+// PEM encoded certificate and key from the given files. The files are loaded
+// again whenever either of them has changed before a new connection is made,
+// so that rotated certificates are picked up; if the rotated files cannot be
+// loaded, the previous certificate keeps being used. It returns an error if
+// the files cannot be loaded initially.
+func (downloader *Downloader) SetClientCertificateFiles(certFile, keyFile string) error {
+	loader := &certificateLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		lock:     &sync.Mutex{},
+	}
+
+	_, err := loader.certificate()
+	if err != nil {
+		return err
+	}
+
+	config := downloader.tlsConfig()
+	config.Certificates = nil
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return loader.certificate()
+	}
+	return nil
+}
+
+// certificateLoader keeps a certificate loaded from files up to date with
+// their contents
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	lock        *sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func (l *certificateLoader) certificate() (*tls.Certificate, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	certModTime, keyModTime, err := l.modTimes()
+	if err == nil && l.cert != nil && certModTime.Equal(l.certModTime) && keyModTime.Equal(l.keyModTime) {
+		return l.cert, nil
+	}
+
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	}
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, err
+	}
+
+	l.cert = &cert
+	l.certModTime = certModTime
+	l.keyModTime = keyModTime
+	return l.cert, nil
+}
+
+func (l *certificateLoader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(l.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(l.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
@@ -0,0 +1,152 @@
+package cacheddownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CloneDirectory makes a clone of the directory at directoryPath, typically
+// one returned by a fetch, for a single consumer to use, e.g. as the root
+// filesystem of a container, so that consumers cannot see each other's
+// changes. The clone is made in the uncached path and is removed once its
+// handle is closed; the directory it was cloned from can be released right
+// away.
+//
+// Files are cloned with reflinks where the file system supports them, as btrfs
+// and xfs do, and otherwise with hardlinks, which makes cloning cheap either
+// way. Files that are hardlinked are shared with the cached directory though:
+// adding, removing and replacing files in the clone is safe, but writing to
+// them in place is not.
+func (c *cachedDownloader) CloneDirectory(directoryPath string) (Directory, error) {
+	err := c.acquireHandle()
+	if err != nil {
+		return nil, err
+	}
+
+	clonePath, err := ioutil.TempDir(c.uncachedPath, "clone")
+	if err == nil {
+		err = cloneTree(directoryPath, clonePath)
+		if err != nil {
+			removeAll(clonePath)
+		}
+	}
+	if err != nil {
+		c.releaseHandle()
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.uncachedDirectories[clonePath] = struct{}{}
+	c.lock.Unlock()
+
+	info := DirectoryInfo{Path: clonePath}
+	info.FileCount, info.SizeInBytes = countFiles(clonePath)
+	handle := &directoryHandle{info: info, release: c.CloseDirectory}
+	runtime.SetFinalizer(handle, c.directoryLeaked)
+	return handle, nil
+}
+
+// cloneTree clones the tree at source into the existing directory destination
+func cloneTree(source, destination string) error {
+	reflinks := true
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relativePath)
+
+		switch {
+		case path == source:
+			return os.Chmod(destination, info.Mode())
+
+		case info.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode())
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return symlink(destination, link, target)
+
+		case info.Mode().IsRegular() && reflinks:
+			err = reflinkFile(path, target, info.Mode())
+			if err == nil {
+				return nil
+			}
+			// the file system does not support them; do not try again
+			os.Remove(target)
+			reflinks = false
+		}
+
+		err = os.Link(path, target)
+		if err != nil && info.Mode().IsRegular() {
+			// e.g. since the uncached path is on another device
+			return copyFile(path, target, info.Mode())
+		}
+		return err
+	})
+}
+
+// reflinkFile clones the file at source to a new file at target that shares
+// its content until either is written to
+func reflinkFile(source, target string, mode os.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	err = reflink(targetFile, sourceFile)
+	if closeErr := targetFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	_, err = writeExtractedFile(target, sourceFile, mode)
+	return err
+}
+
+// countFiles returns the number and total size of the regular files in the
+// tree at root
+func countFiles(root string) (int, int64) {
+	var fileCount int
+	var sizeInBytes int64
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			fileCount++
+			sizeInBytes += info.Size()
+		}
+		return nil
+	})
+	return fileCount, sizeInBytes
+}
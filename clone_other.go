@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package cacheddownloader
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(destination, source *os.File) error {
+	return errors.New("reflinks are not supported")
+}
@@ -0,0 +1,126 @@
+package cacheddownloader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the files stored in the cache, see SetCompression.
+// Compressors for other formats can be plugged in by wrapping their encoders
+// and decoders.
+type Compressor interface {
+	// Compress returns a writer that compresses what is written to it into
+	// w; closing it flushes the compressed stream but does not close w.
+	Compress(w io.Writer) (io.WriteCloser, error)
+	// Decompress returns a reader of the content compressed in r.
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+// SetCompression makes the cachedDownloader compress the files it adds to the
+// cache, trading CPU for capacity. Fetches served from the cache get a
+// decompressed copy in the uncached path, which is removed once closed, and
+// directories are expanded from compressed entries as before. The size of an
+// entry, and thereby the cache size, quotas and the free space reserve, is
+// that of the compressed file. Files are compressed before they are
+// encrypted, see SetEncryption. It should be called before any fetches are
+// started.
+func (c *cachedDownloader) SetCompression(compressor Compressor) {
+	c.cache.atRest.compressor = compressor
+}
+
+// NewGzipCompressor returns a Compressor that uses gzip with the given
+// compression level, e.g. gzip.BestSpeed.
+func NewGzipCompressor(level int) (Compressor, error) {
+	_, err := gzip.NewWriterLevel(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return gzipCompressor{level: level}, nil
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (g gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, g.level)
+}
+
+func (g gzipCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// NewZstdCompressor returns a Compressor that uses zstd with the given
+// compression level from 1 to 22; levels are mapped to the nearest speed of
+// the Go implementation.
+func NewZstdCompressor(level int) (Compressor, error) {
+	if level < 1 || level > 22 {
+		return nil, fmt.Errorf("zstd: invalid compression level: %d", level)
+	}
+	return zstdCompressor{level: zstd.EncoderLevelFromZstd(level)}, nil
+}
+
+type zstdCompressor struct {
+	level zstd.EncoderLevel
+}
+
+func (z zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(z.level))
+}
+
+func (z zstdCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// Compressed files start with compressedMagic, so that they are not mistaken
+// for files that are stored as they are
+const compressedMagic = "\x00cdlcomp"
+
+// compressingReader compresses source as it is read
+func compressingReader(compressor Compressor, source io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := io.WriteString(writer, compressedMagic)
+		if err == nil {
+			err = compressTo(compressor, source, writer)
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+func compressTo(compressor Compressor, source io.Reader, destination io.Writer) error {
+	compressed, err := compressor.Compress(destination)
+	if err != nil {
+		return err
+	}
+
+	_, err = copyBuffered(compressed, source)
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompressingReader decompresses source, which starts with compressedMagic;
+// closing it also closes closer
+func decompressingReader(compressor Compressor, source io.Reader, closer io.Closer) (io.ReadCloser, error) {
+	_, err := io.CopyN(ioutil.Discard, source, int64(len(compressedMagic)))
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := compressor.Decompress(source)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{Reader: decompressed, Closer: closers{decompressed, closer}}, nil
+}
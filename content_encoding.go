@@ -0,0 +1,54 @@
+package cacheddownloader
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// SetRequestGzip controls whether downloads ask the origin to gzip the
+// response, which is the default. A gzipped response is decompressed while it
+// is copied to disk, so that the file, the maximum download size and the
+// checksum all apply to the decoded bytes, while BytesDownloaded counts the
+// bytes received. Resumed and segmented downloads always use the identity
+// encoding, since byte ranges of a gzipped response cannot be decoded on
+// their own. It should be called before any downloads are started.
+func (downloader *Downloader) SetRequestGzip(enabled bool) {
+	downloader.requestGzip = enabled
+}
+
+// gzipped reports whether resp carries a gzipped body in response to a request
+// that asked for one
+func gzipped(req *http.Request, resp *http.Response) bool {
+	return req.Header.Get("Accept-Encoding") == "gzip" &&
+		strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+}
+
+// gunzipReader decompresses a gzipped body and counts the compressed bytes it
+// has read. The gzip header is only read on the first Read, so that a body
+// that is not valid gzip fails like any other broken body.
+type gunzipReader struct {
+	compressed countingReader
+	gzip       *gzip.Reader
+}
+
+func newGunzipReader(body io.Reader) *gunzipReader {
+	return &gunzipReader{compressed: countingReader{reader: body}}
+}
+
+func (r *gunzipReader) Read(p []byte) (int, error) {
+	if r.gzip == nil {
+		gz, err := gzip.NewReader(&r.compressed)
+		if err != nil {
+			return 0, err
+		}
+		r.gzip = gz
+	}
+	return r.gzip.Read(p)
+}
+
+func (r *gunzipReader) compressedBytes() int64 {
+	return atomic.LoadInt64(&r.compressed.read)
+}
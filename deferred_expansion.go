@@ -0,0 +1,81 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net/url"
+	"os"
+)
+
+// fetchDeferredDirectory caches the tarball of a directory fetch without
+// expanding it, see FetchOptions.DeferExpansion
+func (c *cachedDownloader) fetchDeferredDirectory(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (DirectoryInfo, error) {
+	rateLimiter, err := c.acquireLimiter(ctx, cacheKey)
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+	defer c.releaseLimiter(cacheKey, rateLimiter)
+
+	c.cache.removeCollision(cacheKey, options.cacheKey, options.Namespace)
+
+	// the entry is still within its TTL; no need to ask the origin
+	currentCachingInfo, cached := c.cache.cachingInfo(cacheKey)
+	if cached && c.cache.IsFresh(cacheKey) {
+		c.recordHit(0, false)
+		return DirectoryInfo{FromCache: true}, nil
+	}
+
+	// download (short circuits if endpoint respects etag/etc.)
+	options.admissionKey = cacheKey
+	download, cacheIsWarm, size, err := c.populateCache(ctx, url, cacheKey, currentCachingInfo, checksum, []ContextCacheTransformer{directoryTransform}, options)
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+
+	// nothing had to be downloaded; the cached tarball is current
+	if cacheIsWarm {
+		c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+		c.recordHit(0, true)
+		return DirectoryInfo{FromCache: true}, nil
+	}
+
+	c.recordMiss()
+
+	_, _, maxSizeInBytes := c.cache.Usage()
+	if !c.isCacheable(url, download) || download.size > maxSizeInBytes || !c.admitsEntry(options, download.size) {
+		// there is nowhere to keep the tarball until it is expanded
+		c.cache.removeAs(cacheKey, EntryExpired)
+		os.Remove(download.path)
+		return DirectoryInfo{DownloadedSize: size}, nil
+	}
+
+	err = c.ensureFreeSpace(download.size)
+	if err != nil {
+		os.Remove(download.path)
+		return DirectoryInfo{}, err
+	}
+
+	c.makeNamespaceRoom(cacheKey, options, download.size)
+	err = c.cache.AddArchive(cacheKey, download.path, download.size, download.cachingInfo)
+	if err != nil {
+		return DirectoryInfo{}, err
+	}
+
+	c.cache.MarkValidated(cacheKey, c.ttl(options, download.cachingInfo))
+	c.cache.setOrigin(cacheKey, options.cacheKey, options.Namespace, options.Labels)
+	c.cache.recordAdded(cacheKey)
+	c.cache.writeSidecar(cacheKey)
+	return DirectoryInfo{DownloadedSize: size}, nil
+}
+
+// cachingInfo returns the caching info of the entry for cacheKey, if there is
+// one, without using it
+func (c *FileCache) cachingInfo(cacheKey string) (CachingInfoType, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return CachingInfoType{}, false
+	}
+	return entry.CachingInfo, true
+}
@@ -0,0 +1,96 @@
+package cacheddownloader
+
+import (
+	"bufio"
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// e.g. "SHA256 (file.tgz) = 0123..." as written by BSD tools and --tag
+	bsdChecksumLine = regexp.MustCompile(`^(MD5|SHA1|SHA256|SHA512) ?\((.*)\) ?= ?([0-9a-fA-F]+)$`)
+	// e.g. "0123...  file.tgz" or "0123... *file.tgz" as written by coreutils,
+	// or just the checksum
+	gnuChecksumLine = regexp.MustCompile(`^([0-9a-fA-F]+)(?:\s+\*?(.*))?$`)
+)
+
+// detachedChecksum downloads the checksum file at checksumURL and returns the
+// checksum it lists for the artifact at artifactURL
+func (downloader *Downloader) detachedChecksum(
+	ctx context.Context,
+	checksumURL *url.URL,
+	artifactURL *url.URL,
+	createDestination func() (*os.File, error),
+	limiter *bandwidthLimiter,
+) (ChecksumInfoType, error) {
+	content, err := downloader.downloadContent(ctx, checksumURL, createDestination, limiter)
+	if err != nil {
+		return ChecksumInfoType{}, err
+	}
+
+	name := path.Base(artifactURL.Path)
+	checksum, ok := parseChecksumFile(string(content), name)
+	if !ok {
+		return ChecksumInfoType{}, NewChecksumFailedError("checksum file invalid", "a checksum for "+name, checksumURL.String())
+	}
+	return checksum, nil
+}
+
+// parseChecksumFile returns the checksum that content lists for the file
+// name, or its only checksum if it lists a single one. The algorithm of
+// checksums without a tag is told by their length.
+func parseChecksumFile(content, name string) (ChecksumInfoType, bool) {
+	var checksums []ChecksumInfoType
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var checksum ChecksumInfoType
+		var listedName string
+		if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+			checksum = ChecksumInfoType{Algorithm: strings.ToLower(match[1]), Value: strings.ToLower(match[3])}
+			listedName = match[2]
+		} else if match := gnuChecksumLine.FindStringSubmatch(line); match != nil {
+			algorithm, ok := algorithmForLength(len(match[1]))
+			if !ok {
+				continue
+			}
+			checksum = ChecksumInfoType{Algorithm: algorithm, Value: strings.ToLower(match[1])}
+			listedName = match[2]
+		} else {
+			continue
+		}
+
+		if listedName != "" && path.Base(listedName) == name {
+			return checksum, true
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	if len(checksums) == 1 {
+		return checksums[0], true
+	}
+	return ChecksumInfoType{}, false
+}
+
+func algorithmForLength(length int) (string, bool) {
+	switch length {
+	case 32:
+		return "md5", true
+	case 40:
+		return "sha1", true
+	case 64:
+		return "sha256", true
+	case 128:
+		return "sha512", true
+	}
+	return "", false
+}
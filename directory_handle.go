@@ -0,0 +1,75 @@
+package cacheddownloader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// Directory is a handle on an expanded directory, as returned by
+// FetchDirectory. The directory is in use, and cannot be evicted, until the
+// handle is closed.
+type Directory interface {
+	// Path is the expanded directory.
+	Path() string
+	// Info describes the contents of the directory.
+	Info() DirectoryInfo
+	// Close releases the directory; closing it again returns AlreadyClosed.
+	Close() error
+}
+
+type directoryHandle struct {
+	info     DirectoryInfo
+	cacheKey string
+	release  func(cacheKey, directoryPath string) error
+	closed   int32
+}
+
+func (d *directoryHandle) Path() string {
+	return d.info.Path
+}
+
+func (d *directoryHandle) Info() DirectoryInfo {
+	return d.info
+}
+
+func (d *directoryHandle) Close() error {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return AlreadyClosed
+	}
+
+	runtime.SetFinalizer(d, nil)
+	return d.release(d.cacheKey, d.info.Path)
+}
+
+func (c *cachedDownloader) FetchDirectory(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (Directory, error) {
+	options.DeferExpansion = false
+	info, err := c.fetchAsDirectory(ctx, url, cacheKey, checksum, options, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &directoryHandle{info: info, cacheKey: cacheKey, release: c.CloseDirectory}
+	runtime.SetFinalizer(handle, c.directoryLeaked)
+	return handle, nil
+}
+
+// SetDirectoryLeakHandler sets the function that is called with directories
+// whose handles, as returned by FetchDirectory, are garbage collected without
+// being closed; the directories are released then. By default such leaks are
+// reported on stderr. It should be called before any fetches are started.
+func (c *cachedDownloader) SetDirectoryLeakHandler(handler func(DirectoryInfo)) {
+	c.directoryLeakHandler = handler
+}
+
+func (c *cachedDownloader) directoryLeaked(d *directoryHandle) {
+	if c.directoryLeakHandler != nil {
+		c.directoryLeakHandler(d.info)
+	} else {
+		fmt.Fprintln(os.Stderr, "Directory handle was not closed", d.info.Path)
+	}
+	d.Close()
+}
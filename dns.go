@@ -0,0 +1,152 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SetResolver makes the Downloader look up hostnames with resolver instead of
+// the system resolver. The addresses are dialed in the order they are
+// returned until one of them connects. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetResolver(resolver Resolver) {
+	downloader.resolver = resolver
+}
+
+// SetDialContext replaces the function that opens the connections of the
+// Downloader. When a resolver or the DNS cache is set, dial is given resolved
+// addresses. The dial timeout still applies. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) {
+	downloader.dial = dial
+}
+
+// SetUnixSocket makes the Downloader open every connection to the Unix domain
+// socket at path, e.g. of a local sidecar in front of the blobstore. The host
+// of the URL is then only used for the Host header, and for TLS. An empty path
+// restores TCP. It should be called before any downloads are started.
+func (downloader *Downloader) SetUnixSocket(path string) {
+	downloader.unixSocket = path
+}
+
+// SetDNSCache caches the addresses that hostnames resolve to for ttl, so that
+// downloads from the same host do not look it up every time. Failed lookups
+// are not cached, and the addresses of a host are forgotten when none of them
+// can be dialed. Zero, the default, disables the cache. It should be called
+// before any downloads are started.
+func (downloader *Downloader) SetDNSCache(ttl time.Duration) {
+	if ttl <= 0 {
+		downloader.dnsCache = nil
+		return
+	}
+	downloader.dnsCache = &dnsCache{ttl: ttl, entries: map[string]dnsCacheEntry{}}
+}
+
+// dialResolved dials the Unix socket if one is set, and else address,
+// resolving its host with the resolver and the DNS cache if either is set
+func (downloader *Downloader) dialResolved(ctx context.Context, network, address string) (net.Conn, error) {
+	baseDial := downloader.dial
+	if baseDial == nil {
+		baseDial = (&net.Dialer{}).DialContext
+	}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if downloader.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, downloader.dialTimeout)
+			defer cancel()
+		}
+		return baseDial(ctx, network, address)
+	}
+
+	if downloader.unixSocket != "" {
+		return dial(ctx, "unix", downloader.unixSocket)
+	}
+
+	if downloader.resolver == nil && downloader.dnsCache == nil {
+		return dial(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(ctx, network, address)
+	}
+
+	resolver := downloader.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	var addrs []string
+	if downloader.dnsCache != nil {
+		addrs, err = downloader.dnsCache.lookup(ctx, resolver, host)
+	} else {
+		addrs, err = resolver.LookupHost(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if downloader.dnsCache != nil {
+		downloader.dnsCache.forget(host)
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return nil, firstErr
+}
+
+type dnsCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func (c *dnsCache) lookup(ctx context.Context, resolver Resolver, host string) ([]string, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[host]
+	c.lock.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.lock.Unlock()
+
+	return addrs, nil
+}
+
+func (c *dnsCache) forget(host string) {
+	c.lock.Lock()
+	delete(c.entries, host)
+	c.lock.Unlock()
+}
@@ -1,16 +1,21 @@
 package cacheddownloader
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/cloudfoundry/systemcerts"
 )
 
@@ -47,22 +52,66 @@ type idleTimeoutConn struct {
 }
 
 func (c *idleTimeoutConn) Read(b []byte) (n int, err error) {
-	if err = c.Conn.SetDeadline(time.Now().Add(c.Timeout)); err != nil {
+	if err = c.extendDeadline(); err != nil {
 		return
 	}
 	return c.Conn.Read(b)
 }
 
 func (c *idleTimeoutConn) Write(b []byte) (n int, err error) {
-	if err = c.Conn.SetDeadline(time.Now().Add(c.Timeout)); err != nil {
+	if err = c.extendDeadline(); err != nil {
 		return
 	}
 	return c.Conn.Write(b)
 }
 
+func (c *idleTimeoutConn) extendDeadline() error {
+	if c.Timeout <= 0 {
+		return nil
+	}
+	return c.Conn.SetDeadline(time.Now().Add(c.Timeout))
+}
+
+// RequestDecorator is invoked with the fetch context before every request
+// attempt (including retries), so that headers derived from the context, such
+// as tracing information, can be attached to the outgoing request.
+type RequestDecorator func(ctx context.Context, req *http.Request)
+
+// CredentialProvider attaches credentials to an outgoing request. It is
+// invoked immediately before every attempt, so that credentials that expire
+// can be refreshed between retries. An error fails the attempt.
+type CredentialProvider interface {
+	Apply(req *http.Request) error
+}
+
 type Downloader struct {
+	bytesDownloaded           int64
 	client                    *http.Client
-	concurrentDownloadBarrier chan struct{}
+	concurrentDownloadBarrier *admission
+	slotQueue                 *queueTracker
+	requestDecorator          RequestDecorator
+	credentialProvider        CredentialProvider
+	segments                  int
+	minSegmentedSize          int64
+	bandwidthLimiter          *bandwidthLimiter
+	retryPolicy               RetryPolicy
+	maxDownloadSize           int64
+	headPreflight             bool
+	minBytesPerSecond         int64
+	stallWindow               time.Duration
+	s3                        *s3Backend
+	gcs                       *gcsBackend
+	schemeHandlers            map[string]SchemeHandler
+	idleTimeout               time.Duration
+	dialTimeout               time.Duration
+	resolver                  Resolver
+	dial                      func(ctx context.Context, network, address string) (net.Conn, error)
+	dnsCache                  *dnsCache
+	unixSocket                string
+	requestGzip               bool
+	pgpKeyring                openpgp.KeyRing
+	etagVerification          ETagVerification
+	checksumVerifiers         []ChecksumVerifier
 }
 
 func NewDownloader(requestTimeout time.Duration, maxConcurrentDownloads int, skipSSLVerification bool, caCertPool *systemcerts.CertPool) *Downloader {
@@ -76,18 +125,7 @@ func NewDownloaderWithIdleTimeout(requestTimeout time.Duration, idleTimeout time
 	}
 
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: func(netw, addr string) (net.Conn, error) {
-			c, err := net.DialTimeout(netw, addr, 10*time.Second)
-			if err != nil {
-				return nil, err
-			}
-			if tc, ok := c.(*net.TCPConn); ok {
-				tc.SetKeepAlive(true)
-				tc.SetKeepAlivePeriod(30 * time.Second)
-			}
-			return &idleTimeoutConn{idleTimeout, c}, nil
-		},
+		Proxy:               http.ProxyFromEnvironment,
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig: &tls.Config{
 			RootCAs:            certPool,
@@ -95,6 +133,8 @@ func NewDownloaderWithIdleTimeout(requestTimeout time.Duration, idleTimeout time
 			MinVersion:         tls.VersionTLS10,
 		},
 		DisableKeepAlives: true,
+		// gzip is requested and decoded by fetchToFile, see SetRequestGzip
+		DisableCompression: true,
 	}
 
 	client := &http.Client{
@@ -102,10 +142,118 @@ func NewDownloaderWithIdleTimeout(requestTimeout time.Duration, idleTimeout time
 		Timeout:   requestTimeout,
 	}
 
-	return &Downloader{
+	downloader := &Downloader{
 		client: client,
-		concurrentDownloadBarrier: make(chan struct{}, maxConcurrentDownloads),
+		concurrentDownloadBarrier: newAdmission(maxConcurrentDownloads),
+		slotQueue:                 newQueueTracker(DownloadSlotQueue),
+		idleTimeout:               idleTimeout,
+		dialTimeout:               10 * time.Second,
+		requestGzip:               true,
+		retryPolicy:               DefaultRetryPolicy,
+		s3:                        newS3Backend(S3Config{}),
+		gcs:                       newGCSBackend(GCSConfig{}),
+		schemeHandlers:            map[string]SchemeHandler{"sftp": &sftpHandler{}},
+	}
+	transport.DialContext = downloader.dialContext
+
+	return downloader
+}
+
+func (downloader *Downloader) dialContext(ctx context.Context, netw, addr string) (net.Conn, error) {
+	c, err := downloader.dialResolved(ctx, netw, addr)
+	if err != nil {
+		return nil, err
 	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(30 * time.Second)
+	}
+	return &idleTimeoutConn{downloader.idleTimeout, c}, nil
+}
+
+// BytesDownloaded returns the total number of bytes received from origins,
+// including those of failed attempts.
+func (downloader *Downloader) BytesDownloaded() int64 {
+	return atomic.LoadInt64(&downloader.bytesDownloaded)
+}
+
+// InProgress returns the number of downloads currently holding one of the
+// concurrent download slots.
+func (downloader *Downloader) InProgress() int {
+	return downloader.concurrentDownloadBarrier.inProgress()
+}
+
+// SetRequestDecorator installs a decorator that is run against every outgoing
+// request. It should be called before any downloads are started.
+func (downloader *Downloader) SetRequestDecorator(decorator RequestDecorator) {
+	downloader.requestDecorator = decorator
+}
+
+// SetProxy makes the Downloader send its requests through the proxy at the
+// given http or https URL instead of the one configured in the environment.
+// Credentials in the URL's user info are sent to the proxy. A nil URL makes
+// the Downloader connect directly. It should be called before any downloads
+// are started.
+func (downloader *Downloader) SetProxy(proxyURL *url.URL) {
+	downloader.transport().Proxy = http.ProxyURL(proxyURL)
+}
+
+// SetKeepAlives controls whether connections are kept open and reused by
+// later requests to the same origin, e.g. for retries and revalidations. At
+// most maxIdleConnsPerHost idle connections are kept per origin; zero uses the
+// net/http default. Keep-alives are disabled by default. It should be called
+// before any downloads are started.
+func (downloader *Downloader) SetKeepAlives(enabled bool, maxIdleConnsPerHost int) {
+	transport := downloader.transport()
+	transport.DisableKeepAlives = !enabled
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+}
+
+// EnableHTTP2 makes the Downloader use HTTP/2 with origins that support it
+// over TLS. It should be called before any downloads are started.
+func (downloader *Downloader) EnableHTTP2() {
+	downloader.transport().ForceAttemptHTTP2 = true
+}
+
+func (downloader *Downloader) transport() *http.Transport {
+	return downloader.client.Transport.(*http.Transport)
+}
+
+// SetCredentialProvider installs a provider that attaches credentials to every
+// outgoing request, after the request decorator has run. It should be called
+// before any downloads are started.
+func (downloader *Downloader) SetCredentialProvider(provider CredentialProvider) {
+	downloader.credentialProvider = provider
+}
+
+// prepareRequest runs the request decorator and the credential provider
+// against req, and binds it to ctx
+func (downloader *Downloader) prepareRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	if downloader.requestDecorator != nil {
+		downloader.requestDecorator(ctx, req)
+	}
+
+	if downloader.credentialProvider != nil {
+		err := downloader.credentialProvider.Apply(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.URL.Scheme {
+	case "s3":
+		err := downloader.s3.prepare(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	case "gs":
+		err := downloader.gcs.prepare(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return req.WithContext(ctx), nil
 }
 
 func (downloader *Downloader) Download(
@@ -115,22 +263,115 @@ func (downloader *Downloader) Download(
 	checksum ChecksumInfoType,
 	cancelChan <-chan struct{},
 ) (path string, cachingInfoOut CachingInfoType, err error) {
+	ctx, cancel := contextWithCancelChan(context.Background(), cancelChan)
+	defer cancel()
+
+	path, cachingInfoOut, _, err = downloader.download(ctx, url, createDestination, cachingInfoIn, checksum, FetchOptions{})
+	return
+}
+
+// DownloadWithContext behaves like Download, but is cancelled when ctx is done.
+// The request carries ctx, and ctx is handed to the request decorator.
+func (downloader *Downloader) DownloadWithContext(
+	ctx context.Context,
+	url *url.URL,
+	createDestination func() (*os.File, error),
+	cachingInfoIn CachingInfoType,
+	checksum ChecksumInfoType,
+) (path string, cachingInfoOut CachingInfoType, err error) {
+	path, cachingInfoOut, _, err = downloader.download(ctx, url, createDestination, cachingInfoIn, checksum, FetchOptions{})
+	return
+}
+
+// DownloadFromMirrors behaves like DownloadWithContext, but tries each of the
+// given URLs in turn until one of them succeeds. It only fails once every
+// mirror has failed, or the download is cancelled, and then returns the error
+// of the last attempt.
+func (downloader *Downloader) DownloadFromMirrors(
+	ctx context.Context,
+	urls []*url.URL,
+	createDestination func() (*os.File, error),
+	cachingInfoIn CachingInfoType,
+	checksum ChecksumInfoType,
+) (path string, cachingInfoOut CachingInfoType, err error) {
+	if len(urls) == 0 {
+		return "", CachingInfoType{}, NoMirrors
+	}
+
+	path, cachingInfoOut, _, err = downloader.download(ctx, urls[0], createDestination, cachingInfoIn, checksum, FetchOptions{Mirrors: urls[1:]})
+	return
+}
+
+// contextWithCancelChan returns a context that is also cancelled once
+// cancelChan is closed. The returned CancelFunc releases it.
+func contextWithCancelChan(ctx context.Context, cancelChan <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if cancelChan != nil {
+		go func() {
+			select {
+			case <-cancelChan:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return ctx, cancel
+}
+
+// partialDownload is what an interrupted attempt left behind, so that the next
+// attempt can ask the origin for the remaining bytes only
+type partialDownload struct {
+	path string
+	size int64
+	etag string
+}
+
+func (p *partialDownload) discard() {
+	if p.path != "" {
+		os.Remove(p.path)
+	}
+	*p = partialDownload{}
+}
+
+// download downloads url, or else its mirrors, with the per-fetch settings
+// of options
+func (downloader *Downloader) download(
+	ctx context.Context,
+	url *url.URL,
+	createDestination func() (*os.File, error),
+	cachingInfoIn CachingInfoType,
+	checksum ChecksumInfoType,
+	options FetchOptions,
+) (path string, cachingInfoOut CachingInfoType, resp *http.Response, err error) {
 
 	startTime := time.Now()
+	checksum = checksum.fromIntegrity()
 
-	select {
-	case downloader.concurrentDownloadBarrier <- struct{}{}:
-	case <-cancelChan:
-		return "", CachingInfoType{}, NewDownloadCancelledError("download-barrier", time.Now().Sub(startTime), NoBytesReceived)
+	admissionKey := options.admissionKey
+	if admissionKey == "" {
+		admissionKey = url.String()
 	}
 
-	defer func() {
-		<-downloader.concurrentDownloadBarrier
-	}()
+	leaveQueue := downloader.slotQueue.enter(admissionKey)
+	err = downloader.concurrentDownloadBarrier.acquire(ctx, admissionKey, options.Priority)
+	leaveQueue(err != nil)
+	if err != nil {
+		return "", CachingInfoType{}, nil, NewDownloadCancelledError("download-barrier", time.Now().Sub(startTime), NoBytesReceived)
+	}
+	defer downloader.concurrentDownloadBarrier.release()
 
-	for attempt := 0; attempt < MAX_DOWNLOAD_ATTEMPTS; attempt++ {
-		path, cachingInfoOut, err = downloader.fetchToFile(url, createDestination, cachingInfoIn, checksum, cancelChan)
+	limiter := downloader.limiter(options.BytesPerSecond)
 
+	if options.ChecksumURL != nil && checksum.Algorithm == "" && checksum.Value == "" {
+		checksum, err = downloader.detachedChecksum(ctx, options.ChecksumURL, url, createDestination, limiter)
+		if err != nil {
+			return "", CachingInfoType{}, nil, err
+		}
+	}
+
+	path, cachingInfoOut, resp, err = downloader.downloadFrom(ctx, url, options.RefreshURL, createDestination, cachingInfoIn, checksum, limiter)
+	for _, mirror := range options.Mirrors {
 		if err == nil {
 			break
 		}
@@ -139,31 +380,115 @@ func (downloader *Downloader) Download(
 			break
 		}
 
-		if _, ok := err.(*ChecksumFailedError); ok {
+		path, cachingInfoOut, resp, err = downloader.downloadFrom(ctx, mirror, nil, createDestination, cachingInfoIn, checksum, limiter)
+	}
+
+	if err != nil {
+		return "", CachingInfoType{}, nil, err
+	}
+
+	if path != "" && (options.Signature != nil || options.SignatureURL != nil) {
+		err = downloader.verifySignature(ctx, path, options.Signature, options.SignatureURL, createDestination, limiter)
+		if err != nil {
+			os.Remove(path)
+			return "", CachingInfoType{}, nil, err
+		}
+	}
+
+	return
+}
+
+// downloadFrom makes up to as many attempts to download url as the retry
+// policy allows. If refreshURL is set, each retry downloads the URL it
+// returns instead.
+func (downloader *Downloader) downloadFrom(
+	ctx context.Context,
+	url *url.URL,
+	refreshURL func() (*url.URL, error),
+	createDestination func() (*os.File, error),
+	cachingInfoIn CachingInfoType,
+	checksum ChecksumInfoType,
+	limiter *bandwidthLimiter,
+) (path string, cachingInfoOut CachingInfoType, resp *http.Response, err error) {
+	err = downloader.preflight(ctx, url)
+	if err != nil {
+		return "", CachingInfoType{}, nil, err
+	}
+
+	partial := &partialDownload{}
+	defer partial.discard()
+
+	for attempt := 0; attempt < downloader.retryPolicy.attempts(); attempt++ {
+		if attempt > 0 {
+			err = downloader.retryPolicy.wait(ctx, attempt)
+			if err != nil {
+				break
+			}
+
+			if refreshURL != nil {
+				url, err = refreshURL()
+				if err != nil {
+					break
+				}
+			}
+		}
+
+		path, cachingInfoOut, resp, err = downloader.fetchToFile(ctx, url, createDestination, cachingInfoIn, checksum, partial, limiter)
+
+		if err == nil || !IsRetryable(err) {
 			break
 		}
 	}
 
 	if err != nil {
-		return "", CachingInfoType{}, err
+		return "", CachingInfoType{}, nil, err
 	}
 
 	return
 }
 
+// downloadContent downloads a small file that accompanies a download, such as
+// a checksum or a signature, and returns its content
+func (downloader *Downloader) downloadContent(
+	ctx context.Context,
+	url *url.URL,
+	createDestination func() (*os.File, error),
+	limiter *bandwidthLimiter,
+) ([]byte, error) {
+	path, _, _, err := downloader.downloadFrom(ctx, url, nil, createDestination, CachingInfoType{}, ChecksumInfoType{}, limiter)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	return ioutil.ReadFile(path)
+}
+
+// fetchToFile makes a single download attempt. If partial holds the bytes of
+// an interrupted attempt, only the remaining bytes are requested, using
+// If-Range so that the origin sends the whole file instead if it has changed
+// in the meantime. If this attempt is interrupted in turn, partial is updated
+// so that the next attempt can resume it.
 func (downloader *Downloader) fetchToFile(
+	ctx context.Context,
 	url *url.URL,
 	createDestination func() (*os.File, error),
 	cachingInfoIn CachingInfoType,
 	checksum ChecksumInfoType,
-	cancelChan <-chan struct{},
-) (string, CachingInfoType, error) {
+	partial *partialDownload,
+	limiter *bandwidthLimiter,
+) (string, CachingInfoType, *http.Response, error) {
+	if handler, ok := downloader.schemeHandlers[url.Scheme]; ok {
+		path, cachingInfoOut, err := downloader.fetchWithHandler(ctx, handler, url, createDestination, cachingInfoIn, checksum, limiter)
+		return path, cachingInfoOut, nil, err
+	}
+
 	var req *http.Request
 	var err error
 
 	req, err = http.NewRequest("GET", url.String(), nil)
 	if err != nil {
-		return "", CachingInfoType{}, err
+		return "", CachingInfoType{}, nil, err
 	}
 
 	if cachingInfoIn.ETag != "" {
@@ -172,18 +497,16 @@ func (downloader *Downloader) fetchToFile(
 	if cachingInfoIn.LastModified != "" {
 		req.Header.Add("If-Modified-Since", cachingInfoIn.LastModified)
 	}
+	if partial.path != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial.size))
+		req.Header.Set("If-Range", partial.etag)
+	} else if downloader.requestGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
 
-	completeChan := make(chan struct{})
-	defer close(completeChan)
-
-	if transport, ok := downloader.client.Transport.(*http.Transport); ok {
-		go func() {
-			select {
-			case <-completeChan:
-			case <-cancelChan:
-				transport.CancelRequest(req)
-			}
-		}()
+	req, err = downloader.prepareRequest(ctx, req)
+	if err != nil {
+		return "", CachingInfoType{}, nil, err
 	}
 
 	startTime := time.Now()
@@ -192,89 +515,239 @@ func (downloader *Downloader) fetchToFile(
 	resp, err = downloader.client.Do(req)
 	if err != nil {
 		select {
-		case <-cancelChan:
+		case <-ctx.Done():
 			err = NewDownloadCancelledError("fetch-request", time.Now().Sub(startTime), NoBytesReceived)
 		default:
+			err = unwrapRedirectError(err)
 		}
-		return "", CachingInfoType{}, err
+		return "", CachingInfoType{}, nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotModified {
-		return "", CachingInfoType{}, nil
+		partial.discard()
+		return "", CachingInfoType{freshness: freshnessLifetime(resp.Header)}, resp, nil
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", CachingInfoType{}, fmt.Errorf("Download failed: Status code %d", resp.StatusCode)
+	resuming := resp.StatusCode == http.StatusPartialContent && partial.path != "" && resumesAt(resp, partial.size)
+	if !resuming {
+		partial.discard()
+		if resp.StatusCode != http.StatusOK {
+			return "", CachingInfoType{}, nil, NewHTTPStatusError(resp.StatusCode)
+		}
 	}
 
-	var destinationFile *os.File
-	destinationFile, err = createDestination()
-	if err != nil {
-		return "", CachingInfoType{}, err
+	// the size of a gzipped body says little about the decoded size, which is
+	// capped while copying instead
+	encoded := gzipped(req, resp)
+
+	customValidator, customSum := downloader.customChecksum(resp, checksum)
+
+	// without a checksum, the hashes reported by the origin, or else the ETag,
+	// may serve as one. They describe the stored bytes, not the decoded ones.
+	var multipartETag string
+	var trailerValidator *hashValidator
+	if customValidator == nil && checksum.Algorithm == "" && checksum.Value == "" && !encoded {
+		if googSum, ok := googHashChecksum(resp.Header[http.CanonicalHeaderKey("X-Goog-Hash")]); ok {
+			checksum = googSum
+		} else if _, ok := resp.Trailer[http.CanonicalHeaderKey("X-Goog-Hash")]; ok && !resuming {
+			// the hash follows the body; a CRC32C is computed just in case
+			trailerValidator, _ = NewHashValidator("crc32c")
+		} else {
+			checksum, multipartETag, err = downloader.etagChecksum(resp)
+			if err != nil {
+				partial.discard()
+				return "", CachingInfoType{}, nil, err
+			}
+		}
 	}
 
-	defer func() {
-		destinationFile.Close()
+	if resp.ContentLength >= 0 && !encoded {
+		err = downloader.checkSize(partial.size + resp.ContentLength)
 		if err != nil {
-			os.Remove(destinationFile.Name())
+			partial.discard()
+			return "", CachingInfoType{}, nil, err
 		}
-	}()
-
-	_, err = destinationFile.Seek(0, 0)
-	if err != nil {
-		return "", CachingInfoType{}, err
 	}
 
-	err = destinationFile.Truncate(0)
+	var destinationFile *os.File
+	if resuming {
+		destinationFile, err = os.OpenFile(partial.path, os.O_RDWR, 0)
+	} else {
+		destinationFile, err = createDestination()
+	}
 	if err != nil {
-		return "", CachingInfoType{}, err
+		partial.discard()
+		return "", CachingInfoType{}, nil, err
 	}
 
-	go func() {
-		select {
-		case <-completeChan:
-		case <-cancelChan:
-			resp.Body.Close()
+	keepPartial := false
+	defer func() {
+		destinationFile.Close()
+		if err != nil && !keepPartial {
+			partial.discard()
+			os.Remove(destinationFile.Name())
 		}
 	}()
 
 	ioWriters := []io.Writer{destinationFile}
 
-	var checksumValidator *hashValidator
+	checksumValidator := customValidator
 
 	// if checksum data is provided, create the checksum validator
-	if checksum.Algorithm != "" || checksum.Value != "" {
+	if checksumValidator == nil && (checksum.Algorithm != "" || checksum.Value != "") {
 		checksumValidator, err = NewHashValidator(checksum.Algorithm)
 		if err != nil {
-			return "", CachingInfoType{}, err
+			return "", CachingInfoType{}, nil, err
 		}
+	}
+	if checksumValidator != nil {
 		ioWriters = append(ioWriters, checksumValidator.hash)
 	}
+	if trailerValidator != nil {
+		ioWriters = append(ioWriters, trailerValidator.hash)
+	}
+
+	if resuming {
+		// the checksum covers the whole file, including the bytes received earlier
+		if checksumValidator != nil {
+			_, err = copyBufferedN(checksumValidator.hash, destinationFile, partial.size)
+			if err != nil {
+				return "", CachingInfoType{}, nil, err
+			}
+		}
+
+		_, err = destinationFile.Seek(partial.size, 0)
+		if err != nil {
+			return "", CachingInfoType{}, nil, err
+		}
+	} else {
+		_, err = destinationFile.Seek(0, 0)
+		if err != nil {
+			return "", CachingInfoType{}, nil, err
+		}
+
+		err = destinationFile.Truncate(0)
+		if err != nil {
+			return "", CachingInfoType{}, nil, err
+		}
+	}
 
 	startTime = time.Now()
-	written, err := io.Copy(io.MultiWriter(ioWriters...), resp.Body)
+	segmented := !resuming && !encoded && downloader.segmentable(resp)
+	var written, received int64
+	if segmented {
+		written, err = downloader.fetchSegments(ctx, url, resp, destinationFile, limiter)
+		received = written
+	} else {
+		body, stopWatching := downloader.watchStalls(resp.Body)
+		reader := limiter.reader(ctx, body)
+		var gunzip *gunzipReader
+		if encoded {
+			gunzip = newGunzipReader(reader)
+			reader = gunzip
+		}
+
+		written, err = copyBuffered(io.MultiWriter(ioWriters...), downloader.capReader(reader, partial.size))
+		if stallErr := stopWatching(); stallErr != nil && err != nil {
+			err = stallErr
+		}
+
+		received = written
+		if gunzip != nil {
+			received = gunzip.compressedBytes()
+		}
+	}
+	atomic.AddInt64(&downloader.bytesDownloaded, received)
 	if err != nil {
 		select {
-		case <-cancelChan:
+		case <-ctx.Done():
 			err = NewDownloadCancelledError("copy-body", time.Now().Sub(startTime), written)
 		default:
 		}
-		return "", CachingInfoType{}, err
+
+		if !segmented && !encoded && resumable(resp, err, written) {
+			keepPartial = true
+			partial.path = destinationFile.Name()
+			partial.size += written
+			partial.etag = resp.Header.Get("ETag")
+		}
+		return "", CachingInfoType{}, nil, err
 	}
 
 	cachingInfoOut := CachingInfoType{
 		ETag:         resp.Header.Get("ETag"),
 		LastModified: resp.Header.Get("Last-Modified"),
+		freshness:    freshnessLifetime(resp.Header),
+		noStore:      noStore(resp.Header),
+	}
+	if url.Scheme == "gs" {
+		cachingInfoOut = gcsCachingInfo(resp, cachingInfoOut)
 	}
 
 	// validate checksum
 	if checksumValidator != nil {
-		err = checksumValidator.Validate(checksum.Value)
+		if segmented {
+			// the segments arrived out of order; hash the assembled file
+			_, err = destinationFile.Seek(0, 0)
+			if err == nil {
+				_, err = copyBuffered(checksumValidator.hash, destinationFile)
+			}
+			if err != nil {
+				return "", CachingInfoType{}, nil, err
+			}
+		}
+
+		if customValidator != nil {
+			err = checksumValidator.validateSum(customSum)
+		} else {
+			err = checksumValidator.Validate(checksum.Value)
+		}
 		if err != nil {
-			return "", CachingInfoType{}, err
+			return "", CachingInfoType{}, nil, err
 		}
 	}
 
-	return destinationFile.Name(), cachingInfoOut, nil
+	if trailerValidator != nil && !segmented {
+		trailerSum, ok := googHashChecksum(resp.Trailer[http.CanonicalHeaderKey("X-Goog-Hash")])
+		if ok && trailerSum.Algorithm == "crc32c" {
+			err = trailerValidator.Validate(trailerSum.Value)
+			if err != nil {
+				return "", CachingInfoType{}, nil, err
+			}
+		}
+	}
+
+	if multipartETag != "" {
+		err = verifyMultipartETag(destinationFile, multipartETag)
+		if err != nil {
+			return "", CachingInfoType{}, nil, err
+		}
+	}
+
+	// the file is complete; it is no longer a partial download
+	*partial = partialDownload{}
+
+	return destinationFile.Name(), cachingInfoOut, resp, nil
+}
+
+// resumable reports whether a body that failed with err after written bytes
+// can be resumed by a later attempt. That requires a strong ETag for If-Range
+// and an origin that does not rule out range requests.
+func resumable(resp *http.Response, err error, written int64) bool {
+	if !IsRetryable(err) {
+		return false
+	}
+
+	etag := resp.Header.Get("ETag")
+	return written > 0 &&
+		etag != "" && !strings.HasPrefix(etag, "W/") &&
+		resp.Header.Get("Accept-Ranges") != "none"
+}
+
+// resumesAt reports whether a 206 response continues the file at offset
+func resumesAt(resp *http.Response, offset int64) bool {
+	var start, end int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end)
+	return err == nil && start == offset
 }
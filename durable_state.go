@@ -0,0 +1,71 @@
+package cacheddownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SetDurableState makes the cachedDownloader save its state every time an
+// entry is added to or removed from the cache, rather than only when SaveState
+// is called, so that RecoverState (or NewPersistent) can rebuild the cache
+// after a crash instead of starting cold. The state is replaced atomically, so
+// a crash while saving it leaves the previous state in place. It should be
+// called before any fetches are started.
+func (c *cachedDownloader) SetDurableState(durable bool) {
+	path := ""
+	if durable {
+		path = c.cacheLocation
+	}
+	c.cache.SetStatePath(path)
+}
+
+// SetStatePath makes the cache write its entries to the file at path right
+// away, and again every time an entry is added or removed. An empty path, the
+// default, disables it.
+func (c *FileCache) SetStatePath(path string) {
+	lock.Lock()
+	c.statePath = path
+	c.persist()
+	lock.Unlock()
+}
+
+// persist writes the entries to the state path, if there is one. It must be
+// called with the lock held.
+func (c *FileCache) persist() {
+	if c.statePath == "" {
+		return
+	}
+
+	state, err := json.Marshal(c)
+	if err == nil {
+		err = writeFileAtomically(c.statePath, state)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to save cache state", err)
+	}
+}
+
+// writeFileAtomically replaces the file at path with data, so that readers
+// see either the old or the new contents, even after a crash
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,212 @@
+package cacheddownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// KeyWrapper protects the keys that cached files are encrypted with, see
+// SetEncryption. It may be backed by a key management service, or by a key of
+// the caller, see NewStaticKeyWrapper.
+type KeyWrapper interface {
+	// WrapKey encrypts the key of a cached file so that it can be stored
+	// alongside it.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a key returned by WrapKey.
+	UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error)
+}
+
+// SetEncryption makes the cachedDownloader encrypt the files it adds to the
+// cache, each with its own AES-256-GCM key that is wrapped with keys and
+// stored with the file. Fetches served from the cache get a decrypted copy in
+// the uncached path, which is removed once closed. The size of an entry, and
+// thereby the cache size, quotas and the free space reserve, is that of the
+// encrypted file. An entry that cannot be decrypted is treated as corrupt:
+// it is evicted and downloaded again. Expanded directories, and the archives
+// they are expanded from, are not encrypted since they are used in place. It
+// should be called before any fetches are started.
+func (c *cachedDownloader) SetEncryption(keys KeyWrapper) {
+	c.cache.atRest.keys = keys
+}
+
+// NewStaticKeyWrapper returns a KeyWrapper that wraps the keys of cached files
+// with the given AES key, which must be 16, 24 or 32 bytes long.
+func NewStaticKeyWrapper(key []byte) (KeyWrapper, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return staticKeyWrapper{aead: aead}, nil
+}
+
+type staticKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+func (w staticKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (w staticKeyWrapper) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < w.aead.NonceSize() {
+		return nil, errSealedFileInvalid
+	}
+	nonce, sealed := wrappedKey[:w.aead.NonceSize()], wrappedKey[w.aead.NonceSize():]
+	return w.aead.Open(nil, nonce, sealed, nil)
+}
+
+// Encrypted files start with sealedMagic, followed by the length of the
+// wrapped key as a big endian uint16 and the wrapped key itself. The content
+// follows in chunks of sealedChunkSize bytes, each sealed on its own with a
+// nonce made of its index and a flag marking the last chunk, so that chunks
+// cannot be reordered and the file cannot be truncated unnoticed.
+const (
+	sealedMagic     = "\x00cdlseal"
+	sealedChunkSize = 64 * 1024
+	sealedKeySize   = 32
+)
+
+var errSealedFileInvalid = errors.New("encrypted cache file is invalid")
+
+// sealFile encrypts source into destination
+func sealFile(ctx context.Context, keys KeyWrapper, source io.Reader, destination io.Writer) error {
+	key := make([]byte, sealedKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := keys.WrapKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(wrappedKey) > 0xffff {
+		return errors.New("wrapped key is too long")
+	}
+
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := bytes.NewBufferString(sealedMagic)
+	binary.Write(header, binary.BigEndian, uint16(len(wrappedKey)))
+	header.Write(wrappedKey)
+	_, err = destination.Write(header.Bytes())
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(source, sealedChunkSize)
+	chunk := make([]byte, sealedChunkSize)
+	sealed := make([]byte, 0, sealedChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(chunk) || atEOF(reader)
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, index, last), chunk[:n], nil)
+		_, err = destination.Write(sealed)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// unsealFile decrypts source, as encrypted by sealFile, into destination
+func unsealFile(ctx context.Context, keys KeyWrapper, source io.Reader, destination io.Writer) error {
+	reader := bufio.NewReaderSize(source, sealedChunkSize)
+
+	var header struct {
+		Magic     [len(sealedMagic)]byte
+		KeyLength uint16
+	}
+	err := binary.Read(reader, binary.BigEndian, &header)
+	if err != nil || string(header.Magic[:]) != sealedMagic {
+		return errSealedFileInvalid
+	}
+
+	wrappedKey := make([]byte, header.KeyLength)
+	_, err = io.ReadFull(reader, wrappedKey)
+	if err != nil {
+		return errSealedFileInvalid
+	}
+
+	key, err := keys.UnwrapKey(ctx, wrappedKey)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, sealedChunkSize+aead.Overhead())
+	plain := make([]byte, 0, sealedChunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(sealed) || atEOF(reader)
+
+		plain, err = aead.Open(plain[:0], chunkNonce(aead, index, last), sealed[:n], nil)
+		if err != nil {
+			return errSealedFileInvalid
+		}
+		_, err = destination.Write(plain)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func newChunkAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives the nonce of a chunk from its index; every file has its
+// own key, so nonces only need to be unique within a file
+func chunkNonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func atEOF(reader *bufio.Reader) bool {
+	_, err := reader.Peek(1)
+	return err == io.EOF
+}
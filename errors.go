@@ -0,0 +1,222 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NoMirrors is returned when a download is given no URL to download from.
+var NoMirrors = errors.New("At least one URL is required")
+
+// RetryableError is implemented by the errors of this package that know
+// whether the operation that failed may succeed when attempted again.
+type RetryableError interface {
+	error
+	IsRetryable() bool
+}
+
+// IsRetryable reports whether the operation that failed with err may succeed
+// when attempted again. Errors that do not implement RetryableError, such as
+// network errors and timeouts, are considered retryable.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if retryable, ok := err.(RetryableError); ok {
+		return retryable.IsRetryable()
+	}
+
+	return true
+}
+
+// HTTPStatusError is returned when the origin answers a download with a
+// status code other than 200 or 304.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+// NewHTTPStatusError returns a NotFoundError for 404 and 410, and an
+// HTTPStatusError for any other status code.
+func NewHTTPStatusError(statusCode int) error {
+	if statusCode == http.StatusNotFound || statusCode == http.StatusGone {
+		return &NotFoundError{HTTPStatusError{StatusCode: statusCode}}
+	}
+	return &HTTPStatusError{StatusCode: statusCode}
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Download failed: Status code %d", e.StatusCode)
+}
+
+// IsRetryable is true for server errors, 408 Request Timeout and 429 Too Many
+// Requests; any other status code is not expected to change on its own.
+func (e *HTTPStatusError) IsRetryable() bool {
+	return e.StatusCode >= 500 ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// NotFoundError is returned when the origin reports that the download does
+// not exist.
+type NotFoundError struct {
+	HTTPStatusError
+}
+
+func (e *NotFoundError) IsRetryable() bool {
+	return false
+}
+
+// TooLargeError is returned when a download exceeds the maximum download size.
+type TooLargeError struct {
+	Size    int64
+	MaxSize int64
+}
+
+func NewTooLargeError(size, maxSize int64) error {
+	return &TooLargeError{
+		Size:    size,
+		MaxSize: maxSize,
+	}
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("Download too large: '%d' bytes exceeds the maximum of '%d' bytes", e.Size, e.MaxSize)
+}
+
+func (e *TooLargeError) IsRetryable() bool {
+	return false
+}
+
+// StalledDownloadError is returned when a download receives too few bytes
+// during a window of stall detection.
+type StalledDownloadError struct {
+	Received int64
+	Window   time.Duration
+}
+
+func NewStalledDownloadError(received int64, window time.Duration) error {
+	return &StalledDownloadError{
+		Received: received,
+		Window:   window,
+	}
+}
+
+func (e *StalledDownloadError) Error() string {
+	return fmt.Sprintf("Download stalled: received '%d' bytes in '%s'", e.Received, e.Window)
+}
+
+func (e *StalledDownloadError) IsRetryable() bool {
+	return true
+}
+
+func (e *DownloadCancelledError) IsRetryable() bool {
+	return false
+}
+
+func (e *ChecksumFailedError) IsRetryable() bool {
+	return false
+}
+
+// SignatureFailedError is returned when a download does not match its detached
+// PGP signature, or the signature cannot be checked with the keyring.
+type SignatureFailedError struct {
+	Err error
+}
+
+func NewSignatureFailedError(err error) error {
+	return &SignatureFailedError{Err: err}
+}
+
+func (e *SignatureFailedError) Error() string {
+	return fmt.Sprintf("Signature verification failed: %s", e.Err)
+}
+
+func (e *SignatureFailedError) IsRetryable() bool {
+	return false
+}
+
+func (e *TooManyOpenError) IsRetryable() bool {
+	return true
+}
+
+// UnsupportedArchiveError is returned when a download that is transformed to,
+// or expanded from, an archive is not in a supported format: tar, possibly
+// compressed with gzip, zstd or xz, or zip. It matches ErrUnknownArchiveFormat
+// with errors.Is.
+type UnsupportedArchiveError struct {
+	// Magic is the first bytes of the download.
+	Magic []byte
+}
+
+func NewUnsupportedArchiveError(header []byte) error {
+	magic := header
+	if len(magic) > 8 {
+		magic = magic[:8]
+	}
+	return &UnsupportedArchiveError{Magic: append([]byte{}, magic...)}
+}
+
+func (e *UnsupportedArchiveError) Error() string {
+	return fmt.Sprintf("Unsupported archive format: starts with '% x'", e.Magic)
+}
+
+func (e *UnsupportedArchiveError) Is(target error) bool {
+	return target == ErrUnknownArchiveFormat
+}
+
+func (e *UnsupportedArchiveError) IsRetryable() bool {
+	return false
+}
+
+// ExtractionLimitError is returned when an archive expands beyond one of the
+// limits set with ExtractionOptions, e.g. since it is an archive bomb.
+type ExtractionLimitError struct {
+	// Limit is the limit that was exceeded: "expanded size", "file count" or
+	// "path depth", and Max its value.
+	Limit string
+	Max   int64
+}
+
+func NewExtractionLimitError(limit string, max int64) error {
+	return &ExtractionLimitError{
+		Limit: limit,
+		Max:   max,
+	}
+}
+
+func (e *ExtractionLimitError) Error() string {
+	return fmt.Sprintf("Archive exceeds the %s limit of '%d'", e.Limit, e.Max)
+}
+
+func (e *ExtractionLimitError) IsRetryable() bool {
+	return false
+}
+
+// DirectoryModifiedError is returned by VerifyDirectory when the expanded
+// directory of an entry no longer matches the manifest taken when it was
+// expanded, e.g. since a consumer wrote to it. The paths are relative to the
+// directory.
+type DirectoryModifiedError struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+func NewDirectoryModifiedError(added, removed, modified []string) error {
+	return &DirectoryModifiedError{
+		Added:    added,
+		Removed:  removed,
+		Modified: modified,
+	}
+}
+
+func (e *DirectoryModifiedError) Error() string {
+	return fmt.Sprintf("Cached directory was modified: %d added, %d removed, %d modified", len(e.Added), len(e.Removed), len(e.Modified))
+}
+
+func (e *DirectoryModifiedError) IsRetryable() bool {
+	return false
+}
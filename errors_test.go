@@ -0,0 +1,39 @@
+package cacheddownloader_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IsRetryable", func() {
+	It("retries server errors and throttling", func() {
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewHTTPStatusError(http.StatusServiceUnavailable))).To(BeTrue())
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewHTTPStatusError(http.StatusTooManyRequests))).To(BeTrue())
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewHTTPStatusError(http.StatusRequestTimeout))).To(BeTrue())
+	})
+
+	It("does not retry other client errors", func() {
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewHTTPStatusError(http.StatusForbidden))).To(BeFalse())
+	})
+
+	It("reports missing downloads as a NotFoundError", func() {
+		err := cacheddownloader.NewHTTPStatusError(http.StatusNotFound)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.NotFoundError{}))
+		Expect(err.Error()).To(Equal("Download failed: Status code 404"))
+		Expect(cacheddownloader.IsRetryable(err)).To(BeFalse())
+	})
+
+	It("does not retry cancelled downloads or checksum failures", func() {
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewDownloadCancelledError("here", time.Second, cacheddownloader.NoBytesReceived))).To(BeFalse())
+		Expect(cacheddownloader.IsRetryable(cacheddownloader.NewChecksumFailedError("checksum mismatch", "a", "b"))).To(BeFalse())
+	})
+
+	It("retries errors it does not know", func() {
+		Expect(cacheddownloader.IsRetryable(errors.New("connection reset"))).To(BeTrue())
+	})
+})
@@ -0,0 +1,150 @@
+package cacheddownloader
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ETagVerification controls whether downloads without a checksum are verified
+// against the ETag of the response, as S3 computes it. Only enable it for
+// origins that do: other servers use ETags that merely look like digests.
+type ETagVerification int
+
+const (
+	// NoETagVerification ignores ETags for verification. It is the default.
+	NoETagVerification ETagVerification = iota
+	// SkipMultipartETags verifies the downloads whose ETag is the MD5 of
+	// the object, and skips those uploaded in several parts, whose ETag
+	// looks like "<hex>-<number of parts>".
+	SkipMultipartETags
+	// VerifyMultipartETags also verifies multipart ETags, which are the MD5
+	// of the MD5s of the parts. The size of the parts is not part of the
+	// response; the default part sizes of the AWS CLI and SDKs, and the
+	// smallest whole number of MiB that yields the number of parts, are
+	// tried. A download that matches none of them fails.
+	VerifyMultipartETags
+	// RequireChecksumForMultipart verifies single part ETags like
+	// SkipMultipartETags, but fails downloads with a multipart ETag that
+	// were not given a checksum.
+	RequireChecksumForMultipart
+)
+
+const multipartPartSizeUnit = 1024 * 1024
+
+// commonPartSizesInMiB are the part sizes that the AWS CLI and SDKs use by
+// default
+var commonPartSizesInMiB = []int64{5, 8, 15, 16, 64, 100}
+
+var (
+	singlePartETagPattern = regexp.MustCompile(`^"?([0-9a-fA-F]{32})"?$`)
+	multipartETagPattern  = regexp.MustCompile(`^"?([0-9a-fA-F]{32})-([0-9]+)"?$`)
+)
+
+// SetETagVerification sets how downloads that are not given a checksum are
+// verified against their ETag. ETags of objects encrypted with SSE-KMS or a
+// customer key are never used, as S3 does not derive them from the content.
+// It should be called before any downloads are started.
+func (downloader *Downloader) SetETagVerification(verification ETagVerification) {
+	downloader.etagVerification = verification
+}
+
+// etagChecksum returns the checksum that the ETag of resp gives for the
+// response body, or the ETag itself if it is a multipart ETag that must be
+// verified once the whole body has been downloaded
+func (downloader *Downloader) etagChecksum(resp *http.Response) (ChecksumInfoType, string, error) {
+	if downloader.etagVerification == NoETagVerification || !etagIsDigest(resp.Header) {
+		return ChecksumInfoType{}, "", nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if match := singlePartETagPattern.FindStringSubmatch(etag); match != nil {
+		return ChecksumInfoType{Algorithm: "md5", Value: strings.ToLower(match[1])}, "", nil
+	}
+
+	if !multipartETagPattern.MatchString(etag) {
+		return ChecksumInfoType{}, "", nil
+	}
+
+	switch downloader.etagVerification {
+	case VerifyMultipartETags:
+		return ChecksumInfoType{}, etag, nil
+	case RequireChecksumForMultipart:
+		return ChecksumInfoType{}, "", NewChecksumFailedError("checksum required for multipart ETag", "a checksum", etag)
+	}
+	return ChecksumInfoType{}, "", nil
+}
+
+// etagIsDigest reports whether S3 derived the ETag from the content, which it
+// does not for objects encrypted with SSE-KMS or SSE-C
+func etagIsDigest(header http.Header) bool {
+	return header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" &&
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == ""
+}
+
+// verifyMultipartETag verifies the downloaded file against a multipart ETag
+func verifyMultipartETag(file *os.File, etag string) error {
+	match := multipartETagPattern.FindStringSubmatch(etag)
+	expected := strings.ToLower(match[1])
+	parts, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil || parts < 1 {
+		return NewChecksumFailedError("multipart ETag invalid", "a number of parts", etag)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	for _, partSize := range multipartPartSizes(size, parts) {
+		digest, err := multipartDigest(file, size, partSize)
+		if err != nil {
+			return err
+		}
+		if digest == expected {
+			return nil
+		}
+	}
+
+	return NewChecksumFailedError("multipart ETag mismatch", etag, fmt.Sprintf("no matching part size for %d parts", parts))
+}
+
+// multipartPartSizes returns the candidate part sizes that split size bytes
+// into the given number of parts
+func multipartPartSizes(size, parts int64) []int64 {
+	if parts == 1 {
+		return []int64{size}
+	}
+
+	var sizes []int64
+	candidates := append([]int64{(size + parts*multipartPartSizeUnit - 1) / (parts * multipartPartSizeUnit)}, commonPartSizesInMiB...)
+	for _, units := range candidates {
+		partSize := units * multipartPartSizeUnit
+		if partSize > 0 && (size+partSize-1)/partSize == parts {
+			sizes = append(sizes, partSize)
+		}
+	}
+	return sizes
+}
+
+// multipartDigest computes the ETag that S3 gives an object of size bytes
+// uploaded in parts of partSize
+func multipartDigest(file *os.File, size, partSize int64) (string, error) {
+	digests := md5.New()
+	for offset := int64(0); offset < size; offset += partSize {
+		part := md5.New()
+		_, err := io.Copy(part, io.NewSectionReader(file, offset, partSize))
+		if err != nil {
+			return "", err
+		}
+		digests.Write(part.Sum(nil))
+	}
+	return hex.EncodeToString(digests.Sum(nil)), nil
+}
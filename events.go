@@ -0,0 +1,117 @@
+package cacheddownloader
+
+// EntryEventType tells what happened to a cache entry, see EntryEvent.
+type EntryEventType string
+
+const (
+	// EntryAdded is sent when a download is added to the cache.
+	EntryAdded EntryEventType = "added"
+	// EntryEvicted is sent when an entry is evicted to make room, whether for
+	// the size of the cache, a namespace quota or the free space reserve.
+	EntryEvicted EntryEventType = "evicted"
+	// EntryExpired is sent when an entry is replaced or dropped because the
+	// origin has changed the content, or no longer allows it to be cached.
+	EntryExpired EntryEventType = "expired"
+	// EntryCorrupted is sent when an entry is dropped because its content no
+	// longer matches its digest, see SetVerifyOnRead.
+	EntryCorrupted EntryEventType = "corrupted"
+	// EntryRemoved is sent when an entry is removed with Remove,
+	// RemoveByPrefix or Clear.
+	EntryRemoved EntryEventType = "removed"
+)
+
+// EntryEvent describes a change to the entries of the cache.
+type EntryEvent struct {
+	Type EntryEventType
+	// HashedKey names the files of the entry, and Key, Namespace and Labels
+	// are those it was fetched with, if they were recorded.
+	HashedKey string
+	Key       string
+	Namespace string
+	Labels    map[string]string
+	Size      int64
+}
+
+// EntryObserver is called for every change to the entries of the cache.
+type EntryObserver func(EntryEvent)
+
+// SetEntryObserver installs an observer that is told when entries are added
+// to, or leave, the cache, e.g. to invalidate state that depends on a cached
+// directory. The events of a fetch, or of a call to Remove, RemoveByPrefix or
+// Clear, are delivered in order before it returns, outside of any locks of the
+// cachedDownloader, so the observer may call into it. It should be called
+// before any fetches are started.
+func (c *cachedDownloader) SetEntryObserver(observer EntryObserver) {
+	c.cache.setRecordEvents(observer != nil)
+	c.entryObserver = observer
+}
+
+// notifyEntryObserver delivers the events recorded by the cache so far
+func (c *cachedDownloader) notifyEntryObserver() {
+	if c.entryObserver == nil {
+		return
+	}
+
+	c.entryEventLock.Lock()
+	defer c.entryEventLock.Unlock()
+
+	for _, event := range c.cache.takeEvents() {
+		c.entryObserver(event)
+	}
+}
+
+// entryEvents holds the events of a FileCache until they are delivered
+type entryEvents struct {
+	enabled bool
+	pending []EntryEvent
+}
+
+func (c *FileCache) setRecordEvents(record bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.events.enabled = record
+	c.events.pending = nil
+}
+
+// record keeps an event for the entry. It must be called with the lock held.
+func (c *FileCache) record(eventType EntryEventType, hashedKey string, entry *FileCacheEntry) {
+	if !c.events.enabled || entry == nil {
+		return
+	}
+
+	c.events.pending = append(c.events.pending, EntryEvent{
+		Type:      eventType,
+		HashedKey: hashedKey,
+		Key:       entry.Key,
+		Namespace: entry.Namespace,
+		Labels:    copyLabels(entry.Labels),
+		Size:      entry.Size,
+	})
+}
+
+// recordAdded keeps an EntryAdded event for the entry, once its origin has
+// been recorded
+func (c *FileCache) recordAdded(hashedKey string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.record(EntryAdded, hashedKey, c.Entries[hashedKey])
+}
+
+func (c *FileCache) takeEvents() []EntryEvent {
+	lock.Lock()
+	defer lock.Unlock()
+
+	events := c.events.pending
+	c.events.pending = nil
+	return events
+}
+
+// removeAs removes the entry for cacheKey, recording why
+func (c *FileCache) removeAs(cacheKey string, eventType EntryEventType) {
+	lock.Lock()
+	c.remove(cacheKey, eventType)
+	c.persist()
+	lock.Unlock()
+}
@@ -0,0 +1,66 @@
+package cacheddownloader
+
+import "time"
+
+// EvictionPolicy decides which entry is ejected first when the cache needs to
+// make room. Entries that are in use are never ejected, and the eviction
+// preference, see FileCache.SetEvictionPreference, is applied before the
+// policy.
+type EvictionPolicy interface {
+	// EvictBefore reports whether entry should be ejected ahead of other. It
+	// is called with the cache locked, with the same now for every comparison
+	// made to pick an entry.
+	EvictBefore(entry, other *FileCacheEntry, now time.Time) bool
+}
+
+// EvictionPolicyFunc adapts a function to an EvictionPolicy.
+type EvictionPolicyFunc func(entry, other *FileCacheEntry, now time.Time) bool
+
+func (f EvictionPolicyFunc) EvictBefore(entry, other *FileCacheEntry, now time.Time) bool {
+	return f(entry, other, now)
+}
+
+var (
+	// LeastRecentlyUsedPolicy ejects the entry that was accessed longest ago.
+	// It is the default.
+	LeastRecentlyUsedPolicy EvictionPolicy = EvictionPolicyFunc(func(entry, other *FileCacheEntry, now time.Time) bool {
+		return entry.Access.Before(other.Access)
+	})
+
+	// LeastFrequentlyUsedPolicy ejects the entry that was served from the
+	// cache the fewest times, and the least recently used one among those.
+	LeastFrequentlyUsedPolicy EvictionPolicy = EvictionPolicyFunc(func(entry, other *FileCacheEntry, now time.Time) bool {
+		if entry.AccessCount != other.AccessCount {
+			return entry.AccessCount < other.AccessCount
+		}
+		return entry.Access.Before(other.Access)
+	})
+
+	// SizeWeightedPolicy ejects the entry with the largest size multiplied by
+	// the time since it was accessed, so that a large entry that is rarely used
+	// goes before the small ones that are used all the time, even if it was
+	// accessed more recently.
+	SizeWeightedPolicy EvictionPolicy = EvictionPolicyFunc(func(entry, other *FileCacheEntry, now time.Time) bool {
+		entryCost := float64(entry.Size) * now.Sub(entry.Access).Seconds()
+		otherCost := float64(other.Size) * now.Sub(other.Access).Seconds()
+		if entryCost != otherCost {
+			return entryCost > otherCost
+		}
+		return entry.Access.Before(other.Access)
+	})
+)
+
+// SetEvictionPolicy changes the order in which entries are ejected when room
+// is needed. Nil restores the default, LeastRecentlyUsedPolicy.
+func (c *FileCache) SetEvictionPolicy(policy EvictionPolicy) {
+	lock.Lock()
+	c.evictionPolicy = policy
+	lock.Unlock()
+}
+
+// SetEvictionPolicy changes the order in which cached entries are ejected
+// when room is needed, see FileCache.SetEvictionPolicy. It should be called
+// before any fetches are started.
+func (c *cachedDownloader) SetEvictionPolicy(policy EvictionPolicy) {
+	c.cache.SetEvictionPolicy(policy)
+}
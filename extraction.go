@@ -0,0 +1,460 @@
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExtractionOptions controls what is kept of the entries of an archive when it
+// is expanded into a directory, e.g. so that an expanded root filesystem works
+// in a container, and limits how far it may expand. The zero value only keeps
+// what is safe to extract from archives of any origin: regular files,
+// directories and symbolic links are extracted with their permission bits,
+// hardlinks become copies of their target, and device nodes, FIFOs, setuid,
+// setgid and sticky bits, owners, modification times and extended attributes
+// are left out. It sets no limits.
+type ExtractionOptions struct {
+	// SkipSymlinks leaves out symbolic links.
+	SkipSymlinks bool
+	// PreserveHardlinks links the hardlinks of a tarball to their target
+	// rather than copying it.
+	PreserveHardlinks bool
+	// PreserveDevices creates the device nodes and FIFOs of a tarball, which
+	// usually requires root. It is only supported on Linux.
+	PreserveDevices bool
+	// PreserveSpecialModes keeps setuid, setgid and sticky bits.
+	PreserveSpecialModes bool
+	// PreserveOwnership makes the owners recorded in a tarball the owners of
+	// its entries, which usually requires root. Permissions.Chown takes
+	// precedence.
+	PreserveOwnership bool
+	// UIDMappings and GIDMappings, if set, map the owners recorded in a
+	// tarball to those of its entries as they are extracted, e.g. to shift
+	// them into the IDs of a user namespace; they imply PreserveOwnership.
+	// An owner that is not mapped fails the extraction.
+	UIDMappings []IDMapping
+	GIDMappings []IDMapping
+	// PreserveModTimes keeps the modification times of files and directories.
+	PreserveModTimes bool
+	// PreserveXattrs sets the extended attributes recorded in the PAX headers
+	// of a tarball. It is only supported on Linux.
+	PreserveXattrs bool
+
+	// MaxExpandedSizeInBytes, MaxFileCount and MaxPathDepth, if set, limit the
+	// total size of the files of an archive, the number of its entries and
+	// the number of components of their names, so that an archive bomb cannot
+	// fill the disk. An archive that exceeds one of them fails to expand with
+	// an ExtractionLimitError, and what was expanded of it is removed.
+	MaxExpandedSizeInBytes int64
+	MaxFileCount           int
+	MaxPathDepth           int
+}
+
+// IDMapping maps Size user or group IDs starting at ContainerID, as recorded in
+// a tarball, to those starting at HostID, like the ID mappings of a user
+// namespace.
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// mapID returns the ID that id is mapped to; ids are left as they are if
+// there are no mappings
+func mapID(mappings []IDMapping, id int) (int, bool) {
+	if len(mappings) == 0 {
+		return id, true
+	}
+
+	for _, mapping := range mappings {
+		if id >= mapping.ContainerID && id-mapping.ContainerID < mapping.Size {
+			return mapping.HostID + id - mapping.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// owner returns the owner that the tarball entry is extracted with
+func (o ExtractionOptions) owner(header *tar.Header) (int, int, error) {
+	uid, ok := mapID(o.UIDMappings, header.Uid)
+	if !ok {
+		return 0, 0, fmt.Errorf("archive entry %s is owned by unmapped uid %d", header.Name, header.Uid)
+	}
+
+	gid, ok := mapID(o.GIDMappings, header.Gid)
+	if !ok {
+		return 0, 0, fmt.Errorf("archive entry %s is owned by unmapped gid %d", header.Name, header.Gid)
+	}
+	return uid, gid, nil
+}
+
+// extractionLimits keeps count of what has been extracted of an archive
+type extractionLimits struct {
+	options     ExtractionOptions
+	entries     int
+	sizeInBytes int64
+}
+
+// admit counts the archive entry with the given name, failing if it exceeds
+// the file count or path depth limits
+func (l *extractionLimits) admit(name string) error {
+	l.entries++
+	if l.options.MaxFileCount > 0 && l.entries > l.options.MaxFileCount {
+		return NewExtractionLimitError("file count", int64(l.options.MaxFileCount))
+	}
+
+	depth := len(strings.Split(strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/"), "/"))
+	if l.options.MaxPathDepth > 0 && depth > l.options.MaxPathDepth {
+		return NewExtractionLimitError("path depth", int64(l.options.MaxPathDepth))
+	}
+	return nil
+}
+
+// grow counts a file of the given size before it is written, failing if it
+// exceeds the expanded size limit
+func (l *extractionLimits) grow(sizeInBytes int64) error {
+	l.sizeInBytes += sizeInBytes
+	if l.options.MaxExpandedSizeInBytes > 0 && l.sizeInBytes > l.options.MaxExpandedSizeInBytes {
+		return NewExtractionLimitError("expanded size", l.options.MaxExpandedSizeInBytes)
+	}
+	return nil
+}
+
+// paxXattrPrefix prefixes the PAX records that hold extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// SetExtractionOptions controls what is kept of the entries of archives that
+// are expanded into directories, including those that are too large to be
+// cached. Directories that have been expanded already are left as they are.
+// It should be called before any fetches are started.
+func (c *cachedDownloader) SetExtractionOptions(options ExtractionOptions) {
+	c.cache.SetExtractionOptions(options)
+}
+
+// SetExtractionOptions controls what is kept of the entries of the archives
+// that the cache expands from then on.
+func (c *FileCache) SetExtractionOptions(options ExtractionOptions) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.extraction = options
+}
+
+func (c *FileCache) currentExtractionOptions() ExtractionOptions {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return c.extraction
+}
+
+// mode returns the mode that an entry with the given mode is extracted with
+func (o ExtractionOptions) mode(mode os.FileMode) os.FileMode {
+	if o.PreserveSpecialModes {
+		return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	return mode.Perm()
+}
+
+func (o ExtractionOptions) makeDirectory(fullpath string, mode os.FileMode) error {
+	// a directory must not be made, or changed, through a symbolic link
+	info, err := os.Lstat(fullpath)
+	if err == nil && isLink(info) {
+		return fmt.Errorf("archive entry %s is a symbolic link", fullpath)
+	}
+
+	err = os.MkdirAll(fullpath, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if o.mode(mode) != mode.Perm() {
+		return os.Chmod(fullpath, o.mode(mode))
+	}
+	return nil
+}
+
+// restore gives the extracted entry the owner, extended attributes and
+// modification time recorded in its header, as far as the options ask for;
+// owners are mapped as they are set, which saves walking the tree afterwards
+func (o ExtractionOptions) restore(fullpath string, header *tar.Header) error {
+	if o.PreserveOwnership || len(o.UIDMappings) > 0 || len(o.GIDMappings) > 0 {
+		uid, gid, err := o.owner(header)
+		if err != nil {
+			return err
+		}
+
+		err = os.Lchown(fullpath, uid, gid)
+		if err != nil {
+			return err
+		}
+
+		// changing the owner clears the setuid and setgid bits
+		mode := o.mode(header.FileInfo().Mode())
+		if header.Typeflag != tar.TypeSymlink && mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			err = os.Chmod(fullpath, mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.PreserveXattrs && header.Typeflag != tar.TypeSymlink {
+		for key, value := range header.PAXRecords {
+			if !strings.HasPrefix(key, paxXattrPrefix) {
+				continue
+			}
+
+			err := setXattr(fullpath, strings.TrimPrefix(key, paxXattrPrefix), []byte(value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// directories are done once all of their entries are extracted, and the
+	// times of symbolic links cannot be set
+	if o.PreserveModTimes && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeSymlink {
+		accessTime := header.AccessTime
+		if accessTime.IsZero() {
+			accessTime = header.ModTime
+		}
+		return os.Chtimes(fullpath, accessTime, header.ModTime)
+	}
+	return nil
+}
+
+// modTimes collects the modification times of extracted directories, which
+// change as entries are extracted into them
+type modTimes []struct {
+	path    string
+	modTime time.Time
+}
+
+func (m *modTimes) add(path string, modTime time.Time) {
+	*m = append(*m, struct {
+		path    string
+		modTime time.Time
+	}{path, modTime})
+}
+
+func (m modTimes) restore() error {
+	for _, directory := range m {
+		err := os.Chtimes(directory.path, directory.modTime, directory.modTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTar expands the tarball into the destination directory and returns
+// the number and total size of the regular files it extracted
+func extractTar(tarBall io.Reader, destinationDir string, options ExtractionOptions, reporter *extractionReporter) (int, int64, error) {
+	var fileCount int
+	var sizeInBytes int64
+	var directories modTimes
+	limits := &extractionLimits{options: options}
+
+	tarBallReader := tar.NewReader(tarBall)
+	// Extracting tarred files
+	for {
+		header, err := tarBallReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, err
+		}
+
+		fullpath, err := extractionPath(destinationDir, header.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		err = limits.admit(header.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var written int64
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = options.makeDirectory(fullpath, header.FileInfo().Mode())
+			directories.add(fullpath, header.ModTime)
+
+		case tar.TypeSymlink:
+			if options.SkipSymlinks {
+				continue
+			}
+			err = symlink(destinationDir, header.Linkname, fullpath)
+
+		case tar.TypeLink:
+			written, err = extractTarHardlink(destinationDir, fullpath, header, options, limits)
+			fileCount++
+			sizeInBytes += written
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if !options.PreserveDevices {
+				continue
+			}
+			err = os.MkdirAll(filepath.Dir(fullpath), 0777)
+			if err == nil {
+				err = makeDevice(fullpath, header)
+			}
+
+		case tar.TypeXGlobalHeader:
+			continue
+
+		default:
+			// handle normal file
+			err = limits.grow(header.Size)
+			if err != nil {
+				break
+			}
+			written, err = writeExtractedFile(fullpath, tarBallReader, options.mode(header.FileInfo().Mode()))
+			fileCount++
+			sizeInBytes += written
+		}
+		if err == nil {
+			err = options.restore(fullpath, header)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		reporter.entryExtracted(written)
+	}
+
+	if options.PreserveModTimes {
+		err := directories.restore()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	reporter.done()
+	return fileCount, sizeInBytes, nil
+}
+
+// extractTarHardlink links, or copies, the file that the hardlink in the
+// tarball refers to, which has been extracted before it. The target must be a
+// regular file in the destination directory, so that a hardlink to a symbolic
+// link cannot copy a file from outside of it.
+func extractTarHardlink(destinationDir, fullpath string, header *tar.Header, options ExtractionOptions, limits *extractionLimits) (int64, error) {
+	target, err := extractionPath(destinationDir, header.Linkname)
+	if err != nil {
+		return 0, err
+	}
+
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return 0, err
+	}
+	if !targetInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("archive entry %s links to %s, which is not a regular file", header.Name, header.Linkname)
+	}
+
+	err = os.MkdirAll(filepath.Dir(fullpath), 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	if options.PreserveHardlinks {
+		return 0, os.Link(target, fullpath)
+	}
+
+	source, err := os.OpenFile(target, os.O_RDONLY|openNoFollow, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !os.SameFile(info, targetInfo) {
+		return 0, fmt.Errorf("archive entry %s links to %s, which changed while it was extracted", header.Name, header.Linkname)
+	}
+
+	err = limits.grow(info.Size())
+	if err != nil {
+		return 0, err
+	}
+	return writeExtractedFile(fullpath, source, info.Mode())
+}
+
+// refuseSymlinkedParents fails if a directory between the destination
+// directory and fullpath is a symbolic link, through which an entry could be
+// extracted outside of the destination directory
+func refuseSymlinkedParents(destinationDir, fullpath string) error {
+	if fullpath == filepath.Clean(destinationDir) {
+		return nil
+	}
+
+	relativePath, err := filepath.Rel(destinationDir, filepath.Dir(fullpath))
+	if err != nil || relativePath == "." {
+		return err
+	}
+
+	parent := destinationDir
+	for _, component := range strings.Split(relativePath, string(filepath.Separator)) {
+		parent = filepath.Join(parent, component)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			// the rest is created by the extraction
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isLink(info) {
+			return fmt.Errorf("archive entry %s is beneath the symbolic link %s", fullpath, parent)
+		}
+	}
+	return nil
+}
+
+// isLink reports whether info is a symbolic link or another reparse point,
+// such as a junction, which Lstat reports as irregular on Windows
+func isLink(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeSymlink|os.ModeIrregular) != 0
+}
+
+// writeExtractedFile writes the content of an archive entry to fullpath and
+// gives it the mode. An entry that was extracted to fullpath before is
+// replaced rather than written through, since it may be a symbolic link.
+func writeExtractedFile(fullpath string, content io.Reader, mode os.FileMode) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(fullpath), 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Lstat(fullpath)
+	if err == nil && !info.IsDir() {
+		err = os.Remove(fullpath)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	writer, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|openNoFollow, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := copyBuffered(writer, content)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return written, os.Chmod(fullpath, mode)
+}
@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// makeDevice creates the device node or FIFO of the tarball entry
+func makeDevice(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(path, mode, int(deviceNumber(header.Devmajor, header.Devminor)))
+}
+
+// deviceNumber encodes the major and minor numbers of a device the way Linux
+// does
+func deviceNumber(major, minor int64) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= uint64(minor) & 0x000000ff
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
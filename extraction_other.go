@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"fmt"
+	"runtime"
+)
+
+func makeDevice(path string, header *tar.Header) error {
+	return fmt.Errorf("cannot create %s: device nodes are not supported on %s", path, runtime.GOOS)
+}
+
+func setXattr(path, name string, value []byte) error {
+	return fmt.Errorf("cannot set %s on %s: extended attributes are not supported on %s", name, path, runtime.GOOS)
+}
@@ -0,0 +1,70 @@
+package cacheddownloader
+
+import "time"
+
+// DefaultExtractionProgressInterval is the minimum time between two extraction
+// progress reports when FetchOptions does not specify one.
+const DefaultExtractionProgressInterval = time.Second
+
+// ExtractionProgress describes how much of a tarball has been expanded into a
+// directory so far.
+type ExtractionProgress struct {
+	Entries      int
+	BytesWritten int64
+}
+
+type extractionReporter struct {
+	callback func(ExtractionProgress)
+	interval time.Duration
+	last     time.Time
+	reported int
+	progress ExtractionProgress
+}
+
+// newExtractionReporter returns nil if the options do not ask for progress; a
+// nil reporter ignores all updates.
+func newExtractionReporter(options FetchOptions) *extractionReporter {
+	if options.ExtractionProgress == nil {
+		return nil
+	}
+
+	interval := options.ExtractionProgressInterval
+	if interval == 0 {
+		interval = DefaultExtractionProgressInterval
+	}
+
+	return &extractionReporter{
+		callback: options.ExtractionProgress,
+		interval: interval,
+		last:     time.Now(),
+	}
+}
+
+func (r *extractionReporter) entryExtracted(bytesWritten int64) {
+	if r == nil {
+		return
+	}
+
+	r.progress.Entries++
+	r.progress.BytesWritten += bytesWritten
+
+	now := time.Now()
+	if now.Sub(r.last) >= r.interval {
+		r.last = now
+		r.report()
+	}
+}
+
+// done reports the final progress unless it has been reported already
+func (r *extractionReporter) done() {
+	if r == nil || r.reported == r.progress.Entries {
+		return
+	}
+
+	r.report()
+}
+
+func (r *extractionReporter) report() {
+	r.reported = r.progress.Entries
+	r.callback(r.progress)
+}
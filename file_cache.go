@@ -1,14 +1,12 @@
 package cacheddownloader
 
 import (
-	"archive/tar"
 	"errors"
 	"fmt"
-	"io"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/archiver/compressor"
@@ -21,32 +19,121 @@ var (
 	NotCacheable  = errors.New("Not cacheable directory")
 )
 
+// EvictionPreference controls which entries are ejected first when the cache
+// needs to make room.
+type EvictionPreference int
+
+const (
+	// EvictLeastRecentlyUsed ejects entries strictly by their last access time.
+	EvictLeastRecentlyUsed EvictionPreference = iota
+	// EvictFilesFirst ejects plain file entries before entries holding an
+	// expanded directory, which are more expensive to rebuild.
+	EvictFilesFirst
+	// EvictDirectoriesFirst ejects entries holding an expanded directory before
+	// plain file entries.
+	EvictDirectoriesFirst
+)
+
 type FileCache struct {
-	CachedPath     string
-	maxSizeInBytes int64
-	Entries        map[string]*FileCacheEntry
-	OldEntries     map[string]*FileCacheEntry
-	Seq            uint64
+	CachedPath         string
+	shardPaths         []string
+	maxSizeInBytes     int64
+	evictionPreference EvictionPreference
+	evictionPolicy     EvictionPolicy
+	Entries            map[string]*FileCacheEntry
+	OldEntries         map[string]*FileCacheEntry
+	Seq                uint64
+	statePath          string
+	evictions          int64
+	reaper             *reaper
+	events             entryEvents
+	permissions        Permissions
+	extraction         ExtractionOptions
+	retainArchives     bool
+	manifests          bool
+	atRest             atRest
+	sidecars           bool
 }
 
 type FileCacheEntry struct {
+	// Key is the cache key given to the cachedDownloader, before it was
+	// hashed, and Namespace the namespace it was fetched in, if any; Key is
+	// empty for entries saved before it was recorded. The entry is only served
+	// for that key and namespace, in case another key hashes to the same name.
+	// Labels are those given with the fetch that added the entry.
+	Key                   string
+	Namespace             string
+	Labels                map[string]string
 	Size                  int64
 	Access                time.Time
+	AccessCount           int64
 	CachingInfo           CachingInfoType
 	FilePath              string
 	ExpandedDirectoryPath string
-	directoryInUseCount   int
-	fileInUseCount        int
+	ExpandedFileCount     int
+	ExpandedSizeInBytes   int64
+	Validated             time.Time
+	TTL                   time.Duration
+	Digest                string
+	// Retained is set if the entry keeps both its archive and its expanded
+	// directory, see SetRetainArchives.
+	Retained bool
+	// Cacheable is set if the entry was admitted as cacheable, which it may
+	// have been without validators, see SetCacheabilityFunc. Entries saved
+	// before it was recorded are cacheable if they have validators.
+	Cacheable           bool
+	directoryInUseCount int
+	fileInUseCount      int
+	reaper              *reaper
 }
 
 func NewCache(dir string, maxSizeInBytes int64) *FileCache {
+	return NewShardedCache([]string{dir}, maxSizeInBytes)
+}
+
+// NewShardedCache returns a cache whose entries are spread across the given
+// directories by cache key. The size limit and eviction order apply to all of
+// the directories together. CachedPath is set to the first directory.
+func NewShardedCache(dirs []string, maxSizeInBytes int64) *FileCache {
 	return &FileCache{
-		CachedPath:     dir,
+		CachedPath:     dirs[0],
+		shardPaths:     dirs,
 		maxSizeInBytes: maxSizeInBytes,
 		Entries:        map[string]*FileCacheEntry{},
 		OldEntries:     map[string]*FileCacheEntry{},
 		Seq:            0,
+		reaper:         newReaper(),
+	}
+}
+
+// shards returns the directories that hold the entries of the cache
+func (c *FileCache) shards() []string {
+	if len(c.shardPaths) == 0 {
+		return []string{c.CachedPath}
+	}
+	return c.shardPaths
+}
+
+// shardFor deterministically picks the directory that holds the given key
+func (c *FileCache) shardFor(cacheKey string) string {
+	shards := c.shards()
+	if len(shards) == 1 {
+		return shards[0]
 	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(cacheKey))
+	return shards[hash.Sum32()%uint32(len(shards))]
+}
+
+// SetEvictionPreference changes which entries are ejected first when room is
+// needed. Entries within the same group are still ejected in the order of the
+// eviction policy, see SetEvictionPolicy. The default is
+// EvictLeastRecentlyUsed.
+func (c *FileCache) SetEvictionPreference(preference EvictionPreference) {
+	lock.Lock()
+	c.evictionPreference = preference
+	lock.Unlock()
 }
 
 func newFileCacheEntry(cachePath string, size int64, cachingInfo CachingInfoType) *FileCacheEntry {
@@ -56,6 +143,25 @@ func newFileCacheEntry(cachePath string, size int64, cachingInfo CachingInfoType
 		Access:                time.Now(),
 		CachingInfo:           cachingInfo,
 		ExpandedDirectoryPath: "",
+		Cacheable:             true,
+	}
+}
+
+// cacheable reports whether the entry may be kept when the cache is recovered
+func (e *FileCacheEntry) cacheable() bool {
+	return e.Cacheable || e.CachingInfo.isCacheable()
+}
+
+// isFresh reports whether the entry may still be served without revalidating
+// it with the origin
+func (e *FileCacheEntry) isFresh(now time.Time) bool {
+	switch {
+	case e.TTL == NeverRevalidate:
+		return true
+	case e.TTL <= 0:
+		return false
+	default:
+		return now.Before(e.Validated.Add(e.TTL))
 	}
 }
 
@@ -77,8 +183,8 @@ func (e *FileCacheEntry) decrementDirectoryInUseCount() {
 
 	// Delete the directory if the tarball is the only asset
 	// being used or if the directory has been removed (in use count -1)
-	if e.directoryInUseCount < 0 || (e.directoryInUseCount == 0 && e.fileInUseCount > 0) {
-		err := os.RemoveAll(e.ExpandedDirectoryPath)
+	if e.directoryInUseCount < 0 || (e.directoryInUseCount == 0 && e.fileInUseCount > 0 && !e.Retained) {
+		err := e.removePath(e.ExpandedDirectoryPath)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Unable to delete cached directory", err)
 		}
@@ -99,8 +205,8 @@ func (e *FileCacheEntry) decrementFileInUseCount() {
 
 	// Delete the file if the file is not being used and there is
 	// a directory of if the file has been removed (in use count -1)
-	if e.fileInUseCount < 0 || (e.fileInUseCount == 0 && e.directoryInUseCount > 0) {
-		err := os.RemoveAll(e.FilePath)
+	if e.fileInUseCount < 0 || (e.fileInUseCount == 0 && e.directoryInUseCount > 0 && !e.Retained) {
+		err := e.removePath(e.FilePath)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Unable to delete cached file", err)
 		}
@@ -125,7 +231,7 @@ func (e *FileCacheEntry) dirDoesNotExist() bool {
 }
 
 // Can we change this to be an io.ReadCloser return
-func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
+func (e *FileCacheEntry) readCloser(permissions Permissions) (*CachedFile, error) {
 	var f *os.File
 	var err error
 
@@ -136,13 +242,16 @@ func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
 		}
 
 		err = compressor.WriteTar(e.ExpandedDirectoryPath+"/", f)
+		if err == nil {
+			err = permissions.applyToFile(e.FilePath)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		// If the directory is not used remove it
-		if e.directoryInUseCount == 0 {
-			err = os.RemoveAll(e.ExpandedDirectoryPath)
+		// If the directory is not used, nor retained, remove it
+		if e.directoryInUseCount == 0 && !e.Retained {
+			err = e.removePath(e.ExpandedDirectoryPath)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Unable to remove cached directory", err)
 			}
@@ -172,18 +281,29 @@ func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
 	return readCloser, nil
 }
 
-func (e *FileCacheEntry) expandedDirectory() (string, error) {
+func (e *FileCacheEntry) expandedDirectory(reporter *extractionReporter, permissions Permissions, extraction ExtractionOptions, rest atRest, manifest bool) (string, error) {
 	// if it has not been extracted before expand it!
 	if e.dirDoesNotExist() {
 		e.ExpandedDirectoryPath = e.FilePath + ".d"
-		err := extractTarToDirectory(e.FilePath, e.ExpandedDirectoryPath)
+		fileCount, sizeInBytes, err := extractArchiveToDirectory(e.FilePath, e.ExpandedDirectoryPath, rest, extraction, reporter)
+		if err == nil {
+			err = permissions.applyToTree(e.ExpandedDirectoryPath)
+		}
+		if err == nil && manifest {
+			err = writeManifest(e.ExpandedDirectoryPath)
+		}
 		if err != nil {
+			// do not serve what was expanded so far
+			removeAll(e.ExpandedDirectoryPath)
+			e.ExpandedDirectoryPath = ""
 			return "", err
 		}
+		e.ExpandedFileCount = fileCount
+		e.ExpandedSizeInBytes = sizeInBytes
 
-		// If the file is not in use, we can delete it
-		if e.fileInUseCount == 0 {
-			err = os.RemoveAll(e.FilePath)
+		// If the file is not in use, nor retained, we can delete it
+		if e.fileInUseCount == 0 && !e.Retained {
+			err = e.removePath(e.FilePath)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Unable to delete the cached file", err)
 			}
@@ -226,54 +346,138 @@ func (c *FileCache) CloseDirectory(cacheKey, dirPath string) error {
 }
 
 func (c *FileCache) Add(cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
+	stagedPath, err := c.stage(cacheKey, sourcePath, size)
+	if err != nil {
+		return nil, err
+	}
+
 	lock.Lock()
 	defer lock.Unlock()
 
+	newEntry, err := c.add(cacheKey, stagedPath, size, cachingInfo)
+	if err != nil {
+		os.Remove(stagedPath)
+		return nil, err
+	}
+	return newEntry.readCloser(c.permissions)
+}
+
+// AddArchive adds the tarball at sourcePath without expanding it; it is
+// expanded, and the size of the entry grows accordingly, when the entry is
+// first got with GetDirectory.
+func (c *FileCache) AddArchive(cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) error {
+	stagedPath, err := c.stage(cacheKey, sourcePath, size)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err = c.add(cacheKey, stagedPath, size, cachingInfo)
+	if err != nil {
+		os.Remove(stagedPath)
+	}
+	return err
+}
+
+// stage makes room for size bytes, and then moves the file at sourcePath into
+// the shard of cacheKey, see stageFile. Since the lock is released in between,
+// the room is made again when the file is added.
+func (c *FileCache) stage(cacheKey, sourcePath string, size int64) (string, error) {
+	lock.Lock()
+	c.makeRoom(size, "")
+	lock.Unlock()
+
+	return stageFile(sourcePath, c.shardFor(cacheKey))
+}
+
+// add makes the file at stagedPath, which must be in the shard of cacheKey,
+// the new entry for cacheKey
+func (c *FileCache) add(cacheKey, stagedPath string, size int64, cachingInfo CachingInfoType) (*FileCacheEntry, error) {
 	oldEntry := c.Entries[cacheKey]
 
 	c.makeRoom(size, "")
 
 	c.Seq++
 	uniqueName := fmt.Sprintf("%s-%d-%d", cacheKey, time.Now().UnixNano(), c.Seq)
-	cachePath := filepath.Join(c.CachedPath, uniqueName)
+	cachePath := filepath.Join(c.shardFor(cacheKey), uniqueName)
+
+	err := os.Rename(stagedPath, cachePath)
+	if err != nil {
+		return nil, err
+	}
 
-	err := os.Rename(sourcePath, cachePath)
+	err = c.permissions.applyToFile(cachePath)
 	if err != nil {
+		os.Remove(cachePath)
 		return nil, err
 	}
 
 	newEntry := newFileCacheEntry(cachePath, size, cachingInfo)
+	newEntry.reaper = c.reaper
+	newEntry.Retained = c.retainArchives
 	c.Entries[cacheKey] = newEntry
 	if oldEntry != nil {
+		c.record(EntryExpired, cacheKey, oldEntry)
+		newEntry.AccessCount = oldEntry.AccessCount
+		newEntry.Labels = oldEntry.Labels
 		oldEntry.decrementUse()
 		c.updateOldEntries(cacheKey, oldEntry)
 	}
-	return newEntry.readCloser()
+	c.persist()
+	return newEntry, nil
 }
 
 func (c *FileCache) AddDirectory(cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (string, error) {
+	return c.addDirectory(cacheKey, sourcePath, size, cachingInfo, nil)
+}
+
+func (c *FileCache) addDirectory(cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, reporter *extractionReporter) (string, error) {
+	stagedPath, err := c.stage(cacheKey, sourcePath, size)
+	if err != nil {
+		return "", err
+	}
+
 	lock.Lock()
 	defer lock.Unlock()
 
 	oldEntry := c.Entries[cacheKey]
 
+	if c.retainArchives {
+		// the entry holds both the archive and the directory
+		size = size * 2
+	}
 	c.makeRoom(size, "")
 
 	c.Seq++
 	uniqueName := fmt.Sprintf("%s-%d-%d", cacheKey, time.Now().UnixNano(), c.Seq)
-	cachePath := filepath.Join(c.CachedPath, uniqueName)
+	cachePath := filepath.Join(c.shardFor(cacheKey), uniqueName)
+
+	err = os.Rename(stagedPath, cachePath)
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
 
-	err := os.Rename(sourcePath, cachePath)
+	err = c.permissions.applyToFile(cachePath)
 	if err != nil {
+		os.Remove(cachePath)
 		return "", err
 	}
 	newEntry := newFileCacheEntry(cachePath, size, cachingInfo)
+	newEntry.reaper = c.reaper
+	newEntry.Retained = c.retainArchives
 	c.Entries[cacheKey] = newEntry
 	if oldEntry != nil {
+		c.record(EntryExpired, cacheKey, oldEntry)
+		newEntry.AccessCount = oldEntry.AccessCount
+		newEntry.Labels = oldEntry.Labels
 		oldEntry.decrementUse()
 		c.updateOldEntries(cacheKey, oldEntry)
 	}
-	return newEntry.expandedDirectory()
+	c.persist()
+	return newEntry.expandedDirectory(reporter, c.permissions, c.extraction, c.atRest, c.manifests)
 }
 
 func (c *FileCache) Get(cacheKey string) (*CachedFile, CachingInfoType, error) {
@@ -287,10 +491,12 @@ func (c *FileCache) Get(cacheKey string) (*CachedFile, CachingInfoType, error) {
 
 	if entry.fileDoesNotExist() {
 		c.makeRoom(entry.Size, cacheKey)
+		c.persist()
 	}
 
 	entry.Access = time.Now()
-	readCloser, err := entry.readCloser()
+	entry.AccessCount++
+	readCloser, err := entry.readCloser(c.permissions)
 	if err != nil {
 		return nil, CachingInfoType{}, err
 	}
@@ -299,6 +505,10 @@ func (c *FileCache) Get(cacheKey string) (*CachedFile, CachingInfoType, error) {
 }
 
 func (c *FileCache) GetDirectory(cacheKey string) (string, CachingInfoType, error) {
+	return c.getDirectory(cacheKey, nil)
+}
+
+func (c *FileCache) getDirectory(cacheKey string, reporter *extractionReporter) (string, CachingInfoType, error) {
 	lock.Lock()
 	defer lock.Unlock()
 
@@ -312,10 +522,12 @@ func (c *FileCache) GetDirectory(cacheKey string) (string, CachingInfoType, erro
 		// Do we have enough room to double the size?
 		c.makeRoom(entry.Size, cacheKey)
 		entry.Size = entry.Size * 2
+		c.persist()
 	}
 
 	entry.Access = time.Now()
-	dir, err := entry.expandedDirectory()
+	entry.AccessCount++
+	dir, err := entry.expandedDirectory(reporter, c.permissions, c.extraction, c.atRest, c.manifests)
 	if err != nil {
 		return "", CachingInfoType{}, err
 	}
@@ -323,15 +535,56 @@ func (c *FileCache) GetDirectory(cacheKey string) (string, CachingInfoType, erro
 	return dir, entry.CachingInfo, nil
 }
 
-func (c *FileCache) Remove(cacheKey string) {
+// directoryInfo describes the contents of the given expanded directory of the
+// entry, which may since have been replaced by a newer entry
+func (c *FileCache) directoryInfo(cacheKey, dirPath string) DirectoryInfo {
 	lock.Lock()
-	c.remove(cacheKey)
-	lock.Unlock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil || entry.ExpandedDirectoryPath != dirPath {
+		entry = c.OldEntries[cacheKey+dirPath]
+	}
+
+	info := DirectoryInfo{Path: dirPath}
+	if entry != nil {
+		info.FileCount = entry.ExpandedFileCount
+		info.SizeInBytes = entry.ExpandedSizeInBytes
+		info.Labels = copyLabels(entry.Labels)
+	}
+	return info
 }
 
-func (c *FileCache) remove(cacheKey string) {
+// MarkValidated records that the entry for cacheKey has just been confirmed to
+// be current, and may be served without revalidation for the given ttl.
+func (c *FileCache) MarkValidated(cacheKey string, ttl time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	entry := c.Entries[cacheKey]
 	if entry != nil {
+		entry.Validated = time.Now()
+		entry.TTL = ttl
+	}
+}
+
+// IsFresh reports whether the entry for cacheKey is still within its TTL.
+func (c *FileCache) IsFresh(cacheKey string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	return entry != nil && entry.isFresh(time.Now())
+}
+
+func (c *FileCache) Remove(cacheKey string) {
+	c.removeAs(cacheKey, EntryRemoved)
+}
+
+func (c *FileCache) remove(cacheKey string, eventType EntryEventType) {
+	entry := c.Entries[cacheKey]
+	if entry != nil {
+		c.record(eventType, cacheKey, entry)
 		entry.decrementUse()
 		c.updateOldEntries(cacheKey, entry)
 		delete(c.Entries, cacheKey)
@@ -353,116 +606,74 @@ func (c *FileCache) updateOldEntries(cacheKey string, entry *FileCacheEntry) {
 func (c *FileCache) makeRoom(size int64, excludedCacheKey string) {
 	usedSpace := c.usedSpace()
 	for c.maxSizeInBytes < usedSpace+size {
-		var oldestEntry *FileCacheEntry
-		oldestAccessTime, oldestCacheKey := time.Now(), ""
-		for ck, f := range c.Entries {
-			if f.Access.Before(oldestAccessTime) && ck != excludedCacheKey && !f.inUse() {
-				oldestAccessTime = f.Access
-				oldestEntry = f
-				oldestCacheKey = ck
-			}
-		}
-
+		oldestCacheKey, oldestEntry := c.evictionCandidate(excludedCacheKey, nil)
 		if oldestEntry == nil {
 			// could not find anything we could remove
 			return
 		}
 
 		usedSpace -= oldestEntry.Size
-		c.remove(oldestCacheKey)
+		c.remove(oldestCacheKey, EntryEvicted)
+		c.evictions++
 	}
 
 	return
 }
 
-func (c *FileCache) usedSpace() int64 {
-	space := int64(0)
-	for _, f := range c.Entries {
-		space += f.Size
-	}
-	return space
-}
-
-func extractTarToDirectory(sourcePath, destinationDir string) error {
-	_, err := os.Stat(destinationDir)
-	if err != nil && err.(*os.PathError).Err != syscall.ENOENT {
-		return err
-	}
+// evictionCandidate picks the entry to evict next among those that within
+// accepts, or among all entries if within is nil
+func (c *FileCache) evictionCandidate(excludedCacheKey string, within func(*FileCacheEntry) bool) (string, *FileCacheEntry) {
+	var candidate *FileCacheEntry
+	now, candidateKey := time.Now(), ""
+	for ck, f := range c.Entries {
+		if !f.Access.Before(now) || ck == excludedCacheKey || f.inUse() {
+			continue
+		}
+		if within != nil && !within(f) {
+			continue
+		}
 
-	file, err := os.Open(sourcePath)
-	if err != nil {
-		return err
+		if candidate == nil || c.evictBefore(f, candidate, now) {
+			candidate = f
+			candidateKey = ck
+		}
 	}
 
-	defer file.Close()
-
-	var fileReader io.ReadCloser = file
-
-	// Make the target directory
-	err = os.MkdirAll(destinationDir, 0777)
-	if err != nil {
-		return err
-	}
+	return candidateKey, candidate
+}
 
-	tarBallReader := tar.NewReader(fileReader)
-	// Extracting tarred files
-	for {
-		header, err := tarBallReader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// evictBefore reports whether entry should be ejected ahead of other
+func (c *FileCache) evictBefore(entry, other *FileCacheEntry, now time.Time) bool {
+	entryIsDir := entry.ExpandedDirectoryPath != ""
+	otherIsDir := other.ExpandedDirectoryPath != ""
+
+	if entryIsDir != otherIsDir {
+		switch c.evictionPreference {
+		case EvictFilesFirst:
+			return otherIsDir
+		case EvictDirectoriesFirst:
+			return entryIsDir
 		}
+	}
 
-		// get the individual filename and extract to the current directory
-		filename := header.Name
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// handle directory
-			fullpath := filepath.Join(destinationDir, filename)
-			err = os.MkdirAll(fullpath, os.FileMode(header.Mode))
-
-			if err != nil {
-				return err
-			}
-
-		case tar.TypeSymlink:
-			// handle normal file
-			fullpath := filepath.Join(destinationDir, filename)
-
-			err := os.Symlink(header.Linkname, fullpath)
-			if err != nil {
-				return err
-			}
-
-		default:
-			// handle normal file
-			fullpath := filepath.Join(destinationDir, filename)
-
-			err := os.MkdirAll(filepath.Dir(fullpath), 0777)
-			if err != nil {
-				return err
-			}
-
-			writer, err := os.Create(fullpath)
-
-			if err != nil {
-				return err
-			}
-
-			io.Copy(writer, tarBallReader)
-
-			err = os.Chmod(fullpath, os.FileMode(header.Mode))
-
-			if err != nil {
-				return err
-			}
+	if c.evictionPolicy != nil {
+		return c.evictionPolicy.EvictBefore(entry, other, now)
+	}
+	return LeastRecentlyUsedPolicy.EvictBefore(entry, other, now)
+}
 
-			writer.Close()
+// Usage returns the number of entries in the cache, the space they take up and
+// the maximum size of the cache.
+func (c *FileCache) Usage() (entries int, usedSizeInBytes int64, maxSizeInBytes int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	return len(c.Entries), c.usedSpace(), c.maxSizeInBytes
+}
 
-		}
+func (c *FileCache) usedSpace() int64 {
+	space := int64(0)
+	for _, f := range c.Entries {
+		space += f.Size
 	}
-	return nil
+	return space
 }
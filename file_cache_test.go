@@ -2,11 +2,14 @@ package cacheddownloader_test
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/cacheddownloader"
 	. "github.com/onsi/ginkgo"
@@ -183,6 +186,37 @@ var _ = Describe("FileCache", func() {
 				Expect(readCloser).NotTo(BeNil())
 			})
 		})
+
+		Context("when the source is on another filesystem", func() {
+			var otherFilesystem string
+
+			BeforeEach(func() {
+				if info, err := os.Stat("/dev/shm"); err != nil || !info.IsDir() {
+					Skip("no tmpfs at /dev/shm")
+				}
+				otherFilesystem, err = ioutil.TempDir("/dev/shm", "cache-test-source")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(otherFilesystem)
+			})
+
+			It("copies the file into the cache", func() {
+				source := filepath.Join(otherFilesystem, "source")
+				Expect(ioutil.WriteFile(source, []byte("the-file-content"), 0600)).To(Succeed())
+
+				readCloser, err := cache.Add(cacheKey, source, fileSize, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+				defer readCloser.Close()
+
+				content, err := ioutil.ReadAll(readCloser)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("the-file-content"))
+				Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+				Expect(source).NotTo(BeAnExistingFile())
+			})
+		})
 	})
 
 	Describe("AddDirectory", func() {
@@ -339,6 +373,29 @@ var _ = Describe("FileCache", func() {
 		})
 	})
 
+	Describe("AddArchive", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		BeforeEach(func() {
+			cacheInfo.LastModified = "1234"
+			Expect(cache.AddArchive("the-cache-key", sourceArchive.Name(), 100, cacheInfo)).To(Succeed())
+		})
+
+		It("does not expand the archive", func() {
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+			Expect(cache.Entries["the-cache-key"].ExpandedDirectoryPath).To(BeEmpty())
+			Expect(cache.Entries["the-cache-key"].Size).To(BeEquivalentTo(100))
+		})
+
+		It("expands the archive on the first GetDirectory and accounts for it then", func() {
+			dir, _, err := cache.GetDirectory("the-cache-key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+			Expect(cache.Entries["the-cache-key"].Size).To(BeEquivalentTo(200))
+			Expect(cache.CloseDirectory("the-cache-key", dir)).To(Succeed())
+		})
+	})
+
 	Describe("Get", func() {
 		var cacheKey string
 		var fileSize int64
@@ -801,6 +858,638 @@ var _ = Describe("FileCache", func() {
 		})
 	})
 
+	Describe("SetEvictionPreference", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+			cacheInfo.LastModified = "1234"
+
+			// the directory entry is the least recently used one
+			dir, err := cache.AddDirectory("directory-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory("directory-key", dir)).To(Succeed())
+
+			reader, err := cache.Add("file-key", sourceFile.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			newSourceFile := createFile("cache-test-file", "new-file-content")
+			defer os.RemoveAll(newSourceFile.Name())
+
+			reader, err := cache.Add("new-key", newSourceFile.Name(), 200, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		Context("by default", func() {
+			It("evicts the least recently used entry", func() {
+				_, _, err := cache.GetDirectory("directory-key")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+
+				reader, _, err := cache.Get("file-key")
+				Expect(err).NotTo(HaveOccurred())
+				reader.Close()
+			})
+		})
+
+		Context("when preferring to evict files", func() {
+			BeforeEach(func() {
+				cache.SetEvictionPreference(cacheddownloader.EvictFilesFirst)
+			})
+
+			It("evicts file entries before directory entries", func() {
+				_, _, err := cache.Get("file-key")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+
+				dir, _, err := cache.GetDirectory("directory-key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dir).To(BeADirectory())
+			})
+		})
+
+		Context("when preferring to evict directories", func() {
+			BeforeEach(func() {
+				cache.SetEvictionPreference(cacheddownloader.EvictDirectoriesFirst)
+			})
+
+			It("evicts directory entries before file entries", func() {
+				_, _, err := cache.GetDirectory("directory-key")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+
+				reader, _, err := cache.Get("file-key")
+				Expect(err).NotTo(HaveOccurred())
+				reader.Close()
+			})
+		})
+	})
+
+	Describe("SetEvictionPolicy", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		add := func(cacheKey, content string, size int64) {
+			source := createFile("cache-test-file", content)
+			defer os.RemoveAll(source.Name())
+
+			reader, err := cache.Add(cacheKey, source.Name(), size, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		}
+
+		get := func(cacheKey string) error {
+			reader, _, err := cache.Get(cacheKey)
+			if err == nil {
+				reader.Close()
+			}
+			return err
+		}
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+			cacheInfo.LastModified = "1234"
+		})
+
+		Context("when evicting the least frequently used entry", func() {
+			BeforeEach(func() {
+				add("hot-key", "hot", 100)
+				add("cold-key", "cold", 100)
+				for i := 0; i < 3; i++ {
+					Expect(get("hot-key")).To(Succeed())
+				}
+				// the cold entry is the most recently used one
+				Expect(get("cold-key")).To(Succeed())
+			})
+
+			It("evicts the least recently used entry by default", func() {
+				add("new-key", "new", 200)
+				Expect(get("hot-key")).To(Equal(cacheddownloader.EntryNotFound))
+				Expect(get("cold-key")).To(Succeed())
+			})
+
+			It("evicts the entry that was used the fewest times", func() {
+				cache.SetEvictionPolicy(cacheddownloader.LeastFrequentlyUsedPolicy)
+				add("new-key", "new", 200)
+				Expect(get("cold-key")).To(Equal(cacheddownloader.EntryNotFound))
+				Expect(get("hot-key")).To(Succeed())
+			})
+		})
+
+		Context("when weighting entries by their size", func() {
+			BeforeEach(func() {
+				add("small-key", "small", 50)
+				time.Sleep(50 * time.Millisecond)
+				add("huge-key", "huge", 200)
+				time.Sleep(50 * time.Millisecond)
+			})
+
+			It("evicts the huge entry although it was used more recently", func() {
+				cache.SetEvictionPolicy(cacheddownloader.SizeWeightedPolicy)
+				add("new-key", "new", 100)
+				Expect(get("huge-key")).To(Equal(cacheddownloader.EntryNotFound))
+				Expect(get("small-key")).To(Succeed())
+			})
+		})
+
+		It("accepts custom policies", func() {
+			add("a-key", "a", 100)
+			add("b-key", "b", 100)
+
+			cache.SetEvictionPolicy(cacheddownloader.EvictionPolicyFunc(func(entry, other *cacheddownloader.FileCacheEntry, now time.Time) bool {
+				return entry.Access.After(other.Access)
+			}))
+			add("new-key", "new", 200)
+			Expect(get("b-key")).To(Equal(cacheddownloader.EntryNotFound))
+			Expect(get("a-key")).To(Succeed())
+		})
+	})
+
+	Describe("SetPermissions", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		BeforeEach(func() {
+			cacheInfo.LastModified = "1234"
+			Expect(cache.SetPermissions(cacheddownloader.Permissions{
+				FileMode:      0644,
+				DirectoryMode: 0755,
+				Chown:         true,
+				UID:           os.Getuid(),
+				GID:           os.Getgid(),
+			})).To(Succeed())
+		})
+
+		It("changes the mode of the cached path", func() {
+			info, err := os.Stat(cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+
+		It("gives cached files the file mode", func() {
+			reader, err := cache.Add("file-key", sourceFile.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			info, err := os.Stat(reader.Name())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+		})
+
+		It("gives expanded directories the directory mode", func() {
+			dir, err := cache.AddDirectory("dir-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			defer cache.CloseDirectory("dir-key", dir)
+
+			info, err := os.Stat(dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+	})
+
+	Describe("SetExtractionOptions", func() {
+		var (
+			cacheInfo   cacheddownloader.CachingInfoType
+			archivePath string
+			modTime     time.Time
+			dir         string
+		)
+
+		BeforeEach(func() {
+			cacheInfo.LastModified = "1234"
+			modTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+			archive, err := ioutil.TempFile("", "extraction-archive")
+			Expect(err).NotTo(HaveOccurred())
+			archivePath = archive.Name()
+
+			writer := tar.NewWriter(archive)
+			for _, header := range []*tar.Header{
+				{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime},
+				{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, ModTime: modTime},
+				{Name: "bin/tool-link", Typeflag: tar.TypeLink, Linkname: "bin/tool", ModTime: modTime},
+				{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "bin", ModTime: modTime},
+				{Name: "pipe", Typeflag: tar.TypeFifo, Mode: 0644, ModTime: modTime},
+			} {
+				Expect(writer.WriteHeader(header)).To(Succeed())
+				if header.Size > 0 {
+					_, err = writer.Write([]byte("tool"))
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}
+			Expect(writer.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			cache.CloseDirectory("dir-key", dir)
+			os.RemoveAll(archivePath)
+		})
+
+		Context("by default", func() {
+			BeforeEach(func() {
+				dir, err = cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("extracts files without their setuid bits", func() {
+				info, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode()).To(Equal(os.FileMode(0755)))
+				Expect(info.ModTime()).NotTo(BeTemporally("==", modTime))
+			})
+
+			It("copies the target of hardlinks", func() {
+				Expect(ioutil.ReadFile(filepath.Join(dir, "bin", "tool-link"))).To(Equal([]byte("tool")))
+
+				tool, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+				Expect(err).NotTo(HaveOccurred())
+				link, err := os.Stat(filepath.Join(dir, "bin", "tool-link"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.SameFile(tool, link)).To(BeFalse())
+			})
+
+			It("keeps symbolic links", func() {
+				Expect(os.Readlink(filepath.Join(dir, "current"))).To(Equal("bin"))
+			})
+
+			It("leaves out device nodes and FIFOs", func() {
+				_, err := os.Lstat(filepath.Join(dir, "pipe"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Context("when preservation is asked for", func() {
+			BeforeEach(func() {
+				if runtime.GOOS != "linux" {
+					Skip("device nodes are only supported on Linux")
+				}
+
+				cache.SetExtractionOptions(cacheddownloader.ExtractionOptions{
+					SkipSymlinks:         true,
+					PreserveHardlinks:    true,
+					PreserveDevices:      true,
+					PreserveSpecialModes: true,
+					PreserveModTimes:     true,
+				})
+				dir, err = cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("keeps setuid bits and modification times", func() {
+				info, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode()).To(Equal(os.ModeSetuid | 0755))
+				Expect(info.ModTime()).To(BeTemporally("==", modTime))
+
+				info, err = os.Stat(filepath.Join(dir, "bin"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ModTime()).To(BeTemporally("==", modTime))
+			})
+
+			It("links hardlinks to their target", func() {
+				tool, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+				Expect(err).NotTo(HaveOccurred())
+				link, err := os.Stat(filepath.Join(dir, "bin", "tool-link"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.SameFile(tool, link)).To(BeTrue())
+			})
+
+			It("creates FIFOs", func() {
+				info, err := os.Lstat(filepath.Join(dir, "pipe"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode() & os.ModeNamedPipe).NotTo(BeZero())
+			})
+
+			It("skips symbolic links", func() {
+				_, err := os.Lstat(filepath.Join(dir, "current"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Context("when owners are remapped", func() {
+			var options cacheddownloader.ExtractionOptions
+
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("ownership is not supported on Windows")
+				}
+
+				// the entries of the archive are owned by root
+				options = cacheddownloader.ExtractionOptions{
+					UIDMappings: []cacheddownloader.IDMapping{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+					GIDMappings: []cacheddownloader.IDMapping{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+				}
+			})
+
+			JustBeforeEach(func() {
+				cache.SetExtractionOptions(options)
+				dir, err = cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			})
+
+			It("gives the entries their mapped owners", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(dir, "bin", "tool")).To(BeARegularFile())
+			})
+
+			Context("when an owner is not mapped", func() {
+				BeforeEach(func() {
+					options.UIDMappings[0].ContainerID = 1000
+				})
+
+				It("fails and removes what was expanded", func() {
+					Expect(err).To(MatchError(ContainSubstring("unmapped uid 0")))
+					Expect(filepath.Glob(filepath.Join(cacheDir, "*.d"))).To(BeEmpty())
+				})
+			})
+		})
+	})
+
+	Describe("extracting untrusted archives", func() {
+		var (
+			cacheInfo   cacheddownloader.CachingInfoType
+			outside     string
+			archivePath string
+		)
+
+		writeTar := func(headers ...*tar.Header) {
+			archive, err := ioutil.TempFile("", "untrusted-archive")
+			Expect(err).NotTo(HaveOccurred())
+			archivePath = archive.Name()
+
+			writer := tar.NewWriter(archive)
+			for _, header := range headers {
+				Expect(writer.WriteHeader(header)).To(Succeed())
+				if header.Size > 0 {
+					_, err = writer.Write([]byte(strings.Repeat("x", int(header.Size))))
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}
+			Expect(writer.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			cacheInfo.LastModified = "1234"
+
+			outside, err = ioutil.TempDir("", "outside")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outside)
+			os.RemoveAll(archivePath)
+		})
+
+		It("refuses hardlinks to symbolic links", func() {
+			writeTar(
+				&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "secret")},
+				&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"},
+			)
+
+			_, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).To(MatchError(ContainSubstring("not a regular file")))
+			Expect(recursiveList(cacheDir)).NotTo(ContainElement(ContainSubstring("/b")))
+		})
+
+		It("refuses hardlinks to files beneath symbolic links", func() {
+			writeTar(
+				&tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "d/secret"},
+			)
+
+			_, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).To(MatchError(ContainSubstring("beneath the symbolic link")))
+		})
+
+		It("refuses tar entries beneath symbolic links", func() {
+			writeTar(
+				&tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				&tar.Header{Name: "d/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			)
+
+			_, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).To(MatchError(ContainSubstring("beneath the symbolic link")))
+			Expect(filepath.Join(outside, "x")).NotTo(BeAnExistingFile())
+		})
+
+		It("refuses tar directories that are symbolic links", func() {
+			writeTar(
+				&tar.Header{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+				&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0777},
+			)
+
+			_, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).To(MatchError(ContainSubstring("is a symbolic link")))
+		})
+
+		It("replaces symbolic links rather than writing through them", func() {
+			writeTar(
+				&tar.Header{Name: "f", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "secret")},
+				&tar.Header{Name: "f", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			)
+
+			dir, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			defer cache.CloseDirectory("dir-key", dir)
+
+			Expect(ioutil.ReadFile(filepath.Join(dir, "f"))).To(Equal([]byte("x")))
+			Expect(ioutil.ReadFile(filepath.Join(outside, "secret"))).To(Equal([]byte("secret")))
+		})
+
+		It("refuses zip entries beneath symbolic links", func() {
+			archive, err := ioutil.TempFile("", "untrusted-archive")
+			Expect(err).NotTo(HaveOccurred())
+			archivePath = archive.Name()
+
+			writer := zip.NewWriter(archive)
+			link := &zip.FileHeader{Name: "d"}
+			link.SetMode(os.ModeSymlink | 0777)
+			w, err := writer.CreateHeader(link)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.Write([]byte(outside))
+			Expect(err).NotTo(HaveOccurred())
+			w, err = writer.Create("d/x")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.Write([]byte("x"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+
+			_, err = cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			Expect(err).To(MatchError(ContainSubstring("beneath the symbolic link")))
+			Expect(filepath.Join(outside, "x")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("SetRetainArchives", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		BeforeEach(func() {
+			cache.SetRetainArchives(true)
+			cacheInfo.LastModified = "1234"
+		})
+
+		It("keeps the archive of a directory once it is closed", func() {
+			archive, err := ioutil.ReadFile(sourceArchive.Name())
+			Expect(err).NotTo(HaveOccurred())
+
+			dir, err := cache.AddDirectory("the-cache-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory("the-cache-key", dir)).To(Succeed())
+			Expect(cache.Entries["the-cache-key"].Size).To(BeEquivalentTo(200))
+
+			reader, _, err := cache.Get("the-cache-key")
+			Expect(err).NotTo(HaveOccurred())
+			content, err := ioutil.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(content).To(Equal(archive))
+			Expect(dir).To(BeADirectory())
+		})
+
+		It("keeps the directory of an archive once it is closed", func() {
+			reader, err := cache.Add("the-cache-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			dir, _, err := cache.GetDirectory("the-cache-key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory("the-cache-key", dir)).To(Succeed())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(cache.Entries["the-cache-key"].Size).To(BeEquivalentTo(200))
+			Expect(cache.Entries["the-cache-key"].FilePath).To(BeAnExistingFile())
+			Expect(dir).To(BeADirectory())
+		})
+
+		It("still removes both once the entry is evicted", func() {
+			dir, err := cache.AddDirectory("the-cache-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			filePath := cache.Entries["the-cache-key"].FilePath
+			Expect(cache.CloseDirectory("the-cache-key", dir)).To(Succeed())
+
+			cache.Remove("the-cache-key")
+			Expect(dir).NotTo(BeADirectory())
+			Expect(filePath).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("SetDirectoryManifests", func() {
+		var (
+			cacheInfo cacheddownloader.CachingInfoType
+			dir       string
+		)
+
+		BeforeEach(func() {
+			cache.SetDirectoryManifests(true)
+			cacheInfo.LastModified = "1234"
+		})
+
+		JustBeforeEach(func() {
+			dir, err = cache.AddDirectory("the-cache-key", sourceArchive.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			cache.CloseDirectory("the-cache-key", dir)
+		})
+
+		It("verifies a directory that was not modified", func() {
+			Expect(cache.VerifyDirectory("the-cache-key")).To(Succeed())
+		})
+
+		It("reports the paths that were modified", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "testdir", "file.txt"), []byte("changed"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "testdir", "new.txt"), []byte("new"), 0600)).To(Succeed())
+			Expect(os.Remove(filepath.Join(dir, "diego.txt"))).To(Succeed())
+
+			Expect(cache.VerifyDirectory("the-cache-key")).To(Equal(cacheddownloader.NewDirectoryModifiedError(
+				[]string{"testdir/new.txt"},
+				[]string{"diego.txt"},
+				[]string{"testdir/file.txt"},
+			)))
+		})
+
+		It("removes the manifest with the directory", func() {
+			Expect(cache.CloseDirectory("the-cache-key", dir)).To(Succeed())
+			cache.Remove("the-cache-key")
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+
+		Context("when the directory was expanded without a manifest", func() {
+			BeforeEach(func() {
+				cache.SetDirectoryManifests(false)
+			})
+
+			It("returns NoManifest", func() {
+				Expect(cache.VerifyDirectory("the-cache-key")).To(Equal(cacheddownloader.NoManifest))
+			})
+		})
+
+		Context("when the entry has no directory", func() {
+			It("returns EntryNotFound", func() {
+				Expect(cache.VerifyDirectory("another-cache-key")).To(Equal(cacheddownloader.EntryNotFound))
+			})
+		})
+	})
+
+	Describe("SetBackgroundDeletion", func() {
+		var cacheInfo cacheddownloader.CachingInfoType
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+			cache.SetBackgroundDeletion(true)
+			cacheInfo.LastModified = "1234"
+		})
+
+		It("moves evicted directories to the trash and deletes them in the background", func() {
+			dir, err := cache.AddDirectory("dir-key", sourceArchive.Name(), 200, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory("dir-key", dir)).To(Succeed())
+
+			reader, err := cache.Add("file-key", sourceFile.Name(), 200, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			_, _, err = cache.GetDirectory("dir-key")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			Expect(dir).NotTo(BeADirectory())
+
+			cache.WaitForDeletions()
+			Expect(filenamesInDir(filepath.Join(cacheDir, ".trash"))).To(BeEmpty())
+		})
+
+		It("removes entries the same way", func() {
+			reader, err := cache.Add("file-key", sourceFile.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			cache.Remove("file-key")
+			cache.WaitForDeletions()
+			Expect(filenamesInDir(cacheDir)).To(Equal([]string{".trash"}))
+			Expect(filenamesInDir(filepath.Join(cacheDir, ".trash"))).To(BeEmpty())
+		})
+
+		It("does not touch the working directory when removing entries without a directory", func() {
+			workingDir, err := os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			emptyDir, err := ioutil.TempDir("", "working-dir")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(emptyDir)
+			Expect(os.Chdir(emptyDir)).To(Succeed())
+			defer os.Chdir(workingDir)
+
+			reader, err := cache.Add("file-key", sourceFile.Name(), 100, cacheInfo)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			cache.Remove("file-key")
+			cache.WaitForDeletions()
+			Expect(filenamesInDir(emptyDir)).To(BeEmpty())
+		})
+	})
+
 	Describe("Remove", func() {
 		var (
 			cacheKey  string
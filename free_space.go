@@ -0,0 +1,71 @@
+package cacheddownloader
+
+import "errors"
+
+// NotEnoughSpace is returned by fetches when the free space on the disk would
+// drop below the reserve set with SetFreeSpaceReserve, even after evicting
+// every entry that is not in use.
+var NotEnoughSpace = errors.New("Not enough free disk space")
+
+// SetFreeSpaceReserve makes the cachedDownloader keep at least reserveInBytes
+// free on the disks of the cached and uncached paths, which maxSizeInBytes
+// alone does not guarantee when the disks are shared. Before a download
+// starts, and before a tarball is expanded into the cache, entries are
+// evicted until enough space is free; if that is not possible the fetch fails
+// with NotEnoughSpace rather than running out of space halfway through. Zero,
+// the default, disables the check. It should be called before any fetches are
+// started.
+func (c *cachedDownloader) SetFreeSpaceReserve(reserveInBytes int64) {
+	c.freeSpaceReserve = reserveInBytes
+}
+
+// ensureFreeSpace evicts entries until writing needed more bytes leaves the
+// reserve free on every disk the cachedDownloader writes to
+func (c *cachedDownloader) ensureFreeSpace(needed int64) error {
+	if c.freeSpaceReserve <= 0 {
+		return nil
+	}
+
+	paths := append([]string{c.uncachedPath}, c.cache.shards()...)
+	for {
+		enough := true
+		for _, path := range paths {
+			free, err := diskFreeSpace(path)
+			if err != nil {
+				// the check is not supported here
+				continue
+			}
+			if free-needed < c.freeSpaceReserve {
+				enough = false
+				break
+			}
+		}
+
+		if enough {
+			return nil
+		}
+		if !c.cache.evictOne() {
+			return NotEnoughSpace
+		}
+		// the disk space of entries deleted in the background is only
+		// released once they are gone
+		c.cache.WaitForDeletions()
+	}
+}
+
+// evictOne evicts the entry that the eviction policy picks first, and reports
+// whether there was one that could be evicted
+func (c *FileCache) evictOne() bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	cacheKey, entry := c.evictionCandidate("", nil)
+	if entry == nil {
+		return false
+	}
+
+	c.remove(cacheKey, EntryEvicted)
+	c.evictions++
+	c.persist()
+	return true
+}
@@ -0,0 +1,92 @@
+package cacheddownloader_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("SetFreeSpaceReserve with background deletion", func() {
+	var (
+		server       *ghttp.Server
+		scratch      string
+		cachedPath   string
+		uncachedPath string
+		reserving    interface {
+			cacheddownloader.CachedDownloader
+			SetFreeSpaceReserve(int64)
+			SetBackgroundDeletion(bool)
+		}
+	)
+
+	const largeSize = 32 * 1024 * 1024
+
+	fetch := func(path string) error {
+		u, err := url.Parse(server.URL() + path)
+		Expect(err).NotTo(HaveOccurred())
+		file, _, err := reserving.Fetch(u, path, cacheddownloader.ChecksumInfoType{}, nil)
+		if err == nil {
+			Expect(file.Close()).To(Succeed())
+		}
+		return err
+	}
+
+	freeSpace := func() int64 {
+		var stat syscall.Statfs_t
+		Expect(syscall.Statfs(cachedPath, &stat)).To(Succeed())
+		return int64(uint64(stat.Bavail) * uint64(stat.Bsize))
+	}
+
+	BeforeEach(func() {
+		// a quiet file system, whose free space only the cache changes
+		if info, err := os.Stat("/dev/shm"); err != nil || !info.IsDir() {
+			Skip("no tmpfs at /dev/shm")
+		}
+
+		var err error
+		scratch, err = ioutil.TempDir("/dev/shm", "free-space-test")
+		Expect(err).NotTo(HaveOccurred())
+		cachedPath = filepath.Join(scratch, "cached")
+		uncachedPath = filepath.Join(scratch, "uncached")
+		Expect(os.Mkdir(cachedPath, 0777)).To(Succeed())
+		Expect(os.Mkdir(uncachedPath, 0777)).To(Succeed())
+
+		header := http.Header{"ETag": []string{"some-etag"}}
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/large", ghttp.RespondWith(http.StatusOK, bytes.Repeat([]byte("a"), largeSize), header))
+		server.RouteToHandler("GET", "/small", ghttp.RespondWith(http.StatusOK, "small content", header))
+		server.RouteToHandler("GET", "/new", ghttp.RespondWith(http.StatusOK, "new content", header))
+
+		reserving, err = cacheddownloader.New(cachedPath, uncachedPath, 2*largeSize, time.Second, 10, false, nil, cacheddownloader.NoopTransform)
+		Expect(err).NotTo(HaveOccurred())
+		reserving.SetBackgroundDeletion(true)
+
+		Expect(fetch("/large")).To(Succeed())
+		Expect(fetch("/small")).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+		}
+		os.RemoveAll(scratch)
+	})
+
+	It("waits for evicted entries to be deleted before evicting more", func() {
+		reserving.SetFreeSpaceReserve(freeSpace() + largeSize/2)
+
+		Expect(fetch("/new")).To(Succeed())
+		Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("/large")+"*"))).To(BeEmpty())
+		Expect(filepath.Glob(filepath.Join(cachedPath, computeKeyHash("/small")+"*"))).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package cacheddownloader
+
+import "errors"
+
+// diskFreeSpace is not supported on this platform; the free space reserve is
+// not enforced
+func diskFreeSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
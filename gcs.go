@@ -0,0 +1,344 @@
+package cacheddownloader
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// GCSConfig configures how the Downloader fetches gs://bucket/object URLs.
+type GCSConfig struct {
+	// Endpoint is the storage API; empty uses https://storage.googleapis.com.
+	Endpoint string
+	// Credentials authorizes the requests. Nil uses the Application Default
+	// Credentials.
+	Credentials GCSTokenSource
+}
+
+// GCSTokenSource provides the OAuth2 access token for gs:// downloads. It is
+// asked for a token before every request, so that it can refresh it.
+type GCSTokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticGCSToken always provides the given access token.
+type StaticGCSToken string
+
+func (t StaticGCSToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// DefaultGCSCredentials returns the Application Default Credentials: the
+// credentials file named by GOOGLE_APPLICATION_CREDENTIALS, else the one
+// written by `gcloud auth application-default login`, else the service
+// account of the GCE instance.
+func DefaultGCSCredentials() GCSTokenSource {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		wellKnown := filepath.Join(os.Getenv("HOME"), ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(wellKnown); err == nil {
+			path = wellKnown
+		}
+	}
+
+	if path != "" {
+		return &GCSCredentialsFile{Path: path}
+	}
+	return &GCSMetadataCredentials{}
+}
+
+// GCSCredentialsFile provides access tokens for the service account key or
+// the authorized user in a JSON credentials file. Tokens are cached until
+// shortly before they expire.
+type GCSCredentialsFile struct {
+	Path string
+
+	token cachedToken
+}
+
+func (f *GCSCredentialsFile) Token(ctx context.Context) (string, error) {
+	return f.token.get(func() (string, time.Duration, error) {
+		content, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return "", 0, err
+		}
+
+		var file struct {
+			Type         string `json:"type"`
+			ClientEmail  string `json:"client_email"`
+			PrivateKey   string `json:"private_key"`
+			TokenURI     string `json:"token_uri"`
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+			RefreshToken string `json:"refresh_token"`
+		}
+		err = json.Unmarshal(content, &file)
+		if err != nil {
+			return "", 0, err
+		}
+
+		tokenURI := file.TokenURI
+		if tokenURI == "" {
+			tokenURI = "https://oauth2.googleapis.com/token"
+		}
+
+		form := url.Values{}
+		switch file.Type {
+		case "service_account":
+			assertion, err := serviceAccountAssertion(file.ClientEmail, file.PrivateKey, tokenURI, time.Now())
+			if err != nil {
+				return "", 0, err
+			}
+			form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+			form.Set("assertion", assertion)
+		case "authorized_user":
+			form.Set("grant_type", "refresh_token")
+			form.Set("client_id", file.ClientID)
+			form.Set("client_secret", file.ClientSecret)
+			form.Set("refresh_token", file.RefreshToken)
+		default:
+			return "", 0, errors.New("Unsupported GCS credentials type: " + file.Type)
+		}
+
+		body, err := requestString(ctx, &http.Client{Timeout: 10 * time.Second}, "POST", tokenURI, form.Encode(), map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		return parseTokenResponse(body)
+	})
+}
+
+// GCSMetadataCredentials provides access tokens for the service account of
+// the GCE instance, from the metadata server. Tokens are cached until shortly
+// before they expire.
+type GCSMetadataCredentials struct {
+	// Endpoint is the metadata server; empty uses GCE_METADATA_HOST, and else
+	// the default.
+	Endpoint string
+
+	token cachedToken
+}
+
+func (m *GCSMetadataCredentials) Token(ctx context.Context) (string, error) {
+	return m.token.get(func() (string, time.Duration, error) {
+		endpoint := m.Endpoint
+		if endpoint == "" {
+			endpoint = "http://metadata.google.internal"
+			if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+				endpoint = "http://" + host
+			}
+		}
+
+		body, err := requestString(ctx, &http.Client{Timeout: 5 * time.Second}, "GET",
+			endpoint+"/computeMetadata/v1/instance/service-accounts/default/token", "",
+			map[string]string{"Metadata-Flavor": "Google"})
+		if err != nil {
+			return "", 0, err
+		}
+		return parseTokenResponse(body)
+	})
+}
+
+type cachedToken struct {
+	lock       sync.Mutex
+	token      string
+	expiration time.Time
+}
+
+func (c *cachedToken) get(fetch func() (string, time.Duration, error)) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Now().Add(5 * time.Minute).Before(c.expiration) {
+		return c.token, nil
+	}
+
+	token, expiresIn, err := fetch()
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	c.expiration = time.Now().Add(expiresIn)
+	return token, nil
+}
+
+func parseTokenResponse(body string) (string, time.Duration, error) {
+	var response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err := json.Unmarshal([]byte(body), &response)
+	if err != nil {
+		return "", 0, err
+	}
+	if response.AccessToken == "" {
+		return "", 0, errors.New("No access token in the token response")
+	}
+	return response.AccessToken, time.Duration(response.ExpiresIn) * time.Second, nil
+}
+
+// serviceAccountAssertion builds the signed JWT that a service account
+// exchanges for an access token
+func serviceAccountAssertion(email, privateKeyPEM, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return "", errors.New("Invalid service account private key")
+	}
+
+	var key *rsa.PrivateKey
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		var ok bool
+		key, ok = parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("Service account private key is not an RSA key")
+		}
+	} else {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsReadOnlyScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// SetGCSConfig configures how gs:// URLs are downloaded. Without it, gs://
+// URLs are downloaded with the Application Default Credentials. It should be
+// called before any downloads are started.
+func (downloader *Downloader) SetGCSConfig(config GCSConfig) {
+	downloader.gcs = newGCSBackend(config)
+}
+
+type gcsBackend struct {
+	endpoint    string
+	credentials GCSTokenSource
+}
+
+func newGCSBackend(config GCSConfig) *gcsBackend {
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+
+	credentials := config.Credentials
+	if credentials == nil {
+		credentials = DefaultGCSCredentials()
+	}
+
+	return &gcsBackend{
+		endpoint:    endpoint,
+		credentials: credentials,
+	}
+}
+
+// prepare points a request for gs://bucket/object at the storage API and
+// authorizes it. For gs:// URLs the ETag in CachingInfoType is the generation
+// of the object, so revalidation asks for a different generation.
+func (b *gcsBackend) prepare(ctx context.Context, req *http.Request) error {
+	target, err := url.Parse(b.endpoint + "/" + req.URL.Host + req.URL.Path)
+	if err != nil {
+		return err
+	}
+	target.RawQuery = req.URL.RawQuery
+	req.URL = target
+	req.Host = ""
+
+	if generation, ok := gcsGeneration(req.Header.Get("If-None-Match")); ok {
+		req.Header.Del("If-None-Match")
+		req.Header.Set("X-Goog-If-Generation-Not-Match", generation)
+	}
+
+	token, err := b.credentials.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// gcsCachingInfo replaces the ETag with the generation of the object, if the
+// response has one
+func gcsCachingInfo(resp *http.Response, cachingInfo CachingInfoType) CachingInfoType {
+	generation := resp.Header.Get("X-Goog-Generation")
+	if generation != "" {
+		cachingInfo.ETag = strconv.Quote(generation)
+	}
+	return cachingInfo
+}
+
+// googHashChecksum returns the checksum that x-goog-hash header values give
+// for the object, as sent by GCS and some CDNs. CRC32C is preferred over MD5,
+// which is far more expensive to compute; composite objects only have a
+// CRC32C anyway.
+func googHashChecksum(values []string) (ChecksumInfoType, bool) {
+	checksums := map[string]ChecksumInfoType{}
+	for _, header := range values {
+		for _, hash := range strings.Split(header, ",") {
+			parts := strings.SplitN(strings.TrimSpace(hash), "=", 2)
+			if len(parts) != 2 || (parts[0] != "crc32c" && parts[0] != "md5") {
+				continue
+			}
+
+			sum, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			checksums[parts[0]] = ChecksumInfoType{Algorithm: parts[0], Value: hex.EncodeToString(sum)}
+		}
+	}
+
+	for _, algorithm := range []string{"crc32c", "md5"} {
+		if checksum, ok := checksums[algorithm]; ok {
+			return checksum, true
+		}
+	}
+	return ChecksumInfoType{}, false
+}
+
+func gcsGeneration(etag string) (string, bool) {
+	generation, err := strconv.Unquote(etag)
+	if err != nil {
+		return "", false
+	}
+	_, err = strconv.ParseUint(generation, 10, 64)
+	return generation, err == nil
+}
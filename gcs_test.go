@@ -0,0 +1,309 @@
+package cacheddownloader_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("GCS", func() {
+	Describe("downloading gs:// URLs", func() {
+		var (
+			server     *ghttp.Server
+			downloader *cacheddownloader.Downloader
+			gsURL      *url.URL
+			dest       string
+		)
+
+		createDestFile := func() (*os.File, error) {
+			return ioutil.TempFile("", "foo")
+		}
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+			downloader.SetGCSConfig(cacheddownloader.GCSConfig{
+				Endpoint:    server.URL(),
+				Credentials: cacheddownloader.StaticGCSToken("some-token"),
+			})
+
+			var err error
+			gsURL, err = url.Parse("gs://some-bucket/path/to/object")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			if dest != "" {
+				os.Remove(dest)
+			}
+		})
+
+		It("fetches the object with the access token and uses its generation as the ETag", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/some-bucket/path/to/object"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer some-token"),
+				ghttp.RespondWith(http.StatusOK, "object content", http.Header{
+					"ETag":              []string{`"some-etag"`},
+					"X-Goog-Generation": []string{"1234567890"},
+				}),
+			))
+
+			var (
+				cachingInfo cacheddownloader.CachingInfoType
+				err         error
+			)
+			dest, cachingInfo, err = downloader.Download(gsURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cachingInfo.ETag).To(Equal(`"1234567890"`))
+
+			content, err := ioutil.ReadFile(dest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("object content"))
+		})
+
+		It("revalidates the object by its generation", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/some-bucket/path/to/object"),
+				ghttp.VerifyHeaderKV("X-Goog-If-Generation-Not-Match", "1234567890"),
+				func(w http.ResponseWriter, req *http.Request) {
+					Expect(req.Header.Get("If-None-Match")).To(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusNotModified, nil),
+			))
+
+			var err error
+			dest, _, err = downloader.Download(gsURL, createDestFile, cacheddownloader.CachingInfoType{ETag: `"1234567890"`}, cacheddownloader.ChecksumInfoType{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dest).To(BeEmpty())
+		})
+
+		Context("when the response has an MD5 hash", func() {
+			respondWithHash := func(content string) {
+				sum := md5.Sum([]byte(content))
+				server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "object content", http.Header{
+					"X-Goog-Hash": []string{"md5=" + base64.StdEncoding.EncodeToString(sum[:])},
+				}))
+			}
+
+			It("verifies the object against it", func() {
+				respondWithHash("object content")
+
+				var err error
+				dest, _, err = downloader.Download(gsURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("fails when the object does not match", func() {
+				respondWithHash("other content")
+
+				_, _, err := downloader.Download(gsURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+				Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+			})
+		})
+	})
+
+	Describe("x-goog-hash", func() {
+		var (
+			server     *httptest.Server
+			downloader *cacheddownloader.Downloader
+			serverURL  *url.URL
+			hashes     string
+			inTrailer  bool
+		)
+
+		crc32c := func(content string) string {
+			sum := make([]byte, 4)
+			binary.BigEndian.PutUint32(sum, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+			return base64.StdEncoding.EncodeToString(sum)
+		}
+
+		md5Of := func(content string) string {
+			sum := md5.Sum([]byte(content))
+			return base64.StdEncoding.EncodeToString(sum[:])
+		}
+
+		download := func() error {
+			dest, _, err := downloader.Download(serverURL, func() (*os.File, error) {
+				return ioutil.TempFile("", "foo")
+			}, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+			if err == nil {
+				os.Remove(dest)
+			}
+			return err
+		}
+
+		BeforeEach(func() {
+			inTrailer = false
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if inTrailer {
+					w.Header().Set("Trailer", "X-Goog-Hash")
+					w.Write([]byte("object content"))
+					w.Header().Set("X-Goog-Hash", hashes)
+					return
+				}
+				w.Header().Set("X-Goog-Hash", hashes)
+				w.Write([]byte("object content"))
+			}))
+
+			var err error
+			serverURL, err = url.Parse(server.URL + "/object")
+			Expect(err).NotTo(HaveOccurred())
+
+			downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("verifies the CRC32C of any origin, in preference to the MD5", func() {
+			hashes = "crc32c=" + crc32c("object content") + ",md5=" + md5Of("other content")
+			Expect(download()).To(Succeed())
+
+			hashes = "crc32c=" + crc32c("other content") + ",md5=" + md5Of("object content")
+			Expect(download()).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+		})
+
+		It("verifies a CRC32C sent in a trailer", func() {
+			inTrailer = true
+
+			hashes = "crc32c=" + crc32c("object content")
+			Expect(download()).To(Succeed())
+
+			hashes = "crc32c=" + crc32c("other content")
+			Expect(download()).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+		})
+	})
+
+	Describe("GCSMetadataCredentials", func() {
+		It("fetches the token of the instance service account and caches it", func() {
+			metadata := ghttp.NewServer()
+			defer metadata.Close()
+			metadata.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/computeMetadata/v1/instance/service-accounts/default/token"),
+				ghttp.VerifyHeaderKV("Metadata-Flavor", "Google"),
+				ghttp.RespondWith(http.StatusOK, `{"access_token": "some-token", "expires_in": 3600, "token_type": "Bearer"}`),
+			))
+
+			credentials := &cacheddownloader.GCSMetadataCredentials{Endpoint: metadata.URL()}
+			Expect(credentials.Token(context.Background())).To(Equal("some-token"))
+			Expect(credentials.Token(context.Background())).To(Equal("some-token"))
+			Expect(metadata.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("GCSCredentialsFile", func() {
+		var (
+			tokenServer *ghttp.Server
+			dir         string
+		)
+
+		BeforeEach(func() {
+			tokenServer = ghttp.NewServer()
+
+			var err error
+			dir, err = ioutil.TempDir("", "gcs-credentials")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			tokenServer.Close()
+			os.RemoveAll(dir)
+		})
+
+		writeCredentials := func(credentials map[string]string) string {
+			content, err := json.Marshal(credentials)
+			Expect(err).NotTo(HaveOccurred())
+
+			path := filepath.Join(dir, "credentials.json")
+			Expect(ioutil.WriteFile(path, content, 0600)).To(Succeed())
+			return path
+		}
+
+		It("exchanges a signed assertion of a service account for a token", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+			Expect(err).NotTo(HaveOccurred())
+
+			path := writeCredentials(map[string]string{
+				"type":         "service_account",
+				"client_email": "someone@some-project.iam.gserviceaccount.com",
+				"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+				"token_uri":    tokenServer.URL() + "/token",
+			})
+
+			tokenServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/token"),
+				func(w http.ResponseWriter, req *http.Request) {
+					Expect(req.ParseForm()).To(Succeed())
+					Expect(req.Form.Get("grant_type")).To(Equal("urn:ietf:params:oauth:grant-type:jwt-bearer"))
+
+					parts := strings.Split(req.Form.Get("assertion"), ".")
+					Expect(parts).To(HaveLen(3))
+
+					signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+					Expect(err).NotTo(HaveOccurred())
+					digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+					Expect(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature)).To(Succeed())
+
+					claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(claims)).To(ContainSubstring(`"iss":"someone@some-project.iam.gserviceaccount.com"`))
+					Expect(string(claims)).To(ContainSubstring(`"aud":"` + tokenServer.URL() + `/token"`))
+				},
+				ghttp.RespondWith(http.StatusOK, `{"access_token": "some-token", "expires_in": 3600}`),
+			))
+
+			credentials := &cacheddownloader.GCSCredentialsFile{Path: path}
+			Expect(credentials.Token(context.Background())).To(Equal("some-token"))
+		})
+
+		It("refreshes the token of an authorized user", func() {
+			path := writeCredentials(map[string]string{
+				"type":          "authorized_user",
+				"client_id":     "some-client",
+				"client_secret": "some-secret",
+				"refresh_token": "some-refresh-token",
+				"token_uri":     tokenServer.URL() + "/token",
+			})
+
+			tokenServer.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/token"),
+				ghttp.VerifyForm(url.Values{
+					"grant_type":    []string{"refresh_token"},
+					"client_id":     []string{"some-client"},
+					"client_secret": []string{"some-secret"},
+					"refresh_token": []string{"some-refresh-token"},
+				}),
+				ghttp.RespondWith(http.StatusOK, `{"access_token": "some-token", "expires_in": 3600}`),
+			))
+
+			credentials := &cacheddownloader.GCSCredentialsFile{Path: path}
+			Expect(credentials.Token(context.Background())).To(Equal("some-token"))
+		})
+	})
+})
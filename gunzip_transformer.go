@@ -0,0 +1,44 @@
+package cacheddownloader
+
+import (
+	"compress/gzip"
+	"context"
+	"os/exec"
+)
+
+// GunzipTransform decompresses the gzip-compressed file at source to
+// destination, removes the source and returns the decompressed size. Unlike
+// TarTransform it does not care what was compressed. A source that is not
+// gzip-compressed fails with gzip.ErrHeader and is left as it is.
+func GunzipTransform(source string, destination string) (int64, error) {
+	return ContextGunzipTransform(context.Background(), source, destination)
+}
+
+// ContextGunzipTransform behaves like GunzipTransform, but stops decompressing
+// once ctx is done, empties the destination and returns ctx.Err(). It can be
+// given to SetContextTransformer.
+func ContextGunzipTransform(ctx context.Context, source string, destination string) (int64, error) {
+	format, _, err := sniffArchiveFile(source)
+	if err != nil {
+		return 0, err
+	}
+	if format != gzipArchive {
+		return 0, gzip.ErrHeader
+	}
+
+	size, err := gunzipTransform(ctx, source, destination)
+	if err != nil && ctx.Err() != nil {
+		return 0, abortTransform(ctx, destination)
+	}
+	return size, err
+}
+
+// gunzipTransform decompresses source with gunzip if it is on the PATH, since
+// it is faster, and else with compress/gzip
+func gunzipTransform(ctx context.Context, source string, destination string) (int64, error) {
+	gunzipPath, err := exec.LookPath("gunzip")
+	if err == nil {
+		return gunzipTarGZToTar(ctx, gunzipPath, source, destination)
+	}
+	return transformTarGZToTar(ctx, source, destination)
+}
@@ -0,0 +1,104 @@
+package cacheddownloader_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GunzipTransform", func() {
+	var (
+		scratch         string
+		sourcePath      string
+		destinationPath string
+
+		transformedSize int64
+		transformErr    error
+	)
+
+	content := "some-contents, which are not a tarball"
+
+	BeforeEach(func() {
+		var err error
+		scratch, err = ioutil.TempDir("", "gunzip-transformer-scratch")
+		Expect(err).NotTo(HaveOccurred())
+
+		sourcePath = filepath.Join(scratch, "file.gz")
+		source, err := os.Create(sourcePath)
+		Expect(err).NotTo(HaveOccurred())
+		writer := gzip.NewWriter(source)
+		_, err = writer.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(source.Close()).To(Succeed())
+
+		destinationPath = filepath.Join(scratch, "destination")
+		Expect(ioutil.WriteFile(destinationPath, nil, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(scratch)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		transformedSize, transformErr = cacheddownloader.GunzipTransform(sourcePath, destinationPath)
+	})
+
+	itDecompresses := func() {
+		It("decompresses the file to the destination", func() {
+			Expect(transformErr).NotTo(HaveOccurred())
+			Expect(ioutil.ReadFile(destinationPath)).To(Equal([]byte(content)))
+		})
+
+		It("returns the decompressed size", func() {
+			Expect(transformedSize).To(BeEquivalentTo(len(content)))
+		})
+
+		It("removes the source file", func() {
+			Expect(sourcePath).NotTo(BeAnExistingFile())
+		})
+	}
+
+	Context("when gunzip is available on the PATH", func() {
+		BeforeEach(func() {
+			_, err := exec.LookPath("gunzip")
+			if err != nil {
+				Skip("gunzip is not on the PATH")
+			}
+		})
+
+		itDecompresses()
+	})
+
+	Context("when gunzip is not available on the PATH", func() {
+		var oldPATH string
+
+		BeforeEach(func() {
+			oldPATH = os.Getenv("PATH")
+			os.Setenv("PATH", "/dev/null")
+		})
+
+		AfterEach(func() {
+			os.Setenv("PATH", oldPATH)
+		})
+
+		itDecompresses()
+	})
+
+	Context("when the file is not gzip-compressed", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(sourcePath, []byte(content), 0600)).To(Succeed())
+		})
+
+		It("fails and leaves the source", func() {
+			Expect(transformErr).To(Equal(gzip.ErrHeader))
+			Expect(sourcePath).To(BeAnExistingFile())
+		})
+	})
+})
@@ -5,9 +5,11 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"strings"
 )
 
@@ -38,6 +40,18 @@ func NewChecksumFailedError(msg, expected, received string) error {
 	}
 }
 
+// Expected returns what the checksum was expected to be, e.g. the checksum
+// value that was given.
+func (e *ChecksumFailedError) Expected() string {
+	return e.expected
+}
+
+// Received returns what the checksum turned out to be, e.g. the checksum of
+// the downloaded content.
+func (e *ChecksumFailedError) Received() string {
+	return e.received
+}
+
 func (e *ChecksumFailedError) Error() string {
 	return fmt.Sprintf("Checksum failed: '%s', expected '%s', got '%s'",
 		e.msg,
@@ -60,8 +74,14 @@ func NewHashValidator(algorithm string) (*hashValidator, error) {
 		hash = sha1.New()
 	case "sha256":
 		hash = sha256.New()
+	case "sha384":
+		hash = sha512.New384()
+	case "sha512":
+		hash = sha512.New()
+	case "crc32c":
+		hash = crc32.New(crc32.MakeTable(crc32.Castagnoli))
 	default:
-		return nil, NewChecksumFailedError("algorithm invalid", "[md5, sha1, sha256]", algorithm)
+		return nil, NewChecksumFailedError("algorithm invalid", "[md5, sha1, sha256, sha384, sha512, crc32c]", algorithm)
 	}
 	return &hashValidator{
 		algorithm,
@@ -90,6 +110,12 @@ func (v hashValidator) expectedLength() (int, bool) {
 		return 40, true
 	case "sha256":
 		return 64, true
+	case "sha384":
+		return 96, true
+	case "sha512":
+		return 128, true
+	case "crc32c":
+		return 8, true
 	}
 	return -1, false
 }
@@ -2,6 +2,9 @@ package cacheddownloader_test
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"fmt"
 
 	"code.cloudfoundry.org/cacheddownloader"
@@ -11,7 +14,7 @@ import (
 
 var _ = Describe("HashValidator", func() {
 
-	algorithms := []string{"md5", "sha1", "sha256"}
+	algorithms := []string{"md5", "sha1", "sha256", "sha384", "sha512", "crc32c"}
 
 	validateAlgorithm := func(algorithm string) {
 		It("should create a hash validator", func() {
@@ -48,5 +51,43 @@ var _ = Describe("HashValidator", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(fmt.Sprintf(`"%x"`, md5.Sum([]byte(msg)))).NotTo(Equal(value))
 		})
+
+		It("should validate correct sha512", func() {
+			value, err := cacheddownloader.HexValue("sha512", msg)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fmt.Sprintf(`"%x"`, sha512.Sum512([]byte(msg)))).To(Equal(value))
+		})
+	})
+})
+
+var _ = Describe("ParseIntegrity", func() {
+	msg := "manifests kill people"
+	sha256Sum := sha256.Sum256([]byte(msg))
+	sha512Sum := sha512.Sum512([]byte(msg))
+
+	It("converts the base64 digest to hex", func() {
+		checksum, err := cacheddownloader.ParseIntegrity("sha256-" + base64.StdEncoding.EncodeToString(sha256Sum[:]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checksum).To(Equal(cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: fmt.Sprintf("%x", sha256Sum)}))
+	})
+
+	It("uses the strongest of several digests and ignores options", func() {
+		integrity := "sha256-" + base64.StdEncoding.EncodeToString(sha256Sum[:]) +
+			" sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:]) + "?some-option" +
+			" md5-whatever"
+
+		checksum, err := cacheddownloader.ParseIntegrity(integrity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(checksum).To(Equal(cacheddownloader.ChecksumInfoType{Algorithm: "sha512", Value: fmt.Sprintf("%x", sha512Sum)}))
+	})
+
+	It("fails without a digest of a supported algorithm", func() {
+		_, err := cacheddownloader.ParseIntegrity("md5-whatever")
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+	})
+
+	It("fails when the digest is not base64", func() {
+		_, err := cacheddownloader.ParseIntegrity("sha256-not!base64")
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
 	})
 })
@@ -0,0 +1,80 @@
+package cacheddownloader
+
+import (
+	"sort"
+	"time"
+)
+
+// EntryInfo describes an entry of the cache, as returned by Entries.
+type EntryInfo struct {
+	// HashedKey is the hash of the cache key that names the entry's files, and
+	// Key the cache key itself, if it was recorded.
+	HashedKey   string
+	Key         string
+	Size        int64
+	Access      time.Time
+	AccessCount int64
+	CachingInfo CachingInfoType
+	Labels      map[string]string
+	// Validated is when the entry was last confirmed with the origin, and TTL
+	// how long it may be served without confirming it again.
+	Validated time.Time
+	TTL       time.Duration
+	// InUseCount is the number of readers and directories of the entry that
+	// are handed out; an entry in use cannot be evicted.
+	InUseCount int
+	// FilePath is set if the entry is held as a file, and DirectoryPath if it
+	// is held as an expanded directory; it may be held as both.
+	FilePath      string
+	DirectoryPath string
+}
+
+// IsDirectory reports whether the entry is held as an expanded directory.
+func (e EntryInfo) IsDirectory() bool {
+	return e.DirectoryPath != ""
+}
+
+// Entries describes the contents of the cache, largest entries first. It is
+// safe to call concurrently with fetches.
+func (c *cachedDownloader) Entries() []EntryInfo {
+	return c.cache.entryInfos()
+}
+
+func (c *FileCache) entryInfos() []EntryInfo {
+	lock.Lock()
+	defer lock.Unlock()
+
+	infos := make([]EntryInfo, 0, len(c.Entries))
+	for hashedKey, entry := range c.Entries {
+		info := EntryInfo{
+			HashedKey:     hashedKey,
+			Key:           entry.Key,
+			Size:          entry.Size,
+			Access:        entry.Access,
+			AccessCount:   entry.AccessCount,
+			CachingInfo:   entry.CachingInfo,
+			Labels:        copyLabels(entry.Labels),
+			Validated:     entry.Validated,
+			TTL:           entry.TTL,
+			DirectoryPath: entry.ExpandedDirectoryPath,
+		}
+		if entry.fileInUseCount > 0 {
+			info.InUseCount += entry.fileInUseCount
+		}
+		if entry.directoryInUseCount > 0 {
+			info.InUseCount += entry.directoryInUseCount
+		}
+		if !entry.fileDoesNotExist() {
+			info.FilePath = entry.FilePath
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Size != infos[j].Size {
+			return infos[i].Size > infos[j].Size
+		}
+		return infos[i].HashedKey < infos[j].HashedKey
+	})
+	return infos
+}
@@ -46,7 +46,9 @@ var _ = Describe("Integration", func() {
 		url, err = url.Parse(server.URL + "/file")
 		Expect(err).NotTo(HaveOccurred())
 
-		downloader = cacheddownloader.New(cachedPath, uncachedPath, cacheMaxSizeInBytes, downloadTimeout, 10, false, nil, cacheddownloader.NoopTransform)
+		downloader, err = cacheddownloader.New(cachedPath, uncachedPath, cacheMaxSizeInBytes, downloadTimeout, 10, false, nil, cacheddownloader.NoopTransform)
+
+		Expect(err).NotTo(HaveOccurred())
 	})
 
 	AfterEach(func() {
@@ -0,0 +1,60 @@
+package cacheddownloader
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// sriAlgorithms are the algorithms Subresource Integrity values may use,
+// strongest first
+var sriAlgorithms = []string{"sha512", "sha384", "sha256"}
+
+// ParseIntegrity converts a Subresource Integrity value such as
+// "sha256-<base64 digest>" into a ChecksumInfoType. If the value lists several
+// digests separated by whitespace, the one with the strongest algorithm is
+// used; options after a '?' are ignored.
+//
+// A ChecksumInfoType with an empty Algorithm whose Value is in this format is
+// converted the same way, so SRI values can be passed to fetches as they are.
+func ParseIntegrity(integrity string) (ChecksumInfoType, error) {
+	digests := map[string]string{}
+	for _, field := range strings.Fields(integrity) {
+		field = strings.SplitN(field, "?", 2)[0]
+		parts := strings.SplitN(field, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		digests[parts[0]] = parts[1]
+	}
+
+	for _, algorithm := range sriAlgorithms {
+		digest, ok := digests[algorithm]
+		if !ok {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			return ChecksumInfoType{}, NewChecksumFailedError("integrity invalid", "a base64 digest", digest)
+		}
+		return ChecksumInfoType{Algorithm: algorithm, Value: hex.EncodeToString(sum)}, nil
+	}
+
+	return ChecksumInfoType{}, NewChecksumFailedError("integrity invalid", fmt.Sprintf("one of %v", sriAlgorithms), integrity)
+}
+
+// fromIntegrity converts checksum from the Subresource Integrity format if it
+// has no algorithm and its value is in that format
+func (checksum ChecksumInfoType) fromIntegrity() ChecksumInfoType {
+	if checksum.Algorithm != "" || !strings.HasPrefix(checksum.Value, "sha") || !strings.Contains(checksum.Value, "-") {
+		return checksum
+	}
+
+	converted, err := ParseIntegrity(checksum.Value)
+	if err != nil {
+		return checksum
+	}
+	return converted
+}
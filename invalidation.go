@@ -0,0 +1,82 @@
+package cacheddownloader
+
+import (
+	"strings"
+)
+
+func (c *cachedDownloader) Remove(cacheKey string) {
+	defer c.notifyEntryObserver()
+	c.cache.Remove(c.hashCacheKey(cacheKey))
+	c.cache.Remove(c.hashCacheKey(cacheKey + untransformedKeySuffix))
+}
+
+func (c *cachedDownloader) RemoveByPrefix(prefix string) int {
+	defer c.notifyEntryObserver()
+	return c.cache.removeMatching(func(entry *FileCacheEntry) bool {
+		return entry.Key != "" && strings.HasPrefix(entry.Key, prefix)
+	})
+}
+
+func (c *cachedDownloader) Clear() {
+	defer c.notifyEntryObserver()
+	c.cache.removeMatching(func(*FileCacheEntry) bool { return true })
+}
+
+// setOrigin records the cache key, namespace and labels that the entry for
+// hashedKey was fetched with; an entry keeps its labels when it is fetched
+// again without any.
+func (c *FileCache) setOrigin(hashedKey, cacheKey, namespace string, labels map[string]string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[hashedKey]
+	if entry != nil && len(labels) == 0 {
+		labels = entry.Labels
+	}
+	if entry != nil && (entry.Key != cacheKey || entry.Namespace != namespace || !sameLabels(entry.Labels, labels)) {
+		entry.Key = cacheKey
+		entry.Namespace = namespace
+		entry.Labels = copyLabels(labels)
+		c.persist()
+	}
+}
+
+// belongsTo reports whether the entry was fetched with the given cache key and
+// namespace, or was saved before they were recorded
+func (e *FileCacheEntry) belongsTo(cacheKey, namespace string) bool {
+	return e.Key == "" || (e.Key == cacheKey && e.Namespace == namespace)
+}
+
+// removeCollision removes the entry for hashedKey if it was fetched with
+// another cache key whose hash is the same, so that it is not served in place
+// of the entry for the given cache key
+func (c *FileCache) removeCollision(hashedKey, cacheKey, namespace string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[hashedKey]
+	if entry != nil && !entry.belongsTo(cacheKey, namespace) {
+		c.remove(hashedKey, EntryExpired)
+		c.persist()
+	}
+}
+
+// removeMatching removes every entry that matches and returns how many it
+// removed
+func (c *FileCache) removeMatching(matches func(*FileCacheEntry) bool) int {
+	lock.Lock()
+	defer lock.Unlock()
+
+	removed := 0
+	for cacheKey, entry := range c.Entries {
+		if matches(entry) {
+			c.remove(cacheKey, EntryRemoved)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		c.persist()
+	}
+	return removed
+}
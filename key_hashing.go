@@ -0,0 +1,70 @@
+package cacheddownloader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+)
+
+// KeyHasher derives the name of the files of an entry from its cache key. The
+// result must be safe to use in a file name, and should not collide for
+// different keys.
+type KeyHasher func(cacheKey string) string
+
+// SHA256KeyHasher names entries by the hex SHA-256 of their cache key; it is
+// the default.
+func SHA256KeyHasher(cacheKey string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(cacheKey)))
+}
+
+// MD5KeyHasher names entries by the hex MD5 of their cache key, as all
+// entries were named before the hasher could be changed.
+func MD5KeyHasher(cacheKey string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
+}
+
+// SetKeyHasher changes how the files of entries are named after their cache
+// keys; the default is SHA256KeyHasher. Entries named by another hasher, such
+// as those recovered from the state of an older version, are not found, and
+// are evicted eventually; see SetMD5Compatibility. It should be called before
+// any fetches are started.
+func (c *cachedDownloader) SetKeyHasher(hasher KeyHasher) {
+	if hasher == nil {
+		hasher = SHA256KeyHasher
+	}
+	c.keyHasher = hasher
+}
+
+// SetMD5Compatibility makes the cachedDownloader find the entries that were
+// named by MD5KeyHasher, e.g. those recovered from the state of an older
+// version, when there is no entry named by the current hasher: such an entry is
+// taken over by the current name on its first use, while its files keep their
+// names. It should be called before any fetches are started.
+func (c *cachedDownloader) SetMD5Compatibility(enabled bool) {
+	c.md5Compatibility = enabled
+}
+
+// hashCacheKey derives the name of the files of an entry from its cache key
+func (c *cachedDownloader) hashCacheKey(cacheKey string) string {
+	hashedKey := c.keyHasher(cacheKey)
+	if c.md5Compatibility {
+		c.cache.rekey(MD5KeyHasher(cacheKey), hashedKey)
+	}
+	return hashedKey
+}
+
+// rekey moves the entry for oldKey to newKey, unless there already is an
+// entry for newKey
+func (c *FileCache) rekey(oldKey, newKey string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[oldKey]
+	if oldKey == newKey || entry == nil || c.Entries[newKey] != nil {
+		return
+	}
+
+	delete(c.Entries, oldKey)
+	c.Entries[newKey] = entry
+	c.persist()
+}
@@ -0,0 +1,45 @@
+package cacheddownloader
+
+// Labels returns the labels recorded with the entry for the cache key in the
+// given namespace, see FetchOptions.Labels; ok is false if there is no such
+// entry.
+func (c *cachedDownloader) Labels(namespace, cacheKey string) (labels map[string]string, ok bool) {
+	return c.cache.labels(c.hashCacheKey(namespacedKey(namespace, cacheKey)), cacheKey, namespace)
+}
+
+func (c *FileCache) labels(hashedKey, cacheKey, namespace string) (map[string]string, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[hashedKey]
+	if entry == nil || !entry.belongsTo(cacheKey, namespace) {
+		return nil, false
+	}
+	return copyLabels(entry.Labels), true
+}
+
+// copyLabels keeps the labels of entries from being changed through the maps
+// given to, or returned by, the cachedDownloader
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]string, len(labels))
+	for name, value := range labels {
+		copied[name] = value
+	}
+	return copied
+}
+
+func sameLabels(labels, other map[string]string) bool {
+	if len(labels) != len(other) {
+		return false
+	}
+	for name, value := range labels {
+		if otherValue, ok := other[name]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
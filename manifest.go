@@ -0,0 +1,173 @@
+package cacheddownloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// NoManifest is returned by VerifyDirectory for directories that were expanded
+// without a manifest.
+var NoManifest = errors.New("Cached directory has no manifest")
+
+// manifestSuffix names the manifest kept next to an expanded directory
+const manifestSuffix = ".manifest.json"
+
+// manifestEntry describes a file, directory or symbolic link of an expanded
+// directory. Digest is the hex sha256 digest of a file, and Link the target of
+// a symbolic link.
+type manifestEntry struct {
+	Path   string
+	Size   int64
+	Digest string `json:",omitempty"`
+	Link   string `json:",omitempty"`
+}
+
+// SetDirectoryManifests makes the cachedDownloader take a manifest of the
+// paths, sizes and digests of every directory it expands into the cache, so
+// that VerifyDirectory can tell whether a consumer has modified a directory
+// that is shared with others. Taking a manifest reads the whole directory once
+// it is expanded. It should be called before any fetches are started.
+func (c *cachedDownloader) SetDirectoryManifests(enabled bool) {
+	c.cache.SetDirectoryManifests(enabled)
+}
+
+// VerifyDirectory checks the expanded directory of the entry for cacheKey
+// against its manifest, see SetDirectoryManifests, and returns a
+// DirectoryModifiedError if it does not match. The entry is left as it is.
+func (c *cachedDownloader) VerifyDirectory(cacheKey string) error {
+	return c.cache.VerifyDirectory(c.hashCacheKey(cacheKey))
+}
+
+// SetDirectoryManifests makes the cache take a manifest of the directories it
+// expands from then on, see cachedDownloader.SetDirectoryManifests.
+func (c *FileCache) SetDirectoryManifests(enabled bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.manifests = enabled
+}
+
+// VerifyDirectory checks the expanded directory of the entry for cacheKey
+// against its manifest. It returns EntryNotFound if the entry has no expanded
+// directory, and NoManifest if the directory was expanded without one.
+func (c *FileCache) VerifyDirectory(cacheKey string) error {
+	lock.Lock()
+	entry := c.Entries[cacheKey]
+	if entry == nil || entry.dirDoesNotExist() {
+		lock.Unlock()
+		return EntryNotFound
+	}
+	dirPath := entry.ExpandedDirectoryPath
+	lock.Unlock()
+
+	content, err := ioutil.ReadFile(dirPath + manifestSuffix)
+	if os.IsNotExist(err) {
+		return NoManifest
+	}
+	if err != nil {
+		return err
+	}
+
+	var expected []manifestEntry
+	err = json.Unmarshal(content, &expected)
+	if err != nil {
+		return err
+	}
+
+	actual, err := takeManifest(dirPath)
+	if err != nil {
+		return err
+	}
+	return compareManifests(expected, actual)
+}
+
+// writeManifest takes the manifest of the expanded directory and writes it
+// next to the directory
+func writeManifest(dirPath string) error {
+	manifest, err := takeManifest(dirPath)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(dirPath+manifestSuffix, content)
+}
+
+// takeManifest describes every entry of the directory, sorted by path
+func takeManifest(dirPath string) ([]manifestEntry, error) {
+	manifest := []manifestEntry{}
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dirPath {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		entry := manifestEntry{Path: filepath.ToSlash(relativePath)}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Link, err = os.Readlink(path)
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			entry.Digest, err = fileDigest(path)
+		}
+		if err != nil {
+			return err
+		}
+
+		manifest = append(manifest, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest, func(i, j int) bool {
+		return manifest[i].Path < manifest[j].Path
+	})
+	return manifest, nil
+}
+
+// compareManifests returns a DirectoryModifiedError listing the differences
+// between the manifests, if there are any
+func compareManifests(expected, actual []manifestEntry) error {
+	var added, removed, modified []string
+
+	expectedEntries := map[string]manifestEntry{}
+	for _, entry := range expected {
+		expectedEntries[entry.Path] = entry
+	}
+
+	for _, entry := range actual {
+		expectedEntry, ok := expectedEntries[entry.Path]
+		delete(expectedEntries, entry.Path)
+		if !ok {
+			added = append(added, entry.Path)
+		} else if entry != expectedEntry {
+			modified = append(modified, entry.Path)
+		}
+	}
+
+	for path := range expectedEntries {
+		removed = append(removed, path)
+	}
+	sort.Strings(removed)
+
+	if len(added) == 0 && len(removed) == 0 && len(modified) == 0 {
+		return nil
+	}
+	return NewDirectoryModifiedError(added, removed, modified)
+}
@@ -0,0 +1,92 @@
+package cacheddownloader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// SetMaxDownloadSize makes downloads fail with a TooLargeError, before their
+// body is copied, if the origin reports them to be larger than maxSizeInBytes.
+// Since origins may not report the size, or report it wrongly, a download is
+// also aborted, and its file removed, as soon as more than maxSizeInBytes have
+// been received. Zero, the default, means no limit. It should be called before any downloads
+// are started.
+func (downloader *Downloader) SetMaxDownloadSize(maxSizeInBytes int64) {
+	downloader.maxDownloadSize = maxSizeInBytes
+}
+
+// SetHeadPreflight makes the Downloader issue a HEAD request before
+// downloading, so that a download larger than the maximum download size is
+// rejected without sending its body at all. Origins that do not answer the
+// HEAD request with a Content-Length are downloaded as usual. It should be
+// called before any downloads are started.
+func (downloader *Downloader) SetHeadPreflight(preflight bool) {
+	downloader.headPreflight = preflight
+}
+
+// preflight checks the size the origin reports for url in response to a HEAD
+// request. It only fails if the download is known to be too large.
+func (downloader *Downloader) preflight(ctx context.Context, url *url.URL) error {
+	if !downloader.headPreflight || downloader.maxDownloadSize <= 0 {
+		return nil
+	}
+	// scheme handlers have no equivalent of a HEAD request
+	if _, ok := downloader.schemeHandlers[url.Scheme]; ok {
+		return nil
+	}
+
+	req, err := http.NewRequest("HEAD", url.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req, err = downloader.prepareRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := downloader.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	return downloader.checkSize(resp.ContentLength)
+}
+
+// checkSize fails if size, when known, exceeds the maximum download size
+func (downloader *Downloader) checkSize(size int64) error {
+	if downloader.maxDownloadSize > 0 && size > downloader.maxDownloadSize {
+		return NewTooLargeError(size, downloader.maxDownloadSize)
+	}
+	return nil
+}
+
+// capReader wraps body, which continues a download at offset, so that reading
+// past the maximum download size fails with a TooLargeError
+func (downloader *Downloader) capReader(body io.Reader, offset int64) io.Reader {
+	if downloader.maxDownloadSize <= 0 {
+		return body
+	}
+	return &cappedReader{reader: body, read: offset, max: downloader.maxDownloadSize}
+}
+
+type cappedReader struct {
+	reader io.Reader
+	read   int64
+	max    int64
+}
+
+func (r *cappedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.max {
+		return n, NewTooLargeError(r.read, r.max)
+	}
+	return n, err
+}
@@ -0,0 +1,185 @@
+package cacheddownloader
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// SetMemoryTier keeps the content of cached files of up to maxEntrySize bytes
+// in memory as well, up to maxSizeInBytes altogether, evicting the least
+// recently used ones first. Fetches of such an entry that is still within its
+// TTL are served from memory without touching the disk; other fetches
+// revalidate and read the entry as usual. An entry that is replaced or
+// removed from the cache is no longer served from memory. It should be called
+// before any fetches are started.
+func (c *cachedDownloader) SetMemoryTier(maxEntrySize, maxSizeInBytes int64) {
+	c.memory = &memoryTier{
+		maxEntrySize: maxEntrySize,
+		maxSize:      maxSizeInBytes,
+		entries:      map[string]*list.Element{},
+		lru:          list.New(),
+	}
+}
+
+// memoryTier holds the content of small cached files. Each copy is tied to
+// the file of the entry it was read from, so that it is only served for that
+// version of the entry.
+type memoryTier struct {
+	maxEntrySize int64
+	maxSize      int64
+
+	lock    sync.Mutex
+	used    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	hashedKey string
+	filePath  string
+	content   []byte
+}
+
+func (m *memoryTier) get(hashedKey, filePath string) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	element, ok := m.entries[hashedKey]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.filePath != filePath {
+		m.remove(element)
+		return nil, false
+	}
+
+	m.lru.MoveToFront(element)
+	return entry.content, true
+}
+
+func (m *memoryTier) put(hashedKey, filePath string, content []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if element, ok := m.entries[hashedKey]; ok {
+		m.remove(element)
+	}
+
+	size := int64(len(content))
+	for m.used+size > m.maxSize && m.lru.Len() > 0 {
+		m.remove(m.lru.Back())
+	}
+	if m.used+size > m.maxSize {
+		return
+	}
+
+	m.entries[hashedKey] = m.lru.PushFront(&memoryEntry{hashedKey: hashedKey, filePath: filePath, content: content})
+	m.used += size
+}
+
+func (m *memoryTier) drop(hashedKey string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if element, ok := m.entries[hashedKey]; ok {
+		m.remove(element)
+	}
+}
+
+func (m *memoryTier) remove(element *list.Element) {
+	entry := m.lru.Remove(element).(*memoryEntry)
+	delete(m.entries, entry.hashedKey)
+	m.used -= int64(len(entry.content))
+}
+
+// fromMemory serves the entry for cacheKey from memory, if it is there, was
+// fetched with the same cache key and is still within its TTL
+func (c *cachedDownloader) fromMemory(cacheKey string, options FetchOptions) (*memoryFile, bool) {
+	if c.memory == nil {
+		return nil, false
+	}
+
+	filePath, fresh := c.cache.touchIfFresh(cacheKey, options.cacheKey, options.Namespace)
+	if !fresh {
+		return nil, false
+	}
+
+	content, ok := c.memory.get(cacheKey, filePath)
+	if !ok {
+		return nil, false
+	}
+
+	c.recordHit(int64(len(content)), false)
+	return &memoryFile{Reader: bytes.NewReader(content), onClose: c.releaseHandle}, true
+}
+
+// keepInMemory copies a file served from the entry for cacheKey to memory, if
+// it is small enough, and rewinds it. It must be called while the fetch holds
+// the limiter of cacheKey, so that the entry cannot be replaced meanwhile.
+func (c *cachedDownloader) keepInMemory(cacheKey string, file *CachedFile) {
+	if c.memory == nil || file == nil {
+		return
+	}
+
+	size := fileSize(file)
+	filePath := c.cache.filePath(cacheKey)
+	if size > c.memory.maxEntrySize || filePath == "" {
+		c.memory.drop(cacheKey)
+		return
+	}
+
+	content, err := ioutil.ReadAll(file)
+	_, seekErr := file.Seek(0, 0)
+	if err != nil || seekErr != nil {
+		return
+	}
+	c.memory.put(cacheKey, filePath, content)
+}
+
+// touchIfFresh records an access to the entry for hashedKey if it belongs to
+// the given cache key and may be served without revalidation, and returns the
+// path of its file
+func (c *FileCache) touchIfFresh(hashedKey, cacheKey, namespace string) (string, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[hashedKey]
+	if entry == nil || !entry.belongsTo(cacheKey, namespace) || !entry.isFresh(time.Now()) {
+		return "", false
+	}
+
+	entry.Access = time.Now()
+	entry.AccessCount++
+	return entry.FilePath, true
+}
+
+func (c *FileCache) filePath(cacheKey string) string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return ""
+	}
+	return entry.FilePath
+}
+
+// memoryFile is the content of an entry served from memory
+type memoryFile struct {
+	*bytes.Reader
+
+	onClose func()
+}
+
+func (m *memoryFile) Close() error {
+	if m.onClose != nil {
+		m.onClose()
+		m.onClose = nil
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package cacheddownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// moveFile renames source to destination. If they are on different
+// filesystems, e.g. because the uncached path is on another volume than the
+// cache, it copies source to the destination's directory instead, syncs the
+// copy and renames it into place, so that destination never holds a partial
+// file, and then removes source.
+func moveFile(source, destination string) error {
+	err := os.Rename(source, destination)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	err = copyFileAtomically(source, destination)
+	if err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// stagedSuffix marks the files that stageFile moves into a shard
+const stagedSuffix = "-staged"
+
+// removeStagedFiles removes the files that were staged in dir but never
+// added, e.g. because the process exited in between
+func removeStagedFiles(dir string) {
+	staged, _ := filepath.Glob(filepath.Join(dir, "*"+stagedSuffix+"*"))
+	for _, path := range staged {
+		os.Remove(path)
+	}
+}
+
+// stageFile moves source into dir, from where it can be renamed into place
+// without copying. Moving a file from another filesystem copies it, which may
+// take a while for a large file, so it is done before taking the lock that
+// guards the cache.
+func stageFile(source, dir string) (string, error) {
+	staged, err := ioutil.TempFile(dir, filepath.Base(source)+stagedSuffix)
+	if err != nil {
+		return "", err
+	}
+	staged.Close()
+
+	err = moveFile(source, staged.Name())
+	if err != nil {
+		os.Remove(staged.Name())
+		return "", err
+	}
+	return staged.Name(), nil
+}
+
+func copyFileAtomically(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(destination), filepath.Base(destination)+"-move")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = copyBuffered(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destination)
+}
+
+// isCrossDevice reports whether err is the error of a rename between two
+// filesystems
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && isCrossDeviceErrno(linkErr.Err)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package cacheddownloader
+
+import "syscall"
+
+func isCrossDeviceErrno(err error) bool {
+	return err == syscall.EXDEV
+}
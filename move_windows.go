@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package cacheddownloader
+
+import "syscall"
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE, which MoveFileEx fails with
+// when moving a file to another volume
+const errorNotSameDevice = syscall.Errno(17)
+
+func isCrossDeviceErrno(err error) bool {
+	return err == errorNotSameDevice || err == syscall.EXDEV
+}
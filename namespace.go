@@ -0,0 +1,114 @@
+package cacheddownloader
+
+// SetNamespaceQuota limits the entries fetched in the given namespace, see
+// FetchOptions.Namespace, to maxSizeInBytes altogether. When an entry is
+// added to a namespace that is full, the namespace's own entries are evicted
+// to make room, so that one consumer of the cache cannot evict the entries of
+// another; downloads larger than the quota are served from the uncached path.
+// The quotas are layered over the maximum size of the whole cache, which still
+// applies. It should be called before any fetches are started.
+func (c *cachedDownloader) SetNamespaceQuota(namespace string, maxSizeInBytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.namespaceQuotas == nil {
+		c.namespaceQuotas = map[string]int64{}
+	}
+	c.namespaceQuotas[namespace] = maxSizeInBytes
+}
+
+// NamespaceUsage returns the number of entries in the given namespace, the
+// space they take up and the quota of the namespace, zero if it has none.
+func (c *cachedDownloader) NamespaceUsage(namespace string) (entries int, usedSizeInBytes int64, maxSizeInBytes int64) {
+	entries, usedSizeInBytes = c.cache.namespaceUsage(namespace)
+	return entries, usedSizeInBytes, c.namespaceQuota(namespace)
+}
+
+func (c *cachedDownloader) namespaceQuota(namespace string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.namespaceQuotas[namespace]
+}
+
+// namespacedKey keeps the entries of a namespace apart from those with the
+// same cache key in other namespaces
+func namespacedKey(namespace, cacheKey string) string {
+	if namespace == "" {
+		return cacheKey
+	}
+	return namespace + "\x00" + cacheKey
+}
+
+// makeNamespaceRoom evicts entries of the namespace of the fetch until an
+// entry of the given size fits in its quota
+func (c *cachedDownloader) makeNamespaceRoom(cacheKey string, options FetchOptions, size int64) {
+	quota := c.namespaceQuota(options.Namespace)
+	if quota <= 0 {
+		return
+	}
+	c.cache.makeRoomInNamespace(options.Namespace, quota, size, cacheKey)
+}
+
+func (c *FileCache) makeRoomInNamespace(namespace string, quota, size int64, excludedCacheKey string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, usedSpace := c.namespaceUsageLocked(namespace)
+	inNamespace := func(entry *FileCacheEntry) bool {
+		return entry.Namespace == namespace
+	}
+
+	evicted := false
+	for quota < usedSpace+size {
+		cacheKey, entry := c.evictionCandidate(excludedCacheKey, inNamespace)
+		if entry == nil {
+			break
+		}
+
+		usedSpace -= entry.Size
+		c.remove(cacheKey, EntryEvicted)
+		c.evictions++
+		evicted = true
+	}
+
+	if evicted {
+		c.persist()
+	}
+}
+
+func (c *FileCache) namespaceUsage(namespace string) (int, int64) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return c.namespaceUsageLocked(namespace)
+}
+
+func (c *FileCache) namespaceUsageLocked(namespace string) (entries int, usedSpace int64) {
+	for _, entry := range c.Entries {
+		if entry.Namespace == namespace {
+			entries++
+			usedSpace += entry.Size
+		}
+	}
+	return entries, usedSpace
+}
+
+// keyForDirectory returns the hashed key of the entry that the given expanded
+// directory belongs to
+func (c *FileCache) keyForDirectory(dirPath string) (string, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for cacheKey, entry := range c.Entries {
+		if entry.ExpandedDirectoryPath == dirPath {
+			return cacheKey, true
+		}
+	}
+	for oldKey, entry := range c.OldEntries {
+		if entry.ExpandedDirectoryPath == dirPath {
+			return oldKey[:len(oldKey)-len(dirPath)], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package cacheddownloader
+
+import "syscall"
+
+// openNoFollow makes opening a path fail if it is a symbolic link
+const openNoFollow = syscall.O_NOFOLLOW
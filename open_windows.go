@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package cacheddownloader
+
+// openNoFollow is zero on Windows, which has no O_NOFOLLOW; extraction relies
+// on checking paths with Lstat there
+const openNoFollow = 0
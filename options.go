@@ -0,0 +1,143 @@
+package cacheddownloader
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/cloudfoundry/systemcerts"
+)
+
+const (
+	// DefaultMaxSizeInBytes is the size of the cache built by NewWithOptions
+	// unless WithMaxSize is given.
+	DefaultMaxSizeInBytes int64 = 10 * 1024 * 1024 * 1024
+	// DefaultMaxConcurrentDownloads is how many downloads the cachedDownloader
+	// built by NewWithOptions runs at once unless WithMaxConcurrentDownloads
+	// is given.
+	DefaultMaxConcurrentDownloads = 5
+)
+
+// Option configures the cachedDownloader built by NewWithOptions.
+type Option func(*constructorOptions)
+
+type constructorOptions struct {
+	maxSizeInBytes         int64
+	downloader             *Downloader
+	downloadTimeout        time.Duration
+	maxConcurrentDownloads int
+	skipSSLVerification    bool
+	caCertPool             *systemcerts.CertPool
+	tlsConfig              *tls.Config
+	transformer            CacheTransformer
+	contextTransformer     ContextCacheTransformer
+}
+
+// WithMaxSize sets the maximum size of the cache; DefaultMaxSizeInBytes is
+// used otherwise.
+func WithMaxSize(maxSizeInBytes int64) Option {
+	return func(o *constructorOptions) {
+		o.maxSizeInBytes = maxSizeInBytes
+	}
+}
+
+// WithDownloader makes the cachedDownloader use the given Downloader, e.g.
+// one that has been configured with a RequestDecorator, rather than one built
+// from WithDownloadTimeout, WithMaxConcurrentDownloads,
+// WithSkipSSLVerification and WithCACertPool, which are then ignored.
+func WithDownloader(downloader *Downloader) Option {
+	return func(o *constructorOptions) {
+		o.downloader = downloader
+	}
+}
+
+// WithDownloadTimeout limits how long a download may take altogether. By
+// default downloads are only limited by the idle timeout of the Downloader.
+func WithDownloadTimeout(timeout time.Duration) Option {
+	return func(o *constructorOptions) {
+		o.downloadTimeout = timeout
+	}
+}
+
+// WithMaxConcurrentDownloads sets how many downloads run at once;
+// DefaultMaxConcurrentDownloads is used otherwise.
+func WithMaxConcurrentDownloads(maxConcurrentDownloads int) Option {
+	return func(o *constructorOptions) {
+		o.maxConcurrentDownloads = maxConcurrentDownloads
+	}
+}
+
+// WithSkipSSLVerification disables the verification of the certificates of
+// origins.
+func WithSkipSSLVerification(skip bool) Option {
+	return func(o *constructorOptions) {
+		o.skipSSLVerification = skip
+	}
+}
+
+// WithCACertPool sets the certificate authorities that the certificates of
+// origins are verified against, in place of those of the system.
+func WithCACertPool(caCertPool *systemcerts.CertPool) Option {
+	return func(o *constructorOptions) {
+		o.caCertPool = caCertPool
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to origins,
+// including that of a Downloader given with WithDownloader. It takes
+// precedence over WithSkipSSLVerification and WithCACertPool. The config is
+// cloned, so it may not be changed afterwards.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *constructorOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// WithTransformer sets the transformer that downloads are run through before
+// they are cached; NoopTransform is used otherwise.
+func WithTransformer(transformer CacheTransformer) Option {
+	return func(o *constructorOptions) {
+		o.transformer = transformer
+	}
+}
+
+// WithContextTransformer sets a transformer that is handed the context of the
+// fetch, see SetContextTransformer. It takes precedence over WithTransformer.
+func WithContextTransformer(transformer ContextCacheTransformer) Option {
+	return func(o *constructorOptions) {
+		o.contextTransformer = transformer
+	}
+}
+
+// NewWithOptions builds a cachedDownloader that caches in cachedPath and
+// keeps temporary files in uncachedPath, configured by the given options; see
+// New for the paths it accepts. Options that are not given take the defaults
+// documented with them, so that options can be added without breaking
+// callers.
+func NewWithOptions(cachedPath string, uncachedPath string, options ...Option) (*cachedDownloader, error) {
+	o := constructorOptions{
+		maxSizeInBytes:         DefaultMaxSizeInBytes,
+		maxConcurrentDownloads: DefaultMaxConcurrentDownloads,
+		transformer:            NoopTransform,
+	}
+	for _, option := range options {
+		option(&o)
+	}
+
+	downloader := o.downloader
+	if downloader == nil {
+		downloader = NewDownloader(o.downloadTimeout, o.maxConcurrentDownloads, o.skipSSLVerification, o.caCertPool)
+	}
+	if o.tlsConfig != nil {
+		downloader.transport().TLSClientConfig = o.tlsConfig.Clone()
+	}
+
+	c, err := NewWithDownloader(cachedPath, uncachedPath, o.maxSizeInBytes, downloader, o.transformer)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.contextTransformer != nil {
+		c.SetContextTransformer(o.contextTransformer)
+	}
+	return c, nil
+}
@@ -0,0 +1,108 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// LowerDir is a cached directory that is pinned for use as a read-only
+// overlayfs lowerdir, as returned by AcquireLowerDir. Its path does not change
+// and it cannot be evicted until every mount that acquired it has released it.
+// The directory must not be written to while it is pinned.
+type LowerDir interface {
+	// Path is the directory to use as the lowerdir.
+	Path() string
+	// Release is called once the overlay that the directory was acquired for
+	// is unmounted; releasing it again returns AlreadyClosed.
+	Release() error
+}
+
+// lowerDirPin keeps a cached directory in use while it is mounted
+type lowerDirPin struct {
+	directory Directory
+	mounts    int
+}
+
+type lowerDirMount struct {
+	pin      *lowerDirPin
+	release  func(*lowerDirPin) error
+	released int32
+}
+
+func (m *lowerDirMount) Path() string {
+	return m.pin.directory.Path()
+}
+
+func (m *lowerDirMount) Release() error {
+	if !atomic.CompareAndSwapInt32(&m.released, 0, 1) {
+		return AlreadyClosed
+	}
+	return m.release(m.pin)
+}
+
+// AcquireLowerDir fetches the directory as FetchDirectory does and pins it for
+// a mount of an overlay that stacks a writable upper layer on it, so that it
+// need not be copied. Mounts of the same version of an entry share its
+// directory, which is released once the last of them is.
+func (c *cachedDownloader) AcquireLowerDir(ctx context.Context, url *url.URL, cacheKey string, checksum ChecksumInfoType, options FetchOptions) (LowerDir, error) {
+	directory, err := c.FetchDirectory(ctx, url, cacheKey, checksum, options)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.lowerDirs == nil {
+		c.lowerDirs = map[string]*lowerDirPin{}
+	}
+	pin := c.lowerDirs[directory.Path()]
+	shared := pin != nil
+	if !shared {
+		pin = &lowerDirPin{directory: directory}
+		c.lowerDirs[directory.Path()] = pin
+	}
+	pin.mounts++
+	c.lock.Unlock()
+
+	if shared {
+		// the pin holds the directory already
+		directory.Close()
+	}
+	return &lowerDirMount{pin: pin, release: c.releaseLowerDir}, nil
+}
+
+func (c *cachedDownloader) releaseLowerDir(pin *lowerDirPin) error {
+	c.lock.Lock()
+	pin.mounts--
+	unmounted := pin.mounts == 0
+	if unmounted {
+		delete(c.lowerDirs, pin.directory.Path())
+	}
+	c.lock.Unlock()
+
+	if unmounted {
+		return pin.directory.Close()
+	}
+	return nil
+}
+
+// OverlayMountOptions returns the data to mount an overlay with, stacking the
+// upper directory on the lower directories, the first of which is the top
+// one.
+func OverlayMountOptions(lowerDirs []LowerDir, upperDir, workDir string) string {
+	lowerPaths := make([]string, len(lowerDirs))
+	for i, lowerDir := range lowerDirs {
+		lowerPaths[i] = escapeOverlayPath(lowerDir.Path())
+	}
+
+	return "lowerdir=" + strings.Join(lowerPaths, ":") +
+		",upperdir=" + escapeOverlayPath(upperDir) +
+		",workdir=" + escapeOverlayPath(workDir)
+}
+
+// escapeOverlayPath escapes the characters that separate overlay options and
+// lower directories
+func escapeOverlayPath(path string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`, ",", `\,`).Replace(path)
+}
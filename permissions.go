@@ -0,0 +1,100 @@
+package cacheddownloader
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Permissions controls the modes and ownership of what the cache hands out,
+// e.g. so that an expanded root filesystem can be read by the user of a
+// container. The zero value keeps the defaults: cached files are only
+// accessible to the owner, directories keep the modes in their archive, and
+// everything is owned by the current user.
+type Permissions struct {
+	// FileMode, if set, is the mode of the cached files.
+	FileMode os.FileMode
+	// DirectoryMode, if set, is the mode of the cached path and of the root of
+	// each expanded directory.
+	DirectoryMode os.FileMode
+	// Chown makes UID and GID the owners of the cached files and of the whole
+	// tree of each expanded directory. It is not supported on Windows.
+	Chown bool
+	UID   int
+	GID   int
+}
+
+// SetPermissions sets the modes and ownership of the cached files and of the
+// expanded directories, including those that are too large to be cached. The
+// cached path is changed to the directory mode right away. It should be
+// called before any fetches are started.
+func (c *cachedDownloader) SetPermissions(permissions Permissions) error {
+	return c.cache.SetPermissions(permissions)
+}
+
+// SetPermissions sets the modes and ownership of the files and expanded
+// directories that the cache adds from then on.
+func (c *FileCache) SetPermissions(permissions Permissions) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.permissions = permissions
+	if permissions.DirectoryMode == 0 {
+		return nil
+	}
+
+	for _, shard := range c.shards() {
+		err := os.Chmod(shard, permissions.DirectoryMode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FileCache) currentPermissions() Permissions {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return c.permissions
+}
+
+// applyToFile gives the file at path the mode and owner of cached files
+func (p Permissions) applyToFile(path string) error {
+	if p.FileMode != 0 {
+		err := os.Chmod(path, p.FileMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Chown {
+		return os.Chown(path, p.UID, p.GID)
+	}
+	return nil
+}
+
+// applyToTree gives the expanded directory at root its mode and owner
+func (p Permissions) applyToTree(root string) error {
+	if p.DirectoryMode != 0 {
+		err := os.Chmod(root, p.DirectoryMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !p.Chown {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		err = os.Lchown(path, p.UID, p.GID)
+		if err != nil || info.Mode()&(os.ModeSetuid|os.ModeSetgid) == 0 {
+			return err
+		}
+		// changing the owner clears the setuid and setgid bits
+		return os.Chmod(path, info.Mode())
+	})
+}
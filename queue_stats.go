@@ -0,0 +1,128 @@
+package cacheddownloader
+
+import (
+	"sync"
+	"time"
+)
+
+// Queues that fetches wait in, as reported in QueueWait.
+const (
+	// DownloadSlotQueue is where downloads wait for one of the concurrent
+	// download slots of the Downloader.
+	DownloadSlotQueue = "download-slot"
+	// CacheKeyQueue is where fetches wait for a fetch of the same cache key
+	// to finish.
+	CacheKeyQueue = "cache-key"
+)
+
+// QueueStats describes the fetches waiting in a queue. It can be used to tell
+// whether maxConcurrentDownloads is too low: a growing queue or long waits
+// mean that downloads are waiting for slots rather than for the network.
+type QueueStats struct {
+	// Waiting is the number of fetches currently waiting.
+	Waiting int `json:"waiting"`
+	// LongestWait is how long the fetch that has been waiting longest has
+	// been waiting so far.
+	LongestWait time.Duration `json:"longest_wait_ns"`
+	// Waits is the number of fetches that have left the queue, whether they
+	// had to wait or not.
+	Waits int64 `json:"waits"`
+	// TotalWait is how long the fetches that have left the queue have waited
+	// altogether; divided by Waits it gives the average wait.
+	TotalWait time.Duration `json:"total_wait_ns"`
+}
+
+// QueueWait describes how long a fetch waited in a queue.
+type QueueWait struct {
+	// Queue is DownloadSlotQueue or CacheKeyQueue.
+	Queue string
+	// Key is the cache key, or the URL for downloads without one.
+	Key      string
+	Duration time.Duration
+	// Cancelled is set when the fetch stopped waiting because it was
+	// cancelled.
+	Cancelled bool
+}
+
+// QueueObserver is called every time a fetch leaves a queue.
+type QueueObserver func(QueueWait)
+
+// SetQueueObserver installs an observer that is called every time a download
+// has waited for a download slot, including when it did not have to wait. It
+// should be called before any downloads are started.
+func (downloader *Downloader) SetQueueObserver(observer QueueObserver) {
+	downloader.slotQueue.observer = observer
+}
+
+// QueueStats describes the downloads waiting for a download slot.
+func (downloader *Downloader) QueueStats() QueueStats {
+	return downloader.slotQueue.stats()
+}
+
+// SetQueueObserver installs an observer that is called every time a fetch
+// with a cache key has waited for other fetches of the same key to finish,
+// including when it did not have to wait. Waits for download slots are
+// observed with the SetQueueObserver of the Downloader. It should be called
+// before any fetches are started.
+func (c *cachedDownloader) SetQueueObserver(observer QueueObserver) {
+	c.keyQueue.observer = observer
+}
+
+// queueTracker keeps track of the fetches waiting in one queue
+type queueTracker struct {
+	name     string
+	observer QueueObserver
+
+	lock      sync.Mutex
+	nextID    uint64
+	waiting   map[uint64]time.Time
+	waits     int64
+	totalWait time.Duration
+}
+
+func newQueueTracker(name string) *queueTracker {
+	return &queueTracker{name: name, waiting: map[uint64]time.Time{}}
+}
+
+// enter records that a fetch starts waiting and returns a function that
+// records that it stopped
+func (q *queueTracker) enter(key string) func(cancelled bool) {
+	q.lock.Lock()
+	id := q.nextID
+	q.nextID++
+	since := time.Now()
+	q.waiting[id] = since
+	q.lock.Unlock()
+
+	return func(cancelled bool) {
+		waited := time.Since(since)
+
+		q.lock.Lock()
+		delete(q.waiting, id)
+		q.waits++
+		q.totalWait += waited
+		q.lock.Unlock()
+
+		if q.observer != nil {
+			q.observer(QueueWait{Queue: q.name, Key: key, Duration: waited, Cancelled: cancelled})
+		}
+	}
+}
+
+func (q *queueTracker) stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := QueueStats{
+		Waiting:   len(q.waiting),
+		Waits:     q.waits,
+		TotalWait: q.totalWait,
+	}
+	now := time.Now()
+	for _, since := range q.waiting {
+		if wait := now.Sub(since); wait > stats.LongestWait {
+			stats.LongestWait = wait
+		}
+	}
+	return stats
+}
@@ -0,0 +1,143 @@
+package cacheddownloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// trashDirectory is where a cache shard keeps the evicted files and
+// directories that are waiting to be deleted in the background
+const trashDirectory = ".trash"
+
+// SetBackgroundDeletion makes the cache delete evicted and replaced files and
+// directories in the background, so that removing a large directory does not
+// stall the fetch that caused it. The victims are moved to a trash directory
+// in their shard right away, which frees their space in the cache, but the
+// disk space is only released once they are deleted, which the free space
+// reserve waits for. Trash left behind by a crash is removed when the state is
+// recovered. It should be called before any fetches are started.
+func (c *cachedDownloader) SetBackgroundDeletion(background bool) {
+	c.cache.SetBackgroundDeletion(background)
+}
+
+// SetBackgroundDeletion makes the cache delete the files and directories of
+// its entries in the background, see cachedDownloader.SetBackgroundDeletion.
+func (c *FileCache) SetBackgroundDeletion(background bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.reaper.enabled = background
+}
+
+// WaitForDeletions blocks until the files and directories that were being
+// deleted in the background when it was called are gone.
+func (c *FileCache) WaitForDeletions() {
+	c.reaper.wait()
+}
+
+// reaper deletes the files and directories that the cache is done with,
+// either right away or, if enabled, in the background. It is shared by the
+// entries of a cache.
+type reaper struct {
+	enabled bool
+
+	lock    sync.Mutex
+	queue   []string
+	running bool
+
+	// trashed and reaped count the paths queued and deleted so far
+	trashed  int64
+	reaped   int64
+	progress *sync.Cond
+}
+
+func newReaper() *reaper {
+	r := &reaper{}
+	r.progress = sync.NewCond(&r.lock)
+	return r
+}
+
+// wait blocks until the paths that are queued are deleted; the queue is
+// deleted in order, so paths queued later are not waited for
+func (r *reaper) wait() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	trashed := r.trashed
+	for r.reaped < trashed {
+		r.progress.Wait()
+	}
+}
+
+// removePath deletes the file or directory of the entry at path, if it has one
+func (e *FileCacheEntry) removePath(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if path == e.FilePath {
+		os.Remove(path + sidecarSuffix)
+	}
+	if path == e.ExpandedDirectoryPath {
+		os.Remove(path + manifestSuffix)
+	}
+	if e.reaper == nil || !e.reaper.enabled {
+		return removeAll(path)
+	}
+	return e.reaper.discard(path)
+}
+
+// discard moves path to the trash directory next to it and deletes it from
+// there in the background. If it cannot be moved, it is deleted right away.
+func (r *reaper) discard(path string) error {
+	trash := filepath.Join(filepath.Dir(path), trashDirectory)
+	trashed := filepath.Join(trash, filepath.Base(path))
+
+	err := os.MkdirAll(trash, 0770)
+	if err == nil {
+		err = os.Rename(path, trashed)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return removeAll(path)
+	}
+
+	r.lock.Lock()
+	r.trashed++
+	r.queue = append(r.queue, trashed)
+	if !r.running {
+		r.running = true
+		go r.reap()
+	}
+	r.lock.Unlock()
+	return nil
+}
+
+// reap deletes the trashed paths one at a time until the queue is empty
+func (r *reaper) reap() {
+	for {
+		r.lock.Lock()
+		if len(r.queue) == 0 {
+			r.running = false
+			r.lock.Unlock()
+			return
+		}
+		path := r.queue[0]
+		r.queue = r.queue[1:]
+		r.lock.Unlock()
+
+		err := removeAll(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to delete trashed cache entry", err)
+		}
+
+		r.lock.Lock()
+		r.reaped++
+		r.progress.Broadcast()
+		r.lock.Unlock()
+	}
+}
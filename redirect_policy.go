@@ -0,0 +1,94 @@
+package cacheddownloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectPolicy controls which redirects the Downloader follows.
+type RedirectPolicy struct {
+	// MaxRedirects is the maximum number of redirects followed for a request.
+	// Zero uses the net/http default of 10; a negative value follows none.
+	MaxRedirects int
+	// SameHostOnly refuses redirects to a host other than the one of the
+	// original request.
+	SameHostOnly bool
+	// ForwardAuthorization sends the Authorization header of the original
+	// request along to redirects to other hosts. By default it is removed, so
+	// that credentials do not leak to redirect targets.
+	ForwardAuthorization bool
+}
+
+// SetRedirectPolicy replaces the net/http redirect policy of the Downloader.
+// It should be called before any downloads are started.
+func (downloader *Downloader) SetRedirectPolicy(policy RedirectPolicy) {
+	downloader.client.CheckRedirect = policy.checkRedirect
+}
+
+func (p RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := p.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+
+	original := via[0]
+	if len(via) > maxRedirects {
+		return NewRedirectError("too many redirects", req, via)
+	}
+
+	if req.URL.Host == original.URL.Host {
+		return nil
+	}
+
+	if p.SameHostOnly {
+		return NewRedirectError("redirect to another host", req, via)
+	}
+
+	if authorization := original.Header.Get("Authorization"); p.ForwardAuthorization && authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	} else {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// RedirectError is returned when a download is redirected in a way the
+// redirect policy does not allow. Chain lists the URLs visited, ending with
+// the redirect that was refused.
+type RedirectError struct {
+	Reason string
+	Chain  []string
+}
+
+func NewRedirectError(reason string, req *http.Request, via []*http.Request) error {
+	chain := []string{}
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+
+	return &RedirectError{
+		Reason: reason,
+		Chain:  append(chain, req.URL.String()),
+	}
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Redirect refused: %s: %s", e.Reason, strings.Join(e.Chain, " -> "))
+}
+
+func (e *RedirectError) IsRetryable() bool {
+	return false
+}
+
+// unwrapRedirectError returns the RedirectError that the http.Client wrapped
+// in a url.Error, and any other error as it is
+func unwrapRedirectError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		if redirectErr, ok := urlErr.Err.(*RedirectError); ok {
+			return redirectErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package cacheddownloader
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRemoveAttempts is how often the cache tries to remove a file or
+	// directory that is held open by another process.
+	DefaultRemoveAttempts = 5
+	// DefaultRemoveRetryInterval is how long the cache waits after the first
+	// failed attempt; it waits longer after each attempt.
+	DefaultRemoveRetryInterval = 50 * time.Millisecond
+)
+
+var removeRetry = struct {
+	attempts int32
+	interval int64
+}{DefaultRemoveAttempts, int64(DefaultRemoveRetryInterval)}
+
+// SetRemoveRetry sets how often, and how long apart, the cache tries to remove
+// files and directories that cannot be removed yet since they are open, as
+// happens on Windows when a virus scanner or indexer holds on to a file that
+// has just been written. Other errors are not retried, and on other systems,
+// which can remove open files, there is nothing to retry. It applies to all
+// cachedDownloaders, and should be called before any fetches are started.
+func SetRemoveRetry(attempts int, interval time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	atomic.StoreInt32(&removeRetry.attempts, int32(attempts))
+	atomic.StoreInt64(&removeRetry.interval, int64(interval))
+}
+
+// removeAll removes path and everything in it as os.RemoveAll does, retrying
+// while some of it is in use
+func removeAll(path string) error {
+	return retryRemove(func() error {
+		return os.RemoveAll(longPath(path))
+	})
+}
+
+func retryRemove(remove func() error) error {
+	attempts := int(atomic.LoadInt32(&removeRetry.attempts))
+	interval := time.Duration(atomic.LoadInt64(&removeRetry.interval))
+
+	for attempt := 1; ; attempt++ {
+		err := remove()
+		if err == nil || attempt >= attempts || !isSharingViolation(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * interval)
+	}
+}
+
+// isSharingViolation reports whether err is the error of removing a file that
+// is in use
+func isSharingViolation(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return isSharingViolationErrno(err)
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package cacheddownloader
+
+import "os"
+
+// isSharingViolationErrno is false since open files can be removed
+func isSharingViolationErrno(err error) bool {
+	return false
+}
+
+func longPath(path string) string {
+	return path
+}
+
+// symlink creates a symbolic link to target at path; it is never followed
+// during extraction, so it may point outside of destinationDir
+func symlink(destinationDir, target, path string) error {
+	return os.Symlink(target, path)
+}
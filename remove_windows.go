@@ -0,0 +1,162 @@
+//go:build windows
+// +build windows
+
+package cacheddownloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+)
+
+const (
+	errorAccessDenied     = syscall.Errno(5)
+	errorSharingViolation = syscall.Errno(32)
+	errorLockViolation    = syscall.Errno(33)
+	errorPrivilegeNotHeld = syscall.Errno(1314)
+)
+
+const (
+	fsctlSetReparsePoint   = 0x900A4
+	ioReparseTagMountPoint = 0xA0000003
+)
+
+// maxShortPathLength is the length from which paths must be in the
+// extended-length form; directories may be at most MAX_PATH - 12 long
+const maxShortPathLength = 248
+
+// isSharingViolationErrno reports whether err is one of the errors that
+// deleting a file fails with while another process has it open; access is
+// also denied to files that another handle is about to delete
+func isSharingViolationErrno(err error) bool {
+	return err == errorSharingViolation || err == errorLockViolation || err == errorAccessDenied
+}
+
+// longPath returns path in the extended-length form, so that it may be longer
+// than MAX_PATH, which deeply nested expanded directories easily are
+func longPath(path string) string {
+	if len(path) < maxShortPathLength || strings.HasPrefix(path, `\\?\`) || !filepath.IsAbs(path) {
+		return path
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + filepath.Clean(path)[len(`\\`):]
+	}
+	return `\\?\` + filepath.Clean(path)
+}
+
+// symlink creates a symbolic link to target at path. Creating one takes a
+// privilege that the cache usually does not have on Windows; links to
+// directories then become junctions, and links to files hardlinks. These are
+// resolved as they are created, so their target must be within
+// destinationDir.
+func symlink(destinationDir, target, path string) error {
+	err := os.Symlink(target, path)
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != errorPrivilegeNotHeld {
+		return err
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	if !isWithin(destinationDir, target) {
+		return fmt.Errorf("cannot link %s to %s outside of %s without the privilege to create symbolic links", path, target, destinationDir)
+	}
+
+	info, statErr := os.Stat(target)
+	if statErr != nil {
+		// what kind of link it should be cannot be told yet
+		return err
+	}
+	if !info.IsDir() {
+		return os.Link(target, path)
+	}
+
+	err = createJunction(target, path)
+	if err != nil {
+		return fmt.Errorf("creating junction %s to %s: %s", path, target, err)
+	}
+	return nil
+}
+
+// createJunction creates a junction to the directory target at path, which
+// does not exist yet
+func createJunction(target, path string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(path, 0777)
+	if err != nil {
+		return err
+	}
+
+	err = setMountPoint(path, target)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// setMountPoint makes the empty directory at path a junction to target
+func setMountPoint(path, target string) error {
+	name, err := syscall.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return err
+	}
+
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_OPEN_REPARSE_POINT|syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+
+	data := mountPointReparseData(target)
+	var returned uint32
+	return syscall.DeviceIoControl(handle, fsctlSetReparsePoint, &data[0], uint32(len(data)), nil, 0, &returned, nil)
+}
+
+// mountPointReparseData returns the REPARSE_DATA_BUFFER of a junction to the
+// absolute path target
+func mountPointReparseData(target string) []byte {
+	ntPath := `\??\` + target
+	switch {
+	case strings.HasPrefix(target, `\\?\`):
+		ntPath = `\??\` + target[len(`\\?\`):]
+	case strings.HasPrefix(target, `\\`):
+		ntPath = `\??\UNC\` + target[len(`\\`):]
+	}
+	substituteName := utf16.Encode([]rune(ntPath))
+	printName := utf16.Encode([]rune(target))
+
+	// both names are followed by a null character, which their lengths exclude
+	pathBuffer := append(append(append(substituteName, 0), printName...), 0)
+	header := struct {
+		ReparseTag           uint32
+		ReparseDataLength    uint16
+		Reserved             uint16
+		SubstituteNameOffset uint16
+		SubstituteNameLength uint16
+		PrintNameOffset      uint16
+		PrintNameLength      uint16
+	}{
+		ReparseTag:           ioReparseTagMountPoint,
+		ReparseDataLength:    uint16(8 + 2*len(pathBuffer)),
+		SubstituteNameLength: uint16(2 * len(substituteName)),
+		PrintNameOffset:      uint16(2 * (len(substituteName) + 1)),
+		PrintNameLength:      uint16(2 * len(printName)),
+	}
+
+	data := &bytes.Buffer{}
+	binary.Write(data, binary.LittleEndian, header)
+	binary.Write(data, binary.LittleEndian, pathBuffer)
+	return data.Bytes()
+}
@@ -0,0 +1,129 @@
+package cacheddownloader_test
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileCache on Windows", func() {
+	var (
+		cache       *cacheddownloader.FileCache
+		cacheDir    string
+		archivePath string
+		cacheInfo   cacheddownloader.CachingInfoType
+	)
+
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "cache-test")
+		Expect(err).NotTo(HaveOccurred())
+		cache = cacheddownloader.NewCache(cacheDir, 123424)
+		cacheInfo.LastModified = "1234"
+
+		archive, err := ioutil.TempFile("", "windows-archive")
+		Expect(err).NotTo(HaveOccurred())
+		archivePath = archive.Name()
+
+		writer := tar.NewWriter(archive)
+		Expect(writer.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})).To(Succeed())
+		Expect(writer.WriteHeader(&tar.Header{Name: "bin/tool.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})).To(Succeed())
+		_, err = writer.Write([]byte("tool"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.WriteHeader(&tar.Header{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "bin"})).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+		Expect(archive.Close()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(archivePath)
+		os.RemoveAll(cacheDir)
+	})
+
+	It("links directories even without the privilege to create symbolic links", func() {
+		dir, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+		Expect(err).NotTo(HaveOccurred())
+		defer cache.CloseDirectory("dir-key", dir)
+
+		Expect(ioutil.ReadFile(filepath.Join(dir, "current", "tool.txt"))).To(Equal([]byte("tool")))
+	})
+
+	Context("when the archive links outside of the directory", func() {
+		var outside string
+
+		BeforeEach(func() {
+			var err error
+			outside, err = ioutil.TempDir("", "outside")
+			Expect(err).NotTo(HaveOccurred())
+
+			archive, err := os.Create(archivePath)
+			Expect(err).NotTo(HaveOccurred())
+			writer := tar.NewWriter(archive)
+			Expect(writer.WriteHeader(&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside})).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+			Expect(archive.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outside)
+		})
+
+		It("does not create a junction to it", func() {
+			dir, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+			if err != nil {
+				Expect(err).To(MatchError(ContainSubstring("outside of")))
+				return
+			}
+			defer cache.CloseDirectory("dir-key", dir)
+
+			// the cache has the privilege to create symbolic links
+			info, err := os.Lstat(filepath.Join(dir, "escape"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode() & os.ModeSymlink).NotTo(BeZero())
+		})
+	})
+
+	It("does not pass the names of entries to a shell", func() {
+		archive, err := os.Create(archivePath)
+		Expect(err).NotTo(HaveOccurred())
+		writer := tar.NewWriter(archive)
+		Expect(writer.WriteHeader(&tar.Header{Name: "x&mkdir pwned/", Typeflag: tar.TypeDir, Mode: 0755})).To(Succeed())
+		Expect(writer.WriteHeader(&tar.Header{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "x&mkdir pwned"})).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+		Expect(archive.Close()).To(Succeed())
+
+		dir, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+		Expect(err).NotTo(HaveOccurred())
+		defer cache.CloseDirectory("dir-key", dir)
+
+		Expect(filepath.Join(dir, "current")).To(BeADirectory())
+		Expect("pwned").NotTo(BeADirectory())
+		Expect(filepath.Join(dir, "pwned")).NotTo(BeADirectory())
+	})
+
+	It("removes directories once the files that are open in them are closed", func() {
+		cacheddownloader.SetRemoveRetry(10, 20*time.Millisecond)
+		defer cacheddownloader.SetRemoveRetry(cacheddownloader.DefaultRemoveAttempts, cacheddownloader.DefaultRemoveRetryInterval)
+
+		dir, err := cache.AddDirectory("dir-key", archivePath, 100, cacheInfo)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cache.CloseDirectory("dir-key", dir)).To(Succeed())
+
+		// os.Open does not allow others to delete the file while it is open
+		file, err := os.Open(filepath.Join(dir, "bin", "tool.txt"))
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			file.Close()
+		}()
+
+		cache.Remove("dir-key")
+		Expect(dir).NotTo(BeADirectory())
+	})
+})
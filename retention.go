@@ -0,0 +1,23 @@
+package cacheddownloader
+
+// SetRetainArchives makes the entries that are added from then on keep both
+// their archive and their expanded directory once they have been fetched as
+// both, so that consumers that stream the archive and consumers that use the
+// directory can share an entry without it being expanded or archived again.
+// Entries are still expanded on their first fetch as a directory. An entry
+// that holds both is validated once for both, and its size, which counts
+// against the maximum size of the cache, is that of both. It should be called
+// before any fetches are started.
+func (c *cachedDownloader) SetRetainArchives(retain bool) {
+	c.cache.SetRetainArchives(retain)
+}
+
+// SetRetainArchives makes the entries that are added from then on keep both
+// their archive and their expanded directory, see
+// cachedDownloader.SetRetainArchives.
+func (c *FileCache) SetRetainArchives(retain bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.retainArchives = retain
+}
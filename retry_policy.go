@@ -0,0 +1,80 @@
+package cacheddownloader
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how often a failed download is attempted again, and
+// how long to wait in between. Downloads that failed with an error that is not
+// retryable, see IsRetryable, are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry; it doubles with every
+	// further retry. Zero retries immediately.
+	BaseBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is randomly
+	// taken off it, so that clients that failed together do not retry together.
+	Jitter float64
+}
+
+// DefaultRetryPolicy makes MAX_DOWNLOAD_ATTEMPTS attempts without any delay
+// between them.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: MAX_DOWNLOAD_ATTEMPTS}
+
+// SetRetryPolicy replaces DefaultRetryPolicy for the downloads of the
+// Downloader. A download keeps its concurrent download slot while it waits to
+// be retried. It should be called before any downloads are started.
+func (downloader *Downloader) SetRetryPolicy(policy RetryPolicy) {
+	downloader.retryPolicy = policy
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the delay before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.BaseBackoff <= 0 {
+		return 0
+	}
+
+	delay := p.BaseBackoff
+	for i := 1; i < retry && delay < math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// wait blocks for the backoff before the given retry, or until ctx is done
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	delay := p.backoff(retry)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return NewDownloadCancelledError("retry-backoff", delay, NoBytesReceived)
+	}
+}
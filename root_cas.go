@@ -0,0 +1,46 @@
+package cacheddownloader
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// SetRootCAs replaces the certificate authorities that the Downloader trusts
+// to sign the certificates of origins, e.g. with a pool that holds an internal
+// CA. It should be called before any downloads are started.
+func (downloader *Downloader) SetRootCAs(pool *x509.CertPool) {
+	downloader.tlsConfig().RootCAs = pool
+}
+
+// AddRootCAFiles adds the PEM encoded certificates in the given files to the
+// certificate authorities that the Downloader trusts; the system roots are
+// kept if no pool has been given yet. It returns an error if a file cannot be
+// read or holds no certificate. It should be called before any downloads are
+// started.
+func (downloader *Downloader) AddRootCAFiles(paths ...string) error {
+	config := downloader.tlsConfig()
+
+	pool := config.RootCAs
+	if pool == nil {
+		var err error
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+	}
+
+	for _, path := range paths {
+		pemCerts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return fmt.Errorf("No certificates found in '%s'", path)
+		}
+	}
+
+	config.RootCAs = pool
+	return nil
+}
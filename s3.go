@@ -0,0 +1,357 @@
+package cacheddownloader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NoS3Credentials is returned when none of the configured sources can provide
+// credentials for an s3:// download.
+var NoS3Credentials = errors.New("No S3 credentials found")
+
+// emptyPayloadHash is the SHA-256 of the empty body of a GET or HEAD request
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config configures how the Downloader fetches s3://bucket/key URLs.
+type S3Config struct {
+	// Region is the region of the buckets. Empty uses AWS_REGION or
+	// AWS_DEFAULT_REGION, and else us-east-1.
+	Region string
+	// Endpoint, if set, is used instead of AWS, e.g. for an S3 compatible
+	// blobstore; buckets are then addressed by path.
+	Endpoint string
+	// Credentials signs the requests. Nil looks for credentials in the
+	// environment, and else in the instance profile.
+	Credentials S3CredentialSource
+}
+
+// S3Credentials are the AWS credentials requests are signed with.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3CredentialSource provides the credentials for s3:// downloads. It is
+// asked for credentials before every request, so that it can refresh them.
+type S3CredentialSource interface {
+	Retrieve(ctx context.Context) (S3Credentials, error)
+}
+
+// StaticS3Credentials always provides the given credentials.
+type StaticS3Credentials S3Credentials
+
+func (c StaticS3Credentials) Retrieve(ctx context.Context) (S3Credentials, error) {
+	return S3Credentials(c), nil
+}
+
+// EnvS3Credentials provides the credentials in AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type EnvS3Credentials struct{}
+
+func (EnvS3Credentials) Retrieve(ctx context.Context) (S3Credentials, error) {
+	credentials := S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return S3Credentials{}, NoS3Credentials
+	}
+	return credentials, nil
+}
+
+// S3CredentialChain provides the credentials of the first of its sources
+// that has any.
+type S3CredentialChain []S3CredentialSource
+
+func (chain S3CredentialChain) Retrieve(ctx context.Context) (S3Credentials, error) {
+	for _, source := range chain {
+		credentials, err := source.Retrieve(ctx)
+		if err == nil {
+			return credentials, nil
+		}
+	}
+	return S3Credentials{}, NoS3Credentials
+}
+
+// InstanceProfileS3Credentials provides the credentials of the IAM role of
+// the EC2 instance, from the instance metadata service. The credentials are
+// cached until shortly before they expire.
+type InstanceProfileS3Credentials struct {
+	// Endpoint is the instance metadata service; empty uses the default.
+	Endpoint string
+
+	lock        sync.Mutex
+	credentials S3Credentials
+	expiration  time.Time
+}
+
+func (p *InstanceProfileS3Credentials) Retrieve(ctx context.Context) (S3Credentials, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if time.Now().Add(5 * time.Minute).Before(p.expiration) {
+		return p.credentials, nil
+	}
+
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	token, err := requestString(ctx, client, "PUT", endpoint+"/latest/api/token", "", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "21600",
+	})
+	if err != nil {
+		return S3Credentials{}, err
+	}
+
+	tokenHeader := map[string]string{"X-aws-ec2-metadata-token": token}
+	rolesURL := endpoint + "/latest/meta-data/iam/security-credentials/"
+	roles, err := requestString(ctx, client, "GET", rolesURL, "", tokenHeader)
+	if err != nil {
+		return S3Credentials{}, err
+	}
+
+	role := strings.TrimSpace(strings.Split(roles, "\n")[0])
+	if role == "" {
+		return S3Credentials{}, NoS3Credentials
+	}
+
+	body, err := requestString(ctx, client, "GET", rolesURL+role, "", tokenHeader)
+	if err != nil {
+		return S3Credentials{}, err
+	}
+
+	var response struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	err = json.Unmarshal([]byte(body), &response)
+	if err != nil {
+		return S3Credentials{}, err
+	}
+
+	p.credentials = S3Credentials{
+		AccessKeyID:     response.AccessKeyId,
+		SecretAccessKey: response.SecretAccessKey,
+		SessionToken:    response.Token,
+	}
+	p.expiration = response.Expiration
+	return p.credentials, nil
+}
+
+// requestString makes a small request, e.g. to a metadata or token service,
+// and returns the body of its 200 response
+func requestString(ctx context.Context, client *http.Client, method, url, body string, header map[string]string) (string, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", NewHTTPStatusError(resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	return string(content), err
+}
+
+// SetS3Config configures how s3:// URLs are downloaded. Without it, s3:// URLs
+// are downloaded from AWS with the credentials found in the environment or
+// the instance profile. It should be called before any downloads are started.
+func (downloader *Downloader) SetS3Config(config S3Config) {
+	downloader.s3 = newS3Backend(config)
+}
+
+type s3Backend struct {
+	region      string
+	endpoint    string
+	credentials S3CredentialSource
+}
+
+func newS3Backend(config S3Config) *s3Backend {
+	region := config.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	credentials := config.Credentials
+	if credentials == nil {
+		credentials = S3CredentialChain{EnvS3Credentials{}, &InstanceProfileS3Credentials{}}
+	}
+
+	return &s3Backend{
+		region:      region,
+		endpoint:    strings.TrimSuffix(config.Endpoint, "/"),
+		credentials: credentials,
+	}
+}
+
+// prepare points a request for s3://bucket/key at the HTTP endpoint of the
+// bucket and signs it
+func (b *s3Backend) prepare(ctx context.Context, req *http.Request) error {
+	bucket := req.URL.Host
+	key := req.URL.Path
+
+	var target string
+	if b.endpoint != "" {
+		target = b.endpoint + "/" + bucket + key
+	} else {
+		target = fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, b.region, key)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	targetURL.RawQuery = req.URL.RawQuery
+	req.URL = targetURL
+	req.Host = ""
+
+	credentials, err := b.credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+
+	SignV4(req, credentials, b.region, "s3", time.Now())
+	return nil
+}
+
+// SignV4 signs a request without a body with AWS Signature Version 4. The
+// host, the Range header and all x-amz-* headers are signed.
+func SignV4(req *http.Request, credentials S3Credentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := strings.Join([]string{now.Format("20060102"), region, service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of RFC
+// 3986, and slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	encoded := strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
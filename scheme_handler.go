@@ -0,0 +1,124 @@
+package cacheddownloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// NotModified is returned by a SchemeHandler when the download has not
+// changed since the CachingInfoType it was given.
+var NotModified = errors.New("Not modified")
+
+// SchemeHandler downloads the URLs of one scheme. Fetch writes the download to
+// destination and returns the CachingInfoType that later fetches pass back in
+// to revalidate it, or NotModified if it has not changed since cachingInfo.
+// Errors that implement RetryableError control whether a failed attempt is
+// retried.
+//
+// The Downloader takes care of retries, cancellation, bandwidth and size
+// limits, and checksums; writes to destination fail once the download has to
+// be aborted. Handlers should stop when ctx is done.
+type SchemeHandler interface {
+	Fetch(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo CachingInfoType) (CachingInfoType, error)
+}
+
+// RegisterSchemeHandler makes the Downloader download the URLs of scheme with
+// handler. URLs with a scheme that has no handler are downloaded over HTTP,
+// so a handler registered for http or https replaces the built-in client. It
+// should be called before any downloads are started.
+func (downloader *Downloader) RegisterSchemeHandler(scheme string, handler SchemeHandler) {
+	downloader.schemeHandlers[scheme] = handler
+}
+
+// fetchWithHandler makes a single download attempt with handler. It returns
+// an empty path if the download has not been modified.
+func (downloader *Downloader) fetchWithHandler(
+	ctx context.Context,
+	handler SchemeHandler,
+	url *url.URL,
+	createDestination func() (*os.File, error),
+	cachingInfoIn CachingInfoType,
+	checksum ChecksumInfoType,
+	limiter *bandwidthLimiter,
+) (string, CachingInfoType, error) {
+	var checksumValidator *hashValidator
+	var err error
+
+	// if checksum data is provided, create the checksum validator
+	if checksum.Algorithm != "" || checksum.Value != "" {
+		checksumValidator, err = NewHashValidator(checksum.Algorithm)
+		if err != nil {
+			return "", CachingInfoType{}, err
+		}
+	}
+
+	destinationFile, err := createDestination()
+	if err != nil {
+		return "", CachingInfoType{}, err
+	}
+	defer func() {
+		destinationFile.Close()
+		if err != nil {
+			os.Remove(destinationFile.Name())
+		}
+	}()
+
+	ioWriters := []io.Writer{destinationFile}
+	if checksumValidator != nil {
+		ioWriters = append(ioWriters, checksumValidator.hash)
+	}
+
+	// the handler writes into a pipe, so that its bytes pass through the same
+	// readers as an HTTP body
+	pipeReader, pipeWriter := io.Pipe()
+	var cachingInfoOut CachingInfoType
+	var fetchErr error
+	fetched := make(chan struct{})
+	go func() {
+		defer close(fetched)
+		cachingInfoOut, fetchErr = handler.Fetch(ctx, url, pipeWriter, cachingInfoIn)
+		if fetchErr != nil {
+			pipeWriter.CloseWithError(fetchErr)
+		} else {
+			pipeWriter.Close()
+		}
+	}()
+
+	startTime := time.Now()
+	body, stopWatching := downloader.watchStalls(pipeReader)
+	written, err := copyBuffered(io.MultiWriter(ioWriters...), limiter.reader(ctx, downloader.capReader(body, 0)))
+	if stallErr := stopWatching(); stallErr != nil && err != nil {
+		err = stallErr
+	}
+	pipeReader.CloseWithError(err)
+	<-fetched
+	atomic.AddInt64(&downloader.bytesDownloaded, written)
+
+	if err == NotModified {
+		os.Remove(destinationFile.Name())
+		err = nil
+		return "", CachingInfoType{}, nil
+	}
+	if err != nil {
+		select {
+		case <-ctx.Done():
+			err = NewDownloadCancelledError("scheme-handler", time.Now().Sub(startTime), written)
+		default:
+		}
+		return "", CachingInfoType{}, err
+	}
+
+	if checksumValidator != nil {
+		err = checksumValidator.Validate(checksum.Value)
+		if err != nil {
+			return "", CachingInfoType{}, err
+		}
+	}
+
+	return destinationFile.Name(), cachingInfoOut, nil
+}
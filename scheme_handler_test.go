@@ -0,0 +1,137 @@
+package cacheddownloader_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSchemeHandler struct {
+	fetch func(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error)
+	calls int
+}
+
+func (h *fakeSchemeHandler) Fetch(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error) {
+	h.calls++
+	return h.fetch(ctx, url, destination, cachingInfo)
+}
+
+var _ = Describe("SchemeHandler", func() {
+	var (
+		downloader  *cacheddownloader.Downloader
+		handler     *fakeSchemeHandler
+		artifactURL *url.URL
+		dest        string
+	)
+
+	createDestFile := func() (*os.File, error) {
+		return ioutil.TempFile("", "foo")
+	}
+
+	BeforeEach(func() {
+		handler = &fakeSchemeHandler{
+			fetch: func(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error) {
+				if cachingInfo.ETag == "v1" {
+					return cacheddownloader.CachingInfoType{}, cacheddownloader.NotModified
+				}
+				_, err := destination.Write([]byte("content of " + url.Path))
+				return cacheddownloader.CachingInfoType{ETag: "v1"}, err
+			},
+		}
+
+		downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+		downloader.SetRetryPolicy(cacheddownloader.RetryPolicy{MaxAttempts: 3})
+		downloader.RegisterSchemeHandler("artifact", handler)
+
+		var err error
+		artifactURL, err = url.Parse("artifact://store/some/artifact")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if dest != "" {
+			os.Remove(dest)
+		}
+	})
+
+	It("downloads URLs of the scheme with the handler", func() {
+		var (
+			cachingInfo cacheddownloader.CachingInfoType
+			err         error
+		)
+		dest, cachingInfo, err = downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cachingInfo.ETag).To(Equal("v1"))
+
+		content, err := ioutil.ReadFile(dest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(Equal("content of /some/artifact"))
+		Expect(downloader.BytesDownloaded()).To(BeEquivalentTo(len(content)))
+	})
+
+	It("returns no file when the handler reports that the download has not been modified", func() {
+		var err error
+		dest, _, err = downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{ETag: "v1"}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dest).To(BeEmpty())
+	})
+
+	It("verifies the checksum of the download", func() {
+		_, _, err := downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{
+			Algorithm: "md5",
+			Value:     "00000000000000000000000000000000",
+		}, nil)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+	})
+
+	It("retries failed attempts", func() {
+		fetch := handler.fetch
+		handler.fetch = func(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error) {
+			if handler.calls < 3 {
+				return cacheddownloader.CachingInfoType{}, errors.New("transient")
+			}
+			return fetch(ctx, url, destination, cachingInfo)
+		}
+
+		var err error
+		dest, _, err = downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handler.calls).To(Equal(3))
+	})
+
+	It("fails the writes of the handler once the download is too large", func() {
+		downloader.SetMaxDownloadSize(4)
+
+		var writeErr error
+		handler.fetch = func(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error) {
+			for i := 0; i < 10 && writeErr == nil; i++ {
+				_, writeErr = destination.Write([]byte("ab"))
+			}
+			return cacheddownloader.CachingInfoType{}, writeErr
+		}
+
+		_, _, err := downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.TooLargeError{}))
+		Expect(writeErr).To(HaveOccurred())
+	})
+
+	It("fails with a DownloadCancelledError when cancelled", func() {
+		handler.fetch = func(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo cacheddownloader.CachingInfoType) (cacheddownloader.CachingInfoType, error) {
+			<-ctx.Done()
+			return cacheddownloader.CachingInfoType{}, ctx.Err()
+		}
+
+		cancelChan := make(chan struct{})
+		close(cancelChan)
+		_, _, err := downloader.Download(artifactURL, createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, cancelChan)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.DownloadCancelledError{}))
+	})
+})
@@ -0,0 +1,313 @@
+package cacheddownloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecondaryCache is a second tier of cache, shared between cachedDownloaders,
+// e.g. on an NFS directory or on a peer, that is consulted when an entry is
+// not in the local cache. Keys are derived from cache keys and are safe to use
+// as file names.
+type SecondaryCache interface {
+	// Get copies the content stored for key into destination and returns the
+	// caching info it was stored with; found is false if there is none.
+	Get(ctx context.Context, key string, destination *os.File) (cachingInfo CachingInfoType, found bool, err error)
+	// Put stores the file at path for key, along with its caching info.
+	Put(ctx context.Context, key string, path string, cachingInfo CachingInfoType) error
+}
+
+// SetSecondaryCache makes the cachedDownloader consult the secondary cache
+// when a fetch with a cache key misses the local cache. A copy found there is
+// revalidated with the origin using its caching info, so that an unchanged
+// artifact costs a conditional request rather than a download. Downloads from
+// the origin are written through to the secondary cache. Errors of the
+// secondary cache are treated as misses. Fetches that verify a detached
+// checksum or a signature bypass it. It should be called before any fetches
+// are started.
+func (c *cachedDownloader) SetSecondaryCache(secondary SecondaryCache) {
+	c.secondary = secondary
+}
+
+// usesSecondary reports whether the download may be served from, and written
+// through to, the secondary cache
+func (c *cachedDownloader) usesSecondary(name string, options FetchOptions) bool {
+	return c.secondary != nil && name != "uncached" &&
+		options.ChecksumURL == nil && options.SignatureURL == nil && len(options.Signature) == 0
+}
+
+// downloadThroughSecondary downloads the URL for an entry that is not in the
+// local cache, starting from the copy in the secondary cache if there is one
+func (c *cachedDownloader) downloadThroughSecondary(
+	ctx context.Context,
+	url *url.URL,
+	name string,
+	checksum ChecksumInfoType,
+	options FetchOptions,
+	createDestination func() (*os.File, error),
+) (string, CachingInfoType, *http.Response, error) {
+	copyPath, copyInfo, found := c.fromSecondary(ctx, name, checksum, createDestination)
+
+	path, cachingInfo, resp, err := c.downloader.download(ctx, url, createDestination, copyInfo, checksum, options)
+	if found {
+		if err == nil && path == "" {
+			// the copy is current
+			copyInfo.freshness = cachingInfo.freshness
+			copyInfo.noStore = cachingInfo.noStore
+			return copyPath, copyInfo, resp, nil
+		}
+		os.Remove(copyPath)
+	}
+	if err != nil {
+		return "", CachingInfoType{}, nil, err
+	}
+
+	if cachingInfo.isCacheable() && !cachingInfo.noStore {
+		c.secondary.Put(ctx, name, path, cachingInfo)
+	}
+	return path, cachingInfo, resp, nil
+}
+
+// fromSecondary copies the entry from the secondary cache, if it has a copy
+// that can be revalidated and matches the checksum
+func (c *cachedDownloader) fromSecondary(ctx context.Context, name string, checksum ChecksumInfoType, createDestination func() (*os.File, error)) (string, CachingInfoType, bool) {
+	destination, err := createDestination()
+	if err != nil {
+		return "", CachingInfoType{}, false
+	}
+
+	cachingInfo, found, err := c.secondary.Get(ctx, name, destination)
+	closeErr := destination.Close()
+	if err != nil || closeErr != nil || !found || !cachingInfo.isCacheable() || !matchesChecksum(destination.Name(), checksum) {
+		os.Remove(destination.Name())
+		return "", CachingInfoType{}, false
+	}
+
+	return destination.Name(), cachingInfo, true
+}
+
+// matchesChecksum reports whether the file at path matches checksum, if one
+// is given
+func matchesChecksum(path string, checksum ChecksumInfoType) bool {
+	checksum = checksum.fromIntegrity()
+	if checksum.Algorithm == "" && checksum.Value == "" {
+		return true
+	}
+
+	validator, err := NewHashValidator(checksum.Algorithm)
+	if err != nil {
+		return false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = io.Copy(validator.hash, f)
+	return err == nil && validator.Validate(checksum.Value) == nil
+}
+
+// DirectorySecondaryCache is a SecondaryCache kept in a directory, typically
+// one shared between hosts over NFS. It can also be exposed to peers over
+// HTTP, see ServeHTTP and HTTPSecondaryCache.
+type DirectorySecondaryCache struct {
+	path string
+}
+
+// directoryCacheEntry is the metadata that DirectorySecondaryCache keeps next
+// to the content of each key
+type directoryCacheEntry struct {
+	File         string
+	ETag         string
+	LastModified string
+}
+
+func NewDirectorySecondaryCache(path string) (*DirectorySecondaryCache, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectorySecondaryCache{path: path}, nil
+}
+
+func (d *DirectorySecondaryCache) Get(ctx context.Context, key string, destination *os.File) (CachingInfoType, bool, error) {
+	entry, f, err := d.open(key)
+	if os.IsNotExist(err) {
+		return CachingInfoType{}, false, nil
+	}
+	if err != nil {
+		return CachingInfoType{}, false, err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(destination, f)
+	if err != nil {
+		return CachingInfoType{}, false, err
+	}
+	return CachingInfoType{ETag: entry.ETag, LastModified: entry.LastModified}, true, nil
+}
+
+// Put copies the file into the directory, and then replaces the metadata of
+// the key, so that concurrent readers on other hosts see either the old or the
+// new content in full.
+func (d *DirectorySecondaryCache) Put(ctx context.Context, key string, path string, cachingInfo CachingInfoType) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	content, err := ioutil.TempFile(d.path, key+"-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(content, source)
+	if closeErr := content.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(content.Name())
+		return err
+	}
+
+	previous, _ := d.entry(key)
+	metadata, err := json.Marshal(directoryCacheEntry{
+		File:         filepath.Base(content.Name()),
+		ETag:         cachingInfo.ETag,
+		LastModified: cachingInfo.LastModified,
+	})
+	if err == nil {
+		err = writeFileAtomically(d.metadataPath(key), metadata)
+	}
+	if err != nil {
+		os.Remove(content.Name())
+		return err
+	}
+
+	if previous.File != "" {
+		os.Remove(filepath.Join(d.path, previous.File))
+	}
+	return nil
+}
+
+// ServeHTTP serves the content stored for the key at the end of the request
+// path, with its caching info in the ETag and Last-Modified headers, so that
+// peers can use the directory with an HTTPSecondaryCache.
+func (d *DirectorySecondaryCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := path.Base(r.URL.Path)
+	entry, f, err := d.open(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		w.Header().Set("Last-Modified", entry.LastModified)
+	}
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (d *DirectorySecondaryCache) open(key string) (directoryCacheEntry, *os.File, error) {
+	entry, err := d.entry(key)
+	if err != nil {
+		return directoryCacheEntry{}, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(d.path, entry.File))
+	if err != nil {
+		return directoryCacheEntry{}, nil, err
+	}
+	return entry, f, nil
+}
+
+func (d *DirectorySecondaryCache) entry(key string) (directoryCacheEntry, error) {
+	var entry directoryCacheEntry
+
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return entry, os.ErrNotExist
+	}
+
+	metadata, err := ioutil.ReadFile(d.metadataPath(key))
+	if err != nil {
+		return entry, err
+	}
+
+	err = json.Unmarshal(metadata, &entry)
+	if err != nil {
+		return entry, err
+	}
+	if entry.File == "" || filepath.Base(entry.File) != entry.File {
+		return entry, fmt.Errorf("invalid secondary cache entry for %s", key)
+	}
+	return entry, nil
+}
+
+func (d *DirectorySecondaryCache) metadataPath(key string) string {
+	return filepath.Join(d.path, key+".json")
+}
+
+// HTTPSecondaryCache is a read-only SecondaryCache that fetches entries from a
+// peer serving a DirectorySecondaryCache at URL. Peers fill their own
+// caches; Put does nothing.
+type HTTPSecondaryCache struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// NewHTTPSecondaryCache returns an HTTPSecondaryCache for the peer at the
+// given URL. The client defaults to http.DefaultClient.
+func NewHTTPSecondaryCache(peerURL *url.URL, client *http.Client) *HTTPSecondaryCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSecondaryCache{url: peerURL, client: client}
+}
+
+func (h *HTTPSecondaryCache) Get(ctx context.Context, key string, destination *os.File) (CachingInfoType, bool, error) {
+	entryURL := *h.url
+	entryURL.Path = path.Join("/", entryURL.Path, key)
+
+	req, err := http.NewRequest("GET", entryURL.String(), nil)
+	if err != nil {
+		return CachingInfoType{}, false, err
+	}
+
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return CachingInfoType{}, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return CachingInfoType{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return CachingInfoType{}, false, fmt.Errorf("secondary cache responded with %s", resp.Status)
+	}
+
+	_, err = io.Copy(destination, resp.Body)
+	if err != nil {
+		return CachingInfoType{}, false, err
+	}
+	return CachingInfoType{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, true, nil
+}
+
+func (h *HTTPSecondaryCache) Put(ctx context.Context, key string, path string, cachingInfo CachingInfoType) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package cacheddownloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// SetSegmentedDownloads makes the Downloader fetch files of at least
+// minSizeInBytes as the given number of ranged segments over concurrent
+// connections, which are reassembled into the destination file. It only
+// applies to origins that advertise range support and give the file a strong
+// ETag, so that every segment is taken from the same version of the file; a
+// checksum is verified against the whole file. A segmented download holds a
+// single concurrent download slot. It should be called before any downloads
+// are started.
+func (downloader *Downloader) SetSegmentedDownloads(segments int, minSizeInBytes int64) {
+	downloader.segments = segments
+	downloader.minSegmentedSize = minSizeInBytes
+}
+
+func (downloader *Downloader) segmentable(resp *http.Response) bool {
+	etag := resp.Header.Get("ETag")
+	return downloader.segments > 1 &&
+		resp.StatusCode == http.StatusOK &&
+		resp.ContentLength >= downloader.minSegmentedSize &&
+		resp.ContentLength >= int64(downloader.segments) &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		etag != "" && !strings.HasPrefix(etag, "W/")
+}
+
+// fetchSegments reads the first segment from the body of resp, which is then
+// closed, while the remaining segments are fetched concurrently. Every segment
+// is written at its offset in destination. It returns the number of bytes
+// received across all segments.
+func (downloader *Downloader) fetchSegments(ctx context.Context, url *url.URL, resp *http.Response, destination *os.File, limiter *bandwidthLimiter) (int64, error) {
+	size := resp.ContentLength
+	segmentSize := (size + int64(downloader.segments) - 1) / int64(downloader.segments)
+	etag := resp.Header.Get("ETag")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var written int64
+	errs := make(chan error, downloader.segments)
+	pending := 0
+	for start := segmentSize; start < size; start += segmentSize {
+		end := start + segmentSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		pending++
+		go func(start, end int64) {
+			n, err := downloader.fetchSegment(ctx, url, etag, start, end, destination, limiter)
+			atomic.AddInt64(&written, n)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(start, end)
+	}
+
+	body, stopWatching := downloader.watchStalls(resp.Body)
+	n, err := copyBufferedN(&offsetWriter{file: destination}, limiter.reader(ctx, body), segmentSize)
+	if stallErr := stopWatching(); stallErr != nil && err != nil {
+		err = stallErr
+	}
+	atomic.AddInt64(&written, n)
+	if err != nil {
+		cancel()
+	}
+
+	for ; pending > 0; pending-- {
+		segmentErr := <-errs
+		if err == nil {
+			err = segmentErr
+		}
+	}
+
+	return atomic.LoadInt64(&written), err
+}
+
+func (downloader *Downloader) fetchSegment(ctx context.Context, url *url.URL, etag string, start, end int64, destination *os.File, limiter *bandwidthLimiter) (int64, error) {
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Set("If-Range", etag)
+
+	req, err = downloader.prepareRequest(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := downloader.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent || !resumesAt(resp, start) {
+		return 0, fmt.Errorf("Download failed: segment %d-%d: Status code %d", start, end, resp.StatusCode)
+	}
+
+	body, stopWatching := downloader.watchStalls(resp.Body)
+	n, err := copyBufferedN(&offsetWriter{file: destination, offset: start}, limiter.reader(ctx, body), end-start+1)
+	if stallErr := stopWatching(); stallErr != nil && err != nil {
+		err = stallErr
+	}
+	return n, err
+}
+
+// offsetWriter writes sequentially to a file starting at offset, independently
+// of the file's own offset
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
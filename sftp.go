@@ -0,0 +1,126 @@
+package cacheddownloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// NoSSHClientConfig is returned for sftp:// downloads when no SSH client
+// config has been set.
+var NoSSHClientConfig = errors.New("No SSH client config for sftp:// downloads")
+
+// SetSSHClientConfig configures how the Downloader connects to the servers of
+// sftp://[user[:password]@]host[:port]/path URLs. A user and password in the
+// URL take precedence over the config. The modification time of the file is
+// used as its Last-Modified validator. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetSSHClientConfig(config *ssh.ClientConfig) {
+	downloader.RegisterSchemeHandler("sftp", &sftpHandler{config: config})
+}
+
+// sftpHandler is the SchemeHandler for sftp:// URLs
+type sftpHandler struct {
+	config *ssh.ClientConfig
+}
+
+func (h *sftpHandler) Fetch(ctx context.Context, url *url.URL, destination io.Writer, cachingInfo CachingInfoType) (CachingInfoType, error) {
+	client, err := h.dial(ctx, url)
+	if err != nil {
+		return CachingInfoType{}, err
+	}
+	defer client.Close()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-stopWatching:
+		}
+	}()
+
+	info, err := client.Stat(url.Path)
+	if err != nil {
+		return CachingInfoType{}, sftpError(err)
+	}
+
+	if cachingInfo.LastModified != "" {
+		since, err := http.ParseTime(cachingInfo.LastModified)
+		if err == nil && !info.ModTime().Truncate(time.Second).After(since) {
+			return CachingInfoType{}, NotModified
+		}
+	}
+
+	source, err := client.Open(url.Path)
+	if err != nil {
+		return CachingInfoType{}, sftpError(err)
+	}
+	defer source.Close()
+
+	_, err = copyBuffered(destination, source)
+	if err != nil {
+		return CachingInfoType{}, sftpError(err)
+	}
+
+	return CachingInfoType{
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}, nil
+}
+
+func (h *sftpHandler) dial(ctx context.Context, url *url.URL) (*sftp.Client, error) {
+	if h.config == nil {
+		return nil, NoSSHClientConfig
+	}
+
+	config := *h.config
+	if url.User != nil {
+		config.User = url.User.Username()
+		if password, ok := url.User.Password(); ok {
+			config.Auth = append([]ssh.AuthMethod{ssh.Password(password)}, config.Auth...)
+		}
+	}
+
+	address := url.Host
+	if url.Port() == "" {
+		address = net.JoinHostPort(url.Hostname(), "22")
+	}
+
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, &config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, channels, requests)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// sftpError turns a missing file into a NotFoundError, so that it is not
+// retried
+func sftpError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return NewHTTPStatusError(http.StatusNotFound)
+	}
+	return err
+}
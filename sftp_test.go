@@ -0,0 +1,200 @@
+package cacheddownloader_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer serves the local file system over SFTP to the user "some-user"
+// with the password "some-password"
+type sftpServer struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+}
+
+func newSFTPServer() *sftpServer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	Expect(err).NotTo(HaveOccurred())
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "some-user" && string(password) == "some-password" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	return &sftpServer{listener: listener, hostKey: signer.PublicKey()}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+	}
+}
+
+func (s *sftpServer) url(path string) *url.URL {
+	return &url.URL{
+		Scheme: "sftp",
+		User:   url.UserPassword("some-user", "some-password"),
+		Host:   s.listener.Addr().String(),
+		Path:   path,
+	}
+}
+
+var _ = Describe("SFTP", func() {
+	var (
+		server     *sftpServer
+		downloader *cacheddownloader.Downloader
+		dir        string
+		filePath   string
+		modTime    time.Time
+		dest       string
+	)
+
+	createDestFile := func() (*os.File, error) {
+		return ioutil.TempFile("", "foo")
+	}
+
+	BeforeEach(func() {
+		server = newSFTPServer()
+
+		downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+		downloader.SetSSHClientConfig(&ssh.ClientConfig{
+			HostKeyCallback: ssh.FixedHostKey(server.hostKey),
+			Timeout:         time.Second,
+		})
+
+		var err error
+		dir, err = ioutil.TempDir("", "sftp")
+		Expect(err).NotTo(HaveOccurred())
+
+		filePath = filepath.Join(dir, "artifact")
+		Expect(ioutil.WriteFile(filePath, []byte("sftp content"), 0644)).To(Succeed())
+		modTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		Expect(os.Chtimes(filePath, modTime, modTime)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.listener.Close()
+		os.RemoveAll(dir)
+		if dest != "" {
+			os.Remove(dest)
+		}
+	})
+
+	It("downloads the file and uses its modification time as Last-Modified", func() {
+		var (
+			cachingInfo cacheddownloader.CachingInfoType
+			err         error
+		)
+		dest, cachingInfo, err = downloader.Download(server.url(filePath), createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cachingInfo.LastModified).To(Equal(modTime.Format(http.TimeFormat)))
+
+		content, err := ioutil.ReadFile(dest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(Equal("sftp content"))
+	})
+
+	It("does not download the file again if it has not been modified", func() {
+		var err error
+		dest, _, err = downloader.Download(server.url(filePath), createDestFile, cacheddownloader.CachingInfoType{
+			LastModified: modTime.Format(http.TimeFormat),
+		}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dest).To(BeEmpty())
+	})
+
+	It("verifies the checksum", func() {
+		_, _, err := downloader.Download(server.url(filePath), createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{
+			Algorithm: "sha256",
+			Value:     "0000000000000000000000000000000000000000000000000000000000000000",
+		}, nil)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.ChecksumFailedError{}))
+	})
+
+	It("fails with a NotFoundError if the file does not exist", func() {
+		_, _, err := downloader.Download(server.url(filepath.Join(dir, "missing")), createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.NotFoundError{}))
+	})
+
+	It("fails if the host key does not match", func() {
+		otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		otherHostKey, err := ssh.NewPublicKey(otherKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		downloader.SetSSHClientConfig(&ssh.ClientConfig{
+			HostKeyCallback: ssh.FixedHostKey(otherHostKey),
+		})
+		downloader.SetRetryPolicy(cacheddownloader.RetryPolicy{MaxAttempts: 1})
+
+		_, _, err = downloader.Download(server.url(filePath), createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).To(MatchError(ContainSubstring("host key mismatch")))
+	})
+
+	It("fails without an SSH client config", func() {
+		downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+
+		_, _, err := downloader.Download(server.url(filePath), createDestFile, cacheddownloader.CachingInfoType{}, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).To(Equal(cacheddownloader.NoSSHClientConfig))
+	})
+})
@@ -0,0 +1,121 @@
+package cacheddownloader
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// sharedDownload is a download that concurrent fetches of the same URL, under
+// different cache keys, wait on instead of downloading the URL themselves
+type sharedDownload struct {
+	done         chan struct{}
+	participants int
+
+	path        string
+	cachingInfo CachingInfoType
+	response    *http.Response
+	err         error
+}
+
+// SetCoalesceDownloads makes concurrent fetches of the same URL share a single
+// download even when they use different cache keys, e.g. for content
+// addressed URLs that are cached under several names. Only fetches that send
+// the same validators and expect the same checksum share a download, and each
+// of them still gets its own cache entry. Fetches that verify a detached
+// checksum or a signature download on their own. A fetch waiting on a shared download
+// receives its outcome, including a cancellation of the fetch that started it.
+func (c *cachedDownloader) SetCoalesceDownloads(coalesce bool) {
+	c.lock.Lock()
+	c.coalesce = coalesce
+	c.lock.Unlock()
+}
+
+// download fetches the URL into a new file in the uncached path, sharing the
+// download with concurrent fetches of the same URL if coalescing is enabled.
+// Entries missing from the local cache are looked up in the secondary cache
+// first, if there is one.
+func (c *cachedDownloader) download(
+	ctx context.Context,
+	url *url.URL,
+	name string,
+	cachingInfo CachingInfoType,
+	checksum ChecksumInfoType,
+	options FetchOptions,
+) (string, CachingInfoType, *http.Response, error) {
+	createDestination := func() (*os.File, error) {
+		return ioutil.TempFile(c.uncachedPath, name+"-")
+	}
+
+	if !cachingInfo.isCacheable() && c.usesSecondary(name, options) {
+		return c.downloadThroughSecondary(ctx, url, name, checksum, options, createDestination)
+	}
+
+	c.lock.Lock()
+	if !c.coalesce || !coalescable(options) {
+		c.lock.Unlock()
+		return c.downloader.download(ctx, url, createDestination, cachingInfo, checksum, options)
+	}
+
+	key := strings.Join([]string{url.String(), cachingInfo.ETag, cachingInfo.LastModified, checksum.Algorithm, checksum.Value}, "\x00")
+	shared, following := c.sharedDownloads[key]
+	if !following {
+		shared = &sharedDownload{done: make(chan struct{})}
+		c.sharedDownloads[key] = shared
+	}
+	shared.participants++
+	c.lock.Unlock()
+
+	if following {
+		startTime := time.Now()
+		select {
+		case <-shared.done:
+		case <-ctx.Done():
+			c.leaveSharedDownload(shared)
+			return "", CachingInfoType{}, nil, NewDownloadCancelledError("shared-download", time.Now().Sub(startTime), NoBytesReceived)
+		}
+	} else {
+		shared.path, shared.cachingInfo, shared.response, shared.err = c.downloader.download(ctx, url, createDestination, cachingInfo, checksum, options)
+
+		c.lock.Lock()
+		delete(c.sharedDownloads, key)
+		c.lock.Unlock()
+		close(shared.done)
+	}
+
+	defer c.leaveSharedDownload(shared)
+	if shared.err != nil || shared.path == "" {
+		return "", shared.cachingInfo, shared.response, shared.err
+	}
+
+	// every participant transforms, and thereby consumes, its own copy
+	path, err := c.duplicate(shared.path)
+	if err != nil {
+		return "", CachingInfoType{}, nil, err
+	}
+
+	return path, shared.cachingInfo, shared.response, nil
+}
+
+// coalescable reports whether the fetch may share a download: fetches that
+// verify a detached checksum or a signature must verify their own download
+func coalescable(options FetchOptions) bool {
+	return options.ChecksumURL == nil && options.SignatureURL == nil && len(options.Signature) == 0
+}
+
+// leaveSharedDownload removes the downloaded file once the last participant
+// has taken its copy
+func (c *cachedDownloader) leaveSharedDownload(shared *sharedDownload) {
+	c.lock.Lock()
+	shared.participants--
+	last := shared.participants == 0
+	c.lock.Unlock()
+
+	if last && shared.path != "" {
+		os.Remove(shared.path)
+	}
+}
@@ -0,0 +1,102 @@
+package cacheddownloader
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Shutdown stops admitting fetches, which fail with ErrShutDown from then on,
+// and waits for the fetches in flight to return. If ctx is done first, they
+// are cancelled as with CancelAll, and Shutdown returns ctx.Err() once they
+// have returned. Finally it removes the files that fetches left in the
+// uncached path; the uncached files and directories that are still handed out
+// are kept until they are closed, and it waits for the cache entries that are
+// being deleted in the background. SaveState can be called afterwards to keep
+// the cache for the next run.
+func (c *cachedDownloader) Shutdown(ctx context.Context) error {
+	c.lock.Lock()
+	c.shutDown = true
+	c.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		c.fetches.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.CancelAll()
+		<-drained
+	}
+
+	c.stopTempFileReaper()
+	c.removeTempFiles(time.Time{})
+	c.cache.WaitForDeletions()
+	return err
+}
+
+// beginFetch admits a fetch unless the cachedDownloader is shut down. Every
+// admitted fetch must call c.fetches.Done once it returns.
+func (c *cachedDownloader) beginFetch() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.shutDown {
+		return ErrShutDown
+	}
+
+	c.fetches.Add(1)
+	return nil
+}
+
+// handOutTempFile opens a downloaded file that is not stored in the cache; it
+// is removed once closed
+func (c *cachedDownloader) handOutTempFile(path string) (*CachedFile, error) {
+	file, err := tempFileRemoveOnClose(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.uncachedFiles[path] = struct{}{}
+	c.lock.Unlock()
+
+	file.afterClose(func() {
+		c.lock.Lock()
+		delete(c.uncachedFiles, path)
+		c.lock.Unlock()
+	})
+	return file, nil
+}
+
+// removeTempFiles removes everything from the uncached path that is not
+// handed out and, unless modifiedBefore is zero, was last modified before it
+func (c *cachedDownloader) removeTempFiles(modifiedBefore time.Time) {
+	entries, err := ioutil.ReadDir(c.uncachedPath)
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, entry := range entries {
+		path := filepath.Join(c.uncachedPath, entry.Name())
+		if _, ok := c.uncachedFiles[path]; ok {
+			continue
+		}
+		if _, ok := c.uncachedDirectories[path]; ok {
+			continue
+		}
+		if !modifiedBefore.IsZero() && !lastModified(path).Before(modifiedBefore) {
+			continue
+		}
+		removeAll(path)
+	}
+}
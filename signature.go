@@ -0,0 +1,62 @@
+package cacheddownloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// NoPGPKeyring is returned when a fetch asks for its signature to be verified
+// but no keyring has been set with SetPGPKeyring.
+var NoPGPKeyring = errors.New("No PGP keyring to verify signatures with")
+
+// SetPGPKeyring sets the keys that the detached PGP signatures of fetches are
+// verified with, see FetchOptions.SignatureURL. The keyring can be read with
+// ReadArmoredKeyRing of github.com/ProtonMail/go-crypto/openpgp. It should be
+// called before any downloads are started.
+func (downloader *Downloader) SetPGPKeyring(keyring openpgp.KeyRing) {
+	downloader.pgpKeyring = keyring
+}
+
+// verifySignature verifies the downloaded file at path against the detached
+// signature given inline or at signatureURL
+func (downloader *Downloader) verifySignature(
+	ctx context.Context,
+	path string,
+	signature []byte,
+	signatureURL *url.URL,
+	createDestination func() (*os.File, error),
+	limiter *bandwidthLimiter,
+) error {
+	if downloader.pgpKeyring == nil {
+		return NoPGPKeyring
+	}
+
+	if signature == nil {
+		var err error
+		signature, err = downloader.downloadContent(ctx, signatureURL, createDestination, limiter)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(downloader.pgpKeyring, file, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(downloader.pgpKeyring, file, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return NewSignatureFailedError(err)
+	}
+	return nil
+}
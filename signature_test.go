@@ -0,0 +1,115 @@
+package cacheddownloader_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("PGP signatures", func() {
+	var (
+		server       *ghttp.Server
+		downloader   *cacheddownloader.Downloader
+		cache        cacheddownloader.CachedDownloader
+		cachedPath   string
+		uncachedPath string
+		signer       *openpgp.Entity
+		artifactURL  *url.URL
+		content      string
+	)
+
+	sign := func(entity *openpgp.Entity, content string) []byte {
+		signature := &bytes.Buffer{}
+		Expect(openpgp.DetachSign(signature, entity, bytes.NewBufferString(content), nil)).To(Succeed())
+		return signature.Bytes()
+	}
+
+	armoredSign := func(entity *openpgp.Entity, content string) []byte {
+		signature := &bytes.Buffer{}
+		Expect(openpgp.ArmoredDetachSign(signature, entity, bytes.NewBufferString(content), nil)).To(Succeed())
+		return signature.Bytes()
+	}
+
+	BeforeEach(func() {
+		var err error
+		signer, err = openpgp.NewEntity("Release Signer", "", "releases@example.com", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		cachedPath, err = ioutil.TempDir("", "signature_cached")
+		Expect(err).NotTo(HaveOccurred())
+		uncachedPath, err = ioutil.TempDir("", "signature_uncached")
+		Expect(err).NotTo(HaveOccurred())
+
+		content = "the artifact"
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/artifact", ghttp.RespondWith(http.StatusOK, content, http.Header{"ETag": []string{`"v1"`}}))
+		artifactURL, err = url.Parse(server.URL() + "/artifact")
+		Expect(err).NotTo(HaveOccurred())
+
+		downloader = cacheddownloader.NewDownloader(time.Second, 10, false, nil)
+		downloader.SetPGPKeyring(openpgp.EntityList{signer})
+		cache, err = cacheddownloader.NewWithDownloader(cachedPath, uncachedPath, 1024, downloader, cacheddownloader.NoopTransform)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(cachedPath)
+		os.RemoveAll(uncachedPath)
+	})
+
+	fetch := func(options cacheddownloader.FetchOptions) error {
+		file, _, err := cache.FetchWithOptions(context.Background(), artifactURL, "artifact", cacheddownloader.ChecksumInfoType{}, options)
+		if err == nil {
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte(content)))
+			Expect(file.Close()).To(Succeed())
+		}
+		return err
+	}
+
+	It("verifies the download against the signature at the signature URL", func() {
+		server.RouteToHandler("GET", "/artifact.asc", ghttp.RespondWith(http.StatusOK, armoredSign(signer, content)))
+		signatureURL, err := url.Parse(server.URL() + "/artifact.asc")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fetch(cacheddownloader.FetchOptions{SignatureURL: signatureURL})).To(Succeed())
+	})
+
+	It("verifies the download against an inline binary signature", func() {
+		Expect(fetch(cacheddownloader.FetchOptions{Signature: sign(signer, content)})).To(Succeed())
+	})
+
+	It("does not cache a download whose signature does not verify", func() {
+		err := fetch(cacheddownloader.FetchOptions{Signature: sign(signer, "some other artifact")})
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.SignatureFailedError{}))
+		Expect(cacheddownloader.IsRetryable(err)).To(BeFalse())
+
+		Expect(fetch(cacheddownloader.FetchOptions{})).To(Succeed())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+	})
+
+	It("rejects signatures of keys that are not in the keyring", func() {
+		stranger, err := openpgp.NewEntity("Stranger", "", "stranger@example.com", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = fetch(cacheddownloader.FetchOptions{Signature: sign(stranger, content)})
+		Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.SignatureFailedError{}))
+	})
+
+	It("fails without a keyring", func() {
+		downloader.SetPGPKeyring(nil)
+
+		err := fetch(cacheddownloader.FetchOptions{Signature: sign(signer, content)})
+		Expect(err).To(Equal(cacheddownloader.NoPGPKeyring))
+	})
+})
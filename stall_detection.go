@@ -0,0 +1,78 @@
+package cacheddownloader
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SetStallDetection makes a download attempt fail with a StalledDownloadError
+// as soon as fewer than minBytesPerSecond, on average, are received during any
+// window, instead of holding on to its concurrent download slot until the
+// timeout. Each segment of a segmented download is watched on its own. The
+// attempt is retried according to the retry policy. Note that a
+// bandwidth limit below minBytesPerSecond makes every download stall. A zero
+// window, the default, disables stall detection. It should be called before
+// any downloads are started.
+func (downloader *Downloader) SetStallDetection(minBytesPerSecond int64, window time.Duration) {
+	downloader.minBytesPerSecond = minBytesPerSecond
+	downloader.stallWindow = window
+}
+
+// watchStalls returns a reader for body that closes body once a window passes
+// with too few bytes read. The returned function stops watching; it returns a
+// StalledDownloadError if body was closed because the download stalled.
+func (downloader *Downloader) watchStalls(body io.ReadCloser) (io.Reader, func() error) {
+	if downloader.stallWindow <= 0 || downloader.minBytesPerSecond <= 0 {
+		return body, func() error { return nil }
+	}
+
+	window := downloader.stallWindow
+	minBytes := int64(float64(downloader.minBytesPerSecond) * window.Seconds())
+
+	counter := &countingReader{reader: body}
+	done := make(chan struct{})
+	stalled := make(chan error, 1)
+
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+
+		var last int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				read := atomic.LoadInt64(&counter.read)
+				if read-last < minBytes {
+					stalled <- NewStalledDownloadError(read-last, window)
+					body.Close()
+					return
+				}
+				last = read
+			}
+		}
+	}()
+
+	return counter, func() error {
+		close(done)
+		select {
+		case err := <-stalled:
+			return err
+		default:
+			return nil
+		}
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
@@ -0,0 +1,117 @@
+package cacheddownloader
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stats is a point-in-time snapshot of the activity of a cachedDownloader.
+// Hits and misses only account for fetches with a cache key.
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Revalidations counts the hits that had to be confirmed with the origin
+	// first, as opposed to those served within their TTL.
+	Revalidations int64 `json:"revalidations"`
+	// Evictions counts the entries ejected to make room for others.
+	Evictions int64 `json:"evictions"`
+	// BytesServedFromCache is the total size of the files and directories
+	// served on hits.
+	BytesServedFromCache int64 `json:"bytes_served_from_cache"`
+	Entries              int   `json:"entries"`
+	// InUseEntries is the number of entries that have a reader or directory
+	// handed out; they cannot be evicted.
+	InUseEntries    int   `json:"in_use_entries"`
+	UsedSizeInBytes int64 `json:"used_size_in_bytes"`
+	MaxSizeInBytes  int64 `json:"max_size_in_bytes"`
+	InProgress      int   `json:"in_progress"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	OpenHandles     int   `json:"open_handles"`
+	// Corrupted counts the cached files found not to match their digest, see
+	// SetVerifyOnRead.
+	Corrupted int64 `json:"corrupted"`
+	// DownloadQueue describes the downloads waiting for a download slot, and
+	// CacheKeyQueue the fetches waiting for a fetch of the same cache key.
+	DownloadQueue QueueStats `json:"download_queue"`
+	CacheKeyQueue QueueStats `json:"cache_key_queue"`
+}
+
+// Stats returns the current counters of the cachedDownloader. It is safe to
+// call concurrently with fetches.
+func (c *cachedDownloader) Stats() Stats {
+	entries, used, max := c.cache.Usage()
+	inUse, evictions := c.cache.activity()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return Stats{
+		Hits:                 c.hits,
+		Misses:               c.misses,
+		Revalidations:        c.revalidations,
+		Evictions:            evictions,
+		BytesServedFromCache: c.bytesFromCache,
+		Entries:              entries,
+		InUseEntries:         inUse,
+		UsedSizeInBytes:      used,
+		MaxSizeInBytes:       max,
+		InProgress:           c.downloader.InProgress(),
+		BytesDownloaded:      c.downloader.BytesDownloaded(),
+		OpenHandles:          c.openHandles,
+		Corrupted:            c.corrupted,
+		DownloadQueue:        c.downloader.QueueStats(),
+		CacheKeyQueue:        c.keyQueue.stats(),
+	}
+}
+
+// ServeStats renders the current Stats as JSON. It can be mounted on a mux
+// with http.HandlerFunc(cache.ServeStats).
+func (c *cachedDownloader) ServeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(c.Stats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// recordHit accounts for a fetch served from the cache; revalidated tells
+// whether the origin had to confirm the entry first
+func (c *cachedDownloader) recordHit(servedBytes int64, revalidated bool) {
+	c.lock.Lock()
+	c.hits++
+	c.bytesFromCache += servedBytes
+	if revalidated {
+		c.revalidations++
+	}
+	c.lock.Unlock()
+}
+
+func (c *cachedDownloader) recordMiss() {
+	c.lock.Lock()
+	c.misses++
+	c.lock.Unlock()
+}
+
+// fileSize returns the size of a cached file that is handed out
+func fileSize(file *CachedFile) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// activity returns the number of entries in use, and the number of entries
+// evicted so far
+func (c *FileCache) activity() (inUse int, evictions int64) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, entry := range c.Entries {
+		if entry.inUse() {
+			inUse++
+		}
+	}
+	return inUse, c.evictions
+}
@@ -0,0 +1,150 @@
+package cacheddownloader_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Stats", func() {
+	var (
+		cachedPath   string
+		uncachedPath string
+		server       *ghttp.Server
+		fileURL      *url.URL
+		content      string
+
+		downloader interface {
+			cacheddownloader.CachedDownloader
+			ServeStats(w http.ResponseWriter, r *http.Request)
+		}
+	)
+
+	BeforeEach(func() {
+		var err error
+		cachedPath, err = ioutil.TempDir("", "stats_cached")
+		Expect(err).NotTo(HaveOccurred())
+
+		uncachedPath, err = ioutil.TempDir("", "stats_uncached")
+		Expect(err).NotTo(HaveOccurred())
+
+		content = "some content to cache"
+
+		server = ghttp.NewServer()
+		server.RouteToHandler("GET", "/file", func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("If-None-Match") == "some-etag" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", "some-etag")
+			w.Write([]byte(content))
+		})
+
+		fileURL, err = url.Parse(server.URL() + "/file")
+		Expect(err).NotTo(HaveOccurred())
+
+		downloader, err = cacheddownloader.New(cachedPath, uncachedPath, 1024, time.Second, 10, false, nil, cacheddownloader.NoopTransform)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(cachedPath)
+		os.RemoveAll(uncachedPath)
+	})
+
+	fetch := func(cacheKey string) {
+		reader, _, err := downloader.Fetch(fileURL, cacheKey, cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.Close()).To(Succeed())
+	}
+
+	serveStats := func() cacheddownloader.Stats {
+		recorder := httptest.NewRecorder()
+		downloader.ServeStats(recorder, httptest.NewRequest("GET", "/stats", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var stats cacheddownloader.Stats
+		Expect(json.NewDecoder(recorder.Body).Decode(&stats)).To(Succeed())
+		return stats
+	}
+
+	It("renders the stats as JSON", func() {
+		fetch("first-key")
+		fetch("first-key")
+		fetch("second-key")
+		fetch("")
+
+		stats := serveStats()
+		Expect(stats.DownloadQueue.Waiting).To(BeZero())
+		Expect(stats.DownloadQueue.Waits).To(BeEquivalentTo(4))
+		Expect(stats.CacheKeyQueue.Waiting).To(BeZero())
+		Expect(stats.CacheKeyQueue.Waits).To(BeEquivalentTo(3))
+
+		stats.DownloadQueue = cacheddownloader.QueueStats{}
+		stats.CacheKeyQueue = cacheddownloader.QueueStats{}
+		Expect(stats).To(Equal(cacheddownloader.Stats{
+			Hits:                 1,
+			Misses:               2,
+			Revalidations:        1,
+			BytesServedFromCache: int64(len(content)),
+			Entries:              2,
+			UsedSizeInBytes:      int64(2 * len(content)),
+			MaxSizeInBytes:       1024,
+			InProgress:           0,
+			BytesDownloaded:      int64(3 * len(content)),
+			OpenHandles:          0,
+		}))
+	})
+
+	It("counts the entries in use and those evicted", func() {
+		var err error
+		downloader, err = cacheddownloader.New(cachedPath, uncachedPath, int64(2*len(content)), time.Second, 10, false, nil, cacheddownloader.NoopTransform)
+		Expect(err).NotTo(HaveOccurred())
+
+		reader, _, err := downloader.Fetch(fileURL, "held-key", cacheddownloader.ChecksumInfoType{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer reader.Close()
+
+		fetch("first-key")
+		fetch("second-key")
+		fetch("third-key")
+
+		stats := serveStats()
+		Expect(stats.InUseEntries).To(Equal(1))
+		Expect(stats.Evictions).To(BeEquivalentTo(2))
+		Expect(stats.Entries).To(Equal(2))
+	})
+
+	It("is safe to call concurrently with fetches", func() {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 5; i++ {
+			wg.Add(2)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				fetch("some-key")
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				serveStats()
+			}()
+		}
+		wg.Wait()
+
+		stats := serveStats()
+		Expect(stats.Hits + stats.Misses).To(BeEquivalentTo(5))
+	})
+})
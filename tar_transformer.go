@@ -4,75 +4,84 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 )
 
+// ErrUnknownArchiveFormat matches every UnsupportedArchiveError with
+// errors.Is.
 var ErrUnknownArchiveFormat = errors.New("unknown archive format")
 
+// TarTransform converts the archive at source to a tarball at destination. The
+// format of the archive is told by its first bytes, regardless of its name or
+// the Content-Type it was served with; an archive in a format that is not
+// supported fails with an UnsupportedArchiveError.
 func TarTransform(source string, destination string) (int64, error) {
-	file, err := os.Open(source)
-	if err != nil {
-		return 0, err
-	}
+	return ContextTarTransform(context.Background(), source, destination)
+}
 
-	mime, err := mimeType(file)
-	if err != nil {
-		return 0, err
+// ContextTarTransform behaves like TarTransform, but stops converting the
+// archive once ctx is done, empties the destination and returns ctx.Err(). It
+// can be given to SetContextTransformer.
+func ContextTarTransform(ctx context.Context, source string, destination string) (int64, error) {
+	size, err := tarTransform(ctx, source, destination)
+	if err != nil && ctx.Err() != nil {
+		return 0, abortTransform(ctx, destination)
 	}
+	return size, err
+}
 
-	err = file.Close()
+func tarTransform(ctx context.Context, source string, destination string) (int64, error) {
+	format, header, err := sniffArchiveFile(source)
 	if err != nil {
 		return 0, err
 	}
 
-	switch mime {
-	case "application/x-gzip":
-		gunzipPath, err := exec.LookPath("gunzip")
-		if err == nil {
-			return gunzipTarGZToTar(gunzipPath, source, destination)
-		}
-		return transformTarGZToTar(source, destination)
+	switch format {
+	case gzipArchive:
+		return gunzipTransform(ctx, source, destination)
 
-	case "application/zip":
-		return transformZipToTar(source, destination)
+	case zipArchive:
+		return transformZipToTar(ctx, source, destination, false)
 
-	case "application/tar":
+	case zstdArchive, xzArchive:
+		return decompressToTar(ctx, format, source, destination)
+
+	case tarArchive:
 		return NoopTransform(source, destination)
 
 	default:
-		return 0, ErrUnknownArchiveFormat
+		return 0, NewUnsupportedArchiveError(header)
 	}
-
-	panic("unreachable")
 }
 
-func mimeType(fd *os.File) (string, error) {
-	data := make([]byte, 512)
+// abortTransform empties the destination of a transformer that was cancelled
+// and returns the reason it was
+func abortTransform(ctx context.Context, destination string) error {
+	os.Truncate(destination, 0)
+	return ctx.Err()
+}
 
-	_, err := fd.Read(data)
-	if err != nil {
-		return "", err
-	}
+// contextReader fails reads once its context is done, which stops the copies
+// of cancelled transformers
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
 
-	_, err = fd.Seek(0, 0)
+func (r contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
 	if err != nil {
-		return "", err
-	}
-
-	// check for tar magic string
-	if string(data[257:257+6]) == "ustar\x00" {
-		return "application/tar", nil
+		return 0, err
 	}
-
-	return http.DetectContentType(data), nil
+	return r.reader.Read(p)
 }
 
-func transformTarGZToTar(path, destPath string) (int64, error) {
+func transformTarGZToTar(ctx context.Context, path, destPath string) (int64, error) {
 	dest, err := os.OpenFile(destPath, os.O_WRONLY, 0666)
 	if err != nil {
 		return 0, err
@@ -89,7 +98,7 @@ func transformTarGZToTar(path, destPath string) (int64, error) {
 		return 0, err
 	}
 
-	n, err := io.Copy(dest, gr)
+	n, err := copyBuffered(dest, contextReader{ctx, gr})
 	if err != nil {
 		return 0, err
 	}
@@ -107,14 +116,14 @@ func transformTarGZToTar(path, destPath string) (int64, error) {
 	return n, nil
 }
 
-func gunzipTarGZToTar(gunzipPath, path, destPath string) (int64, error) {
+func gunzipTarGZToTar(ctx context.Context, gunzipPath, path, destPath string) (int64, error) {
 	destFile, err := os.OpenFile(destPath, os.O_WRONLY, 0666)
 	if err != nil {
 		return 0, err
 	}
 	defer destFile.Close()
 
-	cmd := exec.Command(gunzipPath, "-c", path)
+	cmd := exec.CommandContext(ctx, gunzipPath, "-c", path)
 	cmd.Stdout = destFile
 	err = cmd.Run()
 	if err != nil {
@@ -134,7 +143,9 @@ func gunzipTarGZToTar(gunzipPath, path, destPath string) (int64, error) {
 	return fileInfo.Size(), nil
 }
 
-func transformZipToTar(path, destPath string) (int64, error) {
+// transformZipToTar converts the zip at path to a tarball at destPath; a
+// normalized tarball has its entries sorted by name and fixed times and owners
+func transformZipToTar(ctx context.Context, path, destPath string, normalized bool) (int64, error) {
 	dest, err := os.OpenFile(destPath, os.O_WRONLY, 0666)
 	if err != nil {
 		return 0, err
@@ -149,8 +160,13 @@ func transformZipToTar(path, destPath string) (int64, error) {
 
 	tarWriter := tar.NewWriter(dest)
 
-	for _, zipEntry := range zr.File {
-		err := writeZipEntryToTar(tarWriter, zipEntry)
+	zipEntries := zr.File
+	if normalized {
+		zipEntries = sortedZipEntries(zr.File)
+	}
+
+	for _, zipEntry := range zipEntries {
+		err := writeZipEntryToTar(ctx, tarWriter, zipEntry, normalized)
 		if err != nil {
 			return 0, err
 		}
@@ -179,17 +195,17 @@ func transformZipToTar(path, destPath string) (int64, error) {
 	return fi.Size(), nil
 }
 
-func writeZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File) error {
+func writeZipEntryToTar(ctx context.Context, tarWriter *tar.Writer, zipEntry *zip.File, normalized bool) error {
 	zipInfo := zipEntry.FileInfo()
 
 	if zipInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
-		return writeSymlinkZipEntryToTar(tarWriter, zipEntry, zipInfo)
+		return writeSymlinkZipEntryToTar(tarWriter, zipEntry, zipInfo, normalized)
 	} else {
-		return writeRegularZipEntryToTar(tarWriter, zipEntry, zipInfo)
+		return writeRegularZipEntryToTar(ctx, tarWriter, zipEntry, zipInfo, normalized)
 	}
 }
 
-func writeRegularZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInfo os.FileInfo) error {
+func writeRegularZipEntryToTar(ctx context.Context, tarWriter *tar.Writer, zipEntry *zip.File, zipInfo os.FileInfo, normalized bool) error {
 	tarHeader, err := tar.FileInfoHeader(zipInfo, "")
 	if err != nil {
 		return err
@@ -197,6 +213,9 @@ func writeRegularZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInf
 
 	// file info only populates the base name; we want the full path
 	tarHeader.Name = zipEntry.FileHeader.Name
+	if normalized {
+		normalizeTarHeader(tarHeader)
+	}
 
 	zipReader, err := zipEntry.Open()
 	if err != nil {
@@ -210,7 +229,7 @@ func writeRegularZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInf
 		return err
 	}
 
-	_, err = io.Copy(tarWriter, zipReader)
+	_, err = copyBuffered(tarWriter, contextReader{ctx, zipReader})
 	if err != nil {
 		return err
 	}
@@ -223,7 +242,7 @@ func writeRegularZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInf
 	return nil
 }
 
-func writeSymlinkZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInfo os.FileInfo) error {
+func writeSymlinkZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInfo os.FileInfo, normalized bool) error {
 	zipReader, err := zipEntry.Open()
 	if err != nil {
 		return err
@@ -243,6 +262,9 @@ func writeSymlinkZipEntryToTar(tarWriter *tar.Writer, zipEntry *zip.File, zipInf
 
 	// file info only populates the base name; we want the full path
 	tarHeader.Name = zipEntry.FileHeader.Name
+	if normalized {
+		normalizeTarHeader(tarHeader)
+	}
 
 	err = tarWriter.WriteHeader(tarHeader)
 	if err != nil {
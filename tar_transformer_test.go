@@ -2,6 +2,8 @@ package cacheddownloader_test
 
 import (
 	"archive/tar"
+	"context"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -9,8 +11,10 @@ import (
 
 	"code.cloudfoundry.org/archiver/extractor/test_helper"
 	"code.cloudfoundry.org/cacheddownloader"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/ulikunitz/xz"
 )
 
 var _ = Describe("TarTransformer", func() {
@@ -192,6 +196,79 @@ var _ = Describe("TarTransformer", func() {
 		})
 	})
 
+	for _, compression := range []struct {
+		extension string
+		compress  func(io.Writer) (io.WriteCloser, error)
+	}{
+		{".zst", func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }},
+		{".xz", func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }},
+	} {
+		compression := compression
+
+		Context("when the file is a .tar"+compression.extension, func() {
+			BeforeEach(func() {
+				tarPath := filepath.Join(scratch, "file.tar")
+				test_helper.CreateTarArchive(tarPath, archiveFiles)
+				tarball, err := ioutil.ReadFile(tarPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				sourcePath = tarPath + compression.extension
+				compressed, err := os.Create(sourcePath)
+				Expect(err).NotTo(HaveOccurred())
+				writer, err := compression.compress(compressed)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = writer.Write(tarball)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writer.Close()).To(Succeed())
+				Expect(compressed.Close()).To(Succeed())
+			})
+
+			It("uncompresses it to a .tar", func() {
+				Expect(transformErr).NotTo(HaveOccurred())
+				verifyTarFile(destinationPath)
+			})
+
+			It("deletes the original file", func() {
+				_, err := os.Stat(sourcePath)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("returns the correct number of bytes written", func() {
+				fi, err := os.Stat(destinationPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fi.Size()).To(Equal(transformedSize))
+			})
+		})
+	}
+
+	Context("when a decompressor is set for the format", func() {
+		BeforeEach(func() {
+			tarPath := filepath.Join(scratch, "file.tar")
+			test_helper.CreateTarArchive(tarPath, archiveFiles)
+			tarball, err := ioutil.ReadFile(tarPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a fake zstd archive: the magic number followed by the plain tarball
+			sourcePath = filepath.Join(scratch, "file.tar.zst")
+			Expect(ioutil.WriteFile(sourcePath, append([]byte("\x28\xb5\x2f\xfd"), tarball...), 0644)).To(Succeed())
+
+			cacheddownloader.SetArchiveDecompressor("zstd", func(compressed io.Reader) (io.ReadCloser, error) {
+				_, err := io.CopyN(ioutil.Discard, compressed, 4)
+				return ioutil.NopCloser(compressed), err
+			})
+		})
+
+		AfterEach(func() {
+			cacheddownloader.SetArchiveDecompressor("zstd", nil)
+		})
+
+		It("uses it", func() {
+			Expect(transformErr).NotTo(HaveOccurred())
+			verifyTarFile(destinationPath)
+		})
+	})
+
 	Context("when the file is a .mp3", func() {
 		BeforeEach(func() {
 			sourcePath = filepath.Join(scratch, "bogus")
@@ -201,7 +278,78 @@ var _ = Describe("TarTransformer", func() {
 		})
 
 		It("blows up horribly", func() {
-			Expect(transformErr).To(Equal(cacheddownloader.ErrUnknownArchiveFormat))
+			Expect(transformErr).To(MatchError(cacheddownloader.ErrUnknownArchiveFormat))
+		})
+
+		It("reports the bytes the file starts with", func() {
+			Expect(transformErr).To(BeAssignableToTypeOf(&cacheddownloader.UnsupportedArchiveError{}))
+			Expect(transformErr.(*cacheddownloader.UnsupportedArchiveError).Magic).To(Equal([]byte("bogus")))
+			Expect(transformErr.Error()).To(ContainSubstring("62 6f 67 75 73"))
+		})
+	})
+
+	Context("when the file is a tarball named like a zip", func() {
+		BeforeEach(func() {
+			sourcePath = filepath.Join(scratch, "file.zip")
+
+			test_helper.CreateTarArchive(sourcePath, archiveFiles)
+		})
+
+		It("tells the format from its content", func() {
+			Expect(transformErr).NotTo(HaveOccurred())
+			verifyTarFile(destinationPath)
+		})
+	})
+})
+
+var _ = Describe("ContextTarTransform", func() {
+	var (
+		scratch         string
+		sourcePath      string
+		destinationPath string
+		ctx             context.Context
+		cancel          context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		var err error
+		scratch, err = ioutil.TempDir("", "tar-transformer-scratch")
+		Expect(err).NotTo(HaveOccurred())
+
+		sourcePath = filepath.Join(scratch, "file.zip")
+		test_helper.CreateZipArchive(sourcePath, []test_helper.ArchiveFile{
+			{Name: "some-file", Body: "some-contents"},
+		})
+
+		destinationPath = filepath.Join(scratch, "destination")
+		Expect(ioutil.WriteFile(destinationPath, nil, 0600)).To(Succeed())
+
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+		Expect(os.RemoveAll(scratch)).To(Succeed())
+	})
+
+	It("converts the archive while the context is not done", func() {
+		_, err := cacheddownloader.ContextTarTransform(ctx, sourcePath, destinationPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sourcePath).NotTo(BeAnExistingFile())
+	})
+
+	Context("when the context is done", func() {
+		BeforeEach(func() {
+			cancel()
+		})
+
+		It("stops, leaving the destination empty", func() {
+			_, err := cacheddownloader.ContextTarTransform(ctx, sourcePath, destinationPath)
+			Expect(err).To(Equal(context.Canceled))
+
+			info, err := os.Stat(destinationPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeZero())
 		})
 	})
 })
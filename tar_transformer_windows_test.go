@@ -19,8 +19,7 @@ var _ = Describe("TarTransformer", func() {
 		sourcePath      string
 		destinationPath string
 
-		transformedSize int64
-		transformErr    error
+		transformErr error
 	)
 
 	archiveFiles := []test_helper.ArchiveFile{
@@ -48,7 +47,7 @@ var _ = Describe("TarTransformer", func() {
 	})
 
 	JustBeforeEach(func() {
-		transformedSize, transformErr = TarTransform(sourcePath, destinationPath)
+		_, transformErr = TarTransform(sourcePath, destinationPath)
 	})
 
 	Context("when the file is a .zip", func() {
@@ -59,6 +58,8 @@ var _ = Describe("TarTransformer", func() {
 		})
 
 		It("closes the tarfile", func() {
+			Expect(transformErr).NotTo(HaveOccurred())
+
 			// On Windows, you can't remove files that are still open.  On Linux, you can.
 			err := os.Remove(destinationPath)
 
@@ -0,0 +1,64 @@
+package cacheddownloader
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StartTempFileReaper removes the files and directories in the uncached path
+// that have not been modified for maxAge, such as partial downloads and
+// transformed files left behind when a previous process crashed mid-download.
+// It sweeps the uncached path right away, and then every interval until
+// Shutdown. Files and directories that are handed out are kept, as are
+// downloads in progress as long as they are being written to; maxAge should
+// therefore be well above the stall detection window, if any.
+func (c *cachedDownloader) StartTempFileReaper(maxAge, interval time.Duration) {
+	stop := make(chan struct{})
+
+	c.lock.Lock()
+	if c.tempFileReaperStop != nil {
+		close(c.tempFileReaperStop)
+	}
+	c.tempFileReaperStop = stop
+	c.lock.Unlock()
+
+	c.removeTempFiles(time.Now().Add(-maxAge))
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.removeTempFiles(time.Now().Add(-maxAge))
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *cachedDownloader) stopTempFileReaper() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tempFileReaperStop != nil {
+		close(c.tempFileReaperStop)
+		c.tempFileReaperStop = nil
+	}
+}
+
+// lastModified returns the latest modification time of the file at path, or
+// of anything in the directory at path, so that a directory that is still
+// being expanded is not mistaken for an abandoned one
+func lastModified(path string) time.Time {
+	var latest time.Time
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
@@ -0,0 +1,26 @@
+package cacheddownloader
+
+import "time"
+
+// SetDialTimeout limits how long opening a connection may take; the default
+// is 10 seconds. Zero means no limit. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetDialTimeout(timeout time.Duration) {
+	downloader.dialTimeout = timeout
+}
+
+// SetTLSHandshakeTimeout limits how long the TLS handshake of a connection may
+// take; the default is 10 seconds. Zero means no limit. It should be called
+// before any downloads are started.
+func (downloader *Downloader) SetTLSHandshakeTimeout(timeout time.Duration) {
+	downloader.transport().TLSHandshakeTimeout = timeout
+}
+
+// SetIdleTimeout replaces the idle timeout given to the constructor: the
+// deadline for every single read from or write to a connection. Links on which
+// individual reads legitimately take longer need a longer timeout; zero means
+// no deadline, and leaves stalls to the request timeout and stall detection.
+// It should be called before any downloads are started.
+func (downloader *Downloader) SetIdleTimeout(timeout time.Duration) {
+	downloader.idleTimeout = timeout
+}
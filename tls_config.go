@@ -0,0 +1,24 @@
+package cacheddownloader
+
+import "crypto/tls"
+
+// SetTLSVersions limits the TLS versions the Downloader negotiates, e.g. to
+// tls.VersionTLS12 and up. A max of zero allows the latest version supported.
+// By default TLS 1.0 and up are allowed. It should be called before any
+// downloads are started.
+func (downloader *Downloader) SetTLSVersions(min, max uint16) {
+	config := downloader.tlsConfig()
+	config.MinVersion = min
+	config.MaxVersion = max
+}
+
+// SetCipherSuites limits the cipher suites the Downloader offers for TLS 1.2
+// and earlier; the suites of TLS 1.3 are not configurable. Nil restores the
+// default suites. It should be called before any downloads are started.
+func (downloader *Downloader) SetCipherSuites(suites []uint16) {
+	downloader.tlsConfig().CipherSuites = suites
+}
+
+func (downloader *Downloader) tlsConfig() *tls.Config {
+	return downloader.transport().TLSClientConfig
+}
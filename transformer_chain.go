@@ -0,0 +1,82 @@
+package cacheddownloader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ChainTransformers returns a CacheTransformer that runs the given
+// transformers one after the other, e.g. to decrypt, decompress and then
+// normalize a download, each working on what the previous one produced. The
+// intermediate files are kept next to the destination and are removed as
+// soon as the next transformer is done with them, or when one of the
+// transformers fails. The size is the one reported by the last transformer.
+// No transformers amount to NoopTransform.
+func ChainTransformers(transformers ...CacheTransformer) CacheTransformer {
+	contextTransformers := make([]ContextCacheTransformer, len(transformers))
+	for i, transformer := range transformers {
+		contextTransformers[i] = withoutContext(transformer)
+	}
+
+	chain := ChainContextTransformers(contextTransformers...)
+	return func(source, destination string) (int64, error) {
+		return chain(context.Background(), source, destination)
+	}
+}
+
+// ChainContextTransformers behaves like ChainTransformers for transformers
+// that are handed the context of the fetch. Once the context is done, the
+// chain does not start the next transformer.
+func ChainContextTransformers(transformers ...ContextCacheTransformer) ContextCacheTransformer {
+	if len(transformers) == 0 {
+		return withoutContext(NoopTransform)
+	}
+
+	return func(ctx context.Context, source, destination string) (int64, error) {
+		var size int64
+		stageSource := source
+		for i, transformer := range transformers {
+			last := i == len(transformers)-1
+
+			if ctx.Err() != nil {
+				removeIntermediate(source, stageSource)
+				return 0, abortTransform(ctx, destination)
+			}
+
+			stageDestination := destination
+			if !last {
+				intermediate, err := ioutil.TempFile(filepath.Dir(destination), "chained")
+				if err != nil {
+					removeIntermediate(source, stageSource)
+					return 0, err
+				}
+				intermediate.Close()
+				stageDestination = intermediate.Name()
+			}
+
+			var err error
+			size, err = transformer(ctx, stageSource, stageDestination)
+			// transformers usually consume their source, but not all of them do
+			removeIntermediate(source, stageSource)
+			if err != nil {
+				if !last {
+					os.Remove(stageDestination)
+				}
+				return 0, err
+			}
+
+			stageSource = stageDestination
+		}
+		return size, nil
+	}
+}
+
+// removeIntermediate removes path unless it is the source given to the chain,
+// which is left to the caller like that of any transformer
+func removeIntermediate(source, path string) {
+	if path != source {
+		os.Remove(path)
+	}
+}
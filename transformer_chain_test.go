@@ -0,0 +1,102 @@
+package cacheddownloader_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChainTransformers", func() {
+	var (
+		scratch         string
+		sourcePath      string
+		destinationPath string
+	)
+
+	rewrite := func(rewrite func(string) string) cacheddownloader.CacheTransformer {
+		return func(source, destination string) (int64, error) {
+			content, err := ioutil.ReadFile(source)
+			if err != nil {
+				return 0, err
+			}
+			rewritten := rewrite(string(content))
+			err = ioutil.WriteFile(destination, []byte(rewritten), 0600)
+			if err != nil {
+				return 0, err
+			}
+			return int64(len(rewritten)), os.Remove(source)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		scratch, err = ioutil.TempDir("", "chain-transformer-scratch")
+		Expect(err).NotTo(HaveOccurred())
+
+		sourcePath = filepath.Join(scratch, "source")
+		destinationPath = filepath.Join(scratch, "destination")
+		Expect(ioutil.WriteFile(sourcePath, []byte("content"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(destinationPath, nil, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(scratch)).To(Succeed())
+	})
+
+	It("runs the transformers in order", func() {
+		transformer := cacheddownloader.ChainTransformers(
+			rewrite(strings.ToUpper),
+			rewrite(func(content string) string { return content + "!" }),
+		)
+
+		size, err := transformer(sourcePath, destinationPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(BeEquivalentTo(len("CONTENT!")))
+		Expect(ioutil.ReadFile(destinationPath)).To(Equal([]byte("CONTENT!")))
+		Expect(filenamesInDir(scratch)).To(Equal([]string{"destination"}))
+	})
+
+	It("removes the intermediate files of transformers that leave their source", func() {
+		keepSource := func(source, destination string) (int64, error) {
+			content, err := ioutil.ReadFile(source)
+			if err != nil {
+				return 0, err
+			}
+			return int64(len(content)), ioutil.WriteFile(destination, content, 0600)
+		}
+		transformer := cacheddownloader.ChainTransformers(rewrite(strings.ToUpper), keepSource, keepSource)
+
+		_, err := transformer(sourcePath, destinationPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.ReadFile(destinationPath)).To(Equal([]byte("CONTENT")))
+		Expect(filenamesInDir(scratch)).To(Equal([]string{"destination"}))
+	})
+
+	Context("when a transformer fails", func() {
+		It("returns its error and removes the intermediate files", func() {
+			failure := func(source, destination string) (int64, error) {
+				return 0, errors.New("boom")
+			}
+			transformer := cacheddownloader.ChainTransformers(rewrite(strings.ToUpper), failure, rewrite(strings.ToLower))
+
+			_, err := transformer(sourcePath, destinationPath)
+			Expect(err).To(MatchError("boom"))
+			Expect(filenamesInDir(scratch)).To(Equal([]string{"destination"}))
+		})
+	})
+
+	Context("when there are no transformers", func() {
+		It("behaves like NoopTransform", func() {
+			size, err := cacheddownloader.ChainTransformers()(sourcePath, destinationPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(BeEquivalentTo(len("content")))
+			Expect(ioutil.ReadFile(destinationPath)).To(Equal([]byte("content")))
+		})
+	})
+})
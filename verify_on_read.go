@@ -0,0 +1,99 @@
+package cacheddownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+)
+
+// SetVerifyOnRead makes the cachedDownloader store the sha256 digest of every
+// file it adds to the cache, and verify it when a fetch is served from the
+// cache, with the given probability: 1 verifies every cache hit, while a lower
+// probability trades detection for the cost of reading the whole entry. An
+// entry that does not match, e.g. because of bit rot or a write that a crash
+// cut short, is evicted and downloaded again. Entries that are only held as
+// an expanded directory are not verified. Zero, the default, disables it. It
+// should be called before any fetches are started.
+func (c *cachedDownloader) SetVerifyOnRead(probability float64) {
+	c.verifyOnRead = probability
+}
+
+// fileDigest returns the hex sha256 digest of the file at path
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// digestForCache returns the digest to store with the file at path, or "" if
+// entries are not verified on read
+func (c *cachedDownloader) digestForCache(path string) string {
+	if c.verifyOnRead <= 0 {
+		return ""
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return ""
+	}
+	return digest
+}
+
+// intact reports whether the cached file of the entry for cacheKey still
+// matches its digest. Entries without a digest, and those not picked for
+// verification this time, are assumed to be intact.
+func (c *cachedDownloader) intact(cacheKey string, file *CachedFile) bool {
+	if c.verifyOnRead <= 0 || rand.Float64() >= c.verifyOnRead {
+		return true
+	}
+
+	expected := c.cache.digest(cacheKey)
+	if expected == "" {
+		return true
+	}
+
+	actual, err := fileDigest(file.Name())
+	if err == nil && actual == expected {
+		return true
+	}
+
+	c.lock.Lock()
+	c.corrupted++
+	c.lock.Unlock()
+	return false
+}
+
+// digest returns the digest stored with the entry for cacheKey
+func (c *FileCache) digest(cacheKey string) string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return ""
+	}
+	return entry.Digest
+}
+
+// setDigest stores the digest of the file of the entry for cacheKey
+func (c *FileCache) setDigest(cacheKey, digest string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if entry != nil && digest != "" {
+		entry.Digest = digest
+		c.persist()
+	}
+}
@@ -0,0 +1,63 @@
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"sort"
+	"time"
+)
+
+// normalizedModTime is the modification time of every entry of a normalized
+// tarball
+var normalizedModTime = time.Unix(0, 0).UTC()
+
+// ZipToTarTransform converts the zip archive at source to a normalized
+// tarball at destination, so that components that only understand tarballs
+// can use zip archives: its entries are sorted by name and have their
+// modification times set to the Unix epoch and their owners to root, so that
+// the same content always yields the same tarball. An archive that is not a
+// zip fails with an UnsupportedArchiveError.
+func ZipToTarTransform(source string, destination string) (int64, error) {
+	return ContextZipToTarTransform(context.Background(), source, destination)
+}
+
+// ContextZipToTarTransform behaves like ZipToTarTransform, but stops
+// converting the archive once ctx is done, empties the destination and returns
+// ctx.Err(). It can be given to SetContextTransformer.
+func ContextZipToTarTransform(ctx context.Context, source string, destination string) (int64, error) {
+	format, header, err := sniffArchiveFile(source)
+	if err != nil {
+		return 0, err
+	}
+	if format != zipArchive {
+		return 0, NewUnsupportedArchiveError(header)
+	}
+
+	size, err := transformZipToTar(ctx, source, destination, true)
+	if err != nil && ctx.Err() != nil {
+		return 0, abortTransform(ctx, destination)
+	}
+	return size, err
+}
+
+// sortedZipEntries returns the entries of a zip sorted by name
+func sortedZipEntries(entries []*zip.File) []*zip.File {
+	sorted := append([]*zip.File{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// normalizeTarHeader clears what would make the tarball differ between
+// conversions of the same content
+func normalizeTarHeader(header *tar.Header) {
+	header.ModTime = normalizedModTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+}
@@ -0,0 +1,109 @@
+package cacheddownloader_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cacheddownloader"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ZipToTarTransform", func() {
+	var scratch string
+
+	createZip := func(name string, modTime time.Time) string {
+		path := filepath.Join(scratch, name)
+		file, err := os.Create(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		writer := zip.NewWriter(file)
+		for _, entry := range []struct{ name, body string }{
+			{"b.txt", "b"},
+			{"a/", ""},
+			{"a/c.txt", "c"},
+		} {
+			header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+			header.SetModTime(modTime)
+			if entry.body == "" {
+				header.SetMode(os.ModeDir | 0755)
+			} else {
+				header.SetMode(0644)
+			}
+			w, err := writer.CreateHeader(header)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = w.Write([]byte(entry.body))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(writer.Close()).To(Succeed())
+		Expect(file.Close()).To(Succeed())
+		return path
+	}
+
+	transform := func(source string) string {
+		destination := source + ".tar"
+		Expect(ioutil.WriteFile(destination, nil, 0600)).To(Succeed())
+
+		size, err := cacheddownloader.ZipToTarTransform(source, destination)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(destination).To(BeARegularFile())
+		info, err := os.Stat(destination)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(info.Size()))
+		Expect(source).NotTo(BeAnExistingFile())
+		return destination
+	}
+
+	BeforeEach(func() {
+		var err error
+		scratch, err = ioutil.TempDir("", "zip-transformer-scratch")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(scratch)).To(Succeed())
+	})
+
+	It("writes the entries sorted by name with fixed modification times", func() {
+		tarball, err := os.Open(transform(createZip("archive.zip", time.Now())))
+		Expect(err).NotTo(HaveOccurred())
+		defer tarball.Close()
+
+		names := []string{}
+		reader := tar.NewReader(tarball)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(header.ModTime.Unix()).To(BeZero())
+			names = append(names, header.Name)
+		}
+		Expect(names).To(Equal([]string{"a/", "a/c.txt", "b.txt"}))
+	})
+
+	It("yields the same tarball for the same content", func() {
+		first := transform(createZip("first.zip", time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)))
+		second := transform(createZip("second.zip", time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)))
+
+		secondContent, err := ioutil.ReadFile(second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.ReadFile(first)).To(Equal(secondContent))
+	})
+
+	Context("when the archive is not a zip", func() {
+		It("fails with an UnsupportedArchiveError", func() {
+			source := filepath.Join(scratch, "archive.zip")
+			Expect(ioutil.WriteFile(source, []byte("not a zip"), 0600)).To(Succeed())
+
+			_, err := cacheddownloader.ZipToTarTransform(source, filepath.Join(scratch, "destination"))
+			Expect(err).To(BeAssignableToTypeOf(&cacheddownloader.UnsupportedArchiveError{}))
+		})
+	})
+})